@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	s "server"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Renders a live view of the cluster, polling the admin API of every node
+// passed as argument (host:port).
+func main() {
+	interval := 1000
+	token := os.Getenv("RAFTCTL_TOKEN")
+	ca := os.Getenv("RAFTCTL_CA")
+	flag.IntVar(&interval, "i", 1000, "Refresh interval in milliseconds")
+	flag.StringVar(&token, "t", token, "Token of a read-only principal, if the nodes run with -auth-tokens")
+	flag.StringVar(&ca, "ca", ca, "Certificate of the cluster CA, if the nodes run with -tls-cert")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Println("Usage: dashboard [-i ms] [-t token] [-ca file] host:port...")
+		os.Exit(1)
+	}
+
+	client := &http.Client{Timeout: time.Duration(interval) * time.Millisecond}
+	scheme := "http://"
+	if ca != "" {
+		config, err := s.ClientTLSConfig(ca)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		client.Transport = &http.Transport{TLSClientConfig: config}
+		scheme = "https://"
+	}
+	if token != "" {
+		client.Transport = s.BearerTransport{Token: token, Next: client.Transport}
+	}
+	for {
+		dumps := make(map[string]*s.StateDump)
+		for _, node := range flag.Args() {
+			dumps[node] = fetchState(client, scheme+node)
+		}
+		render(dumps)
+		time.Sleep(time.Duration(interval) * time.Millisecond)
+	}
+}
+
+// fetchState returns the state of the node at url, its scheme and admin
+// address, or nil if it can't be fetched.
+func fetchState(client *http.Client, url string) *s.StateDump {
+	resp, err := client.Get(url + "/debug/state")
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	dump := &s.StateDump{}
+	if err := json.NewDecoder(resp.Body).Decode(dump); err != nil {
+		return nil
+	}
+	return dump
+}
+
+func render(dumps map[string]*s.StateDump) {
+	nodes := make([]string, 0, len(dumps))
+	for node := range dumps {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	// Clears the screen and moves the cursor to the top left corner.
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("Cluster status at %s\n\n", time.Now().Format("15:04:05"))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tID\tSTATE\tTERM\tLEADER\tLOAD\tLOG\tCOMMIT\tAPPLIED")
+	var leader *s.StateDump
+	for _, node := range nodes {
+		dump := dumps[node]
+		if dump == nil {
+			fmt.Fprintf(w, "%s\t-\tunreachable\t-\t-\t-\t-\t-\t-\n", node)
+			continue
+		}
+		if dump.State == "Leader" {
+			leader = dump
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n", node, dump.Id, dump.State, dump.CurrentTerm,
+			dump.LeaderId, dump.LoadLevel, dump.LogLength, dump.CommitIndex, dump.LastApplied)
+	}
+	w.Flush()
+
+	if leader == nil {
+		fmt.Println("\nNo leader")
+		return
+	}
+
+	fmt.Printf("\nReplication lag (leader %d)\n", leader.Id)
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tMATCH\tLAG\tLOAD")
+	for _, peerId := range leader.PeerIds {
+		match := leader.MatchIndex[peerId]
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\n", peerId, match, leader.LogLength-1-match, leader.LoadLevelMap[peerId])
+	}
+	w.Flush()
+
+	fmt.Println("\nRecent commits")
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIMESTAMP\tTERM\tSERVICE\tCHOSEN")
+	first := leader.LogLength - len(leader.LogTail)
+	for i, entry := range leader.LogTail {
+		if first+i > leader.CommitIndex {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\n", entry.Timestamp, entry.Term, shorten(entry.Command.ServiceID), entry.ChosenId)
+	}
+	w.Flush()
+}
+
+func shorten(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return strings.TrimSpace(id)
+}
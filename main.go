@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	ng "namesgenerator"
 	"net"
 	"os"
+	"os/signal"
 	s "server"
+	"server/discover"
+	"server/mdns"
 	st "storage"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/exp/slices"
@@ -16,34 +23,156 @@ import (
 )
 
 func main() {
-	waitStart(startServer())
+	// Loads the configuration from the environment and the command line.
+	config, err := s.LoadConfig()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	// Overrides the configuration with the cluster file, if any.
+	var cluster *s.ClusterFile
+	if config.ClusterFile != "" {
+		if cluster, err = s.LoadClusterFile(config.ClusterFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		cluster.Configure(&config)
+		// The nodes listed twice are refused by LoadClusterFile.
+		warnings, _ := cluster.Membership().Validate()
+		for _, warning := range warnings {
+			fmt.Printf("Warning: %s: %s\n", config.ClusterFile, warning)
+		}
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	waitStart(startServer(config, cluster))
 }
 
-func startServer() *s.Server {
+func startServer(config s.Config, cluster *s.ClusterFile) *s.Server {
 	// Creates a new server and other network info.
 	ready := make(chan interface{})
-	storage := st.NewMapStorage()
-	commitChannel := make(chan s.CommitEntry)
+	var keyring *st.Keyring
+	if config.EncryptionKeysDir != "" {
+		// Encrypts the log with the newest key, decrypting it with the
+		// one it was written with.
+		var err error
+		if keyring, err = st.LoadKeyring(config.EncryptionKeysDir); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	storage, err := st.NewEncryptedMapStorage(config.LogPath, keyring)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
 	serverIp, subnetMask := s.GetNetworkInfo()
 	serverId := s.GetServerIdFromIp(serverIp, subnetMask)
 	defaultGateway := s.GetDefaultGateway()
 
-	// Gets all peers in the cluster.
-	peersAddrs := s.GetPeersIp(serverIp, subnetMask, nil, false)
-	peersIds := []int{}
 	peers := make(map[int]net.Addr)
+	labels, err := s.ParseLabels(config.Labels)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	capacity, err := s.ParseResources(strings.Fields(config.Capacity))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if cluster != nil {
+		// Takes the ID of the node and its peers from the cluster file.
+		node, ok := cluster.NodeByAddr(serverIp)
+		if !ok {
+			fmt.Printf("Error: %s isn't a node of %s\n", serverIp, config.ClusterFile)
+			os.Exit(1)
+		}
+		serverId = node.Id
+		peers = cluster.Peers(serverId)
+		for key, value := range node.Labels {
+			labels[key] = value
+		}
+	}
+	// Keeps the ID the node was given the first time it started, even if its
+	// IP address changed since.
+	identity, err := st.LoadNodeIdentity(config.IdentityPath, serverId)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if cluster == nil {
+		serverId = identity.Id
 
-	// Assigns ids to peers.
-	for p := 0; p < len(peersAddrs); p++ {
-		if peersAddrs[p] != serverIp && peersAddrs[p].String() != defaultGateway.String() {
-			id := s.GetServerIdFromIp(peersAddrs[p], subnetMask)
-			peers[id] = peersAddrs[p]
-			peersIds = append(peersIds, id)
+		// Gets all peers in the cluster.
+		peersAddrs := s.GetPeersIp(serverIp, subnetMask, nil, false)
+
+		// Assigns ids to peers.
+		for p := 0; p < len(peersAddrs); p++ {
+			if peersAddrs[p] != serverIp && peersAddrs[p].String() != defaultGateway.String() {
+				id := s.GetServerIdFromIp(peersAddrs[p], subnetMask)
+				peers[id] = peersAddrs[p]
+			}
 		}
 	}
 	
-	// Creates the server.
-	server := s.NewServer(serverId, storage, ready, commitChannel)
+	// Creates the server, which exits to be restarted by its container when
+	// asked to by a rolling restart.
+	var server *s.Server
+	restart := func() {
+		// The shutdown waits for the task calling restart to return.
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			server.Shutdown(ctx)
+			os.Exit(0)
+		}()
+	}
+	opts := []s.Option{s.WithStorage(storage), s.WithKeyring(keyring), s.WithRestart(restart)}
+	if config.SigningKeyPath != "" {
+		// Signs the RPCs of the node and verifies the ones of its peers.
+		key, err := st.LoadSigningKey(config.SigningKeyPath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		peerKeys, err := st.LoadPublicKeys(config.PeerKeysDir)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		opts = append(opts, s.WithSigningKeys(key, peerKeys))
+	}
+	if config.AllowedPeers != "" {
+		// Identifies the peers connecting without TLS by their address, as
+		// they're identified when the node starts.
+		opts = append(opts, s.WithPeerResolver(func(addr net.Addr) (int, bool) {
+			if cluster != nil {
+				node, ok := cluster.NodeByAddr(addr)
+				return node.Id, ok
+			}
+			return s.GetServerIdFromIp(addr, subnetMask), true
+		}))
+	}
+	if config.TrustedKeysDir != "" {
+		// Runs only the services signed by the trusted publishers.
+		trusted, err := st.LoadNamedKeys(config.TrustedKeysDir)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		opts = append(opts, s.WithTrustedKeys(trusted))
+	}
+	server, err = s.NewServer(serverId, config, ready, opts...)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -62,21 +191,177 @@ func startServer() *s.Server {
 		}
 	}
 
+	// Reconnects to the cluster formed or joined before a restart.
+	state, err := server.ClusterState()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	} else if state != nil {
+		for id, ip := range state.Peers {
+			if _, ok := peers[id]; !ok && id != serverId {
+				if err := server.AddNode(id, ip); err == nil {
+					peers[id] = &net.IPAddr{IP: net.ParseIP(ip)}
+				}
+			}
+		}
+	}
+
 	time.Sleep(1 * time.Second)
 	close(ready)
 	wg.Wait()
 
+	// Forms a new cluster or joins an existing one.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	switch {
+	case config.Bootstrap:
+		initialPeers := make(map[int]string)
+		for id, addr := range peers {
+			initialPeers[id] = addr.String()
+		}
+		err = server.Bootstrap(ctx, initialPeers)
+	case config.JoinAddr != "":
+		joinIp := &net.IPAddr{IP: net.ParseIP(config.JoinAddr)}
+		joinId := s.GetServerIdFromIp(joinIp, subnetMask)
+		if cluster != nil {
+			if node, ok := cluster.NodeByAddr(joinIp); ok {
+				joinId = node.Id
+			}
+		}
+		err = server.Join(ctx, joinId, config.JoinAddr)
+	}
+	cancel()
+	if err != nil && !errors.Is(err, s.ErrAlreadyBootstrapped) {
+		fmt.Printf("Error: %v\n", err)
+	}
+	// Tells the cluster the new address of the node if it changed since it
+	// formed or joined it.
+	if state != nil && state.Peers[serverId] != serverIp.String() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := server.RegisterAddress(ctx, identity); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		cancel()
+	}
+	// Registers the node as a standby node, excluded from scheduling until it's
+	// activated, when it first joins the cluster.
+	if config.Standby && state == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := server.SetStandby(ctx, true); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		cancel()
+	}
+	// Registers the labels of the node in the configuration of the cluster.
+	if len(labels) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := server.RegisterLabels(ctx, labels); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		cancel()
+	}
+	// Registers the resources the node offers to the services.
+	if config.Capacity != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := server.RegisterCapacity(ctx, capacity); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		cancel()
+	}
+
 	// Starts monitoring the workload.
-	go server.GetConsensusModule().MonitorLoad()
+	server.Go("MonitorLoad", server.GetConsensusModule().MonitorLoad)
 	// Starts checking for new peers.
-	go s.CheckNewPeers(server, &peers)
+	server.Go("CheckNewPeers", func() { s.CheckNewPeers(server, &peers) })
+	// Discovers the nodes of the cluster from DNS.
+	idOf := func(ip net.IP) int {
+		if cluster != nil {
+			if node, ok := cluster.NodeByAddr(&net.IPAddr{IP: ip}); ok {
+				return node.Id
+			}
+		}
+		return s.GetServerIdFromIp(&net.IPAddr{IP: ip}, subnetMask)
+	}
+	if config.DiscoveryDNS != "" {
+		server.StartDiscovery(s.DNSResolver{Name: config.DiscoveryDNS}, idOf, config.DiscoveryInterval)
+	}
+	// Discovers the nodes of the cluster from the cloud or registry provider.
+	if config.Discovery != "" {
+		if provider, err := discover.New(config.Discovery); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			server.StartDiscovery(provider, idOf, config.DiscoveryInterval)
+		}
+	}
+	// Advertises the node on the LAN and discovers the others with mDNS.
+	if config.MDNS {
+		startMDNS(server, net.ParseIP(serverIp.String()), idOf, config.DiscoveryInterval)
+	}
+	// Collects the logs of the cluster and/or ships them to the collector.
+	if path := config.LogAggregatePath; path != "" {
+		if err := server.StartLogCollector(path); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+	if collector := config.LogCollector; collector != "" {
+		server.StartLogShipping(collector)
+	}
+	// Starts the admin API.
+	go server.ServeAdmin()
+	// Starts the REST API.
+	go server.ServeAPI()
+	// Reloads the runtime settings on SIGHUP, or toggles debug logging if
+	// there's no file to reload.
+	if config.ReloadPath != "" {
+		server.Go("HandleReloadSignal", server.HandleReloadSignal)
+	} else {
+		go s.HandleDebugSignal()
+	}
+	// Shuts down on SIGINT and SIGTERM.
+	go handleShutdownSignal(server)
 
 	return server
 }
 
+// startMDNS advertises the node at ip with mDNS, on the NET_IFACE interface
+// if set, and makes the leader add the nodes advertised on the LAN. The IDs
+// advertised by the nodes take precedence over idOf.
+func startMDNS(server *s.Server, ip net.IP, idOf func(net.IP) int, interval time.Duration) {
+	var iface *net.Interface
+	if name := os.Getenv("NET_IFACE"); name != "" {
+		var err error
+		if iface, err = net.InterfaceByName(strings.Fields(name)[0]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+	responder, err := mdns.Listen(iface, mdns.Node{Id: server.GetId(), IP: ip})
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	server.Go("mDNS responder", func() { responder.Run(server.Done()) })
+	server.StartDiscovery(responder, func(ip net.IP) int {
+		if id, ok := responder.IdOf(ip); ok {
+			return id
+		}
+		return idOf(ip)
+	}, interval)
+}
+
+func handleShutdownSignal(server *s.Server) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 func waitStart(server *s.Server) {
 	// Create a listening socket
-	listener, err := net.Listen("tcp", ":" + os.Getenv("GATEWAY_PORT"))
+	listener, err := net.Listen("tcp", ":" + server.GetConfig().GatewayPort)
 	if err != nil {
 		panic(err)
 	}
@@ -109,10 +394,12 @@ func handleConnection(conn net.Conn, server *s.Server) {
 
 	for _, service := range services {
 		// Creates different instances for each request
-		command := s.NewService(service, server)
-		if err == nil {
-			server.Submit(command)
+		command, err := s.NewService(service, server)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
 		}
+		server.Submit(context.Background(), command)
 	}
 }
 
@@ -204,7 +491,17 @@ func parseMessage(message string) ([]string, error) {
 		if err != nil {
 			return nil, err
 		}
-		servicesList = append(servicesList, "ServiceType: " + parseYml["ServiceType"].(string) + "\n\n" + string(yml))
+		header := "ServiceType: " + parseYml["ServiceType"].(string) + "\n"
+		for _, key := range []string{"Priority", "NotBefore", "Namespace", "Resources", "TTL", "Version"} {
+			if value, ok := parseYml[key]; ok {
+				option, err := yaml.Marshal(map[string]interface{}{key: value})
+				if err != nil {
+					return nil, err
+				}
+				header += string(option)
+			}
+		}
+		servicesList = append(servicesList, header + "\n" + string(yml))
 	}
 
 
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	s "server"
+	"sort"
+	st "storage"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: raftctl [-a host:port] [-t token] [-ca file] <command> [args]
+
+The token, also read from RAFTCTL_TOKEN, authenticates the commands if the
+node runs with -auth-tokens. If the node runs with -tls-cert, its admin API
+is reached over TLS, and the certificate of the node must be signed by the
+one in the file of -ca, also read from RAFTCTL_CA.
+
+Commands:
+  status                      Shows the state of the node
+  submit-service <file>       Submits the service described in file
+  sign-service <file> <key>   Prints the service described in file signed
+                              with the private key in file key, created with
+                              its public key, key.pub, if missing
+  undeploy <service-id>       Stops a deployed service
+  crons [remove <name>]       Lists the recurring deployments, or removes one
+  add-cron <name> <file> ...  Deploys the service described in file at the
+                              times of the schedule in the other arguments:
+                              five crontab fields, in UTC, or @every <duration>
+  transfer-leadership <id>    Makes node id start an election
+  nodes [key=value,...]       Lists the peers, with the given labels if any
+  peers                       Shows the health of the peers
+  add-node <id> <ip>          Connects the node to a new peer
+  remove-node <id>            Disconnects the node from a peer
+  cordon [on|off]             Stops or resumes choosing the node for services
+  drain [on|off]              Cordons the node and migrates its services away
+  standby [on|off]            Makes the node a standby node or an active one
+  activate <id>               Activates the standby node id
+  rolling-restart             Restarts the nodes one at a time, from the leader
+  compact                     Compacts the raft log of the node, showing its
+                              size before and after
+  log [from] [limit]          Lists the committed entries from position from
+  verify-log                  Checks that the persisted log wasn't modified and
+                              shows the hash of its latest record
+  audit                       Lists the changes requested to the APIs of the
+                              nodes, with who requested them
+  quotas                      Shows the quotas of the clients submitting
+                              services to the node and their usage
+  resources                   Shows the resources used by the services of
+                              each namespace and client, and their quotas
+  secrets [rotate <what>]     Shows the keys encrypting the log and the TLS
+                              certificate of the node; rotate storage rotates
+                              the key and reencrypts the log, rotate tls
+                              reloads the certificate from its files
+  config [name value]         Shows the runtime settings or changes one
+  chaos [off|key=value ...]   Shows, injects or stops the faults, with keys
+                              drop, duplicate, delay, jitter, partition, pause,
+                              drop-aes, slow-disk and refuse-transfers; the
+                              node must run with -unsafe-chaos to inject them
+`
+
+// Operates a node of the cluster through its admin API.
+func main() {
+	admin := "localhost:9094"
+	token := os.Getenv("RAFTCTL_TOKEN")
+	ca := os.Getenv("RAFTCTL_CA")
+	flag.StringVar(&admin, "a", admin, "Admin address of the node (host:port)")
+	flag.StringVar(&token, "t", token, "Token authenticating the commands")
+	flag.StringVar(&ca, "ca", ca, "Certificate of the cluster CA, for the nodes running with TLS")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	base := "http://" + admin
+	if ca != "" {
+		config, err := s.ClientTLSConfig(ca)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		client.Transport = &http.Transport{TLSClientConfig: config}
+		base = "https://" + admin
+	}
+	if token != "" {
+		client.Transport = s.BearerTransport{Token: token, Next: client.Transport}
+	}
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	// Replaced by the result of the command if args are valid.
+	err := fmt.Errorf("wrong number of arguments for %s", cmd)
+	switch cmd {
+	case "status":
+		err = status(client, base)
+	case "submit-service":
+		if len(args) != 1 {
+			break
+		}
+		var body []byte
+		if body, err = os.ReadFile(args[0]); err == nil {
+			err = do(client, http.MethodPost, base+"/services", strings.NewReader(string(body)))
+		}
+	case "sign-service":
+		if len(args) == 2 {
+			err = signService(args[0], args[1])
+		}
+	case "undeploy":
+		if len(args) == 1 {
+			err = do(client, http.MethodDelete, base+"/services?id="+url.QueryEscape(args[0]), nil)
+		}
+	case "crons":
+		switch {
+		case len(args) == 0:
+			err = do(client, http.MethodGet, base+"/crons", nil)
+		case len(args) == 2 && args[0] == "remove":
+			err = do(client, http.MethodDelete, base+"/crons?name="+url.QueryEscape(args[1]), nil)
+		}
+	case "add-cron":
+		if len(args) < 3 {
+			break
+		}
+		var body []byte
+		if body, err = os.ReadFile(args[1]); err == nil {
+			query := url.Values{"name": {args[0]}, "schedule": {strings.Join(args[2:], " ")}}
+			err = do(client, http.MethodPost, base+"/crons?"+query.Encode(), strings.NewReader(string(body)))
+		}
+	case "transfer-leadership":
+		if len(args) == 1 {
+			err = do(client, http.MethodPost, base+"/leadership?to="+url.QueryEscape(args[0]), nil)
+		}
+	case "nodes":
+		if len(args) <= 1 {
+			selector := ""
+			if len(args) == 1 {
+				selector = args[0]
+			}
+			err = nodes(client, base, selector)
+		}
+	case "peers":
+		if len(args) == 0 {
+			err = peers(client, base)
+		}
+	case "add-node":
+		if len(args) == 2 {
+			err = do(client, http.MethodPost, base+"/nodes?id="+url.QueryEscape(args[0])+"&ip="+url.QueryEscape(args[1]), nil)
+		}
+	case "remove-node":
+		if len(args) == 1 {
+			err = do(client, http.MethodDelete, base+"/nodes?id="+url.QueryEscape(args[0]), nil)
+		}
+	case "activate":
+		if len(args) == 1 {
+			err = do(client, http.MethodPost, base+"/activate?id="+url.QueryEscape(args[0]), nil)
+		}
+	case "cordon", "drain", "standby":
+		enabled := "1"
+		if len(args) == 1 && args[0] == "off" {
+			enabled = "0"
+		}
+		err = do(client, http.MethodPost, base+"/"+cmd+"?enabled="+enabled, nil)
+	case "rolling-restart":
+		// Restarting every node takes longer than the other commands.
+		client.Timeout = 0
+		err = do(client, http.MethodPost, base+"/restart", nil)
+	case "compact":
+		if len(args) == 0 {
+			err = do(client, http.MethodPost, base+"/compact", nil)
+		}
+	case "log":
+		if len(args) <= 2 {
+			query := url.Values{}
+			if len(args) > 0 {
+				query.Set("from", args[0])
+			}
+			if len(args) > 1 {
+				query.Set("limit", args[1])
+			}
+			err = do(client, http.MethodGet, base+"/log?"+query.Encode(), nil)
+		}
+	case "verify-log":
+		if len(args) == 0 {
+			err = do(client, http.MethodGet, base+"/log/verify", nil)
+		}
+	case "audit":
+		if len(args) == 0 {
+			err = do(client, http.MethodGet, base+"/audit", nil)
+		}
+	case "quotas":
+		if len(args) == 0 {
+			err = do(client, http.MethodGet, base+"/quotas", nil)
+		}
+	case "resources":
+		if len(args) == 0 {
+			err = do(client, http.MethodGet, base+"/resources", nil)
+		}
+	case "secrets":
+		switch {
+		case len(args) == 0:
+			err = do(client, http.MethodGet, base+"/secrets", nil)
+		case len(args) == 2 && args[0] == "rotate":
+			err = do(client, http.MethodPost, base+"/secrets?rotate="+url.QueryEscape(args[1]), nil)
+		}
+	case "config":
+		switch len(args) {
+		case 0:
+			err = do(client, http.MethodGet, base+"/config", nil)
+		case 2:
+			err = do(client, http.MethodPost, base+"/config?name="+url.QueryEscape(args[0])+"&value="+url.QueryEscape(args[1]), nil)
+		}
+	case "chaos":
+		switch {
+		case len(args) == 0:
+			err = do(client, http.MethodGet, base+"/chaos", nil)
+		case len(args) == 1 && args[0] == "off":
+			err = do(client, http.MethodDelete, base+"/chaos", nil)
+		default:
+			query := url.Values{}
+			for _, arg := range args {
+				key, value, _ := strings.Cut(arg, "=")
+				query.Set(key, value)
+			}
+			err = do(client, http.MethodPost, base+"/chaos?"+query.Encode(), nil)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// do sends a request to the admin API and prints the body of the response.
+func do(client *http.Client, method string, url string, body io.Reader) error {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(out)))
+	}
+	os.Stdout.Write(out)
+	return nil
+}
+
+// signService prints the service described in file signed with the private
+// key in keyFile, without contacting the node.
+func signService(file string, keyFile string) error {
+	manifest, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	key, err := st.LoadSigningKey(keyFile)
+	if err != nil {
+		return err
+	}
+	signed, err := s.SignService(string(manifest), key)
+	if err != nil {
+		return err
+	}
+	fmt.Print(signed)
+	return nil
+}
+
+func nodes(client *http.Client, base string, selector string) error {
+	resp, err := client.Get(base + "/cluster?labels=" + url.QueryEscape(selector))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	info := &s.ClusterInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tADDR\tREACHABLE\tLOAD\tDRAINING\tSTANDBY\tLABELS\n")
+	for _, peer := range info.Peers {
+		var labels []string
+		for key, value := range peer.Labels {
+			labels = append(labels, key+"="+value)
+		}
+		sort.Strings(labels)
+		fmt.Fprintf(w, "%d\t%s\t%v\t%d\t%v\t%v\t%s\n", peer.Id, peer.Addr, peer.Reachable, peer.LoadLevel, peer.Draining, peer.Standby, strings.Join(labels, ","))
+	}
+	return w.Flush()
+}
+
+func peers(client *http.Client, base string) error {
+	resp, err := client.Get(base + "/peers")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var health []s.PeerHealth
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tSTATUS\tLAST CONTACT\tRTT\tSRTT\tTIMEOUT\tFAILURES\n")
+	for _, h := range health {
+		lastContact := "never"
+		if !h.LastContact.IsZero() {
+			lastContact = time.Since(h.LastContact).Round(time.Millisecond).String() + " ago"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%v\t%v\t%v\t%d\n", h.Id, h.Status, lastContact, h.RTT, h.SmoothedRTT, h.Timeout, h.ConsecutiveFailures)
+	}
+	return w.Flush()
+}
+
+func status(client *http.Client, base string) error {
+	resp, err := client.Get(base + "/debug/state")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dump := &s.StateDump{}
+	if err := json.NewDecoder(resp.Body).Decode(dump); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\t%d\n", dump.Id)
+	fmt.Fprintf(w, "STATE\t%s\n", dump.State)
+	fmt.Fprintf(w, "HEALTH\t%s\n", dump.Health)
+	fmt.Fprintf(w, "TERM\t%d\n", dump.CurrentTerm)
+	fmt.Fprintf(w, "LEADER\t%d\n", dump.LeaderId)
+	fmt.Fprintf(w, "PEERS\t%v\n", dump.PeerIds)
+	fmt.Fprintf(w, "LOAD\t%d\n", dump.LoadLevel)
+	fmt.Fprintf(w, "LOG\t%d\n", dump.LogLength)
+	fmt.Fprintf(w, "COMMIT\t%d\n", dump.CommitIndex)
+	fmt.Fprintf(w, "APPLIED\t%d\n", dump.LastApplied)
+	return w.Flush()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"server"
+	"server/testcluster"
+	"syscall"
+	"time"
+)
+
+// Runs a soak test: a steady workload against an in-process cluster, checking
+// its invariants until the duration elapses, a violation is found or the
+// process is interrupted.
+func main() {
+	config := testcluster.DefaultSoakConfig()
+	nodes := 3
+	verbose := false
+	flag.IntVar(&nodes, "nodes", nodes, "Number of nodes of the cluster")
+	flag.DurationVar(&config.Duration, "duration", config.Duration, "How long the workload runs")
+	flag.DurationVar(&config.Interval, "interval", config.Interval, "Time between two submits")
+	flag.DurationVar(&config.SubmitTimeout, "submit-timeout", config.SubmitTimeout, "How long a submit waits for its commit")
+	flag.DurationVar(&config.CheckInterval, "check-interval", config.CheckInterval, "Time between two checks of the invariants")
+	flag.BoolVar(&verbose, "v", verbose, "Logs the messages of the nodes")
+	flag.Parse()
+
+	logger := log.New(io.Discard, "", 0)
+	if verbose {
+		logger = log.Default()
+	}
+	c, err := testcluster.New(nodes, server.WithLogger(logger))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer c.Shutdown(context.Background())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	config.Progress = func(r testcluster.SoakReport) {
+		fmt.Printf("%v: %d submitted, %d committed, %d failed, %d checks\n", r.Elapsed.Round(time.Second), r.Submitted, r.Committed, r.Failed, r.Checks)
+	}
+	report, err := testcluster.Soak(ctx, c, config)
+	config.Progress(report)
+	if err != nil {
+		fmt.Printf("Violation: %v\n", err)
+		c.Shutdown(context.Background())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Backend is a Storage implementation compared by Benchmark. Open opens the
+// storage persisted at path, creating it if needed, as a node does when it
+// starts.
+type Backend struct {
+	Name string
+	Open func(path string) (Storage, error)
+}
+
+// Backends are the Storage implementations available.
+var Backends = []Backend{
+	{Name: "map", Open: func(path string) (Storage, error) { return NewMapStorage(path) }},
+	{Name: "compressed", Open: func(path string) (Storage, error) { return NewCompressedMapStorage(path, nil) }},
+}
+
+// Workload is a sequence of operations run against a fresh storage at path,
+// shaped like the writes of a node. It returns how many operations it ran.
+type Workload struct {
+	Name string
+	Run  func(b Backend, path string, size int) (int, error)
+}
+
+// Workloads are the workloads run by Benchmark:
+//   - append writes every record through, as the leader persists the
+//     entries it commits
+//   - snapshot sets records in batches of 100 without writing them, each
+//     batch followed by a record written through, that persists the whole
+//     content at once
+//   - restart writes the records and reopens the storage after every tenth
+//     of them, as a node that keeps crashing
+var Workloads = []Workload{
+	{Name: "append", Run: appendWorkload},
+	{Name: "snapshot", Run: snapshotWorkload},
+	{Name: "restart", Run: restartWorkload},
+}
+
+// benchRecord returns the i-th record of a workload, sized like a committed
+// entry.
+func benchRecord(i int) map[string]interface{} {
+	return map[string]interface{}{
+		"Id":        fmt.Sprintf("%064x", i),
+		"Term":      strconv.Itoa(1 + i/1000),
+		"Leader":    "1",
+		"Chosen":    strconv.Itoa(1 + i%5),
+		"Command":   map[string]interface{}{"ServiceID": fmt.Sprintf("service-%d", i), "Kind": "", "Payload": nil},
+		"Timestamp": "2024-01-02 15:04:05.0000",
+	}
+}
+
+func appendWorkload(b Backend, path string, size int) (int, error) {
+	s, err := b.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < size; i++ {
+		if err := s.Set(benchRecord(i), true); err != nil {
+			return i, err
+		}
+	}
+	return size, nil
+}
+
+func snapshotWorkload(b Backend, path string, size int) (int, error) {
+	s, err := b.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < size; i++ {
+		if err := s.Set(benchRecord(i), (i+1)%100 == 0 || i == size-1); err != nil {
+			return i, err
+		}
+	}
+	return size, nil
+}
+
+func restartWorkload(b Backend, path string, size int) (int, error) {
+	s, err := b.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	ops := 0
+	restartEvery := size / 10
+	if restartEvery == 0 {
+		restartEvery = 1
+	}
+	for i := 0; i < size; i++ {
+		if err := s.Set(benchRecord(i), true); err != nil {
+			return ops, err
+		}
+		ops++
+		if (i+1)%restartEvery == 0 {
+			if s, err = b.Open(path); err != nil {
+				return ops, err
+			}
+			ops++
+		}
+	}
+	return ops, nil
+}
+
+// BenchResult is the outcome of a workload on a backend.
+type BenchResult struct {
+	Backend  string
+	Workload string
+	Ops      int
+	Elapsed  time.Duration
+	// Size is the size in bytes of the files left in the directory of the
+	// storage
+	Size int64
+	Err  error
+}
+
+// Benchmark runs every workload with size records against every backend, in
+// a new subdirectory of dir each, and returns the results in order.
+func Benchmark(backends []Backend, workloads []Workload, dir string, size int) []BenchResult {
+	var results []BenchResult
+	for _, b := range backends {
+		for _, w := range workloads {
+			result := BenchResult{Backend: b.Name, Workload: w.Name}
+			runDir, err := os.MkdirTemp(dir, b.Name+"-"+w.Name)
+			if err != nil {
+				result.Err = err
+				results = append(results, result)
+				continue
+			}
+			start := time.Now()
+			result.Ops, result.Err = w.Run(b, filepath.Join(runDir, "log.txt"), size)
+			result.Elapsed = time.Since(start)
+			result.Size = dirSize(runDir)
+			os.RemoveAll(runDir)
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// dirSize returns the size in bytes of the files in dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// WriteBenchTable writes results as a table comparing the backends.
+func WriteBenchTable(w io.Writer, results []BenchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BACKEND\tWORKLOAD\tOPS\tELAPSED\tOPS/S\tSIZE\tERROR")
+	for _, r := range results {
+		rate := 0.0
+		if r.Elapsed > 0 {
+			rate = float64(r.Ops) / r.Elapsed.Seconds()
+		}
+		errText := "-"
+		if r.Err != nil {
+			errText = r.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%v\t%.0f\t%d\t%s\n", r.Backend, r.Workload, r.Ops, r.Elapsed.Round(time.Microsecond), rate, r.Size, errText)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrChainBroken is returned when the records of a storage don't form a hash
+// chain, because one of them was modified, removed or added afterwards.
+var ErrChainBroken = errors.New("hash chain is broken")
+
+// ChainVerifier is a Storage whose persisted records can be checked, see
+// VerifyChain.
+type ChainVerifier interface {
+	VerifyChain() (string, error)
+}
+
+// ChainRecord links record, with its Id, to the record whose hash is prev, or
+// to none if prev is empty: it sets its Prev field to prev and its Hash field
+// to the hash of the other fields, including Prev, and returns the hash.
+func ChainRecord(record map[string]interface{}, prev string) (string, error) {
+	record["Prev"] = prev
+	hash, err := recordHash(record)
+	if err != nil {
+		return "", err
+	}
+	record["Hash"] = hash
+	return hash, nil
+}
+
+// recordHash returns the sha256 of the fields of record but Hash, encoded as
+// JSON after a round trip through the storage file, so that it's the same
+// once the record is read back.
+func recordHash(record map[string]interface{}) (string, error) {
+	fields := make(map[string]interface{}, len(record))
+	for k, v := range record {
+		if k != "Hash" {
+			fields[k] = v
+		}
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return "", err
+	}
+	if data, err = json.Marshal(decoded); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+// VerifyChain checks that records, by Id as stored by MapStorage, form a
+// single hash chain linked by ChainRecord, and returns the hash of its last
+// record, empty if there are none. It returns ErrChainBroken if a record
+// isn't chained, doesn't match its hash, or isn't reachable from the first
+// one. Removing the latest records leaves a valid chain: the head returned
+// must be compared with the one of another node to detect it.
+func VerifyChain(records map[string]map[string]interface{}) (string, error) {
+	order, err := chain(records)
+	if err != nil || len(order) == 0 {
+		return "", err
+	}
+	return records[order[len(order)-1]]["Hash"].(string), nil
+}
+
+// ChainOrder returns records, by Id as stored by MapStorage, in the order
+// they were chained, each with its Id, see VerifyChain. The records written
+// before the storage was chained, without a Hash, come first, by Id.
+func ChainOrder(records map[string]map[string]interface{}) ([]map[string]interface{}, error) {
+	var unchained []string
+	chained := make(map[string]map[string]interface{}, len(records))
+	for id, record := range records {
+		if _, ok := record["Hash"]; ok {
+			chained[id] = record
+		} else {
+			unchained = append(unchained, id)
+		}
+	}
+	sort.Strings(unchained)
+	order, err := chain(chained)
+	if err != nil {
+		return nil, err
+	}
+	ordered := make([]map[string]interface{}, 0, len(records))
+	for _, id := range append(unchained, order...) {
+		record := make(map[string]interface{}, len(records[id])+1)
+		for k, v := range records[id] {
+			record[k] = v
+		}
+		record["Id"] = id
+		ordered = append(ordered, record)
+	}
+	return ordered, nil
+}
+
+// chain returns the Ids of records in the order of their hash chain, or
+// ErrChainBroken as VerifyChain.
+func chain(records map[string]map[string]interface{}) ([]string, error) {
+	ids := make([]string, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// next is the Id of the record following the one of a hash.
+	next := make(map[string]string, len(records))
+	for _, id := range ids {
+		record := records[id]
+		hash, ok := record["Hash"].(string)
+		prev, okPrev := record["Prev"].(string)
+		if !ok || !okPrev {
+			return nil, fmt.Errorf("%w: record %s isn't chained", ErrChainBroken, id)
+		}
+		fields := make(map[string]interface{}, len(record)+1)
+		for k, v := range record {
+			fields[k] = v
+		}
+		fields["Id"] = id
+		expected, err := recordHash(fields)
+		if err != nil {
+			return nil, err
+		}
+		if hash != expected {
+			return nil, fmt.Errorf("%w: record %s doesn't match its hash", ErrChainBroken, id)
+		}
+		if other, ok := next[prev]; ok {
+			return nil, fmt.Errorf("%w: records %s and %s follow the same record", ErrChainBroken, other, id)
+		}
+		next[prev] = id
+	}
+
+	head, order := "", make([]string, 0, len(records))
+	for len(order) < len(records) {
+		id, ok := next[head]
+		if !ok {
+			break
+		}
+		head = records[id]["Hash"].(string)
+		order = append(order, id)
+	}
+	if len(order) != len(records) {
+		return nil, fmt.Errorf("%w: %d of %d records are out of the chain", ErrChainBroken, len(records)-len(order), len(records))
+	}
+	return order, nil
+}
+
+// VerifyChain reads the file of the storage and checks the records
+// persisted, see VerifyChain. The records not written yet aren't checked.
+func (ms *MapStorage) VerifyChain() (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	data, err := ms.readFile()
+	if err != nil {
+		return "", err
+	}
+	var records map[string]map[string]interface{}
+	if bytes.HasPrefix(data, framesMagic) {
+		if err := ms.readFrames(data, &records); err != nil {
+			return "", err
+		}
+	} else if err := json.Unmarshal(data, &records); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrStorageCorrupt, err)
+	}
+	return VerifyChain(records)
+}
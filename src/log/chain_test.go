@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// chained returns the record id linked to prev, see ChainRecord, and its
+// hash.
+func chained(t *testing.T, id int, prev string) (map[string]interface{}, string) {
+	t.Helper()
+	r := record(id)
+	hash, err := ChainRecord(r, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, hash
+}
+
+func TestVerifyChainStorage(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		f := filepath.Join(t.TempDir(), "log.json")
+		open := NewMapStorage
+		if compressed {
+			open = func(f string) (*MapStorage, error) { return NewCompressedMapStorage(f, nil) }
+		}
+		ms, err := open(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		head := ""
+		for i := 1; i <= 3; i++ {
+			var r map[string]interface{}
+			r, head = chained(t, i, head)
+			if err := ms.Set(r, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got, err := ms.VerifyChain(); err != nil || got != head {
+			t.Errorf("compressed=%v: got %q, %v, want %q", compressed, got, err, head)
+		}
+
+		// A record out of the chain is detected.
+		r, _ := chained(t, 4, "")
+		if err := ms.Set(r, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ms.VerifyChain(); !errors.Is(err, ErrChainBroken) {
+			t.Errorf("compressed=%v: got %v with record 4 unchained, want ErrChainBroken", compressed, err)
+		}
+	}
+}
+
+func TestVerifyChainModified(t *testing.T) {
+	records := make(map[string]map[string]interface{})
+	head := ""
+	for i := 1; i <= 3; i++ {
+		var r map[string]interface{}
+		r, head = chained(t, i, head)
+		delete(r, "Id")
+		records[strconv.Itoa(i)] = r
+	}
+	if got, err := VerifyChain(records); err != nil || got != head {
+		t.Fatalf("got %q, %v, want %q", got, err, head)
+	}
+	records["2"]["Term"] = float64(20)
+	if _, err := VerifyChain(records); !errors.Is(err, ErrChainBroken) {
+		t.Errorf("got %v with record 2 modified, want ErrChainBroken", err)
+	}
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// ErrClusterStateExists is returned when a node that already formed or joined
+// a cluster is asked to do it again.
+var ErrClusterStateExists = errors.New("cluster state already stored")
+
+// ClusterState is the configuration a node formed or joined a cluster with.
+// Peers maps the ID of every node, this one included, to its IP address.
+type ClusterState struct {
+	NodeId       int
+	Peers        map[int]string
+	Bootstrapped bool
+	Timestamp    string
+}
+
+// LoadClusterState returns the cluster state stored in f, or nil if the node
+// hasn't formed or joined a cluster yet.
+func LoadClusterState(f string) (*ClusterState, error) {
+	data, err := os.ReadFile(f)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &ClusterState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, ErrStorageCorrupt
+	}
+	return state, nil
+}
+
+// CreateClusterState stores state in f. It fails with ErrClusterStateExists,
+// without overwriting it, if f already exists.
+func CreateClusterState(f string, state ClusterState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(f, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		return ErrClusterStateExists
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(data); err != nil {
+		fd.Close()
+		os.Remove(f)
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		os.Remove(f)
+		return err
+	}
+	return fd.Close()
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// framesMagic starts the file of a compressed MapStorage: a sequence of
+// frames, each the length of its payload, as 4 bytes big endian, and the
+// payload, a JSON object of records compressed with DEFLATE and sealed if
+// the storage is encrypted.
+var framesMagic = []byte("MAPZ1\n")
+
+// NewCompressedMapStorage is NewEncryptedMapStorage keeping the records
+// compressed in memory, each as its JSON compressed with DEFLATE, for the
+// nodes short of memory. The records are appended to the file as frames,
+// see framesMagic, so that a write doesn't decompress the others: the file
+// is compacted into one frame per record when it's opened. Both kinds of
+// storage read both formats, so that a node can switch back and forth.
+func NewCompressedMapStorage(f string, keys *Keyring) (*MapStorage, error) {
+	ms, err := NewEncryptedMapStorage(f, keys)
+	if err != nil {
+		return nil, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.zw, err = flate.NewWriter(nil, flate.BestSpeed); err != nil {
+		return nil, err
+	}
+	ms.z = make(map[string][]byte, len(ms.m))
+	for id, record := range ms.m {
+		if ms.z[id], err = ms.compress(id, record); err != nil {
+			return nil, err
+		}
+	}
+	ms.m = nil
+	return ms, ms.writeFrames()
+}
+
+// compress returns the JSON object of the record id compressed, the payload
+// of its frame before sealing.
+// Expects ms.mu to be locked.
+func (ms *MapStorage) compress(id string, record map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(map[string]map[string]interface{}{id: record})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	ms.zw.Reset(&buf)
+	if _, err := ms.zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := ms.zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressAll returns the records of a compressed storage by Id.
+// Expects ms.mu to be locked.
+func (ms *MapStorage) decompressAll() (map[string]map[string]interface{}, error) {
+	records := make(map[string]map[string]interface{}, len(ms.z))
+	for id, payload := range ms.z {
+		data, err := io.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+		if err == nil {
+			err = json.Unmarshal(data, &records)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: record %s: %v", ErrStorageCorrupt, id, err)
+		}
+	}
+	return records, nil
+}
+
+// setCompressed is Set for a compressed storage. The records set without
+// writing them are appended with the next one written.
+// Expects ms.mu to be locked.
+func (ms *MapStorage) setCompressed(id string, value map[string]interface{}, toWrite bool) error {
+	if ms.z[id] != nil {
+		return nil
+	}
+	data, err := ms.compress(id, value)
+	if err != nil {
+		return err
+	}
+	ms.z[id] = data
+	ms.pending = append(ms.pending, id)
+	if !toWrite {
+		return nil
+	}
+	var buf []byte
+	for _, id := range ms.pending {
+		if buf, err = ms.appendFrame(buf, ms.z[id]); err != nil {
+			return err
+		}
+	}
+	fd, err := os.OpenFile(ms.f, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(buf); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	ms.pending = ms.pending[:0]
+	return nil
+}
+
+// appendFrame appends the frame of payload, sealed if the storage is
+// encrypted, to buf.
+func (ms *MapStorage) appendFrame(buf []byte, payload []byte) ([]byte, error) {
+	if ms.keys != nil {
+		var err error
+		if payload, err = ms.keys.Seal(payload); err != nil {
+			return nil, err
+		}
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(payload)))
+	return append(append(buf, length[:]...), payload...), nil
+}
+
+// writeFrames replaces the file with a frame for every record, without
+// decompressing them. It's written as by WriteLog.
+// Expects ms.mu to be locked.
+func (ms *MapStorage) writeFrames() error {
+	buf := append([]byte{}, framesMagic...)
+	var err error
+	for _, data := range ms.z {
+		if buf, err = ms.appendFrame(buf, data); err != nil {
+			return err
+		}
+	}
+	ms.pending = ms.pending[:0]
+	return ms.replaceFile(buf)
+}
+
+// frames returns the payloads of the frames of data, the content of a file
+// starting with framesMagic. The last frame, if it was cut short by a crash
+// while appending it, is ignored.
+func frames(data []byte) [][]byte {
+	var payloads [][]byte
+	data = data[len(framesMagic):]
+	for len(data) >= 4 {
+		length := binary.BigEndian.Uint32(data)
+		if uint64(len(data)-4) < uint64(length) {
+			break
+		}
+		payloads = append(payloads, data[4:4+length])
+		data = data[4+length:]
+	}
+	return payloads
+}
+
+// readFrames decodes the records of data, the content of a file starting
+// with framesMagic, into records.
+// Expects ms.mu to be locked.
+func (ms *MapStorage) readFrames(data []byte, records *map[string]map[string]interface{}) error {
+	for i, payload := range frames(data) {
+		if ms.keys == nil {
+			if id := KeyOf(payload); id != "" {
+				return fmt.Errorf("%w: encrypted with key %s", ErrUnknownKey, id)
+			}
+		} else {
+			var err error
+			if payload, err = ms.keys.Open(payload); err != nil {
+				return err
+			}
+		}
+		decoded, err := io.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+		if err == nil {
+			err = json.Unmarshal(decoded, records)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: frame %d: %v", ErrStorageCorrupt, i, err)
+		}
+	}
+	return nil
+}
+
+// rekeyFrames is Rekey for a compressed storage: the file is rewritten if a
+// frame was sealed with another key than the current one.
+// Expects ms.mu to be locked.
+func (ms *MapStorage) rekeyFrames(data []byte) (bool, error) {
+	if bytes.HasPrefix(data, framesMagic) {
+		stale := false
+		for _, payload := range frames(data) {
+			if KeyOf(payload) != ms.keys.Current() {
+				stale = true
+				break
+			}
+		}
+		if !stale {
+			return false, nil
+		}
+	}
+	return true, ms.writeFrames()
+}
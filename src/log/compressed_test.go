@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func record(id int) map[string]interface{} {
+	return map[string]interface{}{"Id": strconv.Itoa(id), "Term": float64(id)}
+}
+
+// contents returns the records persisted in f, read by a MapStorage.
+func contents(t *testing.T, f string, keys *Keyring) map[string]map[string]interface{} {
+	t.Helper()
+	ms, err := NewEncryptedMapStorage(f, keys)
+	if err != nil {
+		t.Fatalf("reading %s: %v", f, err)
+	}
+	return ms.m
+}
+
+func TestCompressedSwitch(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		var keys *Keyring
+		if encrypted {
+			var err error
+			if keys, err = LoadKeyring(t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f := filepath.Join(t.TempDir(), "log.json")
+		plain, err := NewEncryptedMapStorage(f, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := plain.Set(record(1), true); err != nil {
+			t.Fatal(err)
+		}
+
+		ms, err := NewCompressedMapStorage(f, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 2 is appended with 3, the next record written.
+		for i, toWrite := range []bool{false, true} {
+			if err := ms.Set(record(i+2), toWrite); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if encrypted {
+			if _, err := keys.Rotate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ms.Set(record(4), true); err != nil {
+			t.Fatal(err)
+		}
+		if encrypted {
+			if rekeyed, err := ms.Rekey(); err != nil || !rekeyed {
+				t.Fatalf("Rekey: got %v, %v, want true", rekeyed, err)
+			}
+		}
+
+		want := map[string]map[string]interface{}{}
+		for i := 1; i <= 4; i++ {
+			want[strconv.Itoa(i)] = map[string]interface{}{"Term": float64(i)}
+		}
+		if got := contents(t, f, keys); !reflect.DeepEqual(got, want) {
+			t.Errorf("encrypted=%v: read %v, want %v", encrypted, got, want)
+		}
+		// Reopened compressed, and back to a MapStorage.
+		if _, err := NewCompressedMapStorage(f, keys); err != nil {
+			t.Fatal(err)
+		}
+		if got := contents(t, f, keys); !reflect.DeepEqual(got, want) {
+			t.Errorf("encrypted=%v: read %v after reopening, want %v", encrypted, got, want)
+		}
+	}
+}
+
+func TestCompressedPartialFrame(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "log.json")
+	ms, err := NewCompressedMapStorage(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Set(record(1), true); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash while appending leaves a frame shorter than its length.
+	fd, err := os.OpenFile(f, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte{0, 0, 1, 0, 'x'})
+	fd.Close()
+
+	ms, err = NewCompressedMapStorage(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The frame cut short was dropped when the file was compacted.
+	if err := ms.Set(record(2), true); err != nil {
+		t.Fatal(err)
+	}
+	if got := contents(t, f, nil); len(got) != 2 {
+		t.Fatalf("read %v, want records 1 and 2", got)
+	}
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// LeaderChange is a single record of the leadership history of a node.
+type LeaderChange struct {
+	Term      int
+	LeaderId  int
+	Timestamp string
+	Reason    string
+}
+
+// LeaderHistory is an append-only history of the latest leadership changes,
+// persisted as one JSON object per line, sealed by its keyring if it has
+// one. Append only records a change in memory: Run writes it to the file, so
+// that the callers never wait for the disk.
+type LeaderHistory struct {
+	mu   sync.Mutex
+	f    string
+	size int
+	keys *Keyring
+
+	// entries is a ring buffer of the latest size changes, the oldest at
+	// next once full
+	entries []LeaderChange
+	next    int
+	full    bool
+
+	// pending are the changes not written yet, lines the lines of the
+	// file, rewritten with the retained changes only past 2*size, or if
+	// stale, as a line isn't sealed with the current key
+	pending []LeaderChange
+	lines   int
+	stale   bool
+	ready   chan struct{}
+
+	// fileMu serializes the writes of the file
+	fileMu sync.Mutex
+}
+
+// NewLeaderHistory opens the history stored in f, retaining the latest size
+// changes already recorded. The changes are encrypted with keys, nil if they
+// aren't; if the file has lines written before encryption was enabled, or
+// sealed with an older key, it's rewritten by Run as soon as it starts.
+func NewLeaderHistory(f string, size int, keys *Keyring) *LeaderHistory {
+	if size < 1 {
+		size = 1
+	}
+	lh := &LeaderHistory{
+		f:       f,
+		size:    size,
+		keys:    keys,
+		entries: make([]LeaderChange, size),
+		ready:   make(chan struct{}, 1),
+	}
+
+	data, err := os.ReadFile(f)
+	if err != nil {
+		return lh
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for _, line := range lines[:len(lines)-1] {
+		lh.lines++
+		var change LeaderChange
+		if line, err := openLine(keys, line); err == nil && json.Unmarshal(line, &change) == nil {
+			lh.add(change)
+		}
+	}
+	if staleLines(keys, data) {
+		lh.stale = true
+		lh.ready <- struct{}{}
+	}
+	return lh
+}
+
+// add stores change in the ring buffer, overwriting the oldest one if full.
+// Expects lh.mu to be locked.
+func (lh *LeaderHistory) add(change LeaderChange) {
+	lh.entries[lh.next] = change
+	lh.next = (lh.next + 1) % lh.size
+	if lh.next == 0 {
+		lh.full = true
+	}
+}
+
+// Append records a new change at the end of the history, to be written by
+// Run.
+func (lh *LeaderHistory) Append(change LeaderChange) {
+	lh.mu.Lock()
+	lh.add(change)
+	lh.pending = append(lh.pending, change)
+	lh.mu.Unlock()
+	select {
+	case lh.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Run writes the appended changes to the file until done is closed, then
+// writes the last ones and returns. The errors are passed to onError.
+func (lh *LeaderHistory) Run(done <-chan struct{}, onError func(error)) {
+	for {
+		select {
+		case <-lh.ready:
+		case <-done:
+			if err := lh.Flush(); err != nil {
+				onError(err)
+			}
+			return
+		}
+		if err := lh.Flush(); err != nil {
+			onError(err)
+		}
+	}
+}
+
+// Flush writes the changes appended since the last call to the file, or
+// rewrites it with the retained changes once it holds more than twice as
+// many lines.
+func (lh *LeaderHistory) Flush() error {
+	lh.fileMu.Lock()
+	defer lh.fileMu.Unlock()
+	return lh.flush()
+}
+
+// Rekey rewrites the file with the current key of the keyring if a line was
+// sealed with another one, returning whether it did, so that the old key can
+// be retired.
+func (lh *LeaderHistory) Rekey() (bool, error) {
+	if lh.keys == nil {
+		return false, nil
+	}
+	lh.fileMu.Lock()
+	defer lh.fileMu.Unlock()
+	data, err := os.ReadFile(lh.f)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !staleLines(lh.keys, data) {
+		return false, nil
+	}
+	lh.mu.Lock()
+	lh.stale = true
+	lh.mu.Unlock()
+	return true, lh.flush()
+}
+
+// flush is Flush.
+// Expects lh.fileMu to be locked.
+func (lh *LeaderHistory) flush() error {
+	lh.mu.Lock()
+	pending := lh.pending
+	lh.pending = nil
+	rewrite := lh.lines+len(pending) > 2*lh.size || lh.stale
+	if rewrite {
+		pending = lh.retained()
+	}
+	lh.mu.Unlock()
+	if len(pending) == 0 && !rewrite {
+		return nil
+	}
+
+	var buf []byte
+	for _, change := range pending {
+		data, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		line, err := sealLine(lh.keys, data)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if rewrite {
+		tmp := lh.f + ".tmp"
+		if err := os.WriteFile(tmp, buf, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, lh.f); err != nil {
+			return err
+		}
+	} else {
+		fd, err := os.OpenFile(lh.f, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = fd.Write(buf)
+		if cerr := fd.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	lh.mu.Lock()
+	if rewrite {
+		lh.lines = len(pending)
+		lh.stale = false
+	} else {
+		lh.lines += len(pending)
+	}
+	lh.mu.Unlock()
+	return nil
+}
+
+// retained returns the changes of the ring buffer, oldest first.
+// Expects lh.mu to be locked.
+func (lh *LeaderHistory) retained() []LeaderChange {
+	if !lh.full {
+		return append([]LeaderChange{}, lh.entries[:lh.next]...)
+	}
+	return append(append([]LeaderChange{}, lh.entries[lh.next:]...), lh.entries[:lh.next]...)
+}
+
+// Entries returns a copy of the retained changes, oldest first.
+func (lh *LeaderHistory) Entries() []LeaderChange {
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+	return lh.retained()
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLeaderHistoryEncrypted(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "leaders.txt")
+	lh := NewLeaderHistory(f, 4, nil)
+	lh.Append(LeaderChange{Term: 1, LeaderId: 1, Reason: "plaintext"})
+	if err := lh.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadKeyring(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The changes written before encryption was enabled are encrypted by
+	// the first flush.
+	lh = NewLeaderHistory(f, 4, keys)
+	if err := lh.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	lh.Append(LeaderChange{Term: 2, LeaderId: 2, Reason: "secret"})
+	if err := lh.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if rekeyed, err := lh.Rekey(); err != nil || !rekeyed {
+		t.Fatalf("Rekey: got %v, %v, want true", rekeyed, err)
+	}
+	if rekeyed, err := lh.Rekey(); err != nil || rekeyed {
+		t.Fatalf("Rekey again: got %v, %v, want false", rekeyed, err)
+	}
+
+	data, err := os.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("plaintext")) || bytes.Contains(data, []byte("secret")) {
+		t.Fatalf("changes written in plaintext: %q", data)
+	}
+	if staleLines(keys, data) {
+		t.Fatalf("changes not sealed with the current key %s", keys.Current())
+	}
+	want := []LeaderChange{{Term: 1, LeaderId: 1, Reason: "plaintext"}, {Term: 2, LeaderId: 2, Reason: "secret"}}
+	if got := NewLeaderHistory(f, 4, keys).Entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries %+v, want %+v", got, want)
+	}
+	if got := NewLeaderHistory(f, 4, nil).Entries(); len(got) != 0 {
+		t.Errorf("entries %+v read without the keyring", got)
+	}
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// NodeIdentity identifies a node independently of its address: UUID is
+// generated the first time the node starts and Id is the ID it was given
+// then.
+type NodeIdentity struct {
+	UUID string
+	Id   int
+}
+
+// LoadNodeIdentity returns the identity stored in f, creating it with the
+// given ID and a new UUID if f doesn't exist.
+func LoadNodeIdentity(f string, id int) (NodeIdentity, error) {
+	var identity NodeIdentity
+	data, err := os.ReadFile(f)
+	if err == nil {
+		if err := json.Unmarshal(data, &identity); err != nil || identity.UUID == "" {
+			return identity, ErrStorageCorrupt
+		}
+		return identity, nil
+	}
+	if !os.IsNotExist(err) {
+		return identity, err
+	}
+
+	identity.Id = id
+	if identity.UUID, err = newUUID(); err != nil {
+		return identity, err
+	}
+	if data, err = json.Marshal(identity); err != nil {
+		return identity, err
+	}
+	if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+		return identity, err
+	}
+	// Written to a temporary file first, so that a crash never leaves a
+	// partial identity behind.
+	tmp := f + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return identity, err
+	}
+	return identity, os.Rename(tmp, f)
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownKey is returned when decrypting data sealed with a key that
+// isn't in the keyring.
+var ErrUnknownKey = errors.New("encryption key not in the keyring")
+
+// sealedMagic starts the data sealed by a Keyring, followed by the ID of the
+// key, a newline, the nonce and the ciphertext.
+var sealedMagic = []byte("RAFTSEALED1 ")
+
+// sealedLineMagic starts the lines written by sealLine: sealedMagic is a
+// multiple of 3 bytes long, so its base64 is the prefix of theirs.
+var sealedLineMagic = []byte(base64.StdEncoding.EncodeToString(sealedMagic))
+
+// Keyring holds the keys encrypting the files of a node at rest, by ID. The
+// current key, the one with the greatest ID, seals the data written; the
+// older ones open the data written before the key was rotated, until it's
+// rewritten.
+type Keyring struct {
+	mu      sync.RWMutex
+	dir     string
+	keys    map[string][]byte
+	current string
+}
+
+// LoadKeyring reads the keys stored in dir, one per <id>.key file holding
+// the hex of a 256 bits key. A first key is created if dir has none. The
+// files must be readable only by the user running the node.
+func LoadKeyring(dir string) (*Keyring, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	k := &Keyring{dir: dir, keys: make(map[string][]byte)}
+	for _, file := range files {
+		id := strings.TrimSuffix(file.Name(), ".key")
+		if file.IsDir() || id == file.Name() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%w: encryption key %s", ErrStorageCorrupt, id)
+		}
+		k.keys[id] = key
+		if id > k.current {
+			k.current = id
+		}
+	}
+	if len(k.keys) == 0 {
+		if _, err := k.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Rotate creates a new key, named after the current time, and makes it the
+// current one. The data sealed with the older keys can still be opened.
+func (k *Keyring) Rotate() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	id := time.Now().UTC().Format("20060102T150405.000000000Z")
+	if id <= k.current {
+		// The clock went back: the new key must still sort last.
+		id = k.current + "-1"
+	}
+	// Written to a temporary file first, so that a crash never leaves a
+	// partial key behind.
+	tmp := filepath.Join(k.dir, "."+id+".tmp")
+	if err := os.WriteFile(tmp, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(k.dir, id+".key")); err != nil {
+		return "", err
+	}
+	k.keys[id] = key
+	k.current = id
+	return id, nil
+}
+
+// Current returns the ID of the current key.
+func (k *Keyring) Current() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// IDs returns the IDs of the keys, the current one last.
+func (k *Keyring) IDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Seal encrypts data with the current key, with AES-256-GCM.
+func (k *Keyring) Seal(data []byte) ([]byte, error) {
+	k.mu.RLock()
+	id, key := k.current, k.keys[k.current]
+	k.mu.RUnlock()
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := append(append(append([]byte{}, sealedMagic...), id...), '\n')
+	sealed := append(header, nonce...)
+	// The header is authenticated too, so that the key ID can't be swapped.
+	return aead.Seal(sealed, nonce, data, header), nil
+}
+
+// Open decrypts data sealed by Seal with any key of the keyring. The data
+// that isn't sealed is returned as it is, so that the files written before
+// encryption was enabled stay readable until they're rewritten.
+func (k *Keyring) Open(data []byte) ([]byte, error) {
+	id := KeyOf(data)
+	if id == "" {
+		return data, nil
+	}
+	k.mu.RLock()
+	key, ok := k.keys[id]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	headerLen := len(sealedMagic) + len(id) + 1
+	if len(data) < headerLen+aead.NonceSize() {
+		return nil, ErrStorageCorrupt
+	}
+	nonce := data[headerLen : headerLen+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[headerLen+aead.NonceSize():], data[:headerLen])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStorageCorrupt, err)
+	}
+	return plain, nil
+}
+
+// KeyOf returns the ID of the key that sealed data, or "" if data isn't
+// sealed.
+func KeyOf(data []byte) string {
+	if !bytes.HasPrefix(data, sealedMagic) {
+		return ""
+	}
+	rest := data[len(sealedMagic):]
+	end := bytes.IndexByte(rest, '\n')
+	if end <= 0 {
+		return ""
+	}
+	return string(rest[:end])
+}
+
+// sealLine returns data sealed by keys and encoded in base64, so that it fits
+// on a line of a file of records separated by newlines, or data as it is if
+// keys is nil.
+func sealLine(keys *Keyring, data []byte) ([]byte, error) {
+	if keys == nil {
+		return data, nil
+	}
+	sealed, err := keys.Seal(data)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(line, sealed)
+	return line, nil
+}
+
+// openLine returns the data of a line written by sealLine. A line that isn't
+// sealed, written before encryption was enabled, is returned as it is.
+func openLine(keys *Keyring, line []byte) ([]byte, error) {
+	sealed, ok := unsealLine(line)
+	if !ok {
+		return line, nil
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("%w: encrypted with key %s", ErrUnknownKey, KeyOf(sealed))
+	}
+	return keys.Open(sealed)
+}
+
+// unsealLine decodes line, reporting whether it was written by sealLine.
+func unsealLine(line []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(line, sealedLineMagic) {
+		return nil, false
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil || KeyOf(sealed) == "" {
+		return nil, false
+	}
+	return sealed, true
+}
+
+// staleLines reports whether a line of data, a file written by sealLine, is
+// sealed with another key than the current one of keys, or not sealed.
+// What follows the last newline, a line cut short, is ignored.
+func staleLines(keys *Keyring, data []byte) bool {
+	if keys == nil {
+		return false
+	}
+	current := keys.Current()
+	lines := bytes.Split(data, []byte("\n"))
+	for _, line := range lines[:len(lines)-1] {
+		sealed, _ := unsealLine(line)
+		if KeyOf(sealed) != current {
+			return true
+		}
+	}
+	return false
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
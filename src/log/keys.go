@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LoadSigningKey returns the private key stored in f, creating a new one if
+// f doesn't exist. The public key is written next to it, in f + ".pub", to
+// be copied to the other nodes, see LoadPublicKeys.
+func LoadSigningKey(f string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(f)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, ErrStorageCorrupt
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(f+".pub", []byte(hex.EncodeToString(public)+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	// Written to a temporary file first, so that a crash never leaves a
+	// partial key behind.
+	tmp := f + ".tmp"
+	if err := os.WriteFile(tmp, []byte(hex.EncodeToString(private.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return private, os.Rename(tmp, f)
+}
+
+// LoadPublicKeys returns the public keys of the nodes stored in dir, by ID:
+// the key of node id is in the file <id>.pub, as written by LoadSigningKey.
+// The other files are ignored.
+func LoadPublicKeys(dir string) (map[int]ed25519.PublicKey, error) {
+	named, err := LoadNamedKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[int]ed25519.PublicKey)
+	for name, key := range named {
+		if id, err := strconv.Atoi(name); err == nil {
+			keys[id] = key
+		}
+	}
+	return keys, nil
+}
+
+// LoadNamedKeys returns the public keys stored in dir, such as the ones of
+// the publishers of the services, by name: the key name is in the file
+// <name>.pub, as written by LoadSigningKey. The other files are ignored.
+func LoadNamedKeys(dir string) (map[string]ed25519.PublicKey, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]ed25519.PublicKey)
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".pub")
+		if file.IsDir() || name == file.Name() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: public key %s", ErrStorageCorrupt, name)
+		}
+		keys[name] = key
+	}
+	return keys, nil
+}
@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// HardState is the Raft state of a node that must survive a crash: the
+// latest term it has seen, the candidate it voted for in that term, -1 if
+// none, and a mark at or above the highest sequence number of the messages
+// received from the other nodes, by ID, so that the ones received before a
+// crash aren't accepted again after it.
+type HardState struct {
+	Term     int
+	VotedFor int
+	Seqs     map[int]uint64 `json:",omitempty"`
+}
+
+// Equal reports whether s and other are the same state.
+func (s HardState) Equal(other HardState) bool {
+	if s.Term != other.Term || s.VotedFor != other.VotedFor || len(s.Seqs) != len(other.Seqs) {
+		return false
+	}
+	for id, seq := range s.Seqs {
+		if otherSeq, ok := other.Seqs[id]; !ok || otherSeq != seq {
+			return false
+		}
+	}
+	return true
+}
+
+// RaftLog persists the HardState and the log of a Raft node in a file, as a
+// sequence of records appended to it, each flushed to disk before the call
+// writing it returns, and sealed by its keyring if it has one. The file is
+// compacted when it's opened, and by Compact and Rekey.
+type RaftLog struct {
+	mu   sync.Mutex
+	f    string
+	fd   *os.File
+	keys *Keyring
+}
+
+// raftLogRecord is a record of the file of a RaftLog: a new HardState, or
+// the entries replacing the ones from position At on.
+type raftLogRecord struct {
+	State   *HardState `json:",omitempty"`
+	At      int
+	Entries []json.RawMessage
+}
+
+// OpenRaftLog opens the RaftLog stored in f, creating it if it doesn't
+// exist, and returns the HardState and the entries persisted, in log order.
+// The records are encrypted with keys, nil if they aren't; the ones written
+// before encryption was enabled are encrypted when the file is compacted.
+// The last record, if it was cut short by a crash while writing it, is
+// ignored; ErrStorageCorrupt is returned if another one can't be decoded.
+func OpenRaftLog(f string, keys *Keyring) (*RaftLog, HardState, []json.RawMessage, error) {
+	rl := &RaftLog{f: f, keys: keys}
+	state, entries, err := rl.load()
+	if err != nil {
+		return nil, HardState{}, nil, err
+	}
+	if err := rl.rewrite(state, entries); err != nil {
+		return nil, HardState{}, nil, err
+	}
+	if rl.fd, err = os.OpenFile(f, os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+		return nil, HardState{}, nil, err
+	}
+	return rl, state, entries, nil
+}
+
+// load reads the records of the file, returning the HardState and the
+// entries they leave.
+func (rl *RaftLog) load() (HardState, []json.RawMessage, error) {
+	state := HardState{VotedFor: -1}
+	data, err := os.ReadFile(rl.f)
+	if os.IsNotExist(err) {
+		return state, nil, nil
+	}
+	if err != nil {
+		return state, nil, err
+	}
+
+	var entries []json.RawMessage
+	// A record is complete once its newline is written: what follows the
+	// last one is a record cut short.
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines[:len(lines)-1] {
+		record, err := rl.decode(line)
+		if errors.Is(err, ErrUnknownKey) {
+			return state, nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		if err != nil {
+			return state, nil, fmt.Errorf("%w: record %d: %v", ErrStorageCorrupt, i, err)
+		}
+		if record.State != nil {
+			state = *record.State
+			continue
+		}
+		if record.At < 0 || record.At > len(entries) {
+			return state, nil, fmt.Errorf("%w: record %d: entries at %d past the end of the log", ErrStorageCorrupt, i, record.At)
+		}
+		entries = append(entries[:record.At], record.Entries...)
+	}
+	return state, entries, nil
+}
+
+// encode returns the line of record, sealed with the current key.
+func (rl *RaftLog) encode(record raftLogRecord) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	line, err := sealLine(rl.keys, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// decode returns the record of line, without its newline.
+func (rl *RaftLog) decode(line []byte) (raftLogRecord, error) {
+	var record raftLogRecord
+	data, err := openLine(rl.keys, line)
+	if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
+
+// rewrite replaces the file with a record of state and one of entries. It's
+// written to a temporary file, flushed to disk and then renamed, so that a
+// crash leaves either file whole.
+func (rl *RaftLog) rewrite(state HardState, entries []json.RawMessage) error {
+	var buf []byte
+	for _, record := range []raftLogRecord{{State: &state}, {Entries: entries}} {
+		line, err := rl.encode(record)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+	}
+	tmp := rl.f + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(buf); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rl.f)
+}
+
+// append writes record at the end of the file and flushes it to disk.
+func (rl *RaftLog) append(record raftLogRecord) error {
+	line, err := rl.encode(record)
+	if err != nil {
+		return err
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.fd == nil {
+		return os.ErrClosed
+	}
+	if _, err := rl.fd.Write(line); err != nil {
+		return err
+	}
+	return rl.fd.Sync()
+}
+
+// SaveState persists state, replacing the previous one.
+func (rl *RaftLog) SaveState(state HardState) error {
+	return rl.append(raftLogRecord{State: &state})
+}
+
+// Append persists entries, the ones of the log from position at on, replacing
+// the ones persisted from there.
+func (rl *RaftLog) Append(at int, entries []json.RawMessage) error {
+	return rl.append(raftLogRecord{At: at, Entries: entries})
+}
+
+// Compact rewrites the file with the latest HardState and the entries of
+// the log only, dropping the records they replaced, and returns the size of
+// the file before and after. The writes wait until it's done.
+func (rl *RaftLog) Compact() (before, after int64, err error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.compact()
+}
+
+// Rekey compacts the file if a record was sealed with another key than the
+// current one of the keyring, returning whether it did, so that the old key
+// can be retired.
+func (rl *RaftLog) Rekey() (bool, error) {
+	if rl.keys == nil {
+		return false, nil
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	data, err := os.ReadFile(rl.f)
+	if err != nil {
+		return false, err
+	}
+	if !staleLines(rl.keys, data) {
+		return false, nil
+	}
+	_, _, err = rl.compact()
+	return true, err
+}
+
+// compact is Compact.
+// Expects rl.mu to be locked.
+func (rl *RaftLog) compact() (before, after int64, err error) {
+	if rl.fd == nil {
+		return 0, 0, os.ErrClosed
+	}
+	info, err := rl.fd.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	state, entries, err := rl.load()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := rl.rewrite(state, entries); err != nil {
+		return 0, 0, err
+	}
+	// The file open is the one replaced.
+	rl.fd.Close()
+	if rl.fd, err = os.OpenFile(rl.f, os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+		rl.fd = nil
+		return 0, 0, err
+	}
+	compacted, err := rl.fd.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.Size(), compacted.Size(), nil
+}
+
+// Close closes the file; the writes that follow fail.
+func (rl *RaftLog) Close() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.fd == nil {
+		return nil
+	}
+	err := rl.fd.Close()
+	rl.fd = nil
+	return err
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func rawEntries(values ...string) []json.RawMessage {
+	entries := make([]json.RawMessage, len(values))
+	for i, v := range values {
+		entries[i] = json.RawMessage(`"` + v + `"`)
+	}
+	return entries
+}
+
+func reopen(t *testing.T, f string) (HardState, []json.RawMessage) {
+	t.Helper()
+	rl, state, entries, err := OpenRaftLog(f, nil)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	rl.Close()
+	return state, entries
+}
+
+func TestRaftLogReopen(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "raft.log")
+	rl, state, entries, err := OpenRaftLog(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Equal(HardState{VotedFor: -1}) || len(entries) != 0 {
+		t.Fatalf("new log: got %+v, %d entries", state, len(entries))
+	}
+	steps := []func() error{
+		func() error { return rl.SaveState(HardState{Term: 1, VotedFor: 2}) },
+		func() error { return rl.Append(0, rawEntries("a", "b", "c")) },
+		// A new leader replaces the entries from b on.
+		func() error { return rl.Append(1, rawEntries("d")) },
+		func() error { return rl.SaveState(HardState{Term: 2, VotedFor: -1, Seqs: map[int]uint64{3: 7}}) },
+		func() error { return rl.Append(2, rawEntries("e")) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rl.Close()
+	if err := rl.SaveState(HardState{Term: 3}); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("writing after Close: got %v, want os.ErrClosed", err)
+	}
+
+	want := rawEntries("a", "d", "e")
+	// Twice, since the file is compacted when it's opened.
+	for i := 0; i < 2; i++ {
+		state, entries := reopen(t, f)
+		if want := (HardState{Term: 2, VotedFor: -1, Seqs: map[int]uint64{3: 7}}); !state.Equal(want) {
+			t.Errorf("state %+v, want %+v", state, want)
+		}
+		if !reflect.DeepEqual(entries, want) {
+			t.Errorf("entries %s, want %s", entries, want)
+		}
+	}
+}
+
+func TestRaftLogCompact(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "raft.log")
+	rl, _, _, err := OpenRaftLog(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	for term := 1; term <= 10; term++ {
+		if err := rl.SaveState(HardState{Term: term, VotedFor: -1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rl.Append(0, rawEntries("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.Append(1, rawEntries("c")); err != nil {
+		t.Fatal(err)
+	}
+	before, after, err := rl.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Errorf("compacted from %d to %d bytes", before, after)
+	}
+	// The writes after the compaction go to the compacted file.
+	if err := rl.Append(2, rawEntries("d")); err != nil {
+		t.Fatal(err)
+	}
+
+	state, entries := reopen(t, f)
+	if want := (HardState{Term: 10, VotedFor: -1}); !state.Equal(want) {
+		t.Errorf("state %+v, want %+v", state, want)
+	}
+	if want := rawEntries("a", "c", "d"); !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries %s, want %s", entries, want)
+	}
+}
+
+func TestRaftLogPartialRecord(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "raft.log")
+	rl, _, _, err := OpenRaftLog(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.Append(0, rawEntries("a")); err != nil {
+		t.Fatal(err)
+	}
+	rl.Close()
+
+	// A crash while appending leaves a record without its newline.
+	fd, err := os.OpenFile(f, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte(`{"At":1,"Entries":["b"`))
+	fd.Close()
+
+	_, entries := reopen(t, f)
+	if want := rawEntries("a"); !reflect.DeepEqual(entries, want) {
+		t.Fatalf("entries %s, want %s", entries, want)
+	}
+}
+
+func TestRaftLogCorrupt(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "raft.log")
+	for name, content := range map[string]string{
+		"garbage":      "{\"At\":0,\"Entries\":[\"a\"]}\nnot json\n",
+		"past the end": "{\"At\":2,\"Entries\":[\"a\"]}\n",
+	} {
+		if err := os.WriteFile(f, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := OpenRaftLog(f, nil); !errors.Is(err, ErrStorageCorrupt) {
+			t.Errorf("%s: got %v, want ErrStorageCorrupt", name, err)
+		}
+	}
+}
+func TestRaftLogEncrypted(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "raft.log")
+	rl, _, _, err := OpenRaftLog(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.Append(0, rawEntries("plaintext")); err != nil {
+		t.Fatal(err)
+	}
+	rl.Close()
+
+	keys, err := LoadKeyring(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The records written before encryption was enabled are encrypted when
+	// the file is opened.
+	rl, _, _, err = OpenRaftLog(f, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	if err := rl.SaveState(HardState{Term: 1, VotedFor: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.Append(1, rawEntries("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if rekeyed, err := rl.Rekey(); err != nil || !rekeyed {
+		t.Fatalf("Rekey: got %v, %v, want true", rekeyed, err)
+	}
+	if rekeyed, err := rl.Rekey(); err != nil || rekeyed {
+		t.Fatalf("Rekey again: got %v, %v, want false", rekeyed, err)
+	}
+
+	data, err := os.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("plaintext")) || bytes.Contains(data, []byte("secret")) {
+		t.Fatalf("entries written in plaintext: %q", data)
+	}
+	if staleLines(keys, data) {
+		t.Fatalf("records not sealed with the current key %s", keys.Current())
+	}
+	if _, _, _, err := OpenRaftLog(f, nil); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("opening without the keyring: got %v, want ErrUnknownKey", err)
+	}
+	rl2, state, entries, err := OpenRaftLog(f, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl2.Close()
+	if want := (HardState{Term: 1, VotedFor: 2}); !state.Equal(want) {
+		t.Errorf("state %+v, want %+v", state, want)
+	}
+	if want := rawEntries("plaintext", "secret"); !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries %s, want %s", entries, want)
+	}
+}
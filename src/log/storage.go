@@ -3,14 +3,26 @@
 package storage
 
 import (
+	"bytes"
+	"compress/flate"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"sync"
 )
 
+// ErrStorageCorrupt is returned when the persisted log can't be decoded.
+var ErrStorageCorrupt = errors.New("storage is corrupt")
+
 // Storage is an interface implemented by stable storage providers.
 type Storage interface {
-	Set(value map[string]interface{}, toWrite bool)
+	Set(value map[string]interface{}, toWrite bool) error
+}
+
+// RecordReader is a Storage whose records can be read back, see Records.
+type RecordReader interface {
+	Records() (map[string]map[string]interface{}, error)
 }
 
 // MapStorage is a simple in-memory implementation of Storage for testing.
@@ -18,49 +30,175 @@ type MapStorage struct {
 	mu sync.Mutex
 	m  map[string]map[string]interface{}
 	f  string
+	keys *Keyring
+
+	// z holds the records instead of m in a compressed storage, see
+	// NewCompressedMapStorage, zw compresses them and pending are the IDs
+	// of the ones not appended to the file yet
+	z  map[string][]byte
+	zw *flate.Writer
+	pending []string
+}
+
+// NewMapStorage creates a MapStorage backed by the file f, loading
+// its content. The file is created if it doesn't exist; ErrStorageCorrupt is
+// returned if it can't be decoded.
+func NewMapStorage(f string) (*MapStorage, error) {
+	return NewEncryptedMapStorage(f, nil)
 }
 
-func NewMapStorage() *MapStorage {
+// NewEncryptedMapStorage is NewMapStorage with the file encrypted by keys:
+// it's always written with the current key, and read with the key it was
+// written with. A file written without encryption is read as it is and
+// encrypted when it's written next. With nil keys it's not encrypted.
+func NewEncryptedMapStorage(f string, keys *Keyring) (*MapStorage, error) {
 	m := make(map[string]map[string]interface{})
 	ms := &MapStorage{
 		m: m,
-		f: os.Getenv("LOG_PATH"),
+		f: f,
 		mu: sync.Mutex{},
+		keys: keys,
 	}
 
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
-	jsonRead, err := os.ReadFile(ms.f)
+	jsonRead, err := ms.readFile()
 
-	if err != nil {
-		fd, _ := os.Create(ms.f)
-		defer fd.Close()
-		jsonWrite, _ := json.MarshalIndent(ms.m, "", "  ")
-		fd.Write(jsonWrite)
-	} else {
-		json.Unmarshal(jsonRead, &ms.m)
+	if os.IsNotExist(err) {
+		return ms, ms.WriteLog()
+	} else if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(jsonRead, framesMagic) {
+		if err := ms.readFrames(jsonRead, &ms.m); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(jsonRead, &ms.m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStorageCorrupt, err)
 	}
 
-	return ms
+	return ms, nil
 
 }
 
-func (ms *MapStorage) Set(value map[string]interface{}, toWrite bool) {
+func (ms *MapStorage) Set(value map[string]interface{}, toWrite bool) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
-	id := value["Id"].(string)
+	id, ok := value["Id"].(string)
+	if !ok {
+		return fmt.Errorf("entry without Id: %v", value)
+	}
 	delete(value, "Id")
 
+	if ms.z != nil {
+		return ms.setCompressed(id, value, toWrite)
+	}
+
 	if ms.m[id] == nil {
 		ms.m[id] = value
 		if toWrite {
-			ms.WriteLog()
+			return ms.WriteLog()
 		}
 	}
+	return nil
 
 }
 
-func (ms *MapStorage) WriteLog() {
-	jsonWrite, _ := json.MarshalIndent(ms.m, "", "  ")
-	os.WriteFile(ms.f, jsonWrite, 0600)
-}
\ No newline at end of file
+// Records returns a copy of the records of the storage by Id, including the
+// ones not written to its file yet.
+func (ms *MapStorage) Records() (map[string]map[string]interface{}, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.z != nil {
+		return ms.decompressAll()
+	}
+	records := make(map[string]map[string]interface{}, len(ms.m))
+	for id, record := range ms.m {
+		c := make(map[string]interface{}, len(record))
+		for k, v := range record {
+			c[k] = v
+		}
+		records[id] = c
+	}
+	return records, nil
+}
+
+// WriteLog writes the whole content of the storage to its file. It's written
+// to a temporary file, flushed to disk and then renamed, so that a crash
+// while persisting leaves the previous content rather than a partial one.
+// Expects ms.mu to be locked.
+func (ms *MapStorage) WriteLog() error {
+	if ms.z != nil {
+		return ms.writeFrames()
+	}
+	jsonWrite, err := json.MarshalIndent(ms.m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if ms.keys != nil {
+		if jsonWrite, err = ms.keys.Seal(jsonWrite); err != nil {
+			return err
+		}
+	}
+	return ms.replaceFile(jsonWrite)
+}
+
+// replaceFile replaces the file of the storage with data, see WriteLog.
+func (ms *MapStorage) replaceFile(data []byte) error {
+	tmp := ms.f + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ms.f)
+}
+
+// readFile reads the file of the storage, decrypting it.
+// Expects ms.mu to be locked.
+func (ms *MapStorage) readFile() ([]byte, error) {
+	data, err := os.ReadFile(ms.f)
+	if err != nil {
+		return nil, err
+	}
+	if ms.keys == nil {
+		if id := KeyOf(data); id != "" {
+			return nil, fmt.Errorf("%w: encrypted with key %s", ErrUnknownKey, id)
+		}
+		return data, nil
+	}
+	return ms.keys.Open(data)
+}
+
+// Rekey rewrites the file of the storage with the current key of its keyring
+// if it was written with another one, returning whether it did. After a
+// rotation the file is rewritten with the new key by the next write anyway;
+// Rekey doesn't wait for it, so that the old key can be retired.
+func (ms *MapStorage) Rekey() (bool, error) {
+	if ms.keys == nil {
+		return false, nil
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	data, err := os.ReadFile(ms.f)
+	if err != nil {
+		return false, err
+	}
+	if ms.z != nil {
+		return ms.rekeyFrames(data)
+	}
+	if KeyOf(data) == ms.keys.Current() {
+		return false, nil
+	}
+	return true, ms.WriteLog()
+}
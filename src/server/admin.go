@@ -0,0 +1,545 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"server/transfer"
+	"strconv"
+)
+
+// logPageSize is the maximum number of log entries returned by a request to
+// the admin API.
+const logPageSize = 100
+
+// ServeAdmin exposes the administrative HTTP API of this server on the admin
+// port, over TLS if the node has a certificate. It blocks until the HTTP
+// server fails or is shut down, see Shutdown.
+// When profiling is enabled, the pprof handlers and the Go runtime stats are
+// exposed too. With tokens
+// configured, see Config.AuthTokensPath, reading needs the read-only role,
+// cordoning, draining and managing services and recurring deployments the
+// operator role, and every
+// other change, profiling and reading the audit log, the quotas and the
+// secrets the admin role. Every change is recorded in the audit log.
+func (s *Server) ServeAdmin() {
+	profiling := s.config.Profiling
+	port := s.config.AdminPort
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.requireRole(RoleReadOnly, RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		s.handleMetrics(w, r)
+		if profiling {
+			writeRuntimeStats(w)
+		}
+	}))
+	mux.HandleFunc("/leaders", s.requireRole(RoleReadOnly, RoleAdmin, s.handleLeaders))
+	mux.HandleFunc("/cluster", s.requireRole(RoleReadOnly, RoleAdmin, s.handleCluster))
+	mux.HandleFunc("/peers", s.requireRole(RoleReadOnly, RoleAdmin, s.handlePeers))
+	mux.HandleFunc("/log", s.requireRole(RoleReadOnly, RoleAdmin, s.handleLog))
+	mux.HandleFunc("/log/verify", s.requireRole(RoleReadOnly, RoleAdmin, s.handleVerifyLog))
+	mux.HandleFunc("/audit", s.requireRole(RoleAdmin, RoleAdmin, s.handleAudit))
+	mux.HandleFunc("/quotas", s.requireRole(RoleAdmin, RoleAdmin, s.handleQuotas))
+	mux.HandleFunc("/resources", s.requireRole(RoleReadOnly, RoleAdmin, s.handleResources))
+	mux.HandleFunc("/secrets", s.requireRole(RoleAdmin, RoleAdmin, s.audited(s.handleSecrets)))
+	mux.HandleFunc("/load", s.requireRole(RoleReadOnly, RoleAdmin, s.handleLoad))
+	mux.HandleFunc("/events", s.requireRole(RoleReadOnly, RoleAdmin, s.handleEvents))
+	mux.HandleFunc("/logs", s.requireRole(RoleReadOnly, RoleAdmin, s.handleLogs))
+	mux.HandleFunc("/debug/logging", s.requireRole(RoleReadOnly, RoleAdmin, s.audited(s.handleLogging)))
+	mux.HandleFunc("/debug/tasks", s.requireRole(RoleReadOnly, RoleAdmin, s.handleTasks))
+	mux.HandleFunc("/debug/crashes", s.requireRole(RoleReadOnly, RoleAdmin, s.handleCrashes))
+	mux.HandleFunc("/debug/state", s.requireRole(RoleReadOnly, RoleAdmin, s.handleDumpState))
+	mux.HandleFunc("/status", s.requireRole(RoleReadOnly, RoleAdmin, s.handleStatus))
+	mux.HandleFunc("/services", s.requireRole(RoleReadOnly, RoleOperator, s.audited(s.handleServices)))
+	mux.HandleFunc("/crons", s.requireRole(RoleReadOnly, RoleOperator, s.audited(s.handleCrons)))
+	mux.HandleFunc("/leadership", s.requireRole(RoleReadOnly, RoleAdmin, s.audited(s.handleLeadership)))
+	mux.HandleFunc("/nodes", s.requireRole(RoleReadOnly, RoleAdmin, s.audited(s.handleNodes)))
+	mux.HandleFunc("/cordon", s.requireRole(RoleReadOnly, RoleOperator, s.audited(s.handleCordon)))
+	mux.HandleFunc("/drain", s.requireRole(RoleReadOnly, RoleOperator, s.audited(s.handleDrain)))
+	mux.HandleFunc("/standby", s.requireRole(RoleReadOnly, RoleAdmin, s.audited(s.handleStandby)))
+	mux.HandleFunc("/activate", s.requireRole(RoleReadOnly, RoleAdmin, s.audited(s.handleActivate)))
+	mux.HandleFunc("/restart", s.requireRole(RoleReadOnly, RoleAdmin, s.audited(s.handleRestart)))
+	mux.HandleFunc("/compact", s.requireRole(RoleReadOnly, RoleAdmin, s.audited(s.handleCompact)))
+	mux.HandleFunc("/config", s.requireRole(RoleReadOnly, RoleAdmin, s.audited(s.handleConfig)))
+	mux.HandleFunc("/chaos", s.requireRole(RoleReadOnly, RoleAdmin, s.audited(s.handleChaos)))
+
+	if profiling {
+		mux.HandleFunc("/debug/pprof/", s.requireRole(RoleAdmin, RoleAdmin, pprof.Index))
+		mux.HandleFunc("/debug/pprof/cmdline", s.requireRole(RoleAdmin, RoleAdmin, pprof.Cmdline))
+		mux.HandleFunc("/debug/pprof/profile", s.requireRole(RoleAdmin, RoleAdmin, pprof.Profile))
+		mux.HandleFunc("/debug/pprof/symbol", s.requireRole(RoleAdmin, RoleAdmin, pprof.Symbol))
+		mux.HandleFunc("/debug/pprof/trace", s.requireRole(RoleAdmin, RoleAdmin, pprof.Trace))
+	}
+
+	s.serveHTTP("admin API", ":"+port, mux)
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.cm.Status().WriteTo(w)
+	s.cm.GetMetrics().WriteTo(w)
+	s.cm.GetLoadHistory().WriteTo(w)
+}
+
+func (s *Server) handleLoad(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cm.GetLoadHistory().Samples())
+}
+
+// writeRuntimeStats writes goroutine and heap stats in the Prometheus text
+// exposition format.
+func writeRuntimeStats(w http.ResponseWriter) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	gauges := []struct {
+		name  string
+		value uint64
+	}{
+		{"go_goroutines", uint64(runtime.NumGoroutine())},
+		{"go_memstats_heap_alloc_bytes", mem.HeapAlloc},
+		{"go_memstats_heap_inuse_bytes", mem.HeapInuse},
+		{"go_memstats_heap_objects", mem.HeapObjects},
+		{"go_memstats_sys_bytes", mem.Sys},
+		{"go_gc_cycles_total", uint64(mem.NumGC)},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# TYPE %s gauge\n%s %d\n", g.name, g.name, g.value)
+	}
+}
+
+func (s *Server) handleLeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cm.LeaderHistory())
+}
+
+func (s *Server) handleCluster(w http.ResponseWriter, r *http.Request) {
+	info := s.cm.ClusterInfo()
+	if selector := r.URL.Query().Get("labels"); selector != "" {
+		labels, err := ParseLabels(selector)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		info.Peers = filterPeers(info.Peers, labels)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// handlePeers returns the health of the peers of this node.
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.GetPeers())
+}
+
+// handleLog returns the committed entries with position in [from, from+limit),
+// with from defaulting to 0 and limit to logPageSize.
+func (s *Server) handleLog(w http.ResponseWriter, r *http.Request) {
+	from, limit := 0, logPageSize
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > logPageSize {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := s.cm.ReadCommittedLog(from, from+limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// handleVerifyLog checks the hash chain of the persisted log and returns the
+// hash of its latest record, see ConsensusModule.VerifyChain.
+func (s *Server) handleVerifyLog(w http.ResponseWriter, r *http.Request) {
+	head, err := s.cm.VerifyChain()
+	switch {
+	case errors.Is(err, ErrChainBroken):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, ErrChainUnsupported):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"Head": head})
+}
+
+// handleAudit returns the audit log, see ConsensusModule.AuditLog.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cm.AuditLog())
+}
+
+// handleQuotas returns the usage of the quotas of the clients, see
+// Server.QuotaUsage.
+func (s *Server) handleQuotas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.QuotaUsage())
+}
+
+// handleResources returns the resources used by the services of each
+// namespace and client, and their quotas, see Server.ResourceUsage.
+func (s *Server) handleResources(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.ResourceUsage())
+}
+
+// handleSecrets returns the keys encrypting the storage and the TLS
+// certificate of the node. A POST request with rotate=storage rotates the
+// storage key, see Server.RotateStorageKey, and one with rotate=tls reloads
+// the certificate, see Server.ReloadCertificate.
+func (s *Server) handleSecrets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var err error
+		switch rotate := r.URL.Query().Get("rotate"); rotate {
+		case "storage":
+			_, err = s.RotateStorageKey()
+		case "tls":
+			err = s.ReloadCertificate()
+		default:
+			err = fmt.Errorf("invalid rotate %q, expected storage or tls", rotate)
+		}
+		if errors.Is(err, ErrNotEncrypted) || errors.Is(err, ErrNoCertificate) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Secrets())
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cm.Events())
+}
+
+// handleLogging returns the debug logging settings. A POST request with the
+// component and enabled (0 or 1) query parameters changes the setting of a
+// component.
+func (s *Server) handleLogging(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		component := r.URL.Query().Get("component")
+		if _, ok := DebugSettings()[component]; !ok {
+			http.Error(w, "unknown component "+component, http.StatusBadRequest)
+			return
+		}
+		SetDebug(component, r.URL.Query().Get("enabled") == "1")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DebugSettings())
+}
+
+func (s *Server) handleTasks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cm.Tasks())
+}
+
+func (s *Server) handleCrashes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cm.CrashReports())
+}
+
+func (s *Server) handleDumpState(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.cm.DumpState())
+}
+
+// handleStatus reports the Raft state of this node without locking its CM.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cm.Status())
+}
+
+// handleServices submits the service in the body of a POST request, and
+// undeploys the service in the id query parameter of a DELETE request.
+func (s *Server) handleServices(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The quota is charged before the artifact is stored by NewService.
+		_, artifact, err := ParseService(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.chargeQuota(r, len(artifact)); err != nil {
+			http.Error(w, err.Error(), quotaStatus(err))
+			return
+		}
+		release, err := s.startSubmit(r)
+		if err != nil {
+			http.Error(w, err.Error(), quotaStatus(err))
+			return
+		}
+		command, err := NewService(string(body), s)
+		if err == nil {
+			principal, _ := PrincipalFrom(r.Context())
+			command, err = submittedBy(command, principal.Name)
+		}
+		if err != nil {
+			release()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setAuditParam(r, "service", command.ServiceID)
+		index, term, accepted, future := s.Submit(r.Context(), command)
+		s.releaseOnCommit(future, release)
+		if !accepted {
+			if err := future.Wait(); errors.Is(err, ErrQuotaExceeded) {
+				http.Error(w, err.Error(), quotaStatus(err))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ServiceId": command.ServiceID,
+			"Index":     index,
+			"Term":      term,
+			"Accepted":  accepted,
+		})
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if !transfer.ValidID(id) {
+			http.Error(w, ErrInvalidServiceID.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.Undeploy(r.Context(), id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCrons returns the recurring deployments. A POST request registers the
+// one in the name query parameter, deploying the service described in the
+// body at the times of schedule, and a DELETE request unregisters it.
+func (s *Server) handleCrons(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body []byte
+		if body, err = io.ReadAll(r.Body); err == nil {
+			err = s.RegisterCron(r.Context(), query.Get("name"), query.Get("schedule"), string(body))
+		}
+	case http.MethodDelete:
+		err = s.UnregisterCron(r.Context(), query.Get("name"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, ErrInvalidService) || errors.Is(err, ErrUnverifiedArtifact) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cm.CronJobs())
+}
+
+// handleConfig returns the runtime settings of this node; a POST request
+// changes the setting in the name query parameter to value.
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		query := r.URL.Query()
+		if err := s.SetConfig(r.Context(), query.Get("name"), query.Get("value")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Settings())
+}
+
+// handleLeadership transfers the leadership to the node in the to query
+// parameter of a POST request.
+func (s *Server) handleLeadership(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	peerId, err := strconv.Atoi(r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, "invalid node id", http.StatusBadRequest)
+		return
+	}
+	if err := s.TransferLeadership(r.Context(), peerId); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// handleNodes connects to the node in the id and ip query parameters of a POST
+// request, and disconnects from the node in the id query parameter of a DELETE
+// request.
+func (s *Server) handleNodes(w http.ResponseWriter, r *http.Request) {
+	peerId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "invalid node id", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		err = s.AddNode(peerId, r.URL.Query().Get("ip"))
+	case http.MethodDelete:
+		err = s.RemoveNode(peerId)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// handleCordon cordons this node, or uncordons it if the enabled query
+// parameter of a POST request is 0.
+func (s *Server) handleCordon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.Cordon(r.URL.Query().Get("enabled") != "0")
+}
+
+// handleDrain drains this node on a POST request, or uncordons it if the
+// enabled query parameter is 0.
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Query().Get("enabled") == "0" {
+		s.Cordon(false)
+		return
+	}
+	if err := s.Drain(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// handleRestart restarts the nodes of the cluster one at a time on a POST
+// request to the leader.
+func (s *Server) handleRestart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.RollingRestart(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// handleStandby makes this node a standby node, or an active one if the
+// enabled query parameter of a POST request is 0.
+func (s *Server) handleStandby(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.SetStandby(r.Context(), r.URL.Query().Get("enabled") != "0"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// handleActivate activates the standby node in the id query parameter of a
+// POST request.
+func (s *Server) handleActivate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nodeId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "invalid node id", http.StatusBadRequest)
+		return
+	}
+	if err := s.Activate(r.Context(), nodeId); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// handleCompact compacts the raft log of this node on a POST request, see
+// ConsensusModule.CompactLog, and returns its size before and after.
+func (s *Server) handleCompact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	before, after, err := s.cm.CompactLog()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"Before": before, "After": after})
+}
+
+// handleChaos returns the faults injected by this node. A POST request
+// injects the faults in its query parameters, see ParseFaults, if the node
+// runs with UnsafeChaos, and a DELETE request stops injecting them.
+func (s *Server) handleChaos(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !s.cm.Config().UnsafeChaos {
+			http.Error(w, "fault injection disabled, see -unsafe-chaos", http.StatusForbidden)
+			return
+		}
+		faults, err := ParseFaults(r.URL.Query())
+		if err == nil {
+			err = s.cm.SetFaults(faults)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		s.cm.SetFaults(Faults{})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cm.Faults())
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Kinds of alerts raised by a CM.
+const (
+	AlertQuorumLost         = "quorum_lost"
+	AlertCommitStuck        = "commit_stuck"
+	AlertTransferFailed     = "transfer_failed"
+	AlertUnverifiedArtifact = "unverified_artifact"
+	AlertVoteFlood          = "vote_flood"
+	AlertMemoryPressure     = "memory_pressure"
+)
+
+// Alert describes a condition that needs the attention of an operator.
+type Alert struct {
+	Kind      string
+	NodeId    int
+	Term      int
+	Message   string
+	Timestamp string
+}
+
+// AlertFunc is a callback invoked for every alert raised by a CM.
+type AlertFunc func(Alert)
+
+// WebhookAlert returns an AlertFunc that POSTs every alert as JSON to url.
+func WebhookAlert(url string) AlertFunc {
+	client := &http.Client{Timeout: 5 * time.Second}
+	return func(alert Alert) {
+		body, err := json.Marshal(alert)
+		if err != nil {
+			return
+		}
+		if resp, err := client.Post(url, "application/json", bytes.NewReader(body)); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// OnAlert registers f to be called for every alert raised by this CM.
+func (cm *ConsensusModule) OnAlert(f AlertFunc) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.alertFuncs = append(cm.alertFuncs, f)
+}
+
+// raiseAlert calls every registered AlertFunc in a separate goroutine.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) raiseAlert(kind string, message string) {
+	alert := Alert{
+		Kind:      kind,
+		NodeId:    cm.id,
+		Term:      cm.currentTerm,
+		Message:   message,
+		Timestamp: cm.clock.Now().Local().Format("2006-01-02 15:04:05.0000"),
+	}
+	cm.Dlog("alert %s: %s", kind, message)
+	cm.recordEvent(EventAlert, "%s: %s", kind, message)
+	for _, f := range cm.alertFuncs {
+		f := f
+		cm.tasks.Go("alert "+kind, func() { f(alert) })
+	}
+}
+
+// watchAlerts periodically checks the conditions that raise alerts: a leader
+// that can't reach a majority of its peers and a commitIndex that doesn't
+// advance for config.AlertStuckAfter while entries are pending. Alerts are
+// raised once when the condition begins. Returns when the CM is Dead.
+func (cm *ConsensusModule) watchAlerts() {
+	quorumLost, commitStuck := false, false
+	lastCommitIndex, lastCommitChange := -1, cm.clock.Now()
+	for {
+		select {
+		case <-cm.clock.After(1 * time.Second):
+		case <-cm.ctx.Done():
+			return
+		}
+		stuckAfter := cm.Config().AlertStuckAfter
+		cm.mu.Lock()
+		if cm.state == Dead {
+			cm.mu.Unlock()
+			return
+		}
+
+		if cm.state == Leader {
+			reachable := 1
+			cm.peersMu.Lock()
+			for _, peerId := range cm.peerIds {
+				// Learners don't vote, see voters.
+				if !cm.learners[peerId] && !cm.peerUnreachable[peerId] {
+					reachable++
+				}
+			}
+			cm.peersMu.Unlock()
+			lost := reachable*2 <= cm.voters()+1
+			if lost && !quorumLost {
+				cm.raiseAlert(AlertQuorumLost, "leader reaches "+strconv.Itoa(reachable)+" of "+strconv.Itoa(cm.voters()+1)+" voters")
+			}
+			quorumLost = lost
+		} else {
+			quorumLost = false
+		}
+
+		if cm.commitIndex != lastCommitIndex {
+			lastCommitIndex, lastCommitChange = cm.commitIndex, cm.clock.Now()
+			commitStuck = false
+		} else if len(cm.log)-1 > cm.commitIndex && cm.clock.Since(lastCommitChange) > stuckAfter {
+			if !commitStuck {
+				cm.raiseAlert(AlertCommitStuck, "commitIndex "+strconv.Itoa(cm.commitIndex)+" stuck with "+strconv.Itoa(len(cm.log)-1-cm.commitIndex)+" pending entries")
+			}
+			commitStuck = true
+		}
+		cm.mu.Unlock()
+	}
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// peerNamePrefix prefixes the node ID in the name of the certificate of a
+// node, see PeerName.
+const peerNamePrefix = "node-"
+
+// handshakeTimeout bounds the TLS handshake of a peer connection.
+const handshakeTimeout = 10 * time.Second
+
+// PeerAllowlist restricts the peers whose connections a node accepts, see
+// Config.AllowedPeers. An empty allowlist accepts every peer.
+type PeerAllowlist struct {
+	// Ids are the node IDs accepted; any if empty.
+	Ids map[int]bool
+
+	// Fingerprints are the hex SHA-256 digests of the TLS certificates
+	// accepted, pinned in place of the ones signed by the cluster CA, with
+	// the ID of the node presenting each; any certificate the CA accepts if
+	// empty.
+	Fingerprints map[string]int
+}
+
+// ParsePeerAllowlist parses an allowlist written as comma-separated node IDs
+// and certificate fingerprints, each bound to the ID of its node, such as
+// "1,2,3" or "1=9f86d0...,2=60303a...".
+func ParsePeerAllowlist(s string) (PeerAllowlist, error) {
+	a := PeerAllowlist{Ids: make(map[int]bool), Fingerprints: make(map[string]int)}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if id, err := strconv.Atoi(entry); err == nil {
+			a.Ids[id] = true
+			continue
+		}
+		if i := strings.Index(entry, "="); i >= 0 {
+			id, err := strconv.Atoi(entry[:i])
+			fingerprint := strings.ToLower(entry[i+1:])
+			if digest, hexErr := hex.DecodeString(fingerprint); err == nil && hexErr == nil && len(digest) == sha256.Size {
+				a.Fingerprints[fingerprint] = id
+				continue
+			}
+		}
+		return PeerAllowlist{}, fmt.Errorf("invalid peer %q, expected a node ID or <node ID>=<SHA-256 fingerprint>", entry)
+	}
+	return a, nil
+}
+
+// PeerName returns the name the certificate of node id must carry among its
+// DNS subject alternative names, when it's signed by the cluster CA rather
+// than pinned, see Config.TLSCA.
+func PeerName(id int) string {
+	return peerNamePrefix + strconv.Itoa(id)
+}
+
+// Fingerprint returns the hex SHA-256 digest of a DER-encoded certificate,
+// as listed in a PeerAllowlist.
+func Fingerprint(cert []byte) string {
+	sum := sha256.Sum256(cert)
+	return hex.EncodeToString(sum[:])
+}
+
+// peerTLSConfig returns the TLS configuration of the RPC connections, on both
+// ends: the node presents its certificate and checks the one of the peer,
+// see verifyPeerCertificate. Peers are dialed by IP address, so the name
+// checked is the one of their node ID, see dialTLSConfig. It fails with
+// ErrUntrustedPeers if there's neither a cluster CA nor pinned certificates
+// to check the peers with.
+func (s *Server) peerTLSConfig() (*tls.Config, error) {
+	if s.config.TLSCA == "" && len(s.allowlist.Fingerprints) == 0 {
+		return nil, ErrUntrustedPeers
+	}
+	config := s.TLSConfig()
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return s.cm.secrets.getCertificate(nil)
+	}
+	config.ClientAuth = tls.RequireAnyClientCert
+	config.InsecureSkipVerify = true
+	var roots *x509.CertPool
+	if s.config.TLSCA != "" {
+		pem, err := os.ReadFile(s.config.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", s.config.TLSCA)
+		}
+	}
+	s.peerRoots = roots
+	config.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+		_, err := s.verifyPeerCertificate(raw)
+		return err
+	}
+	return config, nil
+}
+
+// dialTLSConfig returns the TLS configuration of the connection dialed to
+// node peerId: the certificate of the node answering must be the one of
+// peerId.
+func (s *Server) dialTLSConfig(peerId int) *tls.Config {
+	config := s.peerTLS.Clone()
+	config.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+		id, err := s.verifyPeerCertificate(raw)
+		if err == nil && id != peerId {
+			err = fmt.Errorf("%w: node %d answered with the certificate of node %d", ErrPeerNotAllowed, peerId, id)
+		}
+		return err
+	}
+	return config
+}
+
+// apiTLSConfig returns the TLS configuration of the admin and REST APIs: the
+// node presents its certificate and asks for the one of the client without
+// requiring it, since the clients of the APIs authenticate with their
+// tokens. The peers proxying requests to the REST API present theirs, see
+// forwardedByPeer.
+func (s *Server) apiTLSConfig() *tls.Config {
+	config := s.TLSConfig()
+	config.ClientAuth = tls.RequestClientCert
+	return config
+}
+
+// forwardedByPeer reports whether r was sent by the node it names in its
+// X-Forwarded-By header, authenticated by the certificate it presented, see
+// verifyPeerCertificate, and allowed by the allowlist. The requests aren't
+// authenticated without TLS, so none is forwarded by a peer.
+func (s *Server) forwardedByPeer(r *http.Request) bool {
+	if s.peerTLS == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	raw := make([][]byte, len(r.TLS.PeerCertificates))
+	for i, cert := range r.TLS.PeerCertificates {
+		raw[i] = cert.Raw
+	}
+	id, err := s.verifyPeerCertificate(raw)
+	if err != nil || strconv.Itoa(id) != r.Header.Get("X-Forwarded-By") {
+		return false
+	}
+	return len(s.allowlist.Ids) == 0 || s.allowlist.Ids[id]
+}
+
+// proxyTransport returns the transport of the requests proxied to the REST
+// API of node leaderId, over TLS if the node has a certificate: the leader
+// must present its own, see dialTLSConfig, and this node presents its
+// certificate, see forwardedByPeer.
+func (s *Server) proxyTransport(leaderId int) *http.Transport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.proxyTransports == nil {
+		s.proxyTransports = make(map[int]*http.Transport)
+	}
+	transport, ok := s.proxyTransports[leaderId]
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		if s.peerTLS != nil {
+			transport.TLSClientConfig = s.dialTLSConfig(leaderId)
+		}
+		s.proxyTransports[leaderId] = transport
+	}
+	return transport
+}
+
+// verifyPeerCertificate checks the certificate chain presented by a peer and
+// returns the ID of its node: its certificate must be pinned by the
+// allowlist if it pins any, or else signed by the cluster CA and name the
+// node, see certificatePeerId.
+func (s *Server) verifyPeerCertificate(raw [][]byte) (int, error) {
+	if len(raw) == 0 {
+		return 0, fmt.Errorf("%w: no certificate", ErrPeerNotAllowed)
+	}
+	certs := make([]*x509.Certificate, len(raw))
+	for i, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return 0, err
+		}
+		certs[i] = cert
+	}
+	if len(s.allowlist.Fingerprints) == 0 {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         s.peerRoots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return s.certificatePeerId(certs[0])
+}
+
+// certificatePeerId returns the ID of the node of cert, a certificate
+// verified: the one its fingerprint is pinned with, if the allowlist pins
+// any, or else the one of the single name of a node among its DNS names,
+// see PeerName.
+func (s *Server) certificatePeerId(cert *x509.Certificate) (int, error) {
+	if len(s.allowlist.Fingerprints) > 0 {
+		fingerprint := Fingerprint(cert.Raw)
+		id, ok := s.allowlist.Fingerprints[fingerprint]
+		if !ok {
+			return 0, fmt.Errorf("%w: certificate %s not pinned", ErrPeerNotAllowed, fingerprint)
+		}
+		return id, nil
+	}
+	id, found := 0, false
+	for _, name := range cert.DNSNames {
+		if !strings.HasPrefix(name, peerNamePrefix) {
+			continue
+		}
+		named, err := strconv.Atoi(strings.TrimPrefix(name, peerNamePrefix))
+		if err != nil {
+			continue
+		}
+		if found && named != id {
+			return 0, fmt.Errorf("%w: certificate names nodes %d and %d", ErrPeerNotAllowed, id, named)
+		}
+		id, found = named, true
+	}
+	if !found {
+		return 0, fmt.Errorf("%w: certificate names no node", ErrPeerNotAllowed)
+	}
+	return id, nil
+}
+
+// admitPeer checks that the peer that opened conn is allowed by the
+// allowlist, completing the TLS handshake of conn if it's encrypted. The
+// peers refused are logged and recorded as security events.
+func (s *Server) admitPeer(conn net.Conn) error {
+	err := s.checkPeer(conn)
+	if err != nil {
+		log.Printf("[%v] refused connection from %s: %v", s.serverId, conn.RemoteAddr(), err)
+		s.cm.recordEventUnlocked(EventSecurity, "connection from %s refused: %v", conn.RemoteAddr(), err)
+	}
+	return err
+}
+
+// checkPeer identifies the peer of conn by its certificate if conn is
+// encrypted, or else by its address, see peerIdOf, and checks it against the
+// allowlist.
+func (s *Server) checkPeer(conn net.Conn) error {
+	var id int
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		// The chain was verified by the handshake.
+		certs := tlsConn.ConnectionState().PeerCertificates
+		if len(certs) == 0 {
+			return fmt.Errorf("%w: no certificate", ErrPeerNotAllowed)
+		}
+		var err error
+		if id, err = s.certificatePeerId(certs[0]); err != nil {
+			return err
+		}
+	} else {
+		if len(s.allowlist.Ids) == 0 {
+			return nil
+		}
+		var ok bool
+		if id, ok = s.peerIdOf(conn.RemoteAddr()); !ok {
+			return fmt.Errorf("%w: unknown node", ErrPeerNotAllowed)
+		}
+	}
+	if len(s.allowlist.Ids) > 0 && !s.allowlist.Ids[id] {
+		return fmt.Errorf("%w: node %d", ErrPeerNotAllowed, id)
+	}
+	return nil
+}
+
+// peerIdOf returns the ID of the node at addr, with the resolver set by
+// WithPeerResolver, or else among the peers of this server. It identifies
+// the peers only when the RPCs aren't encrypted: a certificate names its
+// node, unlike an address.
+func (s *Server) peerIdOf(addr net.Addr) (int, bool) {
+	ip := addr
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip = &net.IPAddr{IP: tcp.IP}
+	}
+	if s.resolvePeer != nil {
+		return s.resolvePeer(ip)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, peer := range s.peers {
+		if peer.String() == ip.String() {
+			return id, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"server/transfer"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServeAPI exposes the REST API used to upload, deploy and remove services on
+// the API port, over TLS if the node has a certificate. Requests received by
+// a follower are proxied to the leader; if the leader is unknown they are
+// served locally, in both cases after being authenticated: reading needs the
+// read-only role and the other requests the operator role, see
+// Config.AuthTokensPath. The other requests are recorded
+// in the audit log by the node serving them. It blocks until the HTTP server
+// fails or is shut down, see Shutdown.
+//
+//	POST   /v1/services              uploads a service, returns its ID
+//	POST   /v1/services/<id>/deploy  submits an uploaded service; with ?wait=1
+//	                                 waits for the entry to be committed, with
+//	                                 ?at=<RFC 3339 time> defers it until then
+//	GET    /v1/services/<id>         returns the placement of a service
+//	DELETE /v1/services/<id>         discards or undeploys a service
+func (s *Server) ServeAPI() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/services", s.requireRole(RoleReadOnly, RoleOperator, s.proxyToLeader(s.audited(s.handleUpload))))
+	mux.HandleFunc("/v1/services/", s.requireRole(RoleReadOnly, RoleOperator, s.proxyToLeader(s.audited(s.handleService))))
+
+	s.serveHTTP("REST API", ":"+s.config.APIPort, mux)
+}
+
+// proxyToLeader wraps handler so that requests are forwarded to the REST API
+// of the leader when it's another node, over TLS if the node has a
+// certificate. A request forwarded by a peer, see forwardedByPeer, is served
+// locally rather than forwarded again; one claiming to be forwarded by
+// another client is refused unless this node leads, so that the header
+// can't be used to skip the proxy.
+func (s *Server) proxyToLeader(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		leaderId, leaderAddr := s.cm.GetLeader()
+		forwarded := r.Header.Get("X-Forwarded-By") != ""
+		if leaderId == s.serverId || leaderAddr == "" || forwarded && s.forwardedByPeer(r) {
+			handler(w, r)
+			return
+		}
+		if forwarded {
+			// Forwarding it again could loop between nodes that don't
+			// agree on the leader yet.
+			http.Error(w, fmt.Sprintf("%v: forwarded to node %d", ErrNotLeader, s.serverId), http.StatusMisdirectedRequest)
+			return
+		}
+		target := &url.URL{Scheme: "http", Host: leaderAddr + ":" + s.config.APIPort}
+		if s.peerTLS != nil {
+			target.Scheme = "https"
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.Transport = s.proxyTransport(leaderId)
+		r.Header.Set("X-Forwarded-By", strconv.Itoa(s.serverId))
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// handleUpload saves the service described in the body of a POST request,
+// to be deployed later.
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	command, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service, body, err := ParseService(string(command))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	setAuditParam(r, "service", service.ServiceID)
+	if err := s.cm.verifyArtifact(service.ServiceID, body, service.Signature); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.chargeQuota(r, len(body)); err != nil {
+		http.Error(w, err.Error(), quotaStatus(err))
+		return
+	}
+	if err := s.cm.artifacts.Save(service.ServiceID, body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.mu.Lock()
+	s.artifacts[service.ServiceID] = service
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"ServiceId": service.ServiceID})
+}
+
+// handleService serves the requests about a single service.
+func (s *Server) handleService(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/services/"), "/")
+	id := path[0]
+	if !transfer.ValidID(id) {
+		http.Error(w, ErrInvalidServiceID.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case len(path) == 2 && path[1] == "deploy" && r.Method == http.MethodPost:
+		s.handleDeploy(w, r, id)
+	case len(path) == 1 && r.Method == http.MethodGet:
+		var status ServiceStatusReply
+		s.cm.ServiceStatus(ServiceStatusArgs{ServiceId: id}, &status)
+		if !status.Found {
+			http.Error(w, ErrServiceNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		s.mu.Lock()
+		_, uploaded := s.artifacts[id]
+		delete(s.artifacts, id)
+		s.mu.Unlock()
+		if uploaded {
+			s.cm.artifacts.Remove(id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err := s.Undeploy(r.Context(), id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *Server) handleDeploy(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	service, ok := s.artifacts[id]
+	delete(s.artifacts, id)
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, ErrServiceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	submitted, err := deferService(service, r.URL.Query().Get("at"))
+	if err == nil {
+		principal, _ := PrincipalFrom(r.Context())
+		submitted, err = submittedBy(submitted, principal.Name)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.artifacts[id] = service
+		s.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	release, err := s.startSubmit(r)
+	if err != nil {
+		s.mu.Lock()
+		s.artifacts[id] = service
+		s.mu.Unlock()
+		http.Error(w, err.Error(), quotaStatus(err))
+		return
+	}
+
+	index, term, accepted, future := s.Submit(r.Context(), submitted)
+	s.releaseOnCommit(future, release)
+	if !accepted {
+		err = future.Wait()
+	} else if r.URL.Query().Get("wait") == "1" {
+		err = future.WaitContext(r.Context())
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.artifacts[id] = service
+		s.mu.Unlock()
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, ErrQuotaExceeded) {
+			status = http.StatusTooManyRequests
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ServiceId": id,
+		"Index":     index,
+		"Term":      term,
+	})
+}
+
+// deferService returns the deployment of service, deferred until at, a time
+// in RFC 3339, if it's not empty.
+func deferService(service *Service, at string) (*Service, error) {
+	if at == "" {
+		return service, nil
+	}
+	notBefore, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time %q, expected RFC 3339", at)
+	}
+	payload, err := DecodeCommand(service)
+	if err != nil {
+		return nil, err
+	}
+	deploy := payload.(DeployPayload)
+	deploy.NotBefore = &notBefore
+	deferred := *service
+	if deferred.Payload, err = json.Marshal(deploy); err != nil {
+		return nil, err
+	}
+	return &deferred, nil
+}
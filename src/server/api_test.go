@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes to dir the certificate of name, signed by parent
+// with parentKey or self-signed if parent is nil, and its key, and returns
+// them with the paths of their files.
+func writeCertificate(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, certFile, keyFile
+}
+
+// TestForwardedByPeer serves an API of node 1 over TLS: the X-Forwarded-By
+// header is only honored on the requests of the peer it names, presenting
+// its certificate.
+func TestForwardedByPeer(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeCertificate(t, dir, "ca", nil, nil)
+	servers := make(map[int]*Server)
+	for id := 1; id <= 2; id++ {
+		_, _, certFile, keyFile := writeCertificate(t, dir, PeerName(id), ca, caKey)
+		config := DefaultConfig()
+		config.LogPath = filepath.Join(dir, strconv.Itoa(id), "log.txt")
+		config.TLSCert, config.TLSKey, config.TLSCA = certFile, keyFile, caFile
+		if err := os.MkdirAll(filepath.Dir(config.LogPath), 0700); err != nil {
+			t.Fatal(err)
+		}
+		srv, err := NewServer(id, config, nil)
+		if err != nil {
+			t.Fatalf("starting node %d: %v", id, err)
+		}
+		t.Cleanup(func() { srv.Close() })
+		servers[id] = srv
+	}
+
+	api := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !servers[1].forwardedByPeer(r) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	// Unlike StartTLS, that would present the certificate of httptest.
+	api.Listener = tls.NewListener(api.Listener, servers[1].apiTLSConfig())
+	api.Start()
+	defer api.Close()
+	url := "https://" + api.Listener.Addr().String()
+
+	clientConfig, err := ClientTLSConfig(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		transport   *http.Transport
+		forwardedBy string
+		want        int
+	}{
+		{"peer", servers[2].proxyTransport(1), "2", http.StatusOK},
+		{"peer naming another", servers[2].proxyTransport(1), "3", http.StatusForbidden},
+		{"client", &http.Transport{TLSClientConfig: clientConfig}, "2", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-By", test.forwardedBy)
+		resp, err := (&http.Client{Transport: test.transport}).Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, resp.StatusCode, test.want)
+		}
+	}
+}
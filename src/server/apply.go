@@ -0,0 +1,178 @@
+package server
+
+import "context"
+
+// applyQueueSize is the number of batches of committed entries that can wait
+// to be applied before applyCommitted stops queueing them, and maxApplyBatch
+// the number of entries in a batch.
+const (
+	applyQueueSize = 64
+	maxApplyBatch  = 64
+)
+
+// applyBatch is a batch of consecutive committed entries waiting in the apply
+// queue; first is the position in the log of the first one. A batch with run
+// set carries no entries: run is called in their place, see onApplier.
+type applyBatch struct {
+	first   int
+	entries []LogEntry
+	run     func()
+}
+
+// applyCommitted watches newCommitReadyChan and queues the newly committed
+// entries to be applied by applyQueued, in batches of up to maxApplyBatch
+// entries, so that a slow cm.fsm never holds cm.mu nor delays the commit
+// notifications. When the queue is full, it waits for room without holding
+// cm.mu. This method should run in a separate background goroutine. Returns
+// when the CM is stopped.
+func (cm *ConsensusModule) applyCommitted() {
+	for {
+		select {
+		case <-cm.newCommitReadyChan:
+		case <-cm.ctx.Done():
+			return
+		}
+		cm.mu.Lock()
+		// A snapshot may have moved lastApplied past the queued entries.
+		from := cm.queuedIndex + 1
+		if cm.lastApplied >= from {
+			from = cm.lastApplied + 1
+		}
+		var entries []LogEntry
+		if cm.commitIndex >= from {
+			entries = append([]LogEntry{}, cm.log[from:cm.commitIndex+1]...)
+			cm.queuedIndex = cm.commitIndex
+		}
+		cm.mu.Unlock()
+		cm.Dlog("applyCommitted queueing entries=%v from %d", entries, from)
+
+		for len(entries) > 0 {
+			n := intMin(len(entries), maxApplyBatch)
+			batch := applyBatch{first: from, entries: entries[:n:n]}
+			entries, from = entries[n:], from+n
+			select {
+			case cm.applyQueue <- batch:
+			default:
+				cm.metrics.ApplyQueueFull()
+				select {
+				case cm.applyQueue <- batch:
+				case <-cm.ctx.Done():
+					return
+				}
+			}
+			cm.updateApplyBacklog()
+		}
+	}
+}
+
+// applyQueued applies the batches queued by applyCommitted to cm.fsm, in
+// order, advancing lastApplied. A BatchFSM gets each batch in a single
+// ApplyBatch call. Entries already covered by a snapshot are skipped. This
+// method should run in a separate background goroutine. Returns when the CM
+// is stopped.
+func (cm *ConsensusModule) applyQueued() {
+	for {
+		var batch applyBatch
+		select {
+		case batch = <-cm.applyQueue:
+		case <-cm.ctx.Done():
+			return
+		}
+		if batch.run != nil {
+			batch.run()
+			continue
+		}
+		cm.mu.RLock()
+		if skip := cm.lastApplied + 1 - batch.first; skip > 0 {
+			batch.entries = batch.entries[intMin(skip, len(batch.entries)):]
+			batch.first += skip
+		}
+		cm.mu.RUnlock()
+		if len(batch.entries) == 0 {
+			continue
+		}
+
+		if fsm, ok := cm.fsm.(BatchFSM); ok {
+			if err := fsm.ApplyBatch(batch.entries); err != nil {
+				cm.Dlog("error while applying entries from %d: %v", batch.first, err)
+				cm.recordEventUnlocked(EventPersistError, "applying entries from %d: %v", batch.first, err)
+			}
+			cm.advanceLastApplied(batch.first + len(batch.entries) - 1)
+		} else {
+			for i, entry := range batch.entries {
+				if err := cm.fsm.Apply(entry); err != nil {
+					cm.Dlog("error while applying entry %s: %v", entry.Index, err)
+					cm.recordEventUnlocked(EventPersistError, "applying entry %s: %v", entry.Index, err)
+				}
+				cm.advanceLastApplied(batch.first + i)
+			}
+		}
+		cm.updateApplyBacklog()
+	}
+}
+
+// onApplier runs f on the goroutine of applyQueued, between the batches
+// queued before and after it, so that f sees the FSM in the state of
+// lastApplied and no entry is applied meanwhile. It returns the error of f,
+// ctx.Err() if ctx is done first or ErrStopped if the CM is stopped.
+func (cm *ConsensusModule) onApplier(ctx context.Context, f func() error) error {
+	done := make(chan error, 1)
+	select {
+	case cm.applyQueue <- applyBatch{run: func() { done <- f() }}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cm.ctx.Done():
+		return ErrStopped
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cm.ctx.Done():
+		return ErrStopped
+	}
+}
+
+// restoreSnapshot replaces the state of cm.fsm with snapshot, the state of
+// the entries up to position index, on the goroutine of applyQueued. The
+// entries up to index are then received with the log but not applied again.
+// A snapshot older than the entries applied already is ignored.
+func (cm *ConsensusModule) restoreSnapshot(ctx context.Context, snapshot []byte, index int) error {
+	return cm.onApplier(ctx, func() error {
+		cm.mu.RLock()
+		applied := cm.lastApplied
+		cm.mu.RUnlock()
+		if index <= applied {
+			return nil
+		}
+		if err := cm.fsm.Restore(snapshot); err != nil {
+			return err
+		}
+		cm.advanceLastApplied(index)
+		return nil
+	})
+}
+
+// advanceLastApplied records that the entries up to position are applied.
+func (cm *ConsensusModule) advanceLastApplied(position int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if position > cm.lastApplied {
+		cm.lastApplied = position
+	}
+	cm.signalAdvance()
+}
+
+// updateApplyBacklog records in cm.metrics the committed entries not applied
+// yet and the ones waiting in the apply queue.
+func (cm *ConsensusModule) updateApplyBacklog() {
+	cm.mu.RLock()
+	backlog := cm.commitIndex - cm.lastApplied
+	queued := cm.queuedIndex - cm.lastApplied
+	cm.mu.RUnlock()
+	if queued < 0 {
+		queued = 0
+	}
+	cm.metrics.ApplyBacklog(backlog, queued)
+}
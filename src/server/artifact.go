@@ -0,0 +1,83 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SignService returns manifest, the description of a service as accepted by
+// ParseService, with the signature of its artifact by key, the private key of
+// its publisher. The nodes trusting the publisher, see WithTrustedKeys, only
+// run the artifact if the signature is valid. An earlier signature is
+// replaced.
+func SignService(manifest string, key ed25519.PrivateKey) (string, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return "", fmt.Errorf("invalid signing key of %d bytes", len(key))
+	}
+	_, artifact, err := ParseService(manifest)
+	if err != nil {
+		return "", err
+	}
+	parsed := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(manifest), &parsed); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidService, err)
+	}
+	parsed["Signature"] = hex.EncodeToString(ed25519.Sign(key, artifact))
+	signed, err := yaml.Marshal(parsed)
+	return string(signed), err
+}
+
+// verifyArtifact checks that signature is the signature of artifact, the
+// artifact of the service serviceId, by one of the publishers trusted by this
+// CM. Without trusted keys every artifact is accepted. The artifacts rejected
+// are reported with an alert.
+func (cm *ConsensusModule) verifyArtifact(serviceId string, artifact []byte, signature []byte) error {
+	if cm.trusted == nil {
+		return nil
+	}
+	for _, key := range cm.trusted {
+		if ed25519.Verify(key, artifact, signature) {
+			return nil
+		}
+	}
+	err := fmt.Errorf("%w: %s", ErrUnverifiedArtifact, serviceId)
+	if len(signature) == 0 {
+		err = fmt.Errorf("%w: %s isn't signed", ErrUnverifiedArtifact, serviceId)
+	}
+	cm.mu.Lock()
+	cm.raiseAlert(AlertUnverifiedArtifact, err.Error())
+	cm.mu.Unlock()
+	return err
+}
+
+// verifyStoredArtifact verifies the artifact of serviceId stored by this CM,
+// see verifyArtifact.
+func (cm *ConsensusModule) verifyStoredArtifact(serviceId string) error {
+	if cm.trusted == nil {
+		return nil
+	}
+	artifact, err := cm.artifacts.Load(serviceId)
+	if err != nil {
+		return err
+	}
+	cm.mu.RLock()
+	signature := cm.artifactSignature(serviceId)
+	cm.mu.RUnlock()
+	return cm.verifyArtifact(serviceId, artifact, signature)
+}
+
+// artifactSignature returns the signature of the artifact of serviceId, the
+// one of the command deploying or scheduling it.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) artifactSignature(serviceId string) []byte {
+	for i := len(cm.log) - 1; i >= 0; i-- {
+		command := cm.log[i].Command
+		if command.ServiceID == serviceId && (command.Kind == CommandDeploy || command.Kind == CommandSchedule) {
+			return command.Signature
+		}
+	}
+	return nil
+}
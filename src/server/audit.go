@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// auditTimeout bounds the wait for an audit record to be committed.
+const auditTimeout = 10 * time.Second
+
+// AuditRecord is a record of the audit log, committed by the log entry Id.
+type AuditRecord struct {
+	Id string
+	AuditPayload
+}
+
+// AuditLog returns the audit log: the changes requested to the admin and
+// REST APIs of every node, in log order. It's replicated through the log, so
+// every node returns the same records up to its last applied entry.
+func (cm *ConsensusModule) AuditLog() []AuditRecord {
+	cm.auditMu.Lock()
+	defer cm.auditMu.Unlock()
+	return append([]AuditRecord(nil), cm.audit...)
+}
+
+// appendAudit adds the audit record committed by the log entry id to the
+// audit log.
+func (cm *ConsensusModule) appendAudit(id string, payload AuditPayload) {
+	cm.auditMu.Lock()
+	defer cm.auditMu.Unlock()
+	cm.audit = append(cm.audit, AuditRecord{Id: id, AuditPayload: payload})
+}
+
+// restoreAudit replaces the audit log with the one recorded by the storage
+// records of a snapshot, see StorageRecord.
+func (cm *ConsensusModule) restoreAudit(records []map[string]interface{}) error {
+	var audit []AuditRecord
+	for _, record := range records {
+		data, err := json.Marshal(record["Command"])
+		if err != nil {
+			return err
+		}
+		var command Service
+		if err := json.Unmarshal(data, &command); err != nil {
+			return err
+		}
+		if command.Kind != CommandAudit {
+			continue
+		}
+		payload, err := DecodeCommand(&command)
+		if err != nil {
+			return err
+		}
+		id, _ := record["Id"].(string)
+		audit = append(audit, AuditRecord{Id: id, AuditPayload: payload.(AuditPayload)})
+	}
+	cm.auditMu.Lock()
+	cm.audit = audit
+	cm.auditMu.Unlock()
+	return nil
+}
+
+type auditParamsKey struct{}
+
+// setAuditParam adds key to the parameters recorded in the audit log for r,
+// for the ones not in its query, such as the ID of a submitted service.
+func setAuditParam(r *http.Request, key string, value string) {
+	if params, ok := r.Context().Value(auditParamsKey{}).(map[string]string); ok {
+		params[key] = value
+	}
+}
+
+// statusRecorder is a ResponseWriter remembering the status of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// audited wraps handler so that every request changing something, that is
+// neither GET nor HEAD, is recorded in the audit log with the principal
+// authenticated by requireRole, its query parameters and the status of the
+// response. The record is committed before the response is completed; a
+// failure to commit it is logged, since the change has been made anyway.
+func (s *Server) audited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler(w, r)
+			return
+		}
+		params := make(map[string]string)
+		for key, values := range r.URL.Query() {
+			params[key] = values[0]
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r.WithContext(context.WithValue(r.Context(), auditParamsKey{}, params)))
+
+		principal, ok := PrincipalFrom(r.Context())
+		if !ok {
+			principal = anonymous
+		}
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		payload := AuditPayload{
+			Principal: principal.Name,
+			Role:      principal.Role.String(),
+			Action:    r.Method + " " + r.URL.Path,
+			Status:    recorder.status,
+			Time:      time.Now().UTC(),
+			Node:      s.serverId,
+		}
+		if len(params) > 0 {
+			payload.Params = params
+		}
+		if err := s.audit(payload); err != nil {
+			log.Printf("[%v] recording %s by %s in the audit log: %v", s.serverId, payload.Action, payload.Principal, err)
+			s.cm.recordEventUnlocked(EventWarning, "audit record of %s by %s lost: %v", payload.Action, payload.Principal, err)
+		}
+	}
+}
+
+// audit submits payload to the audit log and waits until it's committed.
+func (s *Server) audit(payload AuditPayload) error {
+	command, err := NewCommand(CommandAudit, "", payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	_, _, _, future := s.Submit(ctx, command)
+	return future.WaitContext(ctx)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Role is the set of operations of the admin and REST APIs allowed to a
+// principal. Every role allows the operations of the lower ones.
+type Role int
+
+const (
+	// RoleReadOnly reads the state of the node and of the cluster.
+	RoleReadOnly Role = iota + 1
+	// RoleOperator submits and undeploys services, and cordons and drains
+	// the node.
+	RoleOperator
+	// RoleAdmin changes the membership and the configuration of the cluster,
+	// moves the leadership, restarts the nodes and injects faults.
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RoleReadOnly: "read-only",
+	RoleOperator: "operator",
+	RoleAdmin:    "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole returns the role with the given name: read-only, operator or
+// admin.
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if roleName == name {
+			return role, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q", name)
+}
+
+// Principal is the user of a request to the APIs. Quota limits the services
+// it submits.
+type Principal struct {
+	Name  string
+	Role  Role
+	Quota Quota
+}
+
+// anonymous is the principal of the requests when authentication is
+// disabled: it's allowed every operation, as before authentication existed.
+var anonymous = Principal{Name: "anonymous", Role: RoleAdmin}
+
+// Tokens authenticates the requests to the APIs by their bearer token.
+type Tokens struct {
+	tokens []tokenEntry
+}
+
+type tokenEntry struct {
+	token     []byte
+	principal Principal
+}
+
+// LoadTokens reads the tokens of the principals from the file at path, with
+// a principal per line, followed by its quota if any, see ParseQuota:
+//
+//	# name   role       token    quota
+//	alice    admin      6f1c...
+//	ci       operator   94ab...  rate=0.2 pending=2 bytes-per-day=104857600
+//	grafana  read-only  d203...
+//
+// Empty lines and lines starting with # are ignored. The file must be
+// readable only by the user running the node.
+func LoadTokens(path string) (*Tokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := &Tokens{}
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected name, role and token", path, line)
+		}
+		role, err := ParseRole(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if names[fields[0]] {
+			return nil, fmt.Errorf("%s:%d: principal %s listed twice", path, line, fields[0])
+		}
+		quota, err := ParseQuota(fields[3:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		names[fields[0]] = true
+		t.tokens = append(t.tokens, tokenEntry{token: []byte(fields[2]), principal: Principal{Name: fields[0], Role: role, Quota: quota}})
+	}
+	return t, scanner.Err()
+}
+
+// Authenticate returns the principal whose token is the bearer token of r.
+// Every token is compared, in constant time, so that the time taken doesn't
+// tell how close a guess is.
+func (t *Tokens) Authenticate(r *http.Request) (Principal, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return Principal{}, false
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	var principal Principal
+	found := false
+	for _, entry := range t.tokens {
+		if subtle.ConstantTimeCompare(entry.token, token) == 1 {
+			principal, found = entry.principal, true
+		}
+	}
+	return principal, found
+}
+
+// BearerTransport sends the requests of the clients of the APIs through
+// Next, or http.DefaultTransport if nil, with Token as bearer token.
+type BearerTransport struct {
+	Token string
+	Next  http.RoundTripper
+}
+
+func (t BearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.Token)
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(r)
+}
+
+type principalKey struct{}
+
+// PrincipalFrom returns the principal of the request of ctx, authenticated
+// by the APIs.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// requireRole wraps handler so that it only serves the principals allowed
+// to: the GET and HEAD requests need the read role, the other ones the write
+// role. Without tokens configured, every request is served. The principal is
+// passed to handler in the context of the request, see PrincipalFrom.
+func (s *Server) requireRole(read Role, write Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal := anonymous
+		if s.tokens != nil {
+			var ok bool
+			if principal, ok = s.tokens.Authenticate(r); !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+				return
+			}
+		}
+		needed := write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			needed = read
+		}
+		if principal.Role < needed {
+			http.Error(w, fmt.Sprintf("%s is %s, %s needs %s", principal.Name, principal.Role, r.URL.Path, needed), http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import "context"
+
+// signalAdvance wakes up the goroutines waiting for commitIndex or
+// lastApplied to advance, and publishes the new status.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) signalAdvance() {
+	cm.publishStatus()
+	close(cm.advanced)
+	cm.advanced = make(chan struct{})
+}
+
+// waitFor blocks until cond holds, checking it whenever commitIndex or
+// lastApplied advance. It returns ctx.Err() if ctx is done first, or
+// ErrStopped if the CM is stopped.
+func (cm *ConsensusModule) waitFor(ctx context.Context, cond func() bool) error {
+	for {
+		cm.mu.Lock()
+		if cond() {
+			cm.mu.Unlock()
+			return nil
+		}
+		advanced := cm.advanced
+		cm.mu.Unlock()
+
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-cm.ctx.Done():
+			return ErrStopped
+		}
+	}
+}
+
+// WaitForCommit blocks until the entry at index is committed.
+func (cm *ConsensusModule) WaitForCommit(ctx context.Context, index int) error {
+	return cm.waitFor(ctx, func() bool { return cm.commitIndex >= index })
+}
+
+// WaitForApply blocks until the entry at index is applied to the FSM.
+func (cm *ConsensusModule) WaitForApply(ctx context.Context, index int) error {
+	return cm.waitFor(ctx, func() bool { return cm.lastApplied >= index })
+}
+
+// Barrier appends a no-op entry to the log and waits until it's applied, so
+// that every entry appended before it has been applied too. It fails with
+// ErrNotLeader if cm isn't the leader.
+func (cm *ConsensusModule) Barrier(ctx context.Context) error {
+	index, _, accepted, future := cm.appendCommand(&Service{Kind: CommandNoop})
+	if !accepted {
+		return future.Wait()
+	}
+	if err := future.WaitContext(ctx); err != nil {
+		return err
+	}
+	return cm.WaitForApply(ctx, index)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	st "storage"
+	"strconv"
+)
+
+// clusterStatePath returns the file where this server stores the cluster it
+// formed or joined.
+func (s *Server) clusterStatePath() string {
+	return filepath.Join(filepath.Dir(s.config.LogPath), "cluster"+strconv.Itoa(s.serverId)+".json")
+}
+
+// ClusterState returns the cluster this server formed or joined, or nil if it
+// hasn't yet.
+func (s *Server) ClusterState() (*st.ClusterState, error) {
+	return st.LoadClusterState(s.clusterStatePath())
+}
+
+// Bootstrap forms a new cluster of this server and initialPeers, that maps
+// the ID of every other node to its IP address. The configuration is stored
+// before connecting to the peers, so that a node is never bootstrapped twice,
+// and is then committed as the first entry of the log. It fails with
+// ErrAlreadyBootstrapped if this server already formed or joined a cluster.
+func (s *Server) Bootstrap(ctx context.Context, initialPeers map[int]string) error {
+	s.cm.mu.Lock()
+	logLength := len(s.cm.log)
+	s.cm.mu.Unlock()
+	if logLength > 0 {
+		return ErrAlreadyBootstrapped
+	}
+
+	peers := map[int]string{s.serverId: s.cm.nodeAddr(s.serverId)}
+	for id, ip := range initialPeers {
+		peers[id] = ip
+	}
+	warnings, err := Membership{Voters: peers}.Validate()
+	if err != nil {
+		return err
+	}
+	s.cm.warn(warnings)
+	if err := s.createClusterState(peers, true); err != nil {
+		return err
+	}
+
+	var errs []error
+	for id, ip := range initialPeers {
+		if id != s.serverId {
+			if err := s.AddNode(id, ip); err != nil {
+				errs = append(errs, fmt.Errorf("connecting to %d: %w", id, err))
+			}
+		}
+	}
+	if err := joinErrors(errs); err != nil {
+		return err
+	}
+	return s.submitConfigChange(ctx, ConfigChangePayload{Add: peers})
+}
+
+// createClusterState stores the cluster of peers formed or joined by this
+// server.
+func (s *Server) createClusterState(peers map[int]string, bootstrapped bool) error {
+	err := st.CreateClusterState(s.clusterStatePath(), st.ClusterState{
+		NodeId:       s.serverId,
+		Peers:        peers,
+		Bootstrapped: bootstrapped,
+		Timestamp:    s.cm.clock.Now().Local().Format("2006-01-02 15:04:05.0000"),
+	})
+	if errors.Is(err, st.ErrClusterStateExists) {
+		return ErrAlreadyBootstrapped
+	}
+	return err
+}
+
+// submitConfigChange submits change and waits until it's committed.
+func (s *Server) submitConfigChange(ctx context.Context, change ConfigChangePayload) error {
+	command, err := NewCommand(CommandConfigChange, "", change)
+	if err != nil {
+		return err
+	}
+	_, _, _, future := s.Submit(ctx, command)
+	return future.WaitContext(ctx)
+}
@@ -0,0 +1,280 @@
+// Package client lets applications submit services to a Raft cluster and
+// follow their deployment without speaking the RPCs of the nodes.
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"server"
+)
+
+var (
+	// ErrNoLeader is returned when no node of the cluster knows the leader.
+	ErrNoLeader = errors.New("no leader found")
+
+	// ErrNoNodes is returned when the client has no node to ask.
+	ErrNoNodes = errors.New("no nodes to ask")
+)
+
+// Submission identifies a service accepted by the leader.
+type Submission struct {
+	ServiceId string
+	Index     int
+	Term      int
+	Leader    string
+}
+
+// Client talks to the nodes of a cluster through their RPC port. It's safe for
+// concurrent use.
+type Client struct {
+	// Retries is how many times a command is resubmitted when the leader
+	// changes, waiting Backoff more before every retry.
+	Retries int
+	Backoff time.Duration
+
+	// Key, if set, signs the commands submitted as the ones of node Id, for
+	// the clusters whose nodes sign their RPCs: the nodes must have its
+	// public key as the one of node Id, see server.WithSigningKeys.
+	Id  int
+	Key ed25519.PrivateKey
+
+	// TLS, if set, encrypts the connections to the nodes, for the clusters
+	// whose nodes have a TLS certificate, see server.Config.TLSCert. It must
+	// present a certificate the nodes accept.
+	TLS *tls.Config
+
+	mu     sync.Mutex
+	addrs  []string
+	leader string
+	conns  map[string]*rpc.Client
+	// seq is the sequence number of the latest command signed
+	seq uint64
+}
+
+// New creates a client of the cluster with the given nodes, as host:port of
+// their RPC port.
+func New(addrs ...string) *Client {
+	return &Client{
+		Retries: 5,
+		Backoff: 200 * time.Millisecond,
+		addrs:   addrs,
+		conns:   make(map[string]*rpc.Client),
+	}
+}
+
+// Close closes the connections to the nodes.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for addr, conn := range c.conns {
+		conn.Close()
+		delete(c.conns, addr)
+	}
+	return nil
+}
+
+// Leader returns the address of the leader, asking the known nodes if it
+// isn't cached.
+func (c *Client) Leader(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	leader, addrs := c.leader, append([]string{}, c.addrs...)
+	c.mu.Unlock()
+	if leader != "" {
+		return leader, nil
+	}
+
+	for _, addr := range addrs {
+		var reply server.LeaderReply
+		if err := c.call(ctx, addr, "ConsensusModule.Leader", server.LeaderArgs{}, &reply); err != nil {
+			continue
+		}
+		if reply.LeaderId < 0 {
+			continue
+		}
+		leader = addr
+		if reply.LeaderAddr != "" {
+			_, port, _ := net.SplitHostPort(addr)
+			leader = net.JoinHostPort(reply.LeaderAddr, port)
+		}
+		c.mu.Lock()
+		c.leader = leader
+		c.mu.Unlock()
+		return leader, nil
+	}
+	return "", ErrNoLeader
+}
+
+// Submit parses command, a service description starting with its
+// ServiceType, and submits it to the leader. The command is resubmitted to
+// the new leader if the leadership changes before it's accepted.
+func (c *Client) Submit(ctx context.Context, command string) (Submission, error) {
+	service, body, err := server.ParseService(command)
+	if err != nil {
+		return Submission{}, err
+	}
+	args := server.SubmitArgs{Command: *service, Body: body, From: c.Id}
+
+	for retries := 0; ; retries++ {
+		leader, err := c.Leader(ctx)
+		if err == nil && c.Key != nil {
+			// Every attempt is signed anew, since the nodes refuse the
+			// commands already received.
+			args.Seq = c.nextSeq()
+			err = server.SignSubmit(&args, c.Key)
+		}
+		if err == nil {
+			var reply server.SubmitReply
+			err = c.call(ctx, leader, "ConsensusModule.Submit", args, &reply)
+			if err == nil && reply.Accepted {
+				return Submission{ServiceId: service.ServiceID, Index: reply.Index, Term: reply.Term, Leader: leader}, nil
+			}
+			if err == nil {
+				err = server.ErrNotLeader
+			}
+			c.forgetLeader(leader)
+		}
+		if retries == c.Retries {
+			return Submission{}, fmt.Errorf("submitting %s: %w", service.ServiceID, err)
+		}
+		if err := c.sleep(ctx, time.Duration(retries+1)*c.Backoff); err != nil {
+			return Submission{}, err
+		}
+	}
+}
+
+// WaitCommit blocks until sub is committed. It returns
+// server.ErrLeadershipLost if the entry was dropped by a new leader.
+func (c *Client) WaitCommit(ctx context.Context, sub Submission) error {
+	var reply server.WaitCommitReply
+	args := server.WaitCommitArgs{Index: sub.Index, Term: sub.Term}
+	if err := c.call(ctx, sub.Leader, "ConsensusModule.WaitCommit", args, &reply); err != nil {
+		return err
+	}
+	if !reply.Committed {
+		c.forgetLeader(sub.Leader)
+		return server.ErrLeadershipLost
+	}
+	return nil
+}
+
+// SubmitAndWait submits command and waits for it to be committed, submitting
+// it again if a leadership change drops it.
+func (c *Client) SubmitAndWait(ctx context.Context, command string) (Submission, error) {
+	for retries := 0; ; retries++ {
+		sub, err := c.Submit(ctx, command)
+		if err != nil {
+			return sub, err
+		}
+		err = c.WaitCommit(ctx, sub)
+		if !errors.Is(err, server.ErrLeadershipLost) || retries == c.Retries {
+			return sub, err
+		}
+	}
+}
+
+// ClusterInfo returns the cluster as seen by the first node that answers.
+func (c *Client) ClusterInfo(ctx context.Context) (server.ClusterInfo, error) {
+	c.mu.Lock()
+	addrs := append([]string{}, c.addrs...)
+	c.mu.Unlock()
+
+	var info server.ClusterInfo
+	err := ErrNoNodes
+	for _, addr := range addrs {
+		if err = c.call(ctx, addr, "ConsensusModule.ClusterInfo", server.ClusterInfoArgs{}, &info); err == nil {
+			return info, nil
+		}
+	}
+	return info, err
+}
+
+// Status returns the deployment status of the service serviceId as known by
+// the leader.
+func (c *Client) Status(ctx context.Context, serviceId string) (server.ServiceStatusReply, error) {
+	var reply server.ServiceStatusReply
+	leader, err := c.Leader(ctx)
+	if err != nil {
+		return reply, err
+	}
+	err = c.call(ctx, leader, "ConsensusModule.ServiceStatus", server.ServiceStatusArgs{ServiceId: serviceId}, &reply)
+	return reply, err
+}
+
+func (c *Client) forgetLeader(leader string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leader == leader {
+		c.leader = ""
+	}
+}
+
+// call calls serviceMethod on the node at addr, dialing it if needed. A
+// connection that fails is dropped, to be dialed again by the next call.
+func (c *Client) call(ctx context.Context, addr string, serviceMethod string, args interface{}, reply interface{}) error {
+	c.mu.Lock()
+	conn := c.conns[addr]
+	c.mu.Unlock()
+	if conn == nil {
+		var d net.Dialer
+		netConn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		if c.TLS != nil {
+			tlsConn := tls.Client(netConn, c.TLS)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				netConn.Close()
+				return err
+			}
+			netConn = tlsConn
+		}
+		conn = rpc.NewClient(netConn)
+		c.mu.Lock()
+		c.conns[addr] = conn
+		c.mu.Unlock()
+	}
+
+	call := conn.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == rpc.ErrShutdown {
+			c.mu.Lock()
+			if c.conns[addr] == conn {
+				delete(c.conns, addr)
+			}
+			c.mu.Unlock()
+		}
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// nextSeq returns the sequence number of the next command signed, starting
+// from the time in nanoseconds like the ones of the nodes.
+func (c *Client) nextSeq() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	if now := uint64(time.Now().UnixNano()); now > c.seq {
+		c.seq = now
+	}
+	return c.seq
+}
@@ -0,0 +1,236 @@
+// Package clock abstracts the passing of time, so that the timing of a node
+// can be driven by tests.
+package clock
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the time and waits for it to pass.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the timer of a Clock, as a time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Real is the Clock of the system.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+
+// WithTimeout is context.WithTimeout with the timeout measured by c: the
+// context returned is done once c has moved forward by d, with
+// context.DeadlineExceeded, or when parent is done or cancel is called.
+func WithTimeout(c Clock, parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if c == Real {
+		return context.WithTimeout(parent, d)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	timeout := &timeoutCtx{Context: ctx, deadline: c.Now().Add(d)}
+	timer := c.NewTimer(d)
+	go func() {
+		select {
+		case <-timer.C():
+			atomic.StoreInt32(&timeout.expired, 1)
+			cancel()
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}()
+	return timeout, cancel
+}
+
+// timeoutCtx is a context given up when the timer of WithTimeout expires.
+type timeoutCtx struct {
+	context.Context
+	deadline time.Time
+	expired  int32
+}
+
+func (ctx *timeoutCtx) Deadline() (time.Time, bool) {
+	return ctx.deadline, true
+}
+
+func (ctx *timeoutCtx) Err() error {
+	if atomic.LoadInt32(&ctx.expired) == 1 {
+		return context.DeadlineExceeded
+	}
+	return ctx.Context.Err()
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// Fake is a Clock whose time only passes when Advance is called. It's safe
+// for concurrent use.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+}
+
+// NewFake returns a Fake clock set at start.
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+// Sleep blocks until the clock is advanced by d.
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Waiters returns how many timers are waiting for the clock to advance, so
+// that tests can wait for a goroutine to block on the clock before advancing
+// it.
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// Next returns the time at which the earliest timer waiting for the clock
+// expires, or false if no timer is waiting.
+func (f *Fake) Next() (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.waiters) == 0 {
+		return time.Time{}, false
+	}
+	next := f.waiters[0].deadline
+	for _, t := range f.waiters[1:] {
+		if t.deadline.Before(next) {
+			next = t.deadline
+		}
+	}
+	return next, true
+}
+
+// Advance moves the clock forward by d, firing the timers that expire, in
+// order.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].deadline.Before(f.waiters[j].deadline) })
+	fired := 0
+	for _, t := range f.waiters {
+		if t.deadline.After(f.now) {
+			break
+		}
+		select {
+		case t.c <- f.now:
+		default:
+		}
+		fired++
+	}
+	f.waiters = f.waiters[fired:]
+}
+
+// AdvanceToNext moves the clock forward to the time at which the earliest
+// timer waiting expires, if it's later, and fires that timer alone, even if
+// others expire at the same time: the next calls fire them, so that the
+// goroutines waiting can be woken one at a time. It reports whether a timer
+// was waiting.
+func (f *Fake) AdvanceToNext() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.waiters) == 0 {
+		return false
+	}
+	sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].deadline.Before(f.waiters[j].deadline) })
+	t := f.waiters[0]
+	if t.deadline.After(f.now) {
+		f.now = t.deadline
+	}
+	select {
+	case t.c <- f.now:
+	default:
+	}
+	f.waiters = f.waiters[1:]
+	return true
+}
+
+// remove removes t from the waiters, reporting whether it was waiting.
+// Expects f.mu to be locked.
+func (f *Fake) remove(t *fakeTimer) bool {
+	for i, waiter := range f.waiters {
+		if waiter == t {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock    *Fake
+	c        chan time.Time
+	deadline time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	active := f.remove(t)
+	t.deadline = f.now.Add(d)
+	if d <= 0 {
+		select {
+		case t.c <- f.now:
+		default:
+		}
+		return active
+	}
+	f.waiters = append(f.waiters, t)
+	return active
+}
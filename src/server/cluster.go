@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"server/transfer"
+)
+
+// ErrServiceNotFound is returned when a service isn't in the log of the node.
+var ErrServiceNotFound = errors.New("service not found")
+
+// UndeployArgs asks a node to stop service Id. Term is the term of the leader
+// asking, used as fencing token.
+type UndeployArgs struct {
+	Id   string
+	Term int
+}
+
+type UndeployReply struct{}
+
+// Undeploy stops the service args.Id on this node, unless args.Term is stale.
+func (cm *ConsensusModule) Undeploy(args UndeployArgs, reply *UndeployReply) error {
+	if err := cm.checkFence(args.Term); err != nil {
+		return err
+	}
+	if !transfer.ValidID(args.Id) {
+		return fmt.Errorf("%w: %q", ErrInvalidServiceID, args.Id)
+	}
+	cm.recordEventUnlocked(EventUndeploy, "%s", args.Id)
+	return cm.executor.Stop(cm.ctx, args.Id)
+}
+
+type TimeoutNowArgs struct{}
+
+type TimeoutNowReply struct{}
+
+// TimeoutNow makes this CM start an election right away, so that the
+// leadership can be transferred to it.
+func (cm *ConsensusModule) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	cm.Dlog("TimeoutNow received")
+	cm.Election()
+	return nil
+}
+
+// SetDraining marks this node as draining: while draining, the leader doesn't
+// choose it to run new services.
+func (cm *ConsensusModule) SetDraining(draining bool) {
+	cm.loadMu.Lock()
+	cm.draining = draining
+	cm.drained[cm.id] = draining
+	cm.loadMu.Unlock()
+	cm.recordEventUnlocked(EventStateChange, "draining=%v", draining)
+}
+
+// Cordon marks this node as unschedulable, so that the leader doesn't choose
+// it for new services, or schedulable again if cordoned is false. The
+// services already running on it are left there.
+func (s *Server) Cordon(cordoned bool) {
+	s.cm.SetDraining(cordoned)
+}
+
+// Drain cordons this node and migrates the services it runs to the nodes
+// chosen by the scheduler, waiting until every migration is committed. It
+// returns the errors of the services that couldn't be migrated.
+func (s *Server) Drain(ctx context.Context) error {
+	s.Cordon(true)
+	var errs []error
+	for _, serviceId := range s.cm.runningServices(s.serverId) {
+		command, err := NewCommand(CommandMigrate, serviceId, MigratePayload{To: AnyNode})
+		if err == nil {
+			_, _, _, future := s.Submit(ctx, command)
+			err = future.WaitContext(ctx)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("migrating %s: %w", serviceId, err))
+		}
+	}
+	return joinErrors(errs)
+}
+
+// Undeploy submits a command removing the service serviceId, and waits until
+// it's committed.
+func (s *Server) Undeploy(ctx context.Context, serviceId string) error {
+	command, err := NewCommand(CommandRemove, serviceId, nil)
+	if err != nil {
+		return err
+	}
+	_, _, _, future := s.Submit(ctx, command)
+	return future.WaitContext(ctx)
+}
+
+// stopService stops the service serviceId on node nodeId, with term as
+// fencing token.
+func (cm *ConsensusModule) stopService(ctx context.Context, term int, nodeId int, serviceId string) error {
+	if cm.CheckCMId(nodeId) {
+		return cm.executor.Stop(ctx, serviceId)
+	}
+	return cm.transport.CallContext(ctx, nodeId, "ConsensusModule.Undeploy", UndeployArgs{Id: serviceId, Term: term}, &UndeployReply{})
+}
+
+// TransferLeadership asks peer peerId to start an election right away.
+func (s *Server) TransferLeadership(ctx context.Context, peerId int) error {
+	if peerId == s.serverId {
+		s.cm.Election()
+		return nil
+	}
+	return s.CallContext(ctx, peerId, "ConsensusModule.TimeoutNow", TimeoutNowArgs{}, &TimeoutNowReply{})
+}
+
+// AddNode connects this server to the node peerId listening at ip.
+func (s *Server) AddNode(peerId int, ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid ip %q", ip)
+	}
+	return s.ConnectToPeer(peerId, &net.IPAddr{IP: parsed})
+}
+
+// RemoveNode disconnects this server from the node peerId.
+func (s *Server) RemoveNode(peerId int) error {
+	return s.DisconnectPeer(peerId)
+}
+
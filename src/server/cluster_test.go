@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait of the tests on a testCluster.
+const testTimeout = 10 * time.Second
+
+// testCluster runs the servers of a cluster in the test process, numbered
+// from 1. The RPCs of a node reach the RPCProxy of another through a
+// net.Pipe.
+type testCluster struct {
+	servers    map[int]*Server
+	transports map[int]*pipeTransport
+}
+
+// newTestCluster starts a cluster of n nodes logging to a temporary
+// directory, connects every node to the others and shuts them down at the
+// end of the test.
+func newTestCluster(t testing.TB, n int) *testCluster {
+	t.Helper()
+	dir := t.TempDir()
+	c := &testCluster{
+		servers:    make(map[int]*Server),
+		transports: make(map[int]*pipeTransport),
+	}
+	t.Cleanup(c.shutdown)
+	for id := 1; id <= n; id++ {
+		config := DefaultConfig()
+		config.LogPath = filepath.Join(dir, strconv.Itoa(id), "log.txt")
+		if err := os.MkdirAll(filepath.Dir(config.LogPath), 0700); err != nil {
+			t.Fatal(err)
+		}
+		transport := &pipeTransport{cluster: c, clients: make(map[int]*rpc.Client)}
+		srv, err := NewServer(id, config, nil, WithTransport(transport))
+		if err != nil {
+			t.Fatalf("starting node %d: %v", id, err)
+		}
+		c.servers[id] = srv
+		c.transports[id] = transport
+	}
+	for id, srv := range c.servers {
+		for peerId := range c.servers {
+			if peerId != id {
+				srv.cm.ConnectPeer(peerId)
+			}
+		}
+	}
+	return c
+}
+
+// shutdown closes the connections of the nodes and shuts them down.
+func (c *testCluster) shutdown() {
+	for _, transport := range c.transports {
+		transport.close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	for _, srv := range c.servers {
+		srv.Shutdown(ctx)
+	}
+}
+
+// elect makes node id start an election and waits until it wins it.
+func (c *testCluster) elect(t testing.TB, id int) *ConsensusModule {
+	t.Helper()
+	cm := c.servers[id].cm
+	cm.Election()
+	select {
+	case <-cm.ElectionChan:
+	case <-time.After(testTimeout):
+		t.Fatalf("%d didn't win the election", id)
+	}
+	return cm
+}
+
+// pipeTransport carries the RPCs of a node of a testCluster, connecting it
+// to a peer on its first RPC to it.
+type pipeTransport struct {
+	cluster *testCluster
+
+	mu      sync.Mutex
+	clients map[int]*rpc.Client
+	closed  bool
+}
+
+func (pt *pipeTransport) CallContext(ctx context.Context, id int, serviceMethod string, args interface{}, reply interface{}) error {
+	client, err := pt.client(id)
+	if err != nil {
+		return err
+	}
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// client returns the connection to node id, serving the RPCProxy of its CM
+// on the other end of a new net.Pipe if needed.
+func (pt *pipeTransport) client(id int) (*rpc.Client, error) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if client := pt.clients[id]; client != nil {
+		return client, nil
+	}
+	if pt.closed {
+		return nil, rpc.ErrShutdown
+	}
+	srv := pt.cluster.servers[id]
+	if srv == nil {
+		return nil, fmt.Errorf("no node %d", id)
+	}
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("ConsensusModule", &RPCProxy{cm: srv.cm}); err != nil {
+		return nil, err
+	}
+	conn, peer := net.Pipe()
+	go rpcServer.ServeConn(peer)
+	client := rpc.NewClient(conn)
+	pt.clients[id] = client
+	return client, nil
+}
+
+// close closes the connections of the node; its RPCs fail from then on.
+func (pt *pipeTransport) close() {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.closed = true
+	for id, client := range pt.clients {
+		client.Close()
+		delete(pt.clients, id)
+	}
+}
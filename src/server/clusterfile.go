@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// ClusterFile is the declarative configuration of a cluster, shared by all
+// its nodes. It's written in YAML or JSON:
+//
+//	nodes:
+//	  - id: 2
+//	    address: 172.18.0.2
+//	    labels:
+//	      zone: eu-1
+//	  - id: 3
+//	    address: 172.18.0.3
+//	ports:
+//	  rpc: "4000"
+//	tls:
+//	  cert: /etc/raft/node.crt
+//	  key: /etc/raft/node.key
+//	  ca: /etc/raft/ca.crt
+//	storage:
+//	  log_path: /log/log.txt
+//	scheduler: load
+//
+// Every field but nodes is optional and overrides the corresponding Config
+// parameter when set; the labels of a node are added to its Config.Labels.
+type ClusterFile struct {
+	Nodes []NodeSpec `yaml:"nodes" json:"nodes"`
+	Ports struct {
+		RPC     string `yaml:"rpc" json:"rpc"`
+		Gateway string `yaml:"gateway" json:"gateway"`
+		Admin   string `yaml:"admin" json:"admin"`
+		API     string `yaml:"api" json:"api"`
+	} `yaml:"ports" json:"ports"`
+	TLS struct {
+		Cert string `yaml:"cert" json:"cert"`
+		Key  string `yaml:"key" json:"key"`
+		CA   string `yaml:"ca" json:"ca"`
+	} `yaml:"tls" json:"tls"`
+	Storage struct {
+		LogPath string `yaml:"log_path" json:"log_path"`
+	} `yaml:"storage" json:"storage"`
+	Scheduler string `yaml:"scheduler" json:"scheduler"`
+}
+
+// NodeSpec is a node of a ClusterFile.
+type NodeSpec struct {
+	Id      int               `yaml:"id" json:"id"`
+	Address string            `yaml:"address" json:"address"`
+	Labels  map[string]string `yaml:"labels" json:"labels"`
+}
+
+// LoadClusterFile reads and validates the cluster file at path. Since JSON is
+// valid YAML, both formats are parsed the same way.
+func LoadClusterFile(path string) (*ClusterFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cf := &ClusterFile{}
+	if err := yaml.Unmarshal(data, cf); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cf.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cf, nil
+}
+
+func (cf *ClusterFile) validate() error {
+	var errs []error
+	if len(cf.Nodes) == 0 {
+		errs = append(errs, fmt.Errorf("nodes: at least one node is required"))
+	}
+	ids := make(map[int]bool)
+	addrs := make(map[string]bool)
+	for i, node := range cf.Nodes {
+		if node.Id <= 0 {
+			errs = append(errs, fmt.Errorf("nodes[%d]: invalid id %d", i, node.Id))
+		} else if ids[node.Id] {
+			errs = append(errs, fmt.Errorf("nodes[%d]: duplicate id %d", i, node.Id))
+		}
+		if net.ParseIP(node.Address) == nil {
+			errs = append(errs, fmt.Errorf("nodes[%d]: invalid address %q", i, node.Address))
+		} else if addrs[node.Address] {
+			errs = append(errs, fmt.Errorf("nodes[%d]: duplicate address %s", i, node.Address))
+		}
+		ids[node.Id], addrs[node.Address] = true, true
+	}
+	return joinErrors(errs)
+}
+
+// Configure overrides the parameters of c set in the cluster file.
+func (cf *ClusterFile) Configure(c *Config) {
+	set := func(dst *string, value string) {
+		if value != "" {
+			*dst = value
+		}
+	}
+	set(&c.RPCPort, cf.Ports.RPC)
+	set(&c.GatewayPort, cf.Ports.Gateway)
+	set(&c.AdminPort, cf.Ports.Admin)
+	set(&c.APIPort, cf.Ports.API)
+	set(&c.TLSCert, cf.TLS.Cert)
+	set(&c.TLSKey, cf.TLS.Key)
+	set(&c.TLSCA, cf.TLS.CA)
+	set(&c.LogPath, cf.Storage.LogPath)
+	set(&c.SchedulerPolicy, cf.Scheduler)
+}
+
+// NodeByAddr returns the node with the given IP address.
+func (cf *ClusterFile) NodeByAddr(addr net.Addr) (NodeSpec, bool) {
+	ip := net.ParseIP(addr.String())
+	for _, node := range cf.Nodes {
+		if ip != nil && ip.Equal(net.ParseIP(node.Address)) {
+			return node, true
+		}
+	}
+	return NodeSpec{}, false
+}
+
+// Membership returns the nodes of the cluster file, all voters.
+func (cf *ClusterFile) Membership() Membership {
+	m := Membership{Voters: make(map[int]string)}
+	for _, node := range cf.Nodes {
+		m.Voters[node.Id] = node.Address
+	}
+	return m
+}
+
+// Peers returns the address of every node but selfId, by ID.
+func (cf *ClusterFile) Peers(selfId int) map[int]net.Addr {
+	peers := make(map[int]net.Addr)
+	for _, node := range cf.Nodes {
+		if node.Id != selfId {
+			peers[node.Id] = &net.IPAddr{IP: net.ParseIP(node.Address)}
+		}
+	}
+	return peers
+}
@@ -5,14 +5,19 @@
 package server
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
+	"errors"
 	"fmt"
-	"log"
 	"math/rand"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"reflect"
-	l "server/resource"
+	"server/clock"
+	"server/executor"
+	"server/scheduler"
+	"server/transfer"
 
 	//"sort"
 	st "storage"
@@ -20,26 +25,15 @@ import (
 
 	//"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var DebugCM string = os.Getenv("DEBUG")
-
-// CommitEntry is the data reported by Raft to the commit channel. Each commit
-// entry notifies the client that consensus was reached on a command and it can
-// be applied to the client's state machine.
-type CommitEntry struct {
-	// Command is the client command being committed.
-	Command Service
-
-	// Index is the log index at which the client command is committed.
-	Index int
-
-	// Term is the Raft term at which the client command is committed.
-	Term int
-
-	// ChosenId is the ID of the chosen client.
-	ChosenId int
+// LeaderChange is sent on LeaderChangeChan every time this CM learns about a
+// new leader. LeaderId is -1 when the leader is unknown.
+type LeaderChange struct {
+	LeaderId int
+	Term     int
 }
 
 type CMState int
@@ -77,12 +71,23 @@ type LogEntry struct {
 
 // ConsensusModule (CM) implements a single node of Raft consensus.
 type ConsensusModule struct {
-	// Mu protects concurrent access to a CM.
-	Mu sync.Mutex
+	// mu protects the Raft state of a CM: its term, log, role and the
+	// replication state of its peers. The read-only paths take it with RLock.
+	// loadMu protects the load data used for scheduling and peersMu the
+	// health of the peers; when both are needed, mu is locked first, and
+	// loadMu and peersMu are never held together.
+	mu      sync.RWMutex
+	loadMu  sync.RWMutex
+	peersMu sync.Mutex
 
 	// id is the server ID of this CM.
 	id int
 
+	// config holds the tunable parameters of this CM. The ones that can be
+	// changed at runtime are read with Config, under configMu.
+	config   Config
+	configMu sync.RWMutex
+
 	// peerIds lists the IDs of our peers in the cluster.
 	peerIds []int
 
@@ -90,12 +95,12 @@ type ConsensusModule struct {
 	// to peers.
 	server *Server
 
-	// loadLevel is the load level of this CM
+	// loadLevel is the load level of this CM, under loadMu
 	loadLevel int
 
 	// stopSendingAEsChan is used to stop sending AEs
 	// startSendingAEsChan is used to start sending AEs
-	stopSendingAEsChan chan interface{}
+	stopSendingAEsChan chan struct{}
 
 	// ElectionChan is used at the end of the election
 	// VotingChan is used at the end of the voting phase
@@ -106,32 +111,199 @@ type ConsensusModule struct {
 	StartTime time.Time
 	// storage is used to persist state.
 	storage st.Storage
-
-	// loadLevelMap is used to store the load level of each CM
+	// raftLog persists the term, the vote and the log, savedState being the
+	// state and persisted the number of entries of the log written to it.
+	// persistMu orders the writes of the entries and persistGen counts the
+	// ones of persistLog; persistChan wakes up persistAppended
+	raftLog     *st.RaftLog
+	savedState  st.HardState
+	persisted   int
+	persistMu   sync.Mutex
+	persistGen  uint64
+	persistChan chan struct{}
+
+	// loadLevelMap is used to store the load level of each CM, under loadMu
 	// usually used by the leader
+	// loadHistory retains the load levels reported over time
 	loadLevelMap map[int]int
+	loadHistory  *LoadHistory
 
 	// chosenChan signals the CM that must execute some command
 	chosenChan chan interface{}
 
-	// commitChan is the channel where this CM is going to report committed log
-	// entries. It's passed in by the client during construction.
-	commitChan chan<- CommitEntry
+	// fsm is the state machine committed log entries are applied to.
+	fsm FSM
+
+	// transport carries the RPCs to peers, scheduler chooses the nodes
+	// running new services, executor runs the ones chosen for this node and
+	// artifacts stores their files, load measures the load of the node;
+	// logger, clock and random are used for logging, timing and random
+	// choices
+	transport Transport
+	scheduler scheduler.Scheduler
+	executor  executor.Executor
+	load      LoadProvider
+	artifacts transfer.Store
+	logger    Logger
+	clock     clock.Clock
+	random    *rand.Rand
+
+	// startedAt is when the CM was created; restart, if not nil, restarts
+	// the node
+	startedAt time.Time
+	restart   func()
+
+	// keys, if not nil, sign the RPCs of the CM and verify the ones of its
+	// peers
+	keys *signingKeys
+
+	// trusted, if not nil, are the keys of the publishers whose artifacts
+	// the CM runs, see WithTrustedKeys
+	trusted map[string]ed25519.PublicKey
+
+	// secrets rotates the key encrypting the storage and the TLS
+	// certificate
+	secrets *secrets
 
 	// newCommitReadyChan is an internal notification channel used by goroutines
-	// that commit new entries to the log to notify that these entries may be sent
-	// on commitChan.
+	// that commit new entries to the log to notify that these entries may be
+	// applied to fsm. It's buffered by one, see notify.
 	newCommitReadyChan chan struct{}
 
 	// triggerAEChan is an internal notification channel used to trigger
 	// sending new AEs to followers when interesting changes occurred.
 	triggerAEChan 		chan struct{}
 
+	// metrics collects commit and apply latencies of the log entries.
+	metrics *Metrics
+
+	// voteThrottle refuses the floods of RequestVote RPCs
+	voteThrottle *voteThrottle
+
+	// leaderId is the ID of the leader known by this CM, -1 if unknown
+	// leaderTerm is the term in which leaderId was learned
+	// history records every change of leaderId
+	leaderId   int
+	leaderTerm int
+	history    *st.LeaderHistory
+
+	// LeaderChangeChan reports every leadership change seen by this CM. It's
+	// buffered and changes are dropped if nobody reads them.
+	LeaderChangeChan chan LeaderChange
+
+	// learners are the nodes, this one included, that receive the log but
+	// don't vote nor count for commitment until they're promoted; promoting
+	// are the learners whose promotion has been appended to the log
+	learners  map[int]bool
+	promoting map[int]bool
+
+	// identities maps the ID of the nodes to the UUID of their NodeIdentity,
+	// labels to the labels they registered and capacity to the resources
+	// they offer to the services, see Server.RegisterCapacity
+	identities map[int]string
+	labels     map[int]map[string]string
+	capacity   map[int]Resources
+
+	// standby records the standby nodes, see Server.SetStandby
+	standby map[int]bool
+
+	// alertFuncs are called whenever an alert is raised
+	// peerUnreachable is true for the peers whose last RPC failed, since
+	// unreachableSince; both under peersMu
+	alertFuncs       []AlertFunc
+	peerUnreachable  map[int]bool
+	unreachableSince map[int]time.Time
+
+	// health records the health of the peers, under peersMu, see
+	// recordContact
+	health map[int]*PeerHealth
+
+	// events retains the latest significant events of this CM
+	events *EventLog
+
+	// audit is the audit log applied so far, see AuditLog
+	auditMu sync.Mutex
+	audit   []AuditRecord
+
+	// cronJobs are the recurring deployments applied so far, by name, see
+	// CronJobs
+	cronMu   sync.Mutex
+	cronJobs map[string]*CronJob
+
+	// resourceQuotas limit the resources of the services by namespace and
+	// by client; nil without Config.ResourceQuotasPath
+	resourceQuotas *ResourceQuotas
+
+	// memoryPressure is 1 while the node uses more memory than allowed, see
+	// UnderMemoryPressure
+	memoryPressure int32
+
+	// futures are the pending CommitFutures, by log index
+	futures map[int]*CommitFuture
+
+	// applyQueue holds the batches of committed entries waiting to be
+	// applied, up to queuedIndex, see applyCommitted
+	applyQueue  chan applyBatch
+	queuedIndex int
+
+	// advanced is closed and replaced whenever commitIndex or lastApplied
+	// advance, waking up WaitForCommit and Barrier
+	advanced chan struct{}
+
+	// draining is true if this node must not be chosen for new services;
+	// drained records the nodes known to be draining; both under loadMu
+	draining bool
+	drained  map[int]bool
+
+	// leaderFuncs are run while this CM is the leader, with leaderCtx, which
+	// is nil when it isn't
+	leaderFuncs  []leaderFunc
+	leaderCtx    context.Context
+	leaderCancel context.CancelFunc
+
+	// ctx is cancelled when the CM is stopped, aborting its blocking
+	// operations such as RPCs to peers
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// tasks tracks the goroutines spawned by this CM and its server
+	// crashes records the panics recovered in those goroutines
+	tasks   *TaskRegistry
+	crashes crashRecorder
+
+	// fenceTerm is the highest term of the side effects requested to this
+	// node by a leader, see checkFence
+	fenceTerm int
+
+	// rejoining is true while this node catches up with the leader, see
+	// rejoinIfBehind
+	rejoining bool
+
 	// Persistent Raft state on all servers
 	currentTerm int
 	votedFor    int
 	log         []LogEntry
 
+	// snapshots are the snapshots being streamed to other nodes
+	snapshots snapshotStreams
+
+	// status is the Status published by publishStatus
+	status atomic.Value
+
+	// faults are the Faults injected in the RPCs to peers, see SetFaults;
+	// droppedAEs counts down the AppendEntries RPCs still to be dropped
+	faults     atomic.Value
+	droppedAEs int32
+
+	// workers send the AEs and the RequestVotes to the peers, by ID
+	workers map[int]*peerWorker
+
+	// votes counts the votes granted to this CM in the current election
+	votes int
+
+	// terms indexes the entries of the log by term
+	terms termIndex
+
 	// Volatile Raft state on all servers
 	commitIndex        int
 	lastApplied        int
@@ -142,136 +314,325 @@ type ConsensusModule struct {
 	matchIndex map[int]int
 }
 
-// NewConsensusModule creates a new CM with the given ID, list of peer IDs and
+// NewConsensusModule creates a new CM with the given ID, configuration and
 // server. The ready channel signals the CM that all peers are connected and
-// it's safe to start its state machine. commitChan is going to be used by the
-// CM to send log entries that have been committed by the Raft cluster.
-func NewConsensusModule(id int, server *Server, storage st.Storage, ready <-chan interface{}, commitChan chan<- CommitEntry) *ConsensusModule {
+// it's safe to start its state machine. Log entries committed by the Raft
+// cluster are applied to the FSM set with WithFSM, or to the SchedulerFSM of
+// the CM. The storage, if not set with WithStorage, is a MapStorage at
+// config.LogPath, encrypted with the keys of WithKeyring if set and
+// compressed in memory if config.CompressLog is.
+func NewConsensusModule(id int, config Config, server *Server, ready <-chan interface{}, opts ...Option) (*ConsensusModule, error) {
+	o := newOptions(opts)
 	cm := new(ConsensusModule)
 	cm.id = id
+	cm.config = config
 	cm.peerIds = []int{}
 	cm.server = server
-	cm.storage = storage
+	cm.storage = o.storage
+	if cm.storage == nil {
+		newStorage := st.NewEncryptedMapStorage
+		if config.CompressLog {
+			newStorage = st.NewCompressedMapStorage
+		}
+		storage, err := newStorage(config.LogPath, o.keyring)
+		if err != nil {
+			return nil, err
+		}
+		cm.storage = storage
+	}
+	secrets, err := newSecrets(config, o.keyring, cm.storage)
+	if err != nil {
+		return nil, err
+	}
+	cm.secrets = secrets
+	cm.storage = faultStorage{next: cm.storage, cm: cm}
+	cm.random = rand.New(o.random)
+	transport := o.transport
+	if transport == nil {
+		transport = server
+	}
+	cm.transport = faultTransport{next: transport, cm: cm}
+	cm.faults.Store(Faults{})
+	cm.scheduler = o.scheduler
+	if cm.scheduler == nil {
+		policy, err := scheduler.New(config.SchedulerPolicy, cm.random)
+		if err != nil {
+			return nil, err
+		}
+		cm.scheduler = policy
+	}
+	cm.executor = o.executor
+	cm.load = o.load
+	cm.artifacts = transfer.Store{Dir: "services"}
+	cm.logger = o.logger
+	cm.clock = o.clock
+	cm.startedAt = cm.clock.Now()
+	cm.restart = o.restart
+	cm.keys = o.keys
+	cm.trusted = o.trusted
 	cm.loadLevelMap = make(map[int]int)
-	cm.commitChan = commitChan
+	cm.cronJobs = make(map[string]*CronJob)
+	if config.ResourceQuotasPath != "" {
+		if cm.resourceQuotas, err = LoadResourceQuotas(config.ResourceQuotasPath); err != nil {
+			return nil, err
+		}
+	}
+	cm.loadHistory = NewLoadHistory(config.LoadHistorySize)
+	cm.fsm = o.fsm
+	if cm.fsm == nil {
+		cm.fsm = NewSchedulerFSM(cm)
+	}
 	cm.ElectionChan = make(chan interface{}, 1)
 	cm.VotingChan = make(chan interface{}, 1)
 	cm.CPUChan = make(chan interface{}, 1)
-	cm.StartTime = time.Now()
-	cm.newCommitReadyChan = make(chan struct{})
+	cm.StartTime = cm.clock.Now()
+	cm.newCommitReadyChan = make(chan struct{}, 1)
 	cm.chosenChan = make(chan interface{}, 1)
 	cm.triggerAEChan = make(chan struct{}, 1)
+	cm.persistChan = make(chan struct{}, 1)
 	cm.state = Follower
 	cm.votedFor = -1
-	cm.stopSendingAEsChan = make(chan interface{}, 1)
+	cm.stopSendingAEsChan = make(chan struct{}, 1)
 	cm.loadLevel = -1
 	cm.commitIndex = -1
 	cm.lastApplied = -1
+	cm.terms = newTermIndex()
+	if err := cm.restoreRaftLog(); err != nil {
+		return nil, err
+	}
+	cm.workers = make(map[int]*peerWorker)
+	cm.snapshots.streams = make(map[uint64]*snapshotStream)
+	cm.applyQueue = make(chan applyBatch, applyQueueSize)
+	cm.queuedIndex = -1
 	cm.nextIndex = make(map[int]int)
 	cm.matchIndex = make(map[int]int)
-
-	go cm.commitChanSender()
-	return cm
+	cm.metrics = NewMetrics()
+	if config.DisableMetrics {
+		cm.metrics = NewDisabledMetrics()
+	}
+	cm.voteThrottle = newVoteThrottle()
+	cm.leaderId = -1
+	cm.LeaderChangeChan = make(chan LeaderChange, 16)
+	cm.peerUnreachable = make(map[int]bool)
+	cm.unreachableSince = make(map[int]time.Time)
+	cm.health = make(map[int]*PeerHealth)
+	cm.learners = make(map[int]bool)
+	cm.identities = make(map[int]string)
+	cm.labels = make(map[int]map[string]string)
+	cm.capacity = make(map[int]Resources)
+	cm.standby = make(map[int]bool)
+	cm.promoting = make(map[int]bool)
+	cm.events = NewEventLog(config.EventLogSize)
+	cm.futures = make(map[int]*CommitFuture)
+	cm.drained = make(map[int]bool)
+	cm.advanced = make(chan struct{})
+	cm.ctx, cm.cancel = context.WithCancel(context.Background())
+	cm.tasks = NewTaskRegistry(cm.recoverPanic)
+	cm.crashes.health = HealthOK
+	if config.AlertWebhook != "" {
+		cm.alertFuncs = append(cm.alertFuncs, WebhookAlert(config.AlertWebhook))
+	}
+	cm.history = st.NewLeaderHistory(filepath.Join(filepath.Dir(config.LogPath), "leaders"+strconv.Itoa(id)+".txt"), config.LeaderHistorySize, o.keyring)
+	cm.secrets.encrypts("leader history", cm.history)
+
+	cm.publishStatus()
+	cm.tasks.Go("applyCommitted", cm.applyCommitted)
+	cm.tasks.Go("applyQueued", cm.applyQueued)
+	cm.tasks.Go("persistAppended", cm.persistAppended)
+	cm.tasks.Go("watchAlerts", cm.watchAlerts)
+	cm.tasks.Go("watchMemory", cm.watchMemory)
+	cm.tasks.Go("writeLeaderHistory", cm.writeLeaderHistory)
+	cm.tasks.Go("expireServices", cm.expireServices)
+	cm.RunOnLeader("evictDeadPeers", cm.evictDeadPeers)
+	cm.RunOnLeader("activateStandby", cm.activateStandby)
+	cm.RunOnLeader("deployScheduled", cm.deployScheduled)
+	cm.RunOnLeader("runCronJobs", cm.runCronJobs)
+	return cm, nil
 }
 
 // Report reports the state of this CM.
 func (cm *ConsensusModule) Report() (id int, term int, isLeader bool) {
-	cm.Mu.Lock()
-	defer cm.Mu.Unlock()
-	return cm.id, cm.currentTerm, cm.state == Leader
+	status := cm.Status()
+	return status.Id, status.Term, status.State == Leader.String()
 }
 
 // Voting submits a new command to the CM. This function doesn't block; clients
-// read the commit channel passed in the constructor to be notified of new
-// committed entries. It returns true iff this CM is the leader - in which case
-// the command is accepted. If false is returned, the client will have to find
-// a different CM to submit this command to.
-func (cm *ConsensusModule) Voting(command *Service) {
-	cm.Mu.Lock()
+// read the commit channel passed in the constructor, or wait on the returned
+// future, to be notified of new committed entries. accepted is true iff this
+// CM is the leader - in which case the command is appended at index in term.
+// If false is returned, the client will have to find a different CM to submit
+// this command to. A command the leader refuses, such as one exceeding a
+// resource quota, isn't forwarded: its future fails with the reason.
+func (cm *ConsensusModule) Voting(command *Service) (index int, term int, accepted bool, future *CommitFuture) {
 	cm.Dlog("Voting received: %v", command)
-	if cm.state == Leader {
-		chosenId := cm.minLoadLevelMap()
-		newLog := cm.NewLog(command, chosenId)
-		cm.log = append(cm.log, newLog)
-
-		cm.Mu.Unlock()
-		cm.Dlog("... log=%v", cm.log)
-		cm.triggerAEChan <- struct{}{}
-	} else {
-		cm.Mu.Unlock()
+	index, term, accepted, future = cm.appendCommand(command)
+	if !accepted && errors.Is(future.Wait(), ErrNotLeader) {
+		index, term, accepted, future = cm.forwardCommand(cm.ctx, command)
 	}
 	cm.VotingChan <- struct{}{}
+	return index, term, accepted, future
+}
+
+// appendCommand appends command to the log if cm is the leader. Otherwise the
+// command is not accepted and the returned future fails with ErrNotLeader, or
+// with the error that makes command invalid. A deployment submitted again is
+// accepted without appending it: the index and the term returned are the ones
+// of the entry that placed the service, see duplicateDeploy.
+//
+// The entry is written to the raft log while the AEs replicating it are
+// sent, and the leader counts itself for its commit once it's written, see
+// persistAppended; cm.storage records the committed entries as they're
+// applied, see applyQueued.
+func (cm *ConsensusModule) appendCommand(command *Service) (index int, term int, accepted bool, future *CommitFuture) {
+	// Configuration changes are validated before locking cm.mu, since the
+	// addresses of the nodes are known by the server.
+	err := cm.validateCommand(command)
+	cm.mu.Lock()
+	var chosenId int
+	var preempt *Service
+	if err == nil {
+		err = ErrNotLeader
+		if cm.state == Leader {
+			if p, ok := cm.duplicateDeploy(command); ok {
+				future = cm.placementFuture(p)
+				cm.mu.Unlock()
+				cm.notify(cm.triggerAEChan)
+				return future.Index, future.Term, true, future
+			}
+			command, chosenId, err = cm.chooseNode(command)
+		}
+		if err == nil && command.Kind == CommandDeploy {
+			var node int
+			if preempt, node = cm.preemption(command); preempt != nil {
+				chosenId = node
+			}
+		}
+	}
+	if err != nil {
+		index, term = -1, cm.currentTerm
+		future = newCommitFuture(index, term)
+		future.resolve(err)
+		cm.mu.Unlock()
+		return index, term, false, future
+	}
+	if preempt != nil {
+		// The preemption is committed with the deployment it makes room
+		// for, right before it.
+		preemptLog := cm.NewLog(preempt, chosenId)
+		cm.log = append(cm.log, preemptLog)
+		cm.terms.add(preemptLog.Term, len(cm.log)-1)
+		cm.metrics.Submitted(preemptLog.Index)
+	}
+	newLog := cm.NewLog(command, chosenId)
+	cm.log = append(cm.log, newLog)
+	cm.terms.add(newLog.Term, len(cm.log)-1)
+	cm.metrics.Submitted(newLog.Index)
+	index, term, accepted = len(cm.log)-1, cm.currentTerm, true
+	future = newCommitFuture(index, term)
+	cm.futures[index] = future
+	cm.Dlog("... log=%v", cm.log)
+
+	cm.mu.Unlock()
+	// The entry is written to disk while it's replicated.
+	cm.notify(cm.persistChan)
+	cm.notify(cm.triggerAEChan)
+	return index, term, accepted, future
 }
 
 // Stop stops this CM, cleaning up its state. This method returns quickly, but
-// it may take a bit of time (up to ~election timeout) for all goroutines to
-// exit.
+// it may take a bit of time for all goroutines to exit; Wait blocks until they
+// have. Stopping a Dead CM does nothing.
 func (cm *ConsensusModule) Stop() {
-	cm.Mu.Lock()
-	defer cm.Mu.Unlock()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state == Dead {
+		return
+	}
 	cm.state = Dead
+	cm.publishStatus()
+	cm.stopLeaderFuncs()
 	cm.Dlog("becomes Dead")
-	close(cm.newCommitReadyChan)
+	cm.recordEvent(EventStateChange, "becomes Dead")
+	cm.failFutures(ErrLeadershipLost)
+	cm.cancel()
+	cm.raftLog.Close()
 }
 
+// Done returns a channel that's closed when the CM is stopped. Background
+// goroutines return once it's closed.
+func (cm *ConsensusModule) Done() <-chan struct{} {
+	return cm.ctx.Done()
+}
+
+// Wait blocks until every goroutine spawned by the CM and its server has
+// returned, or until ctx is done, in which case ctx.Err() is returned.
+func (cm *ConsensusModule) Wait(ctx context.Context) error {
+	return cm.tasks.Wait(ctx)
+}
+
+// notify marks ch, a channel buffered by one, as dirty without blocking. If a
+// notification is already pending, the receiver hasn't caught up yet and
+// will see the latest state anyway, so notifications are coalesced and notify
+// is safe to call with cm.mu locked.
+func (cm *ConsensusModule) notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// DeployArgs asks a node to run service Id, whose file is Service, or only to
+// store it if StoreOnly is set. Term is the term of the leader asking, used
+// as fencing token. Signature is the signature of Service by its publisher.
 type DeployArgs struct {
 	Id string
 	Service []byte
+	Term int
+	StoreOnly bool
+	Signature []byte
 }
 
 type DeployReply struct {}
 
+// Deploy runs the service args.Id on this node, unless args.Term is stale.
 func (cm *ConsensusModule) Deploy(args DeployArgs, reply *DeployReply) error {
-	if err := os.WriteFile("services/" + args.Id, args.Service, 0644); err != nil {
+	if err := cm.checkFence(args.Term); err != nil {
+		return err
+	}
+	if err := cm.verifyArtifact(args.Id, args.Service, args.Signature); err != nil {
+		return err
+	}
+	// Save rejects the IDs that aren't valid, see transfer.ValidID.
+	if err := cm.artifacts.Save(args.Id, args.Service); err != nil {
 		return err
 	}
-	go Exec(args.Id)
+	if args.StoreOnly {
+		return nil
+	}
+	cm.run(args.Id)
 	return nil
 }
 
-// persistToStorage saves all of CM's persistent state in cm.storage.
-// Expects cm.Mu to be locked.
-
-func (cm *ConsensusModule) persistToStorage(logs []LogEntry) {
-	
-	for _, log := range logs {
-		termData := make(map[string]interface{})
-		termData["Term"] = strconv.Itoa(log.Term)
-		termData["Command"] = log.Command
-		termData["Leader"] = strconv.Itoa(log.LeaderId)
-		termData["Chosen"] = strconv.Itoa(log.ChosenId)
-		termData["Id"] = log.Index
-		termData["Timestamp"] = log.Timestamp
-
-		cm.storage.Set(termData, cm.CheckCMId(log.LeaderId))
-
-		if log.Term >= cm.currentTerm {
-			leaderId := log.LeaderId
-			chosenId := log.ChosenId
-			isLeader, isChosen := cm.CheckCMId(leaderId), cm.CheckCMId(chosenId)
-			if isLeader {
-				if isChosen {
-				fmt.Println("Esecuzione da parte del leader")
-				go Exec(termData["Command"].(Service).ServiceID)
-				} else {
-					file, _ := os.ReadFile("services/" + termData["Command"].(Service).ServiceID)
-					args := DeployArgs{
-						Id: termData["Command"].(Service).ServiceID,
-						Service: file,
-					}
-					var reply DeployReply
-					cm.server.Call(chosenId, "ConsensusModule.Deploy", args, &reply)
-				}
-			}
-		}
+// checkFence accepts term as fencing token of a side effect if it's neither
+// older than the current term of this CM, since a newer leader was elected,
+// nor older than the highest token accepted, since the operation was sent by
+// a deposed leader.
+func (cm *ConsensusModule) checkFence(term int) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if term < cm.currentTerm || term < cm.fenceTerm {
+		cm.Dlog("rejecting operation of term %d, current term %d, fence %d", term, cm.currentTerm, cm.fenceTerm)
+		return fmt.Errorf("%w: term %d, current term %d, fence %d", ErrStaleTerm, term, cm.currentTerm, cm.fenceTerm)
 	}
+	cm.fenceTerm = term
+	return nil
 }
 
-// Dlog logs a debugging message is DebugCM > 0.
+// Dlog logs a debugging message if debug logging is enabled for the CM.
 func (cm *ConsensusModule) Dlog(format string, args ...interface{}) {
-	if DebugCM != "0" {
+	if DebugEnabled(ComponentCM) {
 		format = fmt.Sprintf("[%d] ", cm.id) + format
-		log.Printf(format, args...)
+		cm.logger.Printf(format, args...)
 	}
 }
 
@@ -282,6 +643,10 @@ type RequestVoteArgs struct {
 	LastLogIndex 	int
 	LastLogTerm  	int
 	LoadLevel    	int
+	// Seq is the sequence number and Signature the signature of the
+	// candidate, if the nodes sign their RPCs, see WithSigningKeys
+	Seq				uint64
+	Signature		[]byte
 }
 
 type RequestVoteReply struct {
@@ -289,14 +654,21 @@ type RequestVoteReply struct {
 	VoteGranted 	bool
 	LoadLevel   	int
 	VoteElabTime 	time.Duration
+	Draining		bool
+	// Seq is the sequence number of the RequestVote replied to and
+	// Signature the signature of the voter, if the nodes sign their RPCs
+	Seq				uint64
+	Signature		[]byte
 }
 
-// RequestVote RPC.
+// RequestVote RPC. Unless it's a candidate, the CM waits for the vote delay
+// of the candidate before voting, without holding cm.mu, and then decides on
+// its state at that time: its term and log may have changed meanwhile.
 func (cm *ConsensusModule) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
-	cm.Mu.Lock()
-	voteTime := time.Now()
-	defer cm.Mu.Unlock()
+	voteTime := cm.clock.Now()
+	cm.mu.Lock()
 	if cm.state == Dead {
+		cm.mu.Unlock()
 		return nil
 	}
 	lastLogIndex, lastLogTerm := cm.lastLogIndexAndTerm()
@@ -306,25 +678,41 @@ func (cm *ConsensusModule) RequestVote(args RequestVoteArgs, reply *RequestVoteR
 		cm.Dlog("... term out of date in RequestVote")
 		cm.becomeFollower(args.Term)
 	}
+	candidate := cm.state == Candidate
+	cm.mu.Unlock()
 
-	cm.Mu.Unlock()
-	if cm.state != Candidate {
-		runVoteDelay(args.LoadLevel)
+	if !candidate {
+		cm.runVoteDelay(cm.Config().VoteDelay, args.LoadLevel)
 	}
-	cm.Mu.Lock()
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state == Dead {
+		return nil
+	}
+	lastLogIndex, lastLogTerm = cm.lastLogIndexAndTerm()
 	if cm.currentTerm == args.Term &&
 		(cm.votedFor == -1 || cm.votedFor == args.CandidateId) &&
 		(args.LastLogTerm > lastLogTerm ||
 			(args.LastLogTerm == lastLogTerm && args.LastLogIndex >= lastLogIndex)) {
-		cm.Dlog("waited for vote delay of %v", time.Duration(1000/args.LoadLevel)*time.Millisecond)
+		cm.Dlog("waited %v for the vote delay", cm.clock.Since(voteTime))
 		reply.VoteGranted = true
+		cm.loadMu.RLock()
 		reply.LoadLevel = cm.loadLevel
+		cm.loadMu.RUnlock()
 		cm.votedFor = args.CandidateId
 	} else {
 		reply.VoteGranted = false
 	}
 	reply.Term = cm.currentTerm
-	reply.VoteElabTime = time.Since(voteTime)
+	cm.loadMu.RLock()
+	reply.Draining = cm.draining
+	cm.loadMu.RUnlock()
+	reply.VoteElabTime = cm.clock.Since(voteTime)
+	if err := cm.persistState(); err != nil {
+		cm.recordEvent(EventPersistError, "%v", err)
+		return err
+	}
 	cm.Dlog("... RequestVote reply: %+v", reply)
 	return nil
 }
@@ -339,6 +727,10 @@ type AppendEntriesArgs struct {
 	Entries      []LogEntry
 	LeaderCommit int
 	ChosenId	 int
+	// Seq is the sequence number and Signature the signature of the
+	// leader, if the nodes sign their RPCs, see WithSigningKeys
+	Seq			 uint64
+	Signature	 []byte
 }
 
 type AppendEntriesReply struct {
@@ -351,12 +743,16 @@ type AppendEntriesReply struct {
 	ConflictTerm  int
 
 	VoteElabTime  time.Duration
+	// Seq is the sequence number of the AE replied to and Signature the
+	// signature of the follower, if the nodes sign their RPCs
+	Seq			  uint64
+	Signature	  []byte
 }
 
 func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
-	cm.Mu.Lock()
-	defer cm.Mu.Unlock()
-	voteElabTime := time.Now()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	voteElabTime := cm.clock.Now()
 	if cm.state == Dead {
 		return nil
 	}
@@ -372,6 +768,7 @@ func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEn
 		if cm.state != Follower {
 			cm.becomeFollower(args.Term)
 		}
+		cm.setLeader(args.LeaderId, "AppendEntries received from leader")
 
 		// Does our log contain an entry at PrevLogIndex whose term matches
 		// PrevLogTerm? Note that in the extreme case of PrevLogIndex=-1 this is
@@ -380,41 +777,31 @@ func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEn
 			(args.PrevLogIndex < len(cm.log) && args.PrevLogTerm == cm.log[args.PrevLogIndex].Term) {
 			reply.Success = true
 
-			// Find an insertion point - where there's a term mismatch between
-			// the existing log starting at PrevLogIndex+1 and the new entries sent
-			// in the RPC.
-			logInsertIndex := args.PrevLogIndex + 1
-			newEntriesIndex := 0
-
-			for {
-				if logInsertIndex >= len(cm.log) || newEntriesIndex >= len(args.Entries) {
-					break
-				}
-				if cm.log[logInsertIndex].Term != args.Entries[newEntriesIndex].Term {
-					break
-				}
-				logInsertIndex++
-				newEntriesIndex++
-			}
-			// At the end of this loop:
-			// - logInsertIndex points at the end of the log, or an index where the
-			//   term mismatches with an entry from the leader
-			// - newEntriesIndex points at the end of Entries, or an index where the
-			//   term mismatches with the corresponding log entry
+			logInsertIndex, newEntriesIndex := findInsertionPoint(cm.log, args.PrevLogIndex, args.Entries)
 			if newEntriesIndex < len(args.Entries) {
 				cm.Dlog("... inserting entries %v from index %d", args.Entries[newEntriesIndex:], logInsertIndex)
+				if logInsertIndex < len(cm.log) {
+					cm.recordEvent(EventConflict, "truncated %d conflicting entries from index %d", len(cm.log)-logInsertIndex, logInsertIndex)
+				}
 				cm.log = append(cm.log[:logInsertIndex], args.Entries[newEntriesIndex:]...)
-				cm.persistToStorage(cm.log[logInsertIndex:])
+				cm.truncatePersisted(logInsertIndex)
+				cm.terms.truncate(logInsertIndex)
+				for i := logInsertIndex; i < len(cm.log); i++ {
+					cm.terms.add(cm.log[i].Term, i)
+				}
 				cm.Dlog("... log is now: %v", cm.log)
+				cm.resolveFutures()
 			}
 
-			// Set commit index.
-			if args.LeaderCommit > cm.commitIndex {
-				cm.commitIndex = intMin(args.LeaderCommit, len(cm.log)-1)
+			// Set commit index. The entries past the last one sent by the
+			// leader may be stale ones of an older term that didn't conflict
+			// with Entries, so they aren't known to be committed.
+			if commitIndex := intMin(args.LeaderCommit, args.PrevLogIndex+len(args.Entries)); commitIndex > cm.commitIndex {
+				cm.commitIndex = commitIndex
 				cm.Dlog("... setting commitIndex=%d", cm.commitIndex)
-				cm.Mu.Unlock()
-				cm.newCommitReadyChan <- struct{}{}
-				cm.Mu.Lock()	
+				cm.resolveFutures()
+				cm.signalAdvance()
+				cm.notify(cm.newCommitReadyChan)
 			}
 		} else {
 			// No match for PrevLogIndex/PrevLogTerm. Populate
@@ -423,249 +810,346 @@ func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEn
 			if args.PrevLogIndex >= len(cm.log) {
 				reply.ConflictIndex = len(cm.log)
 				reply.ConflictTerm = -1
+				cm.rejoinIfBehind(args)
 			} else {
 				// PrevLogIndex points within our log, but PrevLogTerm doesn't match
 				// cm.log[PrevLogIndex].
 				reply.ConflictTerm = cm.log[args.PrevLogIndex].Term
-
-				var i int
-				for i = args.PrevLogIndex - 1; i >= 0; i-- {
-					if cm.log[i].Term != reply.ConflictTerm {
-						break
-					}
-				}
-				reply.ConflictIndex = i + 1
+				reply.ConflictIndex, _, _ = cm.terms.bounds(reply.ConflictTerm)
 			}
 		}
 	}
 
 	reply.Term = cm.currentTerm
-	reply.VoteElabTime = time.Since(voteElabTime)
+	reply.VoteElabTime = cm.clock.Since(voteElabTime)
+	// The term and the entries are on disk before the leader counts them.
+	if err := cm.persistState(); err != nil {
+		cm.recordEvent(EventPersistError, "%v", err)
+		return err
+	}
+	if err := cm.persistLog(); err != nil {
+		cm.recordEvent(EventPersistError, "%v", err)
+		return err
+	}
 	cm.Dlog("AppendEntries reply: %+v", *reply)
 
 	return nil
 }
 
-func runVoteDelay(loadLevel int) {
-	delay := time.Duration(100/loadLevel) * time.Millisecond
-	time.Sleep(delay)
+// findInsertionPoint finds where the entries sent by the leader after
+// prevLogIndex start to differ from log, that must match the leader at
+// prevLogIndex. It returns:
+//   - logInsertIndex, the end of log or the first index where its term
+//     mismatches the corresponding entry from the leader
+//   - newEntriesIndex, the end of entries or the first index where its term
+//     mismatches the corresponding entry of log
+//
+// entries[newEntriesIndex:] replace log[logInsertIndex:], if any, and
+// logInsertIndex-newEntriesIndex is always prevLogIndex+1.
+func findInsertionPoint(log []LogEntry, prevLogIndex int, entries []LogEntry) (logInsertIndex int, newEntriesIndex int) {
+	logInsertIndex = prevLogIndex + 1
+	for logInsertIndex < len(log) && newEntriesIndex < len(entries) &&
+		log[logInsertIndex].Term == entries[newEntriesIndex].Term {
+		logInsertIndex++
+		newEntriesIndex++
+	}
+	return logInsertIndex, newEntriesIndex
 }
 
-// startElection starts a new election with this CM as a candidate.
-// Expects cm.Mu to be locked.
+// runVoteDelay waits base divided by the load level of the candidate, so that
+// less loaded candidates collect votes first, or not at all if the candidate
+// doesn't know its load level. Expects cm.mu not to be locked.
+func (cm *ConsensusModule) runVoteDelay(base time.Duration, loadLevel int) {
+	if loadLevel <= 0 {
+		return
+	}
+	delay := base / time.Duration(loadLevel)
+	cm.clock.Sleep(delay)
+}
+
+// Election starts a new election with this CM as a candidate.
 func (cm *ConsensusModule) Election() {
-	cm.Mu.Lock()
-	defer cm.Mu.Unlock()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.learners[cm.id] {
+		cm.Dlog("learners don't start elections")
+		return
+	}
 	cm.state = Candidate
 	cm.currentTerm += 1
+	cm.publishStatus()
 	savedCurrentTerm := cm.currentTerm
 	cm.votedFor = cm.id
-	cm.Dlog("becomes Candidate (currentTerm=%d); log=%v; loadLevel=%v", savedCurrentTerm, cm.log, cm.loadLevel)
-	votesReceived := 1
-
-	// Send RequestVote RPCs to all other servers concurrently.
+	cm.loadMu.Lock()
+	savedLoadLevel := cm.loadLevel
 	cm.loadLevelMap[cm.id] = cm.loadLevel
-	for t, peerId := range cm.peerIds {
-		go func(peerId int, t int) {
-			cm.Mu.Lock()
-			savedLastLogIndex, savedLastLogTerm := cm.lastLogIndexAndTerm()
-			cm.Mu.Unlock()
-
-			args := RequestVoteArgs{
-				Term:         savedCurrentTerm,
-				CandidateId:  cm.id,
-				LastLogIndex: savedLastLogIndex,
-				LastLogTerm:  savedLastLogTerm,
-				LoadLevel:    cm.loadLevel,
-			}
+	cm.drained[cm.id] = cm.draining
+	cm.loadMu.Unlock()
+	cm.Dlog("becomes Candidate (currentTerm=%d); log=%v; loadLevel=%v", savedCurrentTerm, cm.log, savedLoadLevel)
+	cm.recordEvent(EventStateChange, "becomes Candidate")
+	// The vote for itself is on disk before it asks for the others.
+	if err := cm.persistState(); err != nil {
+		cm.Dlog("%v", err)
+		cm.recordEvent(EventPersistError, "%v", err)
+		return
+	}
 
-			cm.Dlog("sending RequestVote to %d: %+v", peerId, args)
-			var reply RequestVoteReply
-			if err := cm.server.Call(peerId, "ConsensusModule.RequestVote", args, &reply); err == nil {
-				cm.Mu.Lock()
-				cm.loadLevelMap[peerId] = reply.LoadLevel
-				defer cm.Mu.Unlock()
-				cm.Dlog("received RequestVoteReply %+v", reply)
+	// Send RequestVote RPCs to all other servers concurrently, through
+	// their workers.
+	cm.loadHistory.Record(cm.id, savedLoadLevel)
+	cm.votes = 1
+	for _, peerId := range cm.peerIds {
+		if w := cm.workers[peerId]; w != nil && !cm.learners[peerId] {
+			cm.notify(w.requestVote)
+		}
+	}
+}
 
-				if cm.state != Candidate {
-					cm.Dlog("while waiting for reply, state = %v", cm.state)
-					return
-				}
+// requestVote asks the peer of w to vote for this CM, if it's still a
+// candidate, and counts the vote.
+func (cm *ConsensusModule) requestVote(w *peerWorker) {
+	peerId := w.peerId
+	cm.mu.Lock()
+	if cm.state != Candidate {
+		cm.mu.Unlock()
+		return
+	}
+	savedCurrentTerm := cm.currentTerm
+	savedLastLogIndex, savedLastLogTerm := cm.lastLogIndexAndTerm()
+	cm.mu.Unlock()
+	cm.loadMu.RLock()
+	savedLoadLevel := cm.loadLevelMap[cm.id]
+	cm.loadMu.RUnlock()
+
+	args := RequestVoteArgs{
+		Term:         savedCurrentTerm,
+		CandidateId:  cm.id,
+		LastLogIndex: savedLastLogIndex,
+		LastLogTerm:  savedLastLogTerm,
+		LoadLevel:    savedLoadLevel,
+		Seq:          cm.nextSeq(),
+	}
+	signature, err := cm.sign(args)
+	if err != nil {
+		cm.Dlog("signing RequestVote: %v", err)
+		return
+	}
+	args.Signature = signature
+
+	cm.Dlog("sending RequestVote to %d: %+v", peerId, args)
+	var reply RequestVoteReply
+	// The peer waits up to VoteDelay before answering, see runVoteDelay.
+	ctx, cancel := clock.WithTimeout(cm.clock, cm.ctx, cm.rpcTimeout(peerId)+cm.Config().VoteDelay)
+	defer cancel()
+	if err := cm.transport.CallContext(ctx, peerId, "ConsensusModule.RequestVote", args, &reply); err != nil {
+		return
+	}
+	if err := cm.verifyReply(peerId, reply, reply.Seq, args.Seq, reply.Signature); err != nil {
+		cm.Dlog("refusing RequestVote reply: %v", err)
+		return
+	}
+	cm.loadMu.Lock()
+	cm.loadLevelMap[peerId] = reply.LoadLevel
+	cm.drained[peerId] = reply.Draining
+	cm.loadMu.Unlock()
+	cm.loadHistory.Record(peerId, reply.LoadLevel)
+	cm.mu.Lock()
+	won := cm.countVote(savedCurrentTerm, reply)
+	cm.mu.Unlock()
+	if won {
+		cm.signalElected()
+	}
+}
 
-				if reply.Term > savedCurrentTerm {
-					cm.Dlog("term out of date in RequestVoteReply")
-					cm.becomeFollower(reply.Term)
-					return
-				} else if reply.Term == savedCurrentTerm {
-					if reply.VoteGranted {
-						votesReceived += 1
-						if votesReceived*2 > len(cm.peerIds)/*+1*/ {
-							// +1 is canceled because it should be the server itself, but
-							// I must subtract 1 because the default gateway is included
-							// and it is not a server
-						
-							// Won the election!
-							cm.Dlog("wins election with %d votes", votesReceived)
-							cm.startLeader()
-							return
-						}
-					}
-				}
+// countVote counts the reply to the RequestVote sent in savedCurrentTerm and
+// reports whether it makes cm the leader.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) countVote(savedCurrentTerm int, reply RequestVoteReply) bool {
+	cm.Dlog("received RequestVoteReply %+v", reply)
+
+	if cm.state != Candidate || cm.currentTerm != savedCurrentTerm {
+		cm.Dlog("while waiting for reply, state = %v", cm.state)
+		return false
+	}
+
+	if reply.Term > savedCurrentTerm {
+		cm.Dlog("term out of date in RequestVoteReply")
+		cm.becomeFollower(reply.Term)
+		return false
+	} else if reply.Term == savedCurrentTerm {
+		if reply.VoteGranted {
+			cm.votes += 1
+			// The voters are the peers and this server; the default gateway
+			// isn't among the peers, see CheckNewPeers.
+			if cm.votes*2 > cm.voters()+1 {
+				// Won the election!
+				cm.Dlog("wins election with %d votes", cm.votes)
+				cm.startLeader()
+				return true
 			}
-		}(peerId, t)
+		}
 	}
+	return false
+}
 
+// signalElected notifies the won election on ElectionChan, without cm.mu
+// locked. The send doesn't block: a notification nobody waits for, as when
+// Submit gave up, is dropped, or discarded by the next Submit.
+func (cm *ConsensusModule) signalElected() {
+	select {
+	case cm.ElectionChan <- struct{}{}:
+	default:
+	}
 }
 
 // becomeFollower makes cm a follower and resets its state.
-// Expects cm.Mu to be locked.
+// Expects cm.mu to be locked.
 func (cm *ConsensusModule) becomeFollower(term int) {
 	cm.Dlog("becomes Follower with term=%d; log=%v", term, cm.log)
+	if cm.state == Leader {
+		cm.setLeader(-1, fmt.Sprintf("stepped down, term %d out of date", cm.currentTerm))
+		cm.failFutures(ErrLeadershipLost)
+	}
+	if cm.state != Follower {
+		cm.recordEvent(EventStateChange, "becomes Follower with term=%d", term)
+	}
+	if cm.leaderId == cm.id {
+		cm.setLeader(-1, fmt.Sprintf("lost election for term %d", term))
+	}
 	cm.state = Follower
 	cm.currentTerm = term
 	cm.votedFor = -1
+	cm.publishStatus()
 }
 
 // startLeader switches cm into a leader state and begins process of heartbeats.
-// Expects cm.Mu to be locked.
+// The caller notifies ElectionChan once cm.mu is unlocked, see signalElected.
+// Expects cm.mu to be locked.
 func (cm *ConsensusModule) startLeader(){
 	cm.state = Leader
-	cm.ElectionChan <- struct{}{}
+	cm.publishStatus()
+	cm.setLeader(cm.id, "won election")
+	cm.recordEvent(EventStateChange, "becomes Leader")
 	for _, peerId := range cm.peerIds {
 		cm.nextIndex[peerId] = len(cm.log)
 		cm.matchIndex[peerId] = -1
 	}
 	cm.Dlog("becomes Leader; term=%d, nextIndex=%v, matchIndex=%v; log=%v", cm.currentTerm, cm.nextIndex, cm.matchIndex, cm.log)
+	// A round of AEs is sent right away, as in Raft, so that the followers
+	// learn about the new leader and the entries of the previous terms are
+	// replicated, even though they're only committed with one of this term.
+	cm.notify(cm.triggerAEChan)
+
+	// A Pause sent before this leadership doesn't end it.
+	select {
+	case <-cm.stopSendingAEsChan:
+	default:
+	}
 
 	// This goroutine runs in the background and sends AEs to peers
-	// Whenever something is sent on triggerAEChan
-	go func() {
+	// Whenever something is sent on triggerAEChan. The triggers received
+	// within ReplicationBatchWindow of the first one are coalesced, so that a
+	// burst of submits is replicated in a single round.
+	cm.tasks.Go("AE trigger loop", func() {
 		for {
 			select {	
 			case <-cm.stopSendingAEsChan:
+				// The entries appended before the pause are still sent, as
+				// both channels may be ready at once.
+				select {
+				case <-cm.triggerAEChan:
+					cm.leaderSendAEs()
+				default:
+				}
+				return
+			case <-cm.ctx.Done():
 				return
 			case <-cm.triggerAEChan:
-				cm.Mu.Lock()
+				if window := cm.Config().ReplicationBatchWindow; window > 0 {
+					select {
+					case <-cm.clock.After(window):
+					case <-cm.ctx.Done():
+						return
+					}
+					select {
+					case <-cm.triggerAEChan:
+					default:
+					}
+				}
+				cm.mu.Lock()
 				if cm.state != Leader {
-					cm.Mu.Unlock()
+					cm.mu.Unlock()
 					return
 				}
-				cm.Mu.Unlock()
+				cm.mu.Unlock()
 				cm.leaderSendAEs()
 			}
 		}
-	}()
+	})
 }
 
-// leaderSendAEs sends a round of AEs to all peers, collects their
-// replies and adjusts cm's state.
+// leaderSendAEs triggers a round of AEs to all peers, sent by their
+// workers, see replicate.
 func (cm *ConsensusModule) leaderSendAEs(index ...int) {
-	cm.Mu.Lock()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
 	if cm.state != Leader {
-		cm.Mu.Unlock()
 		return
 	}
-	savedCurrentTerm := cm.currentTerm
-	cm.Mu.Unlock()
-	for t, peerId := range cm.peerIds {
-		go func(peerId int, t int) {
-			cm.Mu.Lock()
-			ni := cm.nextIndex[peerId]
-			prevLogIndex := ni - 1
-			prevLogTerm := -1
-			if prevLogIndex >= 0 {
-				prevLogTerm = cm.log[prevLogIndex].Term
-			}
-			entries := cm.log[ni:]
-			chosenId := -1
-			if len(entries) > 0 {
-				chosenId = entries[0].ChosenId
-			}
-
-			args := AppendEntriesArgs{
-				Term:         savedCurrentTerm,
-				LeaderId:     cm.id,
-				PrevLogIndex: prevLogIndex,
-				PrevLogTerm:  prevLogTerm,
-				Entries:      entries,
-				LeaderCommit: cm.commitIndex,
-				ChosenId:     chosenId,
-			}
-			cm.Mu.Unlock()
-			cm.Dlog("sending AppendEntries to %v: ni=%d, args=%+v", peerId, ni, args)
-			var reply AppendEntriesReply
-			if err := cm.server.Call(peerId, "ConsensusModule.AppendEntries", args, &reply); err == nil {
-				cm.Mu.Lock()
-				if reply.Term > cm.currentTerm {
-					cm.Dlog("term out of date in heartbeat reply")
-					cm.becomeFollower(reply.Term)
-					cm.Mu.Unlock()
-					return
-				}
+	for _, peerId := range cm.peerIds {
+		if w := cm.workers[peerId]; w != nil {
+			cm.notify(w.replicate)
+		}
+	}
+}
 
-				if cm.state == Leader && savedCurrentTerm == reply.Term {
-					if reply.Success {
-						cm.nextIndex[peerId] = ni + len(entries)
-						cm.matchIndex[peerId] = cm.nextIndex[peerId] - 1
-
-						savedCommitIndex := cm.commitIndex
-						for i := cm.commitIndex + 1; i < len(cm.log); i++ {
-							if cm.log[i].Term == cm.currentTerm {
-								matchCount := 1
-								for _, peerId := range cm.peerIds {
-									if cm.matchIndex[peerId] >= i {
-										matchCount++
-									}
-								}
-								if matchCount*2 > len(cm.peerIds)+1 {
-									cm.commitIndex = i
-								}
-							}
-						}
-						cm.Dlog("AppendEntries reply from %d success: nextIndex := %v, matchIndex := %v; commitIndex := %d", peerId, cm.nextIndex, cm.matchIndex, cm.commitIndex)
-						if cm.commitIndex != savedCommitIndex {
-							cm.Dlog("leader sets commitIndex := %d", cm.commitIndex)
-							// Commit index changed: the leader considers new entries to be
-							// committed. Send new entries on the commit channel to this
-							// leader's clients, and notify followers by sending them AEs.
-							cm.Mu.Unlock()
-							cm.persistToStorage(cm.log[savedCommitIndex+1 : cm.commitIndex+1])
-							cm.newCommitReadyChan <- struct{}{}
-							cm.triggerAEChan <- struct{}{}
-						} else {
-							cm.Mu.Unlock()
-						}
-					} else {
-						if reply.ConflictTerm >= 0 {
-							lastIndexOfTerm := -1
-							for i := len(cm.log) - 1; i >= 0; i-- {
-								if cm.log[i].Term == reply.ConflictTerm {
-									lastIndexOfTerm = i
-									break
-								}
-							}
-							if lastIndexOfTerm >= 0 {
-								cm.nextIndex[peerId] = lastIndexOfTerm + 1
-							} else {
-								cm.nextIndex[peerId] = reply.ConflictIndex
-							}
-						} else {
-							cm.nextIndex[peerId] = reply.ConflictIndex
-						}
-						cm.Dlog("AppendEntries reply from %d !success: nextIndex := %d", peerId, ni-1)
-						cm.Mu.Unlock()
-					}
-				} else {
-					cm.Mu.Unlock()
-				}
-			}
-		}(peerId, t)
+// setLeader records that leaderId is the leader of the current term, appending
+// the change to the leadership history, written by writeLeaderHistory.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) setLeader(leaderId int, reason string) {
+	if cm.leaderId == leaderId && cm.leaderTerm == cm.currentTerm {
+		return
+	}
+	cm.leaderId = leaderId
+	cm.leaderTerm = cm.currentTerm
+	cm.publishStatus()
+	if leaderId == cm.id {
+		cm.startLeaderFuncs()
+	} else {
+		cm.stopLeaderFuncs()
+	}
+	change := st.LeaderChange{
+		Term:      cm.currentTerm,
+		LeaderId:  leaderId,
+		Timestamp: cm.clock.Now().Local().Format("2006-01-02 15:04:05.0000"),
+		Reason:    reason,
+	}
+	cm.history.Append(change)
+	select {
+	case cm.LeaderChangeChan <- LeaderChange{LeaderId: leaderId, Term: cm.currentTerm}:
+	default:
+		cm.Dlog("LeaderChangeChan full, dropping change to leader %d", leaderId)
 	}
 }
 
+// writeLeaderHistory writes the leadership changes to the history file, out
+// of cm.mu, until the CM is stopped.
+func (cm *ConsensusModule) writeLeaderHistory() {
+	cm.history.Run(cm.ctx.Done(), func(err error) {
+		cm.Dlog("error while appending to leader history: %v", err)
+		cm.recordEventUnlocked(EventPersistError, "appending to leader history: %v", err)
+	})
+}
+
+// LeaderHistory returns the latest leadership changes seen by this CM, oldest
+// first.
+func (cm *ConsensusModule) LeaderHistory() []st.LeaderChange {
+	return cm.history.Entries()
+}
+
 // lastLogIndexAndTerm returns the last log index and the last log entry's term
 // (or -1 if there's no log) for this server.
-// Expects cm.Mu to be locked.
+// Expects cm.mu to be locked.
 func (cm *ConsensusModule) lastLogIndexAndTerm() (int, int) {
 	if len(cm.log) > 0 {
 		lastIndex := len(cm.log) - 1
@@ -675,38 +1159,6 @@ func (cm *ConsensusModule) lastLogIndexAndTerm() (int, int) {
 	}
 }
 
-// commitChanSender is responsible for sending committed entries on
-// cm.commitChan. It watches newCommitReadyChan for notifications and calculates
-// which new entries are ready to be sent. This method should run in a separate
-// background goroutine; cm.commitChan may be buffered and will limit how fast
-// the client consumes new committed entries. Returns when newCommitReadyChan is
-// closed.
-func (cm *ConsensusModule) commitChanSender() {
-	for {
-		<-cm.newCommitReadyChan
-		// Find which entries we have to apply.
-		cm.Mu.Lock()
-		savedTerm := cm.currentTerm
-		savedLastApplied := cm.lastApplied
-		var entries []LogEntry
-		if cm.commitIndex > cm.lastApplied {
-			entries = cm.log[cm.lastApplied+1 : cm.commitIndex+1]
-			cm.lastApplied = cm.commitIndex
-		}
-		cm.Mu.Unlock()
-		cm.Dlog("commitChanSender entries=%v, savedLastApplied=%d", entries, savedLastApplied)
-
-		for i, entry := range entries {
-			cm.commitChan <- CommitEntry{
-				Command: entry.Command,
-				Index:   savedLastApplied + i + 1,
-				Term:    savedTerm,
-				ChosenId: entry.ChosenId,
-			}
-		}
-	}
-}
-
 func intMin(a, b int) int {
 	if a < b {
 		return a
@@ -714,85 +1166,109 @@ func intMin(a, b int) int {
 	return b
 }
 
+// Pause stops the AEs sent by the leader until the next election, once the
+// entries already appended are sent. It doesn't block if the AEs are already
+// stopped.
 func (cm *ConsensusModule) Pause() {
-	cm.Mu.Lock()
-	cm.stopSendingAEsChan <- struct{}{}
-	cm.Mu.Unlock()
+	cm.notify(cm.stopSendingAEsChan)
 }
 
+// MonitorLoad measures the load level of the node every LoadPollInterval.
+// Returns when the CM is stopped.
 func (cm *ConsensusModule) MonitorLoad() {
 	var cpu float64
 	var load int
 	for {
-		cm.Mu.Lock()
-		load, cpu = l.GetLoadLevel()
-		cm.Mu.Unlock()
+		level, usage := cm.load.LoadLevel()
+		if cm.UnderMemoryPressure() {
+			// The leader places the new services elsewhere
+			level = maxLoadLevel
+		}
+		cm.loadMu.Lock()
+		load, cpu = level, usage
+		cm.loadMu.Unlock()
 		select {
 			case <-cm.CPUChan:
-				go cm.MonitorForTest(&cpu)
+				cm.tasks.Go("MonitorForTest", func() {
+					if err := cm.MonitorForTest(&cpu); err != nil {
+						cm.logger.Printf("[%d] MonitorForTest: %v", cm.id, err)
+					}
+				})
 			default:
-				cm.Mu.Lock()
+				cm.loadMu.Lock()
 				cm.loadLevel = load
-				cm.Mu.Unlock()
-				time.Sleep(20 * time.Millisecond)
+				cm.loadMu.Unlock()
+				select {
+				case <-cm.clock.After(cm.Config().LoadPollInterval):
+				case <-cm.ctx.Done():
+					return
+				}
 		}
 	}
 }
 
-func (cm *ConsensusModule) MonitorForTest(cpu *float64) {
-	timer := time.NewTimer(8 * time.Millisecond)
+func (cm *ConsensusModule) MonitorForTest(cpu *float64) error {
+	timer := cm.clock.NewTimer(8 * time.Millisecond)
 	f, err := os.OpenFile("/log/cpu" + strconv.Itoa(cm.id) + ".txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-	f.WriteString("Times,Perc\n")
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer f.Close()
+	f.WriteString("Times,Perc\n")
 	for {
-		<-timer.C
+		select {
+		case <-timer.C():
+		case <-cm.ctx.Done():
+			timer.Stop()
+			return nil
+		}
 		timer.Reset(8 * time.Millisecond)
-		when := time.Since(cm.StartTime)
-		cm.Mu.Lock()
-		f.WriteString(fmt.Sprintf("%v,%.2f\n", when, *cpu))
-		cm.Mu.Unlock()
+		when := cm.clock.Since(cm.StartTime)
+		// cpu is updated by MonitorLoad under loadMu.
+		cm.loadMu.RLock()
+		usage := *cpu
+		cm.loadMu.RUnlock()
+		f.WriteString(fmt.Sprintf("%v,%.2f\n", when, usage))
 	}
 }
 
 func (cm *ConsensusModule) DisconnectPeer(peerId int) {
-	cm.Mu.Lock()
+	cm.mu.Lock()
+	cm.stopPeerWorker(peerId)
 	for i, peer := range cm.peerIds {
 		if peer == peerId {
 			cm.peerIds = append(cm.peerIds[:i], cm.peerIds[i+1:]...)
 			break
 		}
 	}
-	cm.Mu.Unlock()
+	cm.mu.Unlock()
 }
 
 func (cm *ConsensusModule) ConnectPeer(peerId int) {
-	cm.Mu.Lock()
+	cm.mu.Lock()
 	cm.peerIds = append(cm.peerIds, peerId)
-	cm.Mu.Unlock()
+	cm.startPeerWorker(peerId)
+	cm.mu.Unlock()
 }
 
-func (cm *ConsensusModule) CheckCMId(peerId int) bool {
-	return cm.id == peerId
+// GetLoadHistory returns the load levels reported to this CM over time.
+func (cm *ConsensusModule) GetLoadHistory() *LoadHistory {
+	return cm.loadHistory
 }
 
-func (cm *ConsensusModule) minLoadLevelMap() int {
-	lowestPeers := make([]int, 0)
-	lastPeer := 0
-	lowestLoad := 11
+// Tasks returns the goroutines spawned by this CM and its server that are
+// still running.
+func (cm *ConsensusModule) Tasks() []TaskInfo {
+	return cm.tasks.Tasks()
+}
 
-	for peerId, loadLevel := range cm.loadLevelMap {
-		_, ok := cm.loadLevelMap[lastPeer]
-		if !ok || loadLevel < lowestLoad {
-			lowestLoad = loadLevel
-			lowestPeers = []int{peerId}
-		} else if loadLevel == lowestLoad {
-			lowestPeers = append(lowestPeers, peerId)
-		} 
-		lastPeer = peerId
-	}
-	return lowestPeers[rand.Intn(len(lowestPeers))]
+// GetMetrics returns the latency metrics collected by this CM.
+func (cm *ConsensusModule) GetMetrics() *Metrics {
+	return cm.metrics
+}
+
+func (cm *ConsensusModule) CheckCMId(peerId int) bool {
+	return cm.id == peerId
 }
 
 func (cm *ConsensusModule) NewLog(command *Service, chosenId int) (log LogEntry) {
@@ -802,7 +1278,7 @@ func (cm *ConsensusModule) NewLog(command *Service, chosenId int) (log LogEntry)
 		LeaderId: 	cm.id,
 		ChosenId: 	chosenId,
 		Index: 	  	"",
-		Timestamp: 	time.Now().Local().Format("2006-01-02 15:04:05.0000"),
+		Timestamp: 	cm.clock.Now().Local().Format("2006-01-02 15:04:05.0000"),
 	}
 	values := reflect.ValueOf(newLog)
 	sum := []byte{}
@@ -814,7 +1290,13 @@ func (cm *ConsensusModule) NewLog(command *Service, chosenId int) (log LogEntry)
 			 
 }
 
-func Exec(service string) {
-	exec.Command("docker-compose", "-f", "/home/raft/services/" + service, "up", "-d").Start()
-	fmt.Printf("Eseguito %s\n", service)
+// run starts the service on this node in the background.
+func (cm *ConsensusModule) run(service string) {
+	cm.tasks.Go("Exec "+service, func() {
+		if err := cm.executor.Run(cm.ctx, service); err != nil {
+			cm.logger.Printf("[%d] running %s: %v", cm.id, service, err)
+			return
+		}
+		fmt.Printf("Eseguito %s\n", service)
+	})
 }
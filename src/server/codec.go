@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+)
+
+// The codecs below are the gob codecs of net/rpc with a configurable buffer
+// size: the stock ones buffer 4KB, so a service artifact sent in a Deploy
+// RPC takes a write syscall every 4KB. See Config.TransferBufferSize.
+
+type gobClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+// newClientCodec returns the client codec of conn, buffering size bytes.
+func newClientCodec(conn io.ReadWriteCloser, size int) rpc.ClientCodec {
+	encBuf := bufio.NewWriterSize(conn, size)
+	return &gobClientCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(bufio.NewReaderSize(conn, size)),
+		enc:    gob.NewEncoder(encBuf),
+		encBuf: encBuf,
+	}
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+// newServerCodec returns the server codec of conn, buffering size bytes.
+func newServerCodec(conn io.ReadWriteCloser, size int) rpc.ServerCodec {
+	encBuf := bufio.NewWriterSize(conn, size)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(bufio.NewReaderSize(conn, size)),
+		enc:    gob.NewEncoder(encBuf),
+		encBuf: encBuf,
+	}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// The header couldn't be encoded: the stream is broken.
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// The body couldn't be encoded: the stream is broken.
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		// Only call c.rwc.Close once; otherwise the semantics are undefined.
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
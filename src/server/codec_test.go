@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+// sink receives the artifacts of BenchmarkTransferThroughput.
+type sink struct{}
+
+func (sink) Put(artifact []byte, n *int) error {
+	*n = len(artifact)
+	return nil
+}
+
+// dialSink serves a sink on a loopback connection through the codecs of the
+// RPCs, buffering size bytes, and returns a client of it.
+func dialSink(tb testing.TB, size int) *rpc.Client {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("Sink", sink{}); err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			rpcServer.ServeCodec(newServerCodec(conn, size))
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	client := rpc.NewClientWithCodec(newClientCodec(conn, size))
+	tb.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	client := dialSink(t, 10)
+	artifact := make([]byte, 100<<10)
+	var n int
+	if err := client.Call("Sink.Put", artifact, &n); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(artifact) {
+		t.Fatalf("received %d bytes, sent %d", n, len(artifact))
+	}
+}
+
+// BenchmarkTransferThroughput sends a 64KB artifact: in 10-byte chunks, as
+// the transfers used to, one RPC each, and in a single RPC through codecs
+// buffering 4KB, as the ones of net/rpc, and the default TransferBufferSize.
+func BenchmarkTransferThroughput(b *testing.B) {
+	const artifactSize = 64 << 10
+	artifact := make([]byte, artifactSize)
+	for _, bench := range []struct {
+		chunk, buffer int
+	}{
+		{10, 10},
+		{artifactSize, 4 << 10},
+		{artifactSize, DefaultConfig().TransferBufferSize},
+	} {
+		b.Run(fmt.Sprintf("chunk=%d/buffer=%d", bench.chunk, bench.buffer), func(b *testing.B) {
+			client := dialSink(b, bench.buffer)
+			b.SetBytes(artifactSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for at := 0; at < artifactSize; at += bench.chunk {
+					end := at + bench.chunk
+					if end > artifactSize {
+						end = artifactSize
+					}
+					var n int
+					if err := client.Call("Sink.Put", artifact[at:end], &n); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
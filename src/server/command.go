@@ -0,0 +1,331 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"server/scheduler"
+	"sync"
+	"time"
+)
+
+// CommandKind identifies the operation carried by a log entry.
+type CommandKind string
+
+// Kinds of the built-in commands.
+const (
+	CommandDeploy       CommandKind = ""
+	CommandRemove       CommandKind = "remove"
+	CommandMigrate      CommandKind = "migrate"
+	CommandConfigChange CommandKind = "config_change"
+	CommandNoop         CommandKind = "noop"
+	CommandSetConfig    CommandKind = "set_config"
+	CommandAudit        CommandKind = "audit"
+	CommandPreempt      CommandKind = "preempt"
+	CommandSchedule     CommandKind = "schedule"
+	CommandCron         CommandKind = "cron"
+	CommandExpire       CommandKind = "expire"
+)
+
+// DeployPayload carries the options of a deployment, given by the manifest
+// of the service. A deployment without payload has the zero options.
+type DeployPayload struct {
+	// Priority ranks the service when the cluster is saturated: the
+	// services of lower priority are preempted to run it, see
+	// Config.SaturatedLoad. It may be negative.
+	Priority int `json:",omitempty"`
+
+	// NotBefore is the earliest time the service starts: until then the
+	// deployment waits in the log, in a CommandSchedule entry, and the
+	// leader places it once the time comes.
+	NotBefore *time.Time `json:",omitempty"`
+
+	// Cron is set on the deployments of the runs of a recurring deployment,
+	// see CronPayload.
+	Cron *CronRun `json:",omitempty"`
+
+	// Namespace groups the services charged to the same resource quota,
+	// DefaultNamespace if empty, and Resources are the resources the
+	// service requests, see ResourceQuotas.
+	Namespace string     `json:",omitempty"`
+	Resources *Resources `json:",omitempty"`
+
+	// TTL is the lifetime of the service: once it elapses, the node running
+	// it proposes its undeployment with a CommandExpire. ExpiresAt is set
+	// by the leader when the service is placed.
+	TTL       time.Duration `json:",omitempty"`
+	ExpiresAt *time.Time    `json:",omitempty"`
+
+	// Version is the version of the service, given by its manifest. The
+	// same ServiceID and Version submitted again while the service runs,
+	// such as by a client retrying across a change of leader, isn't placed
+	// twice, see ConsensusModule.duplicateDeploy.
+	Version string `json:",omitempty"`
+
+	// Client is the principal that submitted the service through the APIs,
+	// whose resource quota it's charged to, if any. It's set by the node
+	// that received the request.
+	Client string `json:",omitempty"`
+}
+
+// CronPayload registers the recurring deployment Name of the service
+// described by Manifest, as accepted by ParseService, at the times of
+// Schedule, see cron.Parse, from Created on. Delete unregisters it instead.
+type CronPayload struct {
+	Name     string
+	Schedule string `json:",omitempty"`
+	Manifest string `json:",omitempty"`
+	Created  time.Time
+	Delete   bool `json:",omitempty"`
+}
+
+// CronRun is the run due at At of the recurring deployment Job.
+type CronRun struct {
+	Job string
+	At  time.Time
+}
+
+// PreemptPayload stops a service of priority Priority to run the service By,
+// of the higher priority ByPriority, on its node. It's appended by the leader
+// only, right before the deployment of By.
+type PreemptPayload struct {
+	Priority   int
+	By         string
+	ByPriority int
+}
+
+// MigratePayload moves a deployed service to node To, or to the node chosen
+// by the scheduler if To is AnyNode. From is filled in by the leader when the
+// command is appended.
+type MigratePayload struct {
+	From int
+	To   int
+}
+
+// AnyNode is the destination of a migration left to the scheduler.
+const AnyNode = -1
+
+// ConfigChangePayload adds and removes nodes of the cluster. Add maps the ID
+// of every new node to its IP address; Learners does the same for the nodes
+// added as learners, which become voters when listed in Promote. UUIDs maps
+// the ID of added nodes to their NodeIdentity: a node already known with
+// another UUID isn't added, and one known with the same UUID is reconnected
+// at its new address. Labels replaces the labels of the listed nodes, and
+// Capacity their capacity. Standby makes the listed nodes standby nodes, that
+// aren't scheduled, and Activate makes them active again.
+type ConfigChangePayload struct {
+	Add      map[int]string
+	Remove   []int
+	Learners map[int]string            `json:",omitempty"`
+	Promote  []int                     `json:",omitempty"`
+	UUIDs    map[int]string            `json:",omitempty"`
+	Labels   map[int]map[string]string `json:",omitempty"`
+	Capacity map[int]Resources         `json:",omitempty"`
+	Standby  []int                     `json:",omitempty"`
+	Activate []int                     `json:",omitempty"`
+}
+
+// SetConfigPayload changes a replicated runtime setting on every node.
+type SetConfigPayload struct {
+	Name  string
+	Value string
+}
+
+// AuditPayload records a change requested to the admin or REST API of Node:
+// Principal, with role Role, sent the request for Action, its method and
+// path, with parameters Params, at Time, and was answered with Status.
+type AuditPayload struct {
+	Principal string
+	Role      string
+	Action    string
+	Params    map[string]string `json:",omitempty"`
+	Status    int
+	Time      time.Time
+	Node      int
+}
+
+// CommandDecoder decodes the payload of a command.
+type CommandDecoder func(payload []byte) (interface{}, error)
+
+// decodeDeploy decodes the payload of a deployment, which may be empty.
+func decodeDeploy(payload []byte) (interface{}, error) {
+	var p DeployPayload
+	if len(payload) == 0 {
+		return p, nil
+	}
+	err := json.Unmarshal(payload, &p)
+	return p, err
+}
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = map[CommandKind]CommandDecoder{
+		CommandRemove:   nil,
+		CommandExpire:   nil,
+		CommandNoop:     nil,
+		CommandDeploy:   decodeDeploy,
+		CommandSchedule: decodeDeploy,
+		CommandMigrate: func(payload []byte) (interface{}, error) {
+			var p MigratePayload
+			err := json.Unmarshal(payload, &p)
+			return p, err
+		},
+		CommandConfigChange: func(payload []byte) (interface{}, error) {
+			var p ConfigChangePayload
+			err := json.Unmarshal(payload, &p)
+			return p, err
+		},
+		CommandSetConfig: func(payload []byte) (interface{}, error) {
+			var p SetConfigPayload
+			err := json.Unmarshal(payload, &p)
+			return p, err
+		},
+		CommandAudit: func(payload []byte) (interface{}, error) {
+			var p AuditPayload
+			err := json.Unmarshal(payload, &p)
+			return p, err
+		},
+		CommandPreempt: func(payload []byte) (interface{}, error) {
+			var p PreemptPayload
+			err := json.Unmarshal(payload, &p)
+			return p, err
+		},
+		CommandCron: func(payload []byte) (interface{}, error) {
+			var p CronPayload
+			err := json.Unmarshal(payload, &p)
+			return p, err
+		},
+	}
+)
+
+// RegisterCommand registers the decoder of the payloads of a new kind of
+// command. A nil decoder registers a kind without payload.
+func RegisterCommand(kind CommandKind, decoder CommandDecoder) error {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	if _, ok := decoders[kind]; ok {
+		return fmt.Errorf("command %q already registered", kind)
+	}
+	decoders[kind] = decoder
+	return nil
+}
+
+// NewCommand returns a command of the given kind about the service
+// serviceId, with payload encoded as JSON. payload is ignored if nil.
+func NewCommand(kind CommandKind, serviceId string, payload interface{}) (*Service, error) {
+	command := &Service{ServiceID: serviceId, Kind: kind}
+	if payload != nil {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		command.Payload = encoded
+	}
+	if _, err := DecodeCommand(command); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+// DecodeCommand decodes the payload of command with the decoder registered
+// for its kind. It returns nil for kinds without payload.
+func DecodeCommand(command *Service) (interface{}, error) {
+	decodersMu.RLock()
+	decoder, ok := decoders[command.Kind]
+	decodersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown command %q", command.Kind)
+	}
+	if decoder == nil {
+		return nil, nil
+	}
+	return decoder(command.Payload)
+}
+
+// chooseNode validates command and returns the node that runs it: the least
+// loaded one for a deployment, the one running the service for a removal and
+// the destination for a migration, whose payload is completed with the node
+// the service is moved from. A deployment exceeding a resource quota is
+// refused, see ResourceQuotas. A deployment not due yet is turned into a
+// CommandSchedule for AnyNode, and so is the removal of a scheduled service,
+// which cancels it. The expiry of a service is refused before its time, and
+// a deployment with a TTL is completed with the time it expires at.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) chooseNode(command *Service) (*Service, int, error) {
+	payload, err := DecodeCommand(command)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch command.Kind {
+	case CommandDeploy:
+		deploy := payload.(DeployPayload)
+		if err := cm.checkResourceQuotas(command.ServiceID, deploy); err != nil {
+			return nil, 0, err
+		}
+		if notBefore := deploy.NotBefore; notBefore != nil && notBefore.After(cm.clock.Now()) {
+			scheduled := *command
+			scheduled.Kind = CommandSchedule
+			return &scheduled, AnyNode, nil
+		}
+		if deploy.TTL > 0 {
+			expiresAt := cm.clock.Now().Add(deploy.TTL)
+			deploy.ExpiresAt = &expiresAt
+			placed := *command
+			if placed.Payload, err = json.Marshal(deploy); err != nil {
+				return nil, 0, err
+			}
+			command = &placed
+		}
+		excluded := cm.unschedulable()
+		requested, free := deploy.requested().scheduled(), cm.freeResources(command.ServiceID)
+		cm.loadMu.RLock()
+		defer cm.loadMu.RUnlock()
+		chosenId := cm.scheduler.Choose(cm.id, cm.loadLevelMap, excluded, cm.labels, requested, free)
+		if excluded[chosenId] || !scheduler.Fits(requested, free, chosenId) {
+			// The schedulers fall back on the leader, that may be cordoned
+			// or full.
+			return nil, 0, fmt.Errorf("%w: %s", ErrNoNodeAvailable, command.ServiceID)
+		}
+		return command, chosenId, nil
+	case CommandRemove, CommandMigrate, CommandExpire:
+		i := cm.lastServiceEntry(command.ServiceID)
+		if i < 0 || undeployed(cm.log[i].Command.Kind) {
+			return nil, 0, fmt.Errorf("%w: %s", ErrServiceNotFound, command.ServiceID)
+		}
+		if command.Kind == CommandRemove {
+			return command, cm.log[i].ChosenId, nil
+		}
+		if cm.log[i].Command.Kind == CommandSchedule {
+			return nil, 0, fmt.Errorf("%w: %s is scheduled, not placed yet", ErrServiceNotFound, command.ServiceID)
+		}
+		if command.Kind == CommandExpire {
+			p := cm.placements()[command.ServiceID]
+			if p.deploy.ExpiresAt == nil || cm.clock.Now().Before(*p.deploy.ExpiresAt) {
+				return nil, 0, fmt.Errorf("%w: %s hasn't expired", ErrInvalidService, command.ServiceID)
+			}
+			return command, cm.log[i].ChosenId, nil
+		}
+		migrate := payload.(MigratePayload)
+		migrate.From = cm.log[i].ChosenId
+		if migrate.To == AnyNode {
+			excluded := cm.unschedulable()
+			excluded[migrate.From] = true
+			requested := cm.placements()[command.ServiceID].deploy.requested().scheduled()
+			free := cm.freeResources(command.ServiceID)
+			cm.loadMu.RLock()
+			migrate.To = cm.scheduler.Choose(cm.id, cm.loadLevelMap, excluded, cm.labels, requested, free)
+			cm.loadMu.RUnlock()
+			if migrate.To == migrate.From || !scheduler.Fits(requested, free, migrate.To) {
+				return nil, 0, fmt.Errorf("%w: %s", ErrNoNodeAvailable, command.ServiceID)
+			}
+		}
+		encoded, err := json.Marshal(migrate)
+		if err != nil {
+			return nil, 0, err
+		}
+		completed := *command
+		completed.Payload = encoded
+		return &completed, migrate.To, nil
+	default:
+		return command, cm.id, nil
+	}
+}
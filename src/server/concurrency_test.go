@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentAppends appends entries to the leader from several
+// goroutines while it replicates them: the AEs must carry copies of the
+// entries, not the log being appended to. Run with -race.
+func TestConcurrentAppends(t *testing.T) {
+	c := newTestCluster(t, 3)
+	cm := c.elect(t, 1)
+
+	const writers, entries = 4, 10
+	var wg sync.WaitGroup
+	futures := make(chan *CommitFuture, writers*entries)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < entries; i++ {
+				command, err := NewCommand(CommandNoop, fmt.Sprintf("%d-%d", w, i), nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_, _, accepted, future := cm.appendCommand(command)
+				if !accepted {
+					t.Errorf("appending %s: %v", command.ServiceID, future.Wait())
+					return
+				}
+				futures <- future
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(futures)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	for future := range futures {
+		if err := future.WaitContext(ctx); err != nil {
+			t.Fatalf("entry %d: %v", future.Index, err)
+		}
+	}
+
+	cm.mu.Lock()
+	leaderLog := append([]LogEntry(nil), cm.log...)
+	cm.mu.Unlock()
+	appended := make(map[string]bool)
+	for _, entry := range leaderLog {
+		if appended[entry.Command.ServiceID] {
+			t.Errorf("%s appended twice", entry.Command.ServiceID)
+		}
+		appended[entry.Command.ServiceID] = true
+	}
+	if len(appended) != writers*entries {
+		t.Errorf("%d entries appended, want %d", len(appended), writers*entries)
+	}
+	for _, id := range []int{2, 3} {
+		follower := c.servers[id].cm
+		follower.mu.Lock()
+		for i, entry := range follower.log {
+			if i >= len(leaderLog) || entry.Term != leaderLog[i].Term || entry.Command.ServiceID != leaderLog[i].Command.ServiceID {
+				t.Errorf("entry %d of %d differs from the leader's", i, id)
+				break
+			}
+		}
+		follower.mu.Unlock()
+	}
+}
@@ -0,0 +1,605 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"server/discover"
+	"server/scheduler"
+	st "storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the tunable parameters of a Server and its CM.
+type Config struct {
+	// Ports of the Raft RPCs, of the gateway receiving services, of the admin
+	// HTTP API and of the REST API.
+	RPCPort     string
+	GatewayPort string
+	AdminPort   string
+	APIPort     string
+
+	// LogPath is the file where the committed log is persisted.
+	LogPath string
+
+	// LoadPollInterval is how often the load level of the node is measured.
+	LoadPollInterval time.Duration
+
+	// VoteDelay is the delay before granting a vote to a candidate with load
+	// level 1; candidates with load level n wait VoteDelay/n.
+	VoteDelay time.Duration
+
+	// TransferRetries is how many times a failed service transfer is retried,
+	// waiting TransferBackoff more before every retry.
+	TransferRetries int
+	TransferBackoff time.Duration
+
+	// ReplicationBatchWindow is how long the leader waits after a new entry
+	// before sending the AEs, so that the entries submitted meanwhile are
+	// replicated in the same round. Zero sends them right away.
+	ReplicationBatchWindow time.Duration
+
+	// RPCTimeoutMin and RPCTimeoutMax bound the timeout of the Raft RPCs to
+	// a peer, derived from the round-trip times measured to it.
+	RPCTimeoutMin time.Duration
+	RPCTimeoutMax time.Duration
+
+	// VoteRateLimit is how many RequestVote RPCs per second the node accepts
+	// from a candidate, and MaxTermJump how far ahead of its own the term of
+	// a candidate may be; the others are refused, with an AlertVoteFlood.
+	// Every Submit starts an election, so VoteRateLimit must exceed the
+	// rate of the submissions to a node. Zero disables the limit.
+	VoteRateLimit int
+	MaxTermJump   int
+
+	// SaturatedLoad is the load level from which a node is saturated. When
+	// every schedulable node is, the leader preempts a service of lower
+	// priority to deploy a new one, see DeployPayload. Zero never preempts.
+	SaturatedLoad int
+
+	// SnapshotChunkSize is the size in bytes of the chunks in which the
+	// snapshots are streamed to the joining and rejoining nodes, and
+	// SnapshotRate caps their speed in bytes per second, if positive.
+	SnapshotChunkSize int
+	SnapshotRate      int
+
+	// TransferBufferSize is the size in bytes of the buffers of the RPC
+	// connections, through which the service artifacts are transferred.
+	TransferBufferSize int
+
+	// AlertWebhook, if not empty, receives every alert raised by the CM.
+	// AlertStuckAfter is how long commitIndex may stay still with pending
+	// entries before an alert is raised.
+	AlertWebhook    string
+	AlertStuckAfter time.Duration
+
+	// Sizes of the load history of each node, of the event log and of the
+	// leadership history.
+	LoadHistorySize   int
+	EventLogSize      int
+	LeaderHistorySize int
+
+	// Profiling exposes pprof and the Go runtime stats on the admin API.
+	Profiling bool
+
+	// UnreliableRPC makes the RPC proxy drop and delay some messages.
+	UnreliableRPC bool
+
+	// UnsafeChaos lets the admin API inject faults in the node, see
+	// Faults. It's meant for staging clusters only.
+	UnsafeChaos bool
+
+	// LogCollector is the admin address of the node collecting the cluster
+	// logs; LogAggregatePath, if not empty, makes this node the collector.
+	LogCollector     string
+	LogAggregatePath string
+
+	// ReloadPath, if not empty, is a file of name=value lines applied with
+	// Server.SetConfig when the process receives SIGHUP.
+	ReloadPath string
+
+	// Bootstrap makes this node form a new cluster with the peers it finds.
+	// JoinAddr, if not empty, is the IP address of a node of the cluster to
+	// join instead.
+	Bootstrap bool
+	JoinAddr  string
+
+	// ClusterFile, if not empty, is the ClusterFile listing the nodes of the
+	// cluster; its parameters override the ones in this Config.
+	ClusterFile string
+
+	// SchedulerPolicy names the scheduler.Scheduler choosing the nodes that
+	// run new services, with its affinity and spread by label, see
+	// scheduler.New.
+	SchedulerPolicy string
+
+	// TLS certificate and key of the node, and certificate of the authority
+	// signing the certificates of the cluster. With a certificate, the RPCs
+	// are encrypted with TLS and the peers must present a certificate pinned
+	// by AllowedPeers or, if it pins none, signed by the authority and
+	// naming their node, see PeerName: one of the two is required. The
+	// certificate is reloaded by Server.ReloadCertificate.
+	TLSCert string
+	TLSKey  string
+	TLSCA   string
+
+	// SigningKeyPath, if not empty, is the file of the private key signing
+	// the RequestVote and AppendEntries RPCs of the node, created with its
+	// public key at SigningKeyPath.pub if it doesn't exist. PeerKeysDir is
+	// the directory of the public keys of the nodes, in <id>.pub: the RPCs
+	// of the peers are only accepted if signed by their key.
+	SigningKeyPath string
+	PeerKeysDir    string
+
+	// AuthTokensPath, if not empty, is the file of the tokens authenticating
+	// the requests to the admin and REST APIs, with the role and the quota
+	// of each, see LoadTokens. Every request is allowed if it's empty.
+	AuthTokensPath string
+
+	// ResourceQuotasPath, if not empty, is the file of the resource quotas
+	// of the namespaces and of the clients, see LoadResourceQuotas, enforced
+	// by the leader: it should be the same on every node. The resources
+	// aren't limited if it's empty.
+	ResourceQuotasPath string
+
+	// TrustedKeysDir, if not empty, is the directory of the public keys of
+	// the publishers trusted to sign the artifacts of the services, in
+	// <name>.pub: the artifacts not signed by one of them are refused, see
+	// WithTrustedKeys. Every artifact is accepted if it's empty.
+	TrustedKeysDir string
+
+	// AllowedPeers, if not empty, lists the nodes allowed to connect to this
+	// one, see ParsePeerAllowlist: by ID and, with TLSCert, by fingerprint
+	// of their certificate, bound to their ID. Every peer is allowed if it's
+	// empty; otherwise the clients using the RPC port must run on an allowed
+	// node.
+	AllowedPeers string
+
+	// EncryptionKeysDir, if not empty, is the directory of the keys
+	// encrypting the log at rest, in <id>.key, created with a first key if
+	// it doesn't exist: the log is written with the newest, see
+	// Server.RotateStorageKey. The log isn't encrypted if it's empty.
+	EncryptionKeysDir string
+
+	// DiscoveryDNS, if not empty, is the DNS name the leader resolves every
+	// DiscoveryInterval to learn the nodes of the cluster, see DNSResolver.
+	DiscoveryDNS      string
+	DiscoveryInterval time.Duration
+
+	// Standby makes the node join the cluster as a standby node, see
+	// Server.SetStandby.
+	Standby bool
+
+	// Labels are the labels of the node, as comma-separated key=value pairs
+	// parsed by ParseLabels, registered in the configuration of the cluster.
+	Labels string
+
+	// Capacity is the cpu and memory the node offers to the services, as
+	// settings parsed by ParseResources, such as "cpu=4 memory=8Gi",
+	// registered in the configuration of the cluster. The node isn't limited
+	// if empty.
+	Capacity string
+
+	// Discovery, if not empty, configures the cloud or registry provider the
+	// leader queries every DiscoveryInterval to learn the nodes of the
+	// cluster, see package discover.
+	Discovery string
+
+	// IdentityPath is the file, local to the node, where its NodeIdentity is
+	// stored.
+	IdentityPath string
+
+	// EvictAfter is how long a peer may be unreachable before the leader
+	// removes it from the cluster; NeverEvict disables the removal.
+	EvictAfter time.Duration
+	NeverEvict bool
+
+	// MDNS makes the node advertise itself with multicast DNS and the leader
+	// discover the nodes advertised on the LAN every DiscoveryInterval.
+	MDNS bool
+
+	// Profile is the profile whose defaults the configuration starts from:
+	// empty for DefaultConfig, or ProfileEdge for EdgeConfig. It's read from
+	// the PROFILE environment variable only, before the other parameters.
+	Profile string
+
+	// CompressLog keeps the records of the log compressed in memory, see
+	// storage.NewCompressedMapStorage.
+	CompressLog bool
+
+	// DisableMetrics stops recording the latencies and the transfers
+	// exposed by the admin API, see NewDisabledMetrics.
+	DisableMetrics bool
+
+	// MemoryLimit, if not zero, is the memory in bytes the node may use
+	// before degrading, see ConsensusModule.UnderMemoryPressure.
+	MemoryLimit int64
+}
+
+// ProfileEdge is the profile of the nodes running on constrained devices,
+// see EdgeConfig.
+const ProfileEdge = "edge"
+
+// DefaultConfig returns the default configuration.
+func DefaultConfig() Config {
+	return Config{
+		RPCPort:                "4000",
+		GatewayPort:            "9093",
+		AdminPort:              "9094",
+		APIPort:                "9095",
+		LogPath:                "/log/log.txt",
+		LoadPollInterval:       20 * time.Millisecond,
+		VoteDelay:              100 * time.Millisecond,
+		TransferRetries:        2,
+		TransferBackoff:        100 * time.Millisecond,
+		TransferBufferSize:     64 << 10,
+		ReplicationBatchWindow: 2 * time.Millisecond,
+		RPCTimeoutMin:          100 * time.Millisecond,
+		RPCTimeoutMax:          5 * time.Second,
+		VoteRateLimit:          200,
+		MaxTermJump:            1000,
+		SaturatedLoad:          10,
+		SnapshotChunkSize:      256 << 10,
+		AlertStuckAfter:        10 * time.Second,
+		LoadHistorySize:        360,
+		EventLogSize:           256,
+		LeaderHistorySize:      256,
+		DiscoveryInterval:      30 * time.Second,
+		EvictAfter:             5 * time.Minute,
+		IdentityPath:           "/var/lib/raft/identity.json",
+	}
+}
+
+// EdgeConfig returns the default configuration of the nodes running on
+// constrained devices, such as a Raspberry Pi: smaller buffers and
+// histories, the log compressed in memory, no metrics and a memory limit.
+func EdgeConfig() Config {
+	c := DefaultConfig()
+	c.Profile = ProfileEdge
+	c.TransferBufferSize = 16 << 10
+	c.SnapshotChunkSize = 64 << 10
+	c.LoadHistorySize = 60
+	c.EventLogSize = 64
+	c.LeaderHistorySize = 64
+	c.CompressLog = true
+	c.DisableMetrics = true
+	c.MemoryLimit = 256 << 20
+	return c
+}
+
+// LoadConfig returns the default configuration, the one of the profile in
+// PROFILE if set, overridden by the environment variables that are set.
+func LoadConfig() (Config, error) {
+	c := DefaultConfig()
+	if os.Getenv("PROFILE") == ProfileEdge {
+		c = EdgeConfig()
+	}
+	var errs []error
+	str := func(name string, dst *string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v, ok := os.LookupEnv(name); ok && v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			}
+			*dst = n
+		}
+	}
+	duration := func(name string, dst *time.Duration) {
+		if v, ok := os.LookupEnv(name); ok && v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			}
+			*dst = d
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v, ok := os.LookupEnv(name); ok && v != "" {
+			*dst = v == "1"
+		}
+	}
+
+	str("RPC_PORT", &c.RPCPort)
+	str("GATEWAY_PORT", &c.GatewayPort)
+	str("ADMIN_PORT", &c.AdminPort)
+	str("API_PORT", &c.APIPort)
+	str("LOG_PATH", &c.LogPath)
+	duration("LOAD_POLL_INTERVAL", &c.LoadPollInterval)
+	duration("VOTE_DELAY", &c.VoteDelay)
+	integer("TRANSFER_RETRIES", &c.TransferRetries)
+	integer("VOTE_RATE_LIMIT", &c.VoteRateLimit)
+	integer("MAX_TERM_JUMP", &c.MaxTermJump)
+	integer("SATURATED_LOAD", &c.SaturatedLoad)
+	duration("TRANSFER_BACKOFF", &c.TransferBackoff)
+	integer("TRANSFER_BUFFER_SIZE", &c.TransferBufferSize)
+	duration("REPLICATION_BATCH_WINDOW", &c.ReplicationBatchWindow)
+	duration("RPC_TIMEOUT_MIN", &c.RPCTimeoutMin)
+	duration("RPC_TIMEOUT_MAX", &c.RPCTimeoutMax)
+	integer("SNAPSHOT_CHUNK_SIZE", &c.SnapshotChunkSize)
+	integer("SNAPSHOT_RATE", &c.SnapshotRate)
+	str("ALERT_WEBHOOK", &c.AlertWebhook)
+	stuckSeconds := int(c.AlertStuckAfter / time.Second)
+	integer("ALERT_STUCK_SECONDS", &stuckSeconds)
+	c.AlertStuckAfter = time.Duration(stuckSeconds) * time.Second
+	integer("LOAD_HISTORY_SIZE", &c.LoadHistorySize)
+	integer("EVENT_LOG_SIZE", &c.EventLogSize)
+	integer("LEADER_HISTORY_SIZE", &c.LeaderHistorySize)
+	c.Profiling = os.Getenv("PPROF") == "1"
+	c.UnreliableRPC = len(os.Getenv("RAFT_UNRELIABLE_RPC")) > 0
+	c.UnsafeChaos = os.Getenv("UNSAFE_CHAOS") == "1"
+	str("LOG_COLLECTOR", &c.LogCollector)
+	str("LOG_AGGREGATE_PATH", &c.LogAggregatePath)
+	str("RELOAD_PATH", &c.ReloadPath)
+	c.Bootstrap = os.Getenv("BOOTSTRAP") == "1"
+	str("JOIN_ADDR", &c.JoinAddr)
+	str("CLUSTER_FILE", &c.ClusterFile)
+	str("SCHEDULER", &c.SchedulerPolicy)
+	str("TLS_CERT", &c.TLSCert)
+	str("TLS_KEY", &c.TLSKey)
+	str("TLS_CA", &c.TLSCA)
+	str("SIGNING_KEY_PATH", &c.SigningKeyPath)
+	str("PEER_KEYS_DIR", &c.PeerKeysDir)
+	str("AUTH_TOKENS_PATH", &c.AuthTokensPath)
+	str("RESOURCE_QUOTAS_PATH", &c.ResourceQuotasPath)
+	str("TRUSTED_KEYS_DIR", &c.TrustedKeysDir)
+	str("ENCRYPTION_KEYS_DIR", &c.EncryptionKeysDir)
+	str("ALLOWED_PEERS", &c.AllowedPeers)
+	str("DISCOVERY_DNS", &c.DiscoveryDNS)
+	str("DISCOVERY", &c.Discovery)
+	str("LABELS", &c.Labels)
+	str("CAPACITY", &c.Capacity)
+	c.Standby = os.Getenv("STANDBY") == "1"
+	duration("DISCOVERY_INTERVAL", &c.DiscoveryInterval)
+	c.MDNS = os.Getenv("MDNS") == "1"
+	str("IDENTITY_PATH", &c.IdentityPath)
+	duration("EVICT_AFTER", &c.EvictAfter)
+	c.NeverEvict = os.Getenv("NEVER_EVICT") == "1"
+	str("PROFILE", &c.Profile)
+	boolean("COMPRESS_LOG", &c.CompressLog)
+	boolean("DISABLE_METRICS", &c.DisableMetrics)
+	if v, ok := os.LookupEnv("MEMORY_LIMIT"); ok && v != "" {
+		n, err := ParseBytes(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MEMORY_LIMIT: %v", err))
+		}
+		c.MemoryLimit = n
+	}
+
+	if len(errs) > 0 {
+		return c, joinErrors(errs)
+	}
+	return c, nil
+}
+
+// RegisterFlags defines a command-line flag for every parameter of c, using
+// the current values as defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.RPCPort, "rpc-port", c.RPCPort, "Port of the Raft RPCs")
+	fs.StringVar(&c.GatewayPort, "gateway-port", c.GatewayPort, "Port receiving the services")
+	fs.StringVar(&c.AdminPort, "admin-port", c.AdminPort, "Port of the admin HTTP API")
+	fs.StringVar(&c.APIPort, "api-port", c.APIPort, "Port of the REST API")
+	fs.StringVar(&c.LogPath, "log-path", c.LogPath, "File where the committed log is persisted")
+	fs.DurationVar(&c.LoadPollInterval, "load-poll-interval", c.LoadPollInterval, "How often the load level is measured")
+	fs.DurationVar(&c.VoteDelay, "vote-delay", c.VoteDelay, "Vote delay for candidates with load level 1")
+	fs.IntVar(&c.TransferRetries, "transfer-retries", c.TransferRetries, "Retries of a failed service transfer")
+	fs.IntVar(&c.VoteRateLimit, "vote-rate-limit", c.VoteRateLimit, "RequestVote RPCs per second accepted from a candidate, 0 for any")
+	fs.IntVar(&c.MaxTermJump, "max-term-jump", c.MaxTermJump, "How far ahead the term of a candidate may be, 0 for any")
+	fs.IntVar(&c.SaturatedLoad, "saturated-load", c.SaturatedLoad, "Load level from which a node is saturated, 0 to never preempt services")
+	fs.DurationVar(&c.TransferBackoff, "transfer-backoff", c.TransferBackoff, "Backoff between service transfer retries")
+	fs.IntVar(&c.TransferBufferSize, "transfer-buffer-size", c.TransferBufferSize, "Buffer size in bytes of the RPC connections")
+	fs.DurationVar(&c.ReplicationBatchWindow, "replication-batch-window", c.ReplicationBatchWindow, "How long new entries are batched before being replicated")
+	fs.DurationVar(&c.RPCTimeoutMin, "rpc-timeout-min", c.RPCTimeoutMin, "Lower bound of the adaptive timeout of the Raft RPCs")
+	fs.DurationVar(&c.RPCTimeoutMax, "rpc-timeout-max", c.RPCTimeoutMax, "Upper bound of the adaptive timeout of the Raft RPCs")
+	fs.IntVar(&c.SnapshotChunkSize, "snapshot-chunk-size", c.SnapshotChunkSize, "Size in bytes of the chunks of the streamed snapshots")
+	fs.IntVar(&c.SnapshotRate, "snapshot-rate", c.SnapshotRate, "Maximum speed in bytes per second of the streamed snapshots, 0 for none")
+	fs.StringVar(&c.AlertWebhook, "alert-webhook", c.AlertWebhook, "URL receiving the alerts")
+	fs.DurationVar(&c.AlertStuckAfter, "alert-stuck-after", c.AlertStuckAfter, "How long commitIndex may be stuck before an alert")
+	fs.IntVar(&c.LoadHistorySize, "load-history-size", c.LoadHistorySize, "Load samples retained for each node")
+	fs.IntVar(&c.EventLogSize, "event-log-size", c.EventLogSize, "Events retained by the event log")
+	fs.IntVar(&c.LeaderHistorySize, "leader-history-size", c.LeaderHistorySize, "Leadership changes retained by the leadership history")
+	fs.BoolVar(&c.Profiling, "pprof", c.Profiling, "Expose pprof on the admin API")
+	fs.BoolVar(&c.UnreliableRPC, "unreliable-rpc", c.UnreliableRPC, "Drop and delay some RPCs")
+	fs.BoolVar(&c.UnsafeChaos, "unsafe-chaos", c.UnsafeChaos, "Let the admin API inject faults in the node")
+	fs.StringVar(&c.LogCollector, "log-collector", c.LogCollector, "Admin address of the log collector")
+	fs.StringVar(&c.LogAggregatePath, "log-aggregate-path", c.LogAggregatePath, "File where this node merges the cluster logs")
+	fs.StringVar(&c.ReloadPath, "reload-path", c.ReloadPath, "File of settings applied on SIGHUP")
+	fs.BoolVar(&c.Bootstrap, "bootstrap", c.Bootstrap, "Form a new cluster with the peers found")
+	fs.StringVar(&c.JoinAddr, "join", c.JoinAddr, "IP address of a node of the cluster to join")
+	fs.StringVar(&c.ClusterFile, "cluster-file", c.ClusterFile, "YAML or JSON file describing the cluster")
+	fs.StringVar(&c.SchedulerPolicy, "scheduler", c.SchedulerPolicy, "Scheduler policy (load or random)")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate of the node")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS key of the node")
+	fs.StringVar(&c.TLSCA, "tls-ca", c.TLSCA, "Certificate of the cluster CA")
+	fs.StringVar(&c.SigningKeyPath, "signing-key", c.SigningKeyPath, "Private key signing the RPCs of the node, created if missing")
+	fs.StringVar(&c.PeerKeysDir, "peer-keys", c.PeerKeysDir, "Directory of the public keys of the nodes, in <id>.pub")
+	fs.StringVar(&c.AuthTokensPath, "auth-tokens", c.AuthTokensPath, "File of the tokens and roles allowed to use the APIs")
+	fs.StringVar(&c.ResourceQuotasPath, "resource-quotas", c.ResourceQuotasPath, "File of the resource quotas of the namespaces and clients")
+	fs.StringVar(&c.TrustedKeysDir, "trusted-keys", c.TrustedKeysDir, "Directory of the public keys of the trusted publishers of services, in <name>.pub")
+	fs.StringVar(&c.AllowedPeers, "allowed-peers", c.AllowedPeers, "Comma-separated IDs of the nodes, and <ID>=<fingerprint> of their TLS certificates, allowed to connect")
+	fs.StringVar(&c.EncryptionKeysDir, "encryption-keys", c.EncryptionKeysDir, "Directory of the keys encrypting the log, in <id>.key")
+	fs.StringVar(&c.DiscoveryDNS, "discovery-dns", c.DiscoveryDNS, "DNS name resolved to discover the nodes")
+	fs.BoolVar(&c.Standby, "standby", c.Standby, "Join the cluster as a standby node")
+	fs.StringVar(&c.Labels, "labels", c.Labels, "Labels of the node, such as \"zone=eu-1,class=gpu\"")
+	fs.StringVar(&c.Capacity, "capacity", c.Capacity, "Resources the node offers to the services, such as \"cpu=4 memory=8Gi\"")
+	fs.StringVar(&c.Discovery, "discovery", c.Discovery, "Provider queried to discover the nodes, such as \"provider=consul service=raft\"")
+	fs.DurationVar(&c.DiscoveryInterval, "discovery-interval", c.DiscoveryInterval, "How often the nodes are discovered")
+	fs.BoolVar(&c.MDNS, "mdns", c.MDNS, "Discover the nodes on the LAN with multicast DNS")
+	fs.StringVar(&c.IdentityPath, "identity-path", c.IdentityPath, "File where the identity of the node is stored")
+	fs.DurationVar(&c.EvictAfter, "evict-after", c.EvictAfter, "How long a peer may be unreachable before it's removed")
+	fs.BoolVar(&c.NeverEvict, "never-evict", c.NeverEvict, "Never remove unreachable peers")
+	fs.BoolVar(&c.CompressLog, "compress-log", c.CompressLog, "Keep the log compressed in memory")
+	fs.BoolVar(&c.DisableMetrics, "disable-metrics", c.DisableMetrics, "Don't record the latency and transfer metrics")
+	fs.Func("memory-limit", "Memory the node may use before degrading, such as 256Mi, 0 for none", func(v string) (err error) {
+		c.MemoryLimit, err = ParseBytes(v)
+		return err
+	})
+}
+
+// Validate checks that every parameter of c has a usable value.
+func (c Config) Validate() error {
+	var errs []error
+	ports := make(map[string]string)
+	for name, port := range map[string]string{"RPCPort": c.RPCPort, "GatewayPort": c.GatewayPort, "AdminPort": c.AdminPort, "APIPort": c.APIPort} {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			errs = append(errs, fmt.Errorf("%s: invalid port %q", name, port))
+		} else if other, ok := ports[port]; ok {
+			errs = append(errs, fmt.Errorf("%s: port %s already used by %s", name, port, other))
+		} else {
+			ports[port] = name
+		}
+	}
+	if c.LogPath == "" {
+		errs = append(errs, errors.New("LogPath: must not be empty"))
+	}
+	if c.IdentityPath == "" {
+		errs = append(errs, errors.New("IdentityPath: must not be empty"))
+	}
+	for name, d := range map[string]time.Duration{
+		"LoadPollInterval":  c.LoadPollInterval,
+		"VoteDelay":         c.VoteDelay,
+		"TransferBackoff":   c.TransferBackoff,
+		"AlertStuckAfter":   c.AlertStuckAfter,
+		"DiscoveryInterval": c.DiscoveryInterval,
+		"EvictAfter":        c.EvictAfter,
+		"RPCTimeoutMin":     c.RPCTimeoutMin,
+		"RPCTimeoutMax":     c.RPCTimeoutMax,
+	} {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s: must be positive, got %v", name, d))
+		}
+	}
+	if c.TransferRetries < 0 {
+		errs = append(errs, fmt.Errorf("TransferRetries: must not be negative, got %d", c.TransferRetries))
+	}
+	if c.VoteRateLimit < 0 {
+		errs = append(errs, fmt.Errorf("VoteRateLimit: must not be negative, got %d", c.VoteRateLimit))
+	}
+	if c.MaxTermJump < 0 {
+		errs = append(errs, fmt.Errorf("MaxTermJump: must not be negative, got %d", c.MaxTermJump))
+	}
+	if c.SaturatedLoad < 0 {
+		errs = append(errs, fmt.Errorf("SaturatedLoad: must not be negative, got %d", c.SaturatedLoad))
+	}
+	if c.Profile != "" && c.Profile != ProfileEdge {
+		errs = append(errs, fmt.Errorf("Profile: unknown profile %q, expected %q or none", c.Profile, ProfileEdge))
+	}
+	if c.MemoryLimit < 0 {
+		errs = append(errs, fmt.Errorf("MemoryLimit: must not be negative, got %d", c.MemoryLimit))
+	}
+	if c.RPCTimeoutMin > c.RPCTimeoutMax {
+		errs = append(errs, fmt.Errorf("RPCTimeoutMin: must not exceed RPCTimeoutMax %v, got %v", c.RPCTimeoutMax, c.RPCTimeoutMin))
+	}
+	if c.ReplicationBatchWindow < 0 {
+		errs = append(errs, fmt.Errorf("ReplicationBatchWindow: must not be negative, got %v", c.ReplicationBatchWindow))
+	}
+	if c.SnapshotChunkSize <= 0 {
+		errs = append(errs, fmt.Errorf("SnapshotChunkSize: must be positive, got %d", c.SnapshotChunkSize))
+	}
+	if c.SnapshotRate < 0 {
+		errs = append(errs, fmt.Errorf("SnapshotRate: must not be negative, got %d", c.SnapshotRate))
+	}
+	if c.TransferBufferSize <= 0 {
+		errs = append(errs, fmt.Errorf("TransferBufferSize: must be positive, got %d", c.TransferBufferSize))
+	}
+	if c.LoadHistorySize <= 0 {
+		errs = append(errs, fmt.Errorf("LoadHistorySize: must be positive, got %d", c.LoadHistorySize))
+	}
+	if c.EventLogSize <= 0 {
+		errs = append(errs, fmt.Errorf("EventLogSize: must be positive, got %d", c.EventLogSize))
+	}
+	if c.LeaderHistorySize <= 0 {
+		errs = append(errs, fmt.Errorf("LeaderHistorySize: must be positive, got %d", c.LeaderHistorySize))
+	}
+	if c.Bootstrap && c.JoinAddr != "" {
+		errs = append(errs, errors.New("Bootstrap: can't both bootstrap and join a cluster"))
+	}
+	if _, err := scheduler.New(c.SchedulerPolicy, nil); err != nil {
+		errs = append(errs, fmt.Errorf("SchedulerPolicy: %v", err))
+	}
+	if _, err := ParseLabels(c.Labels); err != nil {
+		errs = append(errs, fmt.Errorf("Labels: %v", err))
+	}
+	if _, err := ParseResources(strings.Fields(c.Capacity)); err != nil {
+		errs = append(errs, fmt.Errorf("Capacity: %v", err))
+	}
+	if c.Discovery != "" {
+		if _, err := discover.New(c.Discovery); err != nil {
+			errs = append(errs, fmt.Errorf("Discovery: %v", err))
+		}
+	}
+	for name, path := range map[string]string{"TLSCert": c.TLSCert, "TLSKey": c.TLSKey, "TLSCA": c.TLSCA} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("TLSCert: certificate and key must be set together"))
+	}
+	if (c.SigningKeyPath == "") != (c.PeerKeysDir == "") {
+		errs = append(errs, errors.New("SigningKeyPath: signing key and peer keys must be set together"))
+	} else if c.PeerKeysDir != "" {
+		if info, err := os.Stat(c.PeerKeysDir); err != nil {
+			errs = append(errs, fmt.Errorf("PeerKeysDir: %v", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("PeerKeysDir: %s isn't a directory", c.PeerKeysDir))
+		}
+	}
+	if c.AuthTokensPath != "" {
+		if _, err := LoadTokens(c.AuthTokensPath); err != nil {
+			errs = append(errs, fmt.Errorf("AuthTokensPath: %v", err))
+		}
+	}
+	if c.ResourceQuotasPath != "" {
+		if _, err := LoadResourceQuotas(c.ResourceQuotasPath); err != nil {
+			errs = append(errs, fmt.Errorf("ResourceQuotasPath: %v", err))
+		}
+	}
+	if c.TrustedKeysDir != "" {
+		if keys, err := st.LoadNamedKeys(c.TrustedKeysDir); err != nil {
+			errs = append(errs, fmt.Errorf("TrustedKeysDir: %v", err))
+		} else if len(keys) == 0 {
+			errs = append(errs, fmt.Errorf("TrustedKeysDir: no public key in %s", c.TrustedKeysDir))
+		}
+	}
+	if allowlist, err := ParsePeerAllowlist(c.AllowedPeers); err != nil {
+		errs = append(errs, fmt.Errorf("AllowedPeers: %v", err))
+	} else if len(allowlist.Fingerprints) > 0 && c.TLSCert == "" {
+		errs = append(errs, errors.New("AllowedPeers: fingerprints need a TLS certificate"))
+	} else if c.TLSCert != "" && c.TLSCA == "" && len(allowlist.Fingerprints) == 0 {
+		errs = append(errs, fmt.Errorf("TLSCA: %v, set TLSCA or pin fingerprints in AllowedPeers", ErrUntrustedPeers))
+	}
+	if c.EncryptionKeysDir != "" {
+		if info, err := os.Stat(c.EncryptionKeysDir); err == nil && !info.IsDir() {
+			errs = append(errs, fmt.Errorf("EncryptionKeysDir: %s isn't a directory", c.EncryptionKeysDir))
+		}
+	}
+	if c.JoinAddr != "" && net.ParseIP(c.JoinAddr) == nil {
+		errs = append(errs, fmt.Errorf("JoinAddr: invalid IP address %q", c.JoinAddr))
+	}
+	return joinErrors(errs)
+}
+
+// joinErrors returns an error whose message lists all errs, or nil if errs is
+// empty.
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// crashReportsSize is the number of crash reports retained by each node.
+const crashReportsSize = 32
+
+// Health states of a node.
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+)
+
+// CrashReport describes a panic recovered in a goroutine of the node.
+type CrashReport struct {
+	Task      string
+	Panic     string
+	Stack     string
+	Timestamp string
+}
+
+// crashRecorder keeps the latest crash reports and the health of the node.
+type crashRecorder struct {
+	mu      sync.Mutex
+	health  string
+	reports []CrashReport
+}
+
+// recoverPanic must be deferred: it turns a panic of task into a crash report,
+// marking the node as degraded. If errp is not nil, the panic is also returned
+// as an error through it.
+func (cm *ConsensusModule) recoverPanic(task string, errp *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	report := CrashReport{
+		Task:      task,
+		Panic:     fmt.Sprint(r),
+		Stack:     string(debug.Stack()),
+		Timestamp: time.Now().Local().Format("2006-01-02 15:04:05.0000"),
+	}
+	cm.logger.Printf("[%d] recovered panic in %s: %s\n%s", cm.id, task, report.Panic, report.Stack)
+
+	cm.crashes.mu.Lock()
+	cm.crashes.health = HealthDegraded
+	cm.crashes.reports = append(cm.crashes.reports, report)
+	if len(cm.crashes.reports) > crashReportsSize {
+		cm.crashes.reports = cm.crashes.reports[1:]
+	}
+	cm.crashes.mu.Unlock()
+	cm.events.Add(Event{
+		Timestamp: report.Timestamp,
+		Kind:      EventCrash,
+		Message:   task + ": " + report.Panic,
+	})
+
+	if errp != nil {
+		*errp = fmt.Errorf("%s panicked: %v", task, r)
+	}
+}
+
+// Health returns the health of this node: HealthDegraded once a panic has
+// been recovered, HealthOK otherwise.
+func (cm *ConsensusModule) Health() string {
+	cm.crashes.mu.Lock()
+	defer cm.crashes.mu.Unlock()
+	return cm.crashes.health
+}
+
+// CrashReports returns the latest crash reports, oldest first.
+func (cm *ConsensusModule) CrashReports() []CrashReport {
+	cm.crashes.mu.Lock()
+	defer cm.crashes.mu.Unlock()
+	return append([]CrashReport{}, cm.crashes.reports...)
+}
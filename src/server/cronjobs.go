@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"server/cron"
+)
+
+// cronCatchUp is how many of the runs of a recurring deployment missed by
+// the leader, such as the ones due during a change of leader, are run late;
+// the older ones are skipped.
+const cronCatchUp = 3
+
+// CronJob is a recurring deployment, see Server.RegisterCron. LastRun is the
+// time of its latest run committed, zero if none.
+type CronJob struct {
+	Name     string
+	Schedule string
+	Manifest string
+	Created  time.Time
+	LastRun  time.Time
+}
+
+// validateCron checks the schedule and the manifest of a recurring
+// deployment, unless it's deleted.
+func validateCron(p CronPayload) error {
+	if p.Name == "" {
+		return fmt.Errorf("%w: recurring deployment without name", ErrInvalidService)
+	}
+	if p.Delete {
+		return nil
+	}
+	if _, err := cron.Parse(p.Schedule); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidService, err)
+	}
+	_, _, err := ParseService(p.Manifest)
+	return err
+}
+
+// cronRunId returns the ID of the service deployed by run, the same on every
+// node, so that a run is never deployed twice.
+func cronRunId(run CronRun) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(run.Job+"\n"+run.At.UTC().Format(time.RFC3339Nano))))
+}
+
+// applyCron registers or unregisters the recurring deployment of p.
+func (cm *ConsensusModule) applyCron(p CronPayload) {
+	cm.cronMu.Lock()
+	defer cm.cronMu.Unlock()
+	if p.Delete {
+		delete(cm.cronJobs, p.Name)
+		return
+	}
+	cm.cronJobs[p.Name] = &CronJob{Name: p.Name, Schedule: p.Schedule, Manifest: p.Manifest, Created: p.Created}
+}
+
+// recordCronRun records that run was committed.
+func (cm *ConsensusModule) recordCronRun(run CronRun) {
+	cm.cronMu.Lock()
+	defer cm.cronMu.Unlock()
+	if job := cm.cronJobs[run.Job]; job != nil && run.At.After(job.LastRun) {
+		job.LastRun = run.At
+	}
+}
+
+// restoreCronJobs rebuilds the recurring deployments and their latest runs
+// from records, the ones of a snapshot.
+func (cm *ConsensusModule) restoreCronJobs(records []map[string]interface{}) error {
+	cm.cronMu.Lock()
+	cm.cronJobs = make(map[string]*CronJob)
+	cm.cronMu.Unlock()
+	for _, record := range records {
+		data, err := json.Marshal(record["Command"])
+		if err != nil {
+			return err
+		}
+		var command Service
+		if err := json.Unmarshal(data, &command); err != nil {
+			return err
+		}
+		if command.Kind != CommandCron && command.Kind != CommandDeploy {
+			continue
+		}
+		payload, err := DecodeCommand(&command)
+		if err != nil {
+			return err
+		}
+		switch p := payload.(type) {
+		case CronPayload:
+			cm.applyCron(p)
+		case DeployPayload:
+			if p.Cron != nil {
+				cm.recordCronRun(*p.Cron)
+			}
+		}
+	}
+	return nil
+}
+
+// CronJobs returns the recurring deployments registered, by name.
+func (cm *ConsensusModule) CronJobs() []CronJob {
+	cm.cronMu.Lock()
+	defer cm.cronMu.Unlock()
+	jobs := make([]CronJob, 0, len(cm.cronJobs))
+	for _, job := range cm.cronJobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	return jobs
+}
+
+// dueRuns returns the times job was due to run after its latest run, or its
+// creation, until now, keeping the latest cronCatchUp, and how many were
+// skipped.
+func dueRuns(job CronJob, schedule cron.Schedule, now time.Time) (runs []time.Time, skipped int) {
+	last := job.Created
+	if job.LastRun.After(last) {
+		last = job.LastRun
+	}
+	for t := schedule.Next(last); !t.IsZero() && !t.After(now); t = schedule.Next(t) {
+		runs = append(runs, t)
+		if len(runs) > cronCatchUp {
+			runs = runs[1:]
+			skipped++
+		}
+	}
+	return runs, skipped
+}
+
+// runCronJobs runs on the leader: it submits the deployment of the runs of
+// the recurring deployments as they come due. The runs are committed in the
+// log with the service they deploy, so a new leader runs the ones its
+// predecessor missed, late, see cronCatchUp. Returns when ctx is done.
+func (cm *ConsensusModule) runCronJobs(ctx context.Context) {
+	for {
+		select {
+		case <-cm.clock.After(scheduleCheckInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		now := cm.clock.Now()
+		for _, job := range cm.CronJobs() {
+			schedule, err := cron.Parse(job.Schedule)
+			if err != nil {
+				cm.Dlog("recurring deployment %s: %v", job.Name, err)
+				continue
+			}
+			runs, skipped := dueRuns(job, schedule, now)
+			for _, at := range runs {
+				run := CronRun{Job: job.Name, At: at}
+				cm.mu.RLock()
+				deployed := cm.lastServiceEntry(cronRunId(run)) >= 0
+				cm.mu.RUnlock()
+				if deployed {
+					continue
+				}
+				if skipped > 0 {
+					cm.recordEventUnlocked(EventWarning, "%d missed runs of %s skipped", skipped, job.Name)
+					skipped = 0
+				}
+				if now.Sub(at) > 2*scheduleCheckInterval {
+					cm.recordEventUnlocked(EventWarning, "run of %s due at %v deployed late", job.Name, at)
+				}
+				if err := cm.deployCronRun(job, run); err != nil {
+					cm.logger.Printf("[%d] run of %s due at %v: %v", cm.id, job.Name, at, err)
+					break
+				}
+			}
+		}
+	}
+}
+
+// deployCronRun stores the artifact of run, a run of job, and appends its
+// deployment to the log.
+func (cm *ConsensusModule) deployCronRun(job CronJob, run CronRun) error {
+	service, artifact, err := ParseService(job.Manifest)
+	if err != nil {
+		return err
+	}
+	id := cronRunId(run)
+	if err := cm.verifyArtifact(id, artifact, service.Signature); err != nil {
+		return err
+	}
+	if err := cm.artifacts.Save(id, artifact); err != nil {
+		return err
+	}
+	payload, err := DecodeCommand(service)
+	if err != nil {
+		return err
+	}
+	deploy := payload.(DeployPayload)
+	deploy.NotBefore, deploy.Cron = nil, &run
+	command := &Service{ServiceID: id, Type: service.Type, Signature: service.Signature}
+	if command.Payload, err = json.Marshal(deploy); err != nil {
+		return err
+	}
+	_, _, accepted, future := cm.appendCommand(command)
+	if !accepted {
+		return future.Wait()
+	}
+	return nil
+}
+
+// RegisterCron registers the recurring deployment name of the service
+// described by manifest, as accepted by ParseService, at the times of
+// schedule, see cron.Parse, replacing the one with the same name. It waits
+// until the registration is committed.
+func (s *Server) RegisterCron(ctx context.Context, name string, schedule string, manifest string) error {
+	p := CronPayload{Name: name, Schedule: schedule, Manifest: manifest, Created: s.cm.clock.Now()}
+	if err := validateCron(p); err != nil {
+		return err
+	}
+	service, artifact, _ := ParseService(manifest)
+	if err := s.cm.verifyArtifact(name, artifact, service.Signature); err != nil {
+		return err
+	}
+	return s.submitCron(ctx, p)
+}
+
+// UnregisterCron unregisters the recurring deployment name, and waits until
+// it's committed. The services it deployed keep running.
+func (s *Server) UnregisterCron(ctx context.Context, name string) error {
+	return s.submitCron(ctx, CronPayload{Name: name, Delete: true, Created: s.cm.clock.Now()})
+}
+
+func (s *Server) submitCron(ctx context.Context, p CronPayload) error {
+	command, err := NewCommand(CommandCron, "", p)
+	if err != nil {
+		return err
+	}
+	_, _, _, future := s.Submit(ctx, command)
+	return future.WaitContext(ctx)
+}
@@ -0,0 +1,79 @@
+package server
+
+// dumpLogTail is the number of trailing log entries included in a StateDump.
+const dumpLogTail = 10
+
+// StateDump is a point-in-time copy of the whole state of a CM, meant to be
+// attached to bug reports.
+type StateDump struct {
+	Id          int
+	State       string
+	Health      string
+	CurrentTerm int
+	VotedFor    int
+	LeaderId    int
+	PeerIds     []int
+	LoadLevel   int
+
+	LogLength   int
+	LogTail     []LogEntry
+	CommitIndex int
+	LastApplied int
+
+	NextIndex    map[int]int
+	MatchIndex   map[int]int
+	LoadLevelMap map[int]int
+
+	// ChanDepths is the number of pending elements of each internal channel.
+	ChanDepths map[string]int
+}
+
+// DumpState returns a snapshot of the state of this CM, taken under cm.mu.
+func (cm *ConsensusModule) DumpState() StateDump {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	cm.loadMu.RLock()
+	defer cm.loadMu.RUnlock()
+
+	tailStart := len(cm.log) - dumpLogTail
+	if tailStart < 0 {
+		tailStart = 0
+	}
+	dump := StateDump{
+		Id:           cm.id,
+		State:        cm.state.String(),
+		Health:       cm.Health(),
+		CurrentTerm:  cm.currentTerm,
+		VotedFor:     cm.votedFor,
+		LeaderId:     cm.leaderId,
+		PeerIds:      append([]int{}, cm.peerIds...),
+		LoadLevel:    cm.loadLevel,
+		LogLength:    len(cm.log),
+		LogTail:      append([]LogEntry{}, cm.log[tailStart:]...),
+		CommitIndex:  cm.commitIndex,
+		LastApplied:  cm.lastApplied,
+		NextIndex:    copyIntMap(cm.nextIndex),
+		MatchIndex:   copyIntMap(cm.matchIndex),
+		LoadLevelMap: copyIntMap(cm.loadLevelMap),
+		ChanDepths: map[string]int{
+			"ElectionChan":       len(cm.ElectionChan),
+			"VotingChan":         len(cm.VotingChan),
+			"CPUChan":            len(cm.CPUChan),
+			"chosenChan":         len(cm.chosenChan),
+			"triggerAEChan":      len(cm.triggerAEChan),
+			"stopSendingAEsChan": len(cm.stopSendingAEsChan),
+			"newCommitReadyChan": len(cm.newCommitReadyChan),
+			"applyQueue":         len(cm.applyQueue),
+			"LeaderChangeChan":   len(cm.LeaderChangeChan),
+		},
+	}
+	return dump
+}
+
+func copyIntMap(m map[int]int) map[int]int {
+	c := make(map[int]int, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,53 @@
+package server
+
+// duplicateDeploy returns the placement of the service of command if command
+// deploys it again: the service still runs with the same Version, as when a
+// client retries a submission across a change of leader. The placement is
+// the one of the log of the leader, so it's committed or will be, even if a
+// new leader doesn't know yet. The deployment of a service that was removed,
+// preempted or expired, or of another version, isn't a duplicate.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) duplicateDeploy(command *Service) (placement, bool) {
+	if command.Kind != CommandDeploy {
+		return placement{}, false
+	}
+	i := cm.lastServiceEntry(command.ServiceID)
+	if i < 0 {
+		return placement{}, false
+	}
+	if kind := cm.log[i].Command.Kind; kind != CommandDeploy && kind != CommandMigrate {
+		return placement{}, false
+	}
+	p, ok := cm.placements()[command.ServiceID]
+	if !ok || p.deploy.Version != deployOptions(command).Version {
+		return placement{}, false
+	}
+	cm.Dlog("%s version %q already placed on %d at %d", command.ServiceID, p.deploy.Version, p.node, p.index)
+	return p, true
+}
+
+// placementFuture returns the future of the entry that placed p, resolved if
+// it's committed already. An entry of a previous term is only committed with
+// an entry of the current one, so a no-op is appended if the log has none;
+// it's written to disk like the other entries, for the leader to count
+// itself for its commit.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) placementFuture(p placement) *CommitFuture {
+	if future := cm.futures[p.index]; future != nil {
+		return future
+	}
+	future := newCommitFuture(p.index, cm.log[p.index].Term)
+	if p.index <= cm.commitIndex {
+		future.resolve(nil)
+		return future
+	}
+	cm.futures[p.index] = future
+	if cm.log[len(cm.log)-1].Term != cm.currentTerm {
+		noop := cm.NewLog(&Service{Kind: CommandNoop}, cm.id)
+		cm.log = append(cm.log, noop)
+		cm.terms.add(noop.Term, len(cm.log)-1)
+		cm.metrics.Submitted(noop.Index)
+		cm.notify(cm.persistChan)
+	}
+	return future
+}
@@ -0,0 +1,71 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Consul finds the healthy instances of a service registered in Consul.
+type Consul struct {
+	// Address is the address of the Consul agent, 127.0.0.1:8500 by default.
+	Address string
+	Service string
+	// Tag, if not empty, only keeps the instances with this tag.
+	Tag   string
+	Token string
+}
+
+func newConsul(args map[string]string) (Discovery, error) {
+	values, err := require(args, "service")
+	if err != nil {
+		return nil, err
+	}
+	c := Consul{Address: args["address"], Service: values[0], Tag: args["tag"], Token: args["token"]}
+	if c.Address == "" {
+		c.Address = "127.0.0.1:8500"
+	}
+	return c, nil
+}
+
+func (c Consul) Resolve(ctx context.Context) ([]net.IP, error) {
+	query := url.Values{"passing": {"1"}}
+	if c.Tag != "" {
+		query.Set("tag", c.Tag)
+	}
+	u := url.URL{Scheme: "http", Host: c.Address, Path: "/v1/health/service/" + c.Service, RawQuery: query.Encode()}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	resp, err := send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var entries []struct {
+		Node    struct{ Address string }
+		Service struct{ Address string }
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, entry := range entries {
+		// The address of the service defaults to the one of its node.
+		addr := entry.Service.Address
+		if addr == "" {
+			addr = entry.Node.Address
+		}
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
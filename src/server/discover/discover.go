@@ -0,0 +1,96 @@
+// Package discover finds the nodes of a cluster through the API of the cloud
+// or service registry they run in, so that a cluster in an autoscaling group
+// forms and grows by itself.
+//
+// A provider is configured by a string of space-separated key=value pairs,
+// the provider key choosing it:
+//
+//	provider=aws region=eu-west-1 tag_key=cluster tag_value=raft
+//	provider=gce project=my-project zone=europe-west1-b group=raft
+//	provider=consul service=raft address=127.0.0.1:8500
+package discover
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Discovery looks up the IP addresses of the nodes of a cluster.
+type Discovery interface {
+	Resolve(ctx context.Context) ([]net.IP, error)
+}
+
+// Providers maps the name of every provider to the function creating it from
+// its configuration.
+var Providers = map[string]func(args map[string]string) (Discovery, error){
+	"aws":    newEC2,
+	"gce":    newGCE,
+	"consul": newConsul,
+}
+
+// client is the HTTP client of the providers.
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// New returns the provider configured by spec.
+func New(spec string) (Discovery, error) {
+	args, err := parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	provider, ok := Providers[args["provider"]]
+	if !ok {
+		return nil, fmt.Errorf("unknown discovery provider %q, expected one of %s", args["provider"], names())
+	}
+	return provider(args)
+}
+
+// parse returns the key=value pairs of spec.
+func parse(spec string) (map[string]string, error) {
+	args := make(map[string]string)
+	for _, field := range strings.Fields(spec) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid discovery argument %q, expected key=value", field)
+		}
+		args[key] = value
+	}
+	return args, nil
+}
+
+// require returns the values of keys in args, failing if any is missing.
+func require(args map[string]string, keys ...string) ([]string, error) {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		if values[i] = args[key]; values[i] == "" {
+			return nil, fmt.Errorf("%s discovery: missing %s", args["provider"], key)
+		}
+	}
+	return values, nil
+}
+
+func names() string {
+	var names []string
+	for name := range Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// send sends req and returns its response if successful.
+func send(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Host, resp.Status)
+	}
+	return resp, nil
+}
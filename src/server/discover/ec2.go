@@ -0,0 +1,210 @@
+package discover
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metadataURL is the address of the EC2 instance metadata service.
+const metadataURL = "http://169.254.169.254/latest"
+
+// EC2 finds the running EC2 instances with a tag, such as the ones of an
+// autoscaling group. The credentials are taken from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables or else
+// from the role of the instance, and Region defaults to the one of the
+// instance.
+type EC2 struct {
+	Region   string
+	TagKey   string
+	TagValue string
+}
+
+func newEC2(args map[string]string) (Discovery, error) {
+	values, err := require(args, "tag_key", "tag_value")
+	if err != nil {
+		return nil, err
+	}
+	return EC2{Region: args["region"], TagKey: values[0], TagValue: values[1]}, nil
+}
+
+type awsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+}
+
+func (e EC2) Resolve(ctx context.Context) ([]net.IP, error) {
+	creds, err := e.credentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("aws credentials: %w", err)
+	}
+	region := e.Region
+	if region == "" {
+		if region, err = metadata(ctx, "/meta-data/placement/region"); err != nil {
+			return nil, fmt.Errorf("aws region: %w", err)
+		}
+	}
+
+	var ips []net.IP
+	query := url.Values{
+		"Action":           {"DescribeInstances"},
+		"Version":          {"2016-11-15"},
+		"Filter.1.Name":    {"tag:" + e.TagKey},
+		"Filter.1.Value.1": {e.TagValue},
+		"Filter.2.Name":    {"instance-state-name"},
+		"Filter.2.Value.1": {"running"},
+	}
+	for {
+		req, err := http.NewRequest(http.MethodGet, "https://ec2."+region+".amazonaws.com/?"+canonicalQuery(query), nil)
+		if err != nil {
+			return nil, err
+		}
+		signV4(req, creds, region, "ec2", time.Now().UTC())
+		resp, err := send(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Reservations []struct {
+				Instances []struct {
+					PrivateIP string `xml:"privateIpAddress"`
+				} `xml:"instancesSet>item"`
+			} `xml:"reservationSet>item"`
+			NextToken string `xml:"nextToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range result.Reservations {
+			for _, instance := range reservation.Instances {
+				if ip := net.ParseIP(instance.PrivateIP); ip != nil {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		if result.NextToken == "" {
+			return ips, nil
+		}
+		query.Set("NextToken", result.NextToken)
+	}
+}
+
+// credentials returns the credentials in the environment, or else the ones of
+// the role of the instance.
+func (e EC2) credentials(ctx context.Context) (awsCredentials, error) {
+	creds := awsCredentials{
+		AccessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Token:           os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyId != "" && creds.SecretAccessKey != "" {
+		return creds, nil
+	}
+	role, err := metadata(ctx, "/meta-data/iam/security-credentials/")
+	if err != nil {
+		return creds, err
+	}
+	data, err := metadata(ctx, "/meta-data/iam/security-credentials/"+strings.TrimSpace(strings.Split(role, "\n")[0]))
+	if err != nil {
+		return creds, err
+	}
+	err = json.Unmarshal([]byte(data), &creds)
+	return creds, err
+}
+
+// metadata returns the instance metadata at path, using a session token as
+// required by IMDSv2.
+func metadata(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequest(http.MethodPut, metadataURL+"/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := send(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	token, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+
+	if req, err = http.NewRequest(http.MethodGet, metadataURL+path, nil); err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	if resp, err = send(ctx, req); err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return string(data), err
+}
+
+// canonicalQuery encodes query as required by Signature Version 4: sorted by
+// key, with spaces escaped as %20.
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// signV4 signs req, a request without body, with AWS Signature Version 4.
+func signV4(req *http.Request, creds awsCredentials, region string, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host, "x-amz-date": amzDate}
+	if creds.Token != "" {
+		headers["x-amz-security-token"] = creds.Token
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	emptyHash := sha256.Sum256(nil)
+	canonicalRequest := strings.Join([]string{
+		req.Method, "/", req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(emptyHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyId, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,145 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	gceMetadataURL = "http://metadata.google.internal/computeMetadata/v1"
+	computeURL     = "https://compute.googleapis.com/compute/v1"
+)
+
+// GCE finds the running instances of a Google Compute Engine instance group,
+// such as a managed instance group with autoscaling. The requests are
+// authorized with the service account of the instance, and Project and Zone
+// default to the ones of the instance.
+type GCE struct {
+	Project string
+	Zone    string
+	Group   string
+}
+
+func newGCE(args map[string]string) (Discovery, error) {
+	values, err := require(args, "group")
+	if err != nil {
+		return nil, err
+	}
+	return GCE{Project: args["project"], Zone: args["zone"], Group: values[0]}, nil
+}
+
+func (g GCE) Resolve(ctx context.Context) ([]net.IP, error) {
+	project, zone := g.Project, g.Zone
+	var err error
+	if project == "" {
+		if project, err = gceMetadata(ctx, "/project/project-id"); err != nil {
+			return nil, err
+		}
+	}
+	if zone == "" {
+		// The zone is returned as projects/<number>/zones/<zone>.
+		if zone, err = gceMetadata(ctx, "/instance/zone"); err != nil {
+			return nil, err
+		}
+		zone = path.Base(zone)
+	}
+	data, err := gceMetadata(ctx, "/instance/service-accounts/default/token")
+	if err != nil {
+		return nil, err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal([]byte(data), &token); err != nil {
+		return nil, err
+	}
+
+	groupURL := computeURL + "/projects/" + url.PathEscape(project) + "/zones/" + url.PathEscape(zone) +
+		"/instanceGroups/" + url.PathEscape(g.Group) + "/listInstances"
+	var instances []string
+	pageToken := ""
+	for {
+		var page struct {
+			Items []struct {
+				Instance string `json:"instance"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		u := groupURL
+		if pageToken != "" {
+			u += "?pageToken=" + url.QueryEscape(pageToken)
+		}
+		if err := g.call(ctx, http.MethodPost, u, token.AccessToken, `{"instanceState":"RUNNING"}`, &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			instances = append(instances, item.Instance)
+		}
+		if pageToken = page.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+
+	var ips []net.IP
+	for _, instance := range instances {
+		var details struct {
+			NetworkInterfaces []struct {
+				NetworkIP string `json:"networkIP"`
+			} `json:"networkInterfaces"`
+		}
+		if err := g.call(ctx, http.MethodGet, instance, token.AccessToken, "", &details); err != nil {
+			return nil, err
+		}
+		if len(details.NetworkInterfaces) > 0 {
+			if ip := net.ParseIP(details.NetworkInterfaces[0].NetworkIP); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// call sends a request with body, if not empty, to the Compute Engine API and
+// decodes the response into v.
+func (g GCE) call(ctx context.Context, method string, u string, token string, body string, v interface{}) error {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := send(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// gceMetadata returns the metadata of the instance at path.
+func gceMetadata(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, gceMetadataURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := send(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return string(data), err
+}
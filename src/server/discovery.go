@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// Resolver looks up the IP addresses of the nodes of a cluster.
+type Resolver interface {
+	Resolve(ctx context.Context) ([]net.IP, error)
+}
+
+// DNSResolver resolves the nodes of a cluster from DNS. A Name starting with
+// an underscore, such as _raft._tcp.example.com, is looked up as an SRV
+// record whose targets are resolved in turn; any other name, such as the one
+// of a headless Kubernetes service, is looked up as A and AAAA records.
+type DNSResolver struct {
+	Name string
+
+	// Resolver is the resolver used, or net.DefaultResolver if nil.
+	Resolver *net.Resolver
+}
+
+func (r DNSResolver) Resolve(ctx context.Context) ([]net.IP, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	hosts := []string{r.Name}
+	if strings.HasPrefix(r.Name, "_") {
+		_, srvs, err := resolver.LookupSRV(ctx, "", "", r.Name)
+		if err != nil {
+			return nil, err
+		}
+		hosts = hosts[:0]
+		for _, srv := range srvs {
+			hosts = append(hosts, srv.Target)
+		}
+	}
+
+	var ips []net.IP
+	for _, host := range hosts {
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	return ips, nil
+}
+
+// StartDiscovery makes the leader resolve the nodes of the cluster with
+// resolver every interval, submitting a configuration change that adds the
+// nodes that appeared and removes the ones that disappeared since the
+// previous lookup. idOf returns the ID of the node at an IP address. Failed
+// or empty lookups are ignored, so that a DNS outage doesn't empty the
+// cluster.
+func (s *Server) StartDiscovery(resolver Resolver, idOf func(ip net.IP) int, interval time.Duration) {
+	s.cm.RunOnLeader("discovery", func(ctx context.Context) {
+		discovered := make(map[int]string)
+		for {
+			ips, err := resolver.Resolve(ctx)
+			if err != nil {
+				s.cm.Dlog("discovery failed: %v", err)
+			} else if len(ips) > 0 {
+				discovered = s.applyDiscovered(ctx, discovered, ips, idOf)
+			}
+			select {
+			case <-s.cm.clock.After(interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// applyDiscovered submits the configuration change from the nodes discovered
+// before to the ones at ips, and returns the nodes now discovered.
+func (s *Server) applyDiscovered(ctx context.Context, before map[int]string, ips []net.IP, idOf func(ip net.IP) int) map[int]string {
+	now := make(map[int]string)
+	for _, ip := range ips {
+		if id := idOf(ip); id != s.serverId {
+			now[id] = ip.String()
+		}
+	}
+
+	change := ConfigChangePayload{Add: make(map[int]string)}
+	for id, ip := range now {
+		if s.PeerAddr(id) == nil {
+			change.Add[id] = ip
+		}
+	}
+	for id := range before {
+		if _, ok := now[id]; !ok && s.PeerAddr(id) != nil {
+			change.Remove = append(change.Remove, id)
+		}
+	}
+	if len(change.Add) == 0 && len(change.Remove) == 0 {
+		return now
+	}
+	if err := s.submitConfigChange(ctx, change); err != nil {
+		s.cm.Dlog("discovery: configuration change %+v failed: %v", change, err)
+		// Tried again at the next lookup.
+		return before
+	}
+	return now
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"server/transfer"
+	st "storage"
+)
+
+var (
+	// ErrNotLeader is returned when a command is submitted to a CM that isn't
+	// the leader.
+	ErrNotLeader = errors.New("not the leader")
+
+	// ErrLeadershipLost is the error of a CommitFuture whose entry can't be
+	// committed by the leader that accepted it.
+	ErrLeadershipLost = errors.New("leadership lost before the entry was committed")
+
+	// ErrStorageCorrupt is returned when the persisted state can't be decoded.
+	ErrStorageCorrupt = st.ErrStorageCorrupt
+
+	// ErrChainBroken is returned when the persisted records were modified
+	// after being written, see ConsensusModule.VerifyChain.
+	ErrChainBroken = st.ErrChainBroken
+
+	// ErrChainUnsupported is returned when verifying the records of a storage
+	// that can't be read back.
+	ErrChainUnsupported = errors.New("storage doesn't support verifying its records")
+
+	// ErrTransferFailed is returned when a service can't be transferred to the
+	// node chosen to run it.
+	ErrTransferFailed = errors.New("service transfer failed")
+
+	// ErrStopped is returned when waiting on a CM that has been stopped.
+	ErrStopped = errors.New("consensus module stopped")
+
+	// ErrInvalidService is returned when a service description can't be parsed.
+	ErrInvalidService = errors.New("invalid service")
+
+	// ErrNoNodeAvailable is returned when no node but the one running a
+	// service can run it, or no node can run a new one.
+	ErrNoNodeAvailable = errors.New("no other node available")
+
+	// ErrStaleTerm is returned when a side effect is requested by a leader
+	// whose term is older than the fencing token seen by the node.
+	ErrStaleTerm = errors.New("operation from a stale term")
+
+	// ErrSnapshotNotFound is returned when reading a snapshot that was never
+	// opened or was dropped.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+
+	// ErrAlreadyBootstrapped is returned when a node that already formed or
+	// joined a cluster is bootstrapped or joined again.
+	ErrAlreadyBootstrapped = errors.New("node already part of a cluster")
+
+	// ErrInjectedFault is returned when an RPC fails because of a fault
+	// injected with SetFaults.
+	ErrInjectedFault = errors.New("injected network fault")
+
+	// ErrBadSignature is returned when an RPC isn't signed by the key of the
+	// node it claims to come from, see WithSigningKeys.
+	ErrBadSignature = errors.New("bad signature")
+
+	// ErrReplayed is returned when a signed RPC was already received, or a
+	// signed reply doesn't answer the RPC sent, see WithSigningKeys.
+	ErrReplayed = errors.New("replayed message")
+
+	// ErrInvalidServiceID is returned for a service ID that isn't the hex
+	// SHA-256 digest given by ParseService, since it would name a file out
+	// of the directory of the services.
+	ErrInvalidServiceID = transfer.ErrInvalidID
+
+	// ErrUnverifiedArtifact is returned when the artifact of a service isn't
+	// signed by a trusted publisher, see WithTrustedKeys.
+	ErrUnverifiedArtifact = errors.New("artifact not signed by a trusted publisher")
+
+	// ErrNotEncrypted is returned when rotating the storage key of a node
+	// whose storage isn't encrypted, see Config.EncryptionKeysDir.
+	ErrNotEncrypted = errors.New("storage not encrypted")
+
+	// ErrNoCertificate is returned when reloading the TLS certificate of a
+	// node without one, see Config.TLSCert.
+	ErrNoCertificate = errors.New("no TLS certificate")
+
+	// ErrPeerNotAllowed is returned when a peer connects to a node that
+	// doesn't allow it, see Config.AllowedPeers.
+	ErrPeerNotAllowed = errors.New("peer not allowed")
+
+	// ErrUntrustedPeers is returned when a node has a TLS certificate but
+	// neither the cluster CA nor pinned certificates to check the ones of
+	// its peers, see Config.TLSCA and Config.AllowedPeers.
+	ErrUntrustedPeers = errors.New("no CA nor pinned certificates to verify the peers")
+
+	// ErrQuotaExceeded is returned when a client submits more than its
+	// quota allows, see Quota.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// ErrVoteThrottled is returned when a RequestVote RPC is refused to
+	// protect the node from a flood of them, see Config.VoteRateLimit and
+	// MaxTermJump.
+	ErrVoteThrottled = errors.New("RequestVote throttled")
+
+	// ErrMemoryPressure is returned when an artifact is refused by a node
+	// using more memory than Config.MemoryLimit allows.
+	ErrMemoryPressure = errors.New("node under memory pressure")
+)
+
+// NotLeaderError is returned when a command can't be forwarded to the leader.
+// LeaderId is -1 and LeaderAddr empty if the leader is unknown. It matches
+// ErrNotLeader with errors.Is.
+type NotLeaderError struct {
+	LeaderId   int
+	LeaderAddr string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.LeaderId < 0 {
+		return "not the leader, leader unknown"
+	}
+	return fmt.Sprintf("not the leader, leader is %d at %s", e.LeaderId, e.LeaderAddr)
+}
+
+func (e *NotLeaderError) Unwrap() error {
+	return ErrNotLeader
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Kinds of events recorded in the EventLog.
+const (
+	EventStateChange  = "state_change"
+	EventPersistError = "persist_error"
+	EventConflict     = "conflict"
+	EventTransfer     = "transfer"
+	EventAlert        = "alert"
+	EventCrash        = "crash"
+	EventUndeploy     = "undeploy"
+	EventWarning      = "warning"
+	EventChaos        = "chaos"
+	EventRotation     = "rotation"
+	EventSecurity     = "security"
+	EventPreemption   = "preemption"
+)
+
+// Event is a significant occurrence in the life of a node.
+type Event struct {
+	Timestamp string
+	Kind      string
+	Term      int
+	Message   string
+}
+
+// EventLog is a fixed-size ring buffer of events, safe for concurrent use.
+type EventLog struct {
+	mu     sync.Mutex
+	events []Event
+	next   int
+	full   bool
+}
+
+func NewEventLog(size int) *EventLog {
+	return &EventLog{
+		events: make([]Event, size),
+	}
+}
+
+// Add stores event, overwriting the oldest one if the buffer is full.
+func (el *EventLog) Add(event Event) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	el.events[el.next] = event
+	el.next = (el.next + 1) % len(el.events)
+	if el.next == 0 {
+		el.full = true
+	}
+}
+
+// Events returns the retained events, oldest first.
+func (el *EventLog) Events() []Event {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	if !el.full {
+		return append([]Event{}, el.events[:el.next]...)
+	}
+	return append(append([]Event{}, el.events[el.next:]...), el.events[:el.next]...)
+}
+
+// recordEvent adds an event to the event log of this CM.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) recordEvent(kind string, format string, args ...interface{}) {
+	cm.events.Add(Event{
+		Timestamp: cm.clock.Now().Local().Format("2006-01-02 15:04:05.0000"),
+		Kind:      kind,
+		Term:      cm.currentTerm,
+		Message:   fmt.Sprintf(format, args...),
+	})
+}
+
+// recordEventUnlocked is recordEvent for the callers not holding cm.mu.
+func (cm *ConsensusModule) recordEventUnlocked(kind string, format string, args ...interface{}) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.recordEvent(kind, format, args...)
+}
+
+// Events returns the significant events recorded by this CM, oldest first.
+func (cm *ConsensusModule) Events() []Event {
+	return cm.events.Events()
+}
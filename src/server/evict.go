@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// evictionCheckInterval is how often the leader looks for peers to evict.
+const evictionCheckInterval = 5 * time.Second
+
+// evictDeadPeers runs on the leader: it submits the removal of every peer
+// down and unreachable for longer than config.EvictAfter, so that the quorum no longer
+// counts it, unless config.NeverEvict is set. Returns when ctx is done.
+func (cm *ConsensusModule) evictDeadPeers(ctx context.Context) {
+	for {
+		select {
+		case <-cm.clock.After(evictionCheckInterval):
+		case <-ctx.Done():
+			return
+		}
+		config := cm.Config()
+		if config.NeverEvict {
+			continue
+		}
+
+		var dead []int
+		cm.mu.RLock()
+		peerIds := append([]int{}, cm.peerIds...)
+		cm.mu.RUnlock()
+		cm.peersMu.Lock()
+		for _, peerId := range peerIds {
+			if cm.isDown(peerId) && cm.clock.Since(cm.unreachableSince[peerId]) > config.EvictAfter {
+				dead = append(dead, peerId)
+			}
+		}
+		cm.peersMu.Unlock()
+
+		for _, peerId := range dead {
+			command, err := NewCommand(CommandConfigChange, "", ConfigChangePayload{Remove: []int{peerId}})
+			if err != nil {
+				return
+			}
+			_, _, _, future := cm.appendCommand(command)
+			if err := future.WaitContext(ctx); err != nil {
+				cm.Dlog("eviction of %d failed: %v", peerId, err)
+				break
+			}
+			cm.recordEventUnlocked(EventStateChange, "node %d evicted, unreachable for more than %v", peerId, config.EvictAfter)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Package executor runs the services deployed on a node.
+package executor
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"server/transfer"
+)
+
+// Executor starts and stops services by ID.
+type Executor interface {
+	Run(ctx context.Context, service string) error
+	Stop(ctx context.Context, service string) error
+}
+
+// Compose runs services with docker-compose, using the artifact of every
+// service as its compose file. The services are sandboxed by an override of
+// their compose file, next to it, unless they opt out, see Sandbox.
+type Compose struct {
+	Dir string
+}
+
+// Run starts the service in the background.
+func (c Compose) Run(ctx context.Context, service string) error {
+	file, err := transfer.Path(c.Dir, service)
+	if err != nil {
+		return err
+	}
+	sandbox, err := sandbox(file, file+".sandbox")
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "docker-compose", "-f", file, "-f", file+".sandbox", "up", "-d")
+	cmd.Env = environ(sandbox)
+	return cmd.Run()
+}
+
+// Stop stops the service and removes its containers.
+func (c Compose) Stop(ctx context.Context, service string) error {
+	file, err := transfer.Path(c.Dir, service)
+	if err != nil {
+		return err
+	}
+	args := []string{"-f", file}
+	if _, err := os.Stat(file + ".sandbox"); err == nil {
+		args = append(args, "-f", file+".sandbox")
+	}
+	if err := exec.CommandContext(ctx, "docker-compose", append(args, "down")...).Run(); err != nil {
+		return err
+	}
+	os.Remove(file + ".sandbox")
+	return nil
+}
@@ -0,0 +1,172 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrSandboxEscape is returned for a compose file giving its services access
+// to the node, which the override can't take away, without opting out of
+// the sandbox with x-sandbox.root.
+var ErrSandboxEscape = errors.New("service escapes the sandbox without x-sandbox.root")
+
+// nobody is the unprivileged user the services run as, unless their compose
+// file sets another user that isn't root.
+const nobody = "65534:65534"
+
+// Sandbox lists the opt-outs of a service from the restrictions every service
+// runs with: as an unprivileged user without capabilities, with a read-only
+// root filesystem, a private /tmp and none of the environment of the node.
+// Unless it opts out with Root, its compose file can't make it privileged,
+// add capabilities, lift its confinement, share the namespaces of the node,
+// or mount its devices and its directories.
+// They're declared by the compose file of the service, signed with it by its
+// publisher, under the x-sandbox extension, which docker-compose ignores:
+//
+//	x-sandbox:
+//	  root: true
+//	  writable-root: true
+//	  inherit-env: true
+type Sandbox struct {
+	// Root runs the containers as the user of their compose file or image,
+	// even root, with the capabilities docker gives them.
+	Root bool `yaml:"root"`
+
+	// WritableRoot makes the root filesystem of the containers writable.
+	WritableRoot bool `yaml:"writable-root"`
+
+	// InheritEnv runs docker-compose with the environment of the node, which
+	// the compose file can then interpolate.
+	InheritEnv bool `yaml:"inherit-env"`
+}
+
+// composeFile is the part of a compose file the sandbox looks at.
+type composeFile struct {
+	Sandbox  Sandbox                   `yaml:"x-sandbox"`
+	Services map[string]composeService `yaml:"services"`
+}
+
+// composeService is the part of a service of a compose file the sandbox
+// looks at.
+type composeService struct {
+	User        string        `yaml:"user"`
+	Privileged  bool          `yaml:"privileged"`
+	CapAdd      []string      `yaml:"cap_add"`
+	SecurityOpt []string      `yaml:"security_opt"`
+	Pid         string        `yaml:"pid"`
+	Ipc         string        `yaml:"ipc"`
+	NetworkMode string        `yaml:"network_mode"`
+	UsernsMode  string        `yaml:"userns_mode"`
+	Devices     []string      `yaml:"devices"`
+	Volumes     []interface{} `yaml:"volumes"`
+}
+
+// escapes returns how service reaches out of the sandbox, if it does.
+func (service composeService) escapes() []string {
+	var escapes []string
+	if service.Privileged {
+		escapes = append(escapes, "privileged")
+	}
+	if len(service.CapAdd) > 0 {
+		escapes = append(escapes, "cap_add")
+	}
+	for _, opt := range service.SecurityOpt {
+		opt = strings.ReplaceAll(opt, "=", ":")
+		if strings.HasSuffix(opt, ":unconfined") || opt == "label:disable" || opt == "no-new-privileges:false" {
+			escapes = append(escapes, "security_opt "+opt)
+		}
+	}
+	for key, mode := range map[string]string{"pid": service.Pid, "ipc": service.Ipc, "network_mode": service.NetworkMode, "userns_mode": service.UsernsMode} {
+		if mode == "host" {
+			escapes = append(escapes, key+": host")
+		}
+	}
+	if len(service.Devices) > 0 {
+		escapes = append(escapes, "devices")
+	}
+	for _, volume := range service.Volumes {
+		if source, ok := bindMount(volume); ok {
+			escapes = append(escapes, "bind mount of "+source)
+		}
+	}
+	return escapes
+}
+
+// bindMount returns the directory of the node mounted by volume, as written
+// in the volumes of a service, if it's a bind mount rather than a volume.
+func bindMount(volume interface{}) (string, bool) {
+	switch v := volume.(type) {
+	case string:
+		source, _, found := strings.Cut(v, ":")
+		return source, found && (strings.HasPrefix(source, "/") || strings.HasPrefix(source, ".") || strings.HasPrefix(source, "~"))
+	case map[string]interface{}:
+		source, _ := v["source"].(string)
+		return source, v["type"] == "bind"
+	}
+	return "", false
+}
+
+// sandbox writes the override of the compose file at file that sandboxes its
+// services to override, and returns the opt-outs of the service.
+func sandbox(file string, override string) (Sandbox, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return Sandbox{}, err
+	}
+	var compose composeFile
+	if err := yaml.Unmarshal(data, &compose); err != nil {
+		return Sandbox{}, fmt.Errorf("invalid compose file: %v", err)
+	}
+	services := make(map[string]map[string]interface{})
+	for name, service := range compose.Services {
+		if escapes := service.escapes(); !compose.Sandbox.Root && len(escapes) > 0 {
+			sort.Strings(escapes)
+			return Sandbox{}, fmt.Errorf("%w: service %s: %s", ErrSandboxEscape, name, strings.Join(escapes, ", "))
+		}
+		s := map[string]interface{}{"tmpfs": []string{"/tmp"}}
+		if !compose.Sandbox.Root {
+			s["user"] = nobody
+			if service.User != "" && !isRoot(service.User) {
+				s["user"] = service.User
+			}
+			s["cap_drop"] = []string{"ALL"}
+			s["security_opt"] = []string{"no-new-privileges:true"}
+		}
+		if !compose.Sandbox.WritableRoot {
+			s["read_only"] = true
+		}
+		services[name] = s
+	}
+	data, err = yaml.Marshal(map[string]interface{}{"services": services})
+	if err != nil {
+		return Sandbox{}, err
+	}
+	return compose.Sandbox, os.WriteFile(override, data, 0600)
+}
+
+// isRoot reports whether user, as written in a compose file, is root.
+func isRoot(user string) bool {
+	name, _, _ := strings.Cut(user, ":")
+	return name == "root" || name == "0"
+}
+
+// environ returns the environment docker-compose runs with: only what it
+// needs to reach docker, unless the service inherits the one of the node.
+func environ(s Sandbox) []string {
+	if s.InheritEnv {
+		return os.Environ()
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if name == "PATH" || name == "HOME" || strings.HasPrefix(name, "DOCKER_") || strings.HasPrefix(name, "COMPOSE_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
@@ -0,0 +1,222 @@
+package executor
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sandboxed is the override of a service that doesn't opt out of anything.
+func sandboxed(user string) map[string]interface{} {
+	return map[string]interface{}{
+		"tmpfs":        []interface{}{"/tmp"},
+		"user":         user,
+		"cap_drop":     []interface{}{"ALL"},
+		"security_opt": []interface{}{"no-new-privileges:true"},
+		"read_only":    true,
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	tests := []struct {
+		name     string
+		compose  string
+		sandbox  Sandbox
+		override map[string]interface{}
+		err      error
+	}{
+		{
+			name:     "default",
+			compose:  "services:\n  web:\n    image: nginx\n",
+			override: sandboxed(nobody),
+		},
+		{
+			name:     "user",
+			compose:  "services:\n  web:\n    image: nginx\n    user: \"1000:1000\"\n",
+			override: sandboxed("1000:1000"),
+		},
+		{
+			name:     "root user",
+			compose:  "services:\n  web:\n    image: nginx\n    user: root\n",
+			override: sandboxed(nobody),
+		},
+		{
+			name:     "root uid",
+			compose:  "services:\n  web:\n    image: nginx\n    user: \"0:0\"\n",
+			override: sandboxed(nobody),
+		},
+		{
+			name:     "root opt-out",
+			compose:  "x-sandbox:\n  root: true\nservices:\n  web:\n    image: nginx\n    user: root\n",
+			sandbox:  Sandbox{Root: true},
+			override: map[string]interface{}{"tmpfs": []interface{}{"/tmp"}, "read_only": true},
+		},
+		{
+			name:    "writable root opt-out",
+			compose: "x-sandbox:\n  writable-root: true\nservices:\n  web:\n    image: nginx\n",
+			sandbox: Sandbox{WritableRoot: true},
+			override: map[string]interface{}{
+				"tmpfs":        []interface{}{"/tmp"},
+				"user":         nobody,
+				"cap_drop":     []interface{}{"ALL"},
+				"security_opt": []interface{}{"no-new-privileges:true"},
+			},
+		},
+		{
+			name:     "inherit env opt-out",
+			compose:  "x-sandbox:\n  inherit-env: true\nservices:\n  web:\n    image: nginx\n",
+			sandbox:  Sandbox{InheritEnv: true},
+			override: sandboxed(nobody),
+		},
+		{
+			name:    "privileged",
+			compose: "services:\n  web:\n    image: nginx\n    privileged: true\n",
+			err:     ErrSandboxEscape,
+		},
+		{
+			name:    "cap_add",
+			compose: "services:\n  web:\n    image: nginx\n    cap_add: [SYS_ADMIN]\n",
+			err:     ErrSandboxEscape,
+		},
+		{
+			name:    "unconfined",
+			compose: "services:\n  web:\n    image: nginx\n    security_opt: [\"seccomp=unconfined\"]\n",
+			err:     ErrSandboxEscape,
+		},
+		{
+			name:    "host pid",
+			compose: "services:\n  web:\n    image: nginx\n    pid: host\n",
+			err:     ErrSandboxEscape,
+		},
+		{
+			name:    "host network",
+			compose: "services:\n  web:\n    image: nginx\n    network_mode: host\n",
+			err:     ErrSandboxEscape,
+		},
+		{
+			name:    "devices",
+			compose: "services:\n  web:\n    image: nginx\n    devices: [\"/dev/sda:/dev/sda\"]\n",
+			err:     ErrSandboxEscape,
+		},
+		{
+			name:    "bind mount",
+			compose: "services:\n  web:\n    image: nginx\n    volumes: [\"/etc:/host/etc\"]\n",
+			err:     ErrSandboxEscape,
+		},
+		{
+			name:    "long bind mount",
+			compose: "services:\n  web:\n    image: nginx\n    volumes:\n      - type: bind\n        source: /\n        target: /host\n",
+			err:     ErrSandboxEscape,
+		},
+		{
+			name:     "named volume",
+			compose:  "services:\n  web:\n    image: nginx\n    volumes: [\"data:/data\"]\nvolumes:\n  data:\n",
+			override: sandboxed(nobody),
+		},
+		{
+			name:     "privileged root opt-out",
+			compose:  "x-sandbox:\n  root: true\nservices:\n  web:\n    image: nginx\n    privileged: true\n    volumes: [\"/etc:/host/etc\"]\n",
+			sandbox:  Sandbox{Root: true},
+			override: map[string]interface{}{"tmpfs": []interface{}{"/tmp"}, "read_only": true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file, override := filepath.Join(dir, "service"), filepath.Join(dir, "service.sandbox")
+			if err := os.WriteFile(file, []byte(test.compose), 0600); err != nil {
+				t.Fatal(err)
+			}
+			sandbox, err := sandbox(file, override)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got %v, want %v", err, test.err)
+				}
+				if _, err := os.Stat(override); !os.IsNotExist(err) {
+					t.Errorf("override written for a refused compose file")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sandbox != test.sandbox {
+				t.Errorf("got opt-outs %+v, want %+v", sandbox, test.sandbox)
+			}
+			data, err := os.ReadFile(override)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got struct {
+				Services map[string]map[string]interface{} `yaml:"services"`
+			}
+			if err := yaml.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]map[string]interface{}{"web": test.override}
+			if !reflect.DeepEqual(got.Services, want) {
+				t.Errorf("got override %v, want %v", got.Services, want)
+			}
+		})
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	t.Setenv("PATH", "/usr/bin")
+	t.Setenv("HOME", "/home/raft")
+	t.Setenv("DOCKER_HOST", "unix:///var/run/docker.sock")
+	t.Setenv("COMPOSE_PROJECT_NAME", "raft")
+	t.Setenv("SECRET_TOKEN", "hunter2")
+
+	tests := []struct {
+		name    string
+		sandbox Sandbox
+		want    []string
+		without []string
+	}{
+		{
+			name:    "default",
+			want:    []string{"COMPOSE_PROJECT_NAME=raft", "DOCKER_HOST=unix:///var/run/docker.sock", "HOME=/home/raft", "PATH=/usr/bin"},
+			without: []string{"SECRET_TOKEN=hunter2"},
+		},
+		{
+			name:    "inherit env opt-out",
+			sandbox: Sandbox{InheritEnv: true},
+			want:    []string{"PATH=/usr/bin", "SECRET_TOKEN=hunter2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := environ(test.sandbox)
+			has := make(map[string]bool, len(env))
+			for _, kv := range env {
+				has[kv] = true
+			}
+			for _, kv := range test.want {
+				if !has[kv] {
+					t.Errorf("%s missing from %v", kv, env)
+				}
+			}
+			for _, kv := range test.without {
+				if has[kv] {
+					t.Errorf("%s inherited", kv)
+				}
+			}
+			if test.sandbox.InheritEnv {
+				return
+			}
+			// Only the variables reaching docker are kept.
+			for _, kv := range env {
+				name, _, _ := strings.Cut(kv, "=")
+				if name != "PATH" && name != "HOME" && !strings.HasPrefix(name, "DOCKER_") && !strings.HasPrefix(name, "COMPOSE_") {
+					t.Errorf("%s inherited", kv)
+				}
+			}
+		})
+	}
+}
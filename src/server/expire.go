@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// expiryRetry is how long a node waits before proposing again the expiry of a
+// service whose entry wasn't committed.
+const expiryRetry = 10 * time.Second
+
+// expireServices runs on every node: it proposes, through the leader, the
+// undeployment of the services placed on the node whose TTL elapsed. The
+// leader stops them once the CommandExpire entry is committed. Returns when
+// the CM is stopped.
+func (cm *ConsensusModule) expireServices() {
+	proposed := make(map[string]time.Time)
+	for {
+		select {
+		case <-cm.clock.After(scheduleCheckInterval):
+		case <-cm.ctx.Done():
+			return
+		}
+
+		now := cm.clock.Now()
+		var expired []string
+		cm.mu.RLock()
+		for serviceId, p := range cm.placements() {
+			if p.node != cm.id || p.deploy.ExpiresAt == nil || p.deploy.ExpiresAt.After(now) {
+				continue
+			}
+			if at, ok := proposed[serviceId]; ok && now.Sub(at) < expiryRetry {
+				continue
+			}
+			expired = append(expired, serviceId)
+		}
+		cm.mu.RUnlock()
+
+		for id := range proposed {
+			if now.Sub(proposed[id]) >= expiryRetry {
+				delete(proposed, id)
+			}
+		}
+		for _, serviceId := range expired {
+			proposed[serviceId] = now
+			command, err := NewCommand(CommandExpire, serviceId, nil)
+			if err != nil {
+				cm.Dlog("expiry of %s failed: %v", serviceId, err)
+				continue
+			}
+			_, _, accepted, future := cm.appendCommand(command)
+			if !accepted && errors.Is(future.Wait(), ErrNotLeader) {
+				_, _, accepted, future = cm.forwardCommand(cm.ctx, command)
+			}
+			if !accepted {
+				cm.Dlog("expiry of %s failed: %v", serviceId, future.Wait())
+			}
+		}
+	}
+}
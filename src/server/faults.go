@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	st "storage"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Faults are the network faults injected in the RPCs a node sends to its
+// peers, to exercise the cluster on an unreliable network, and the faults of
+// the node itself. The zero value injects none.
+type Faults struct {
+	// Drop and Duplicate are the probabilities that an RPC is dropped, failing
+	// with ErrInjectedFault, or delivered twice
+	Drop      float64
+	Duplicate float64
+
+	// Delay is added to every RPC, together with a random duration up to
+	// Jitter
+	Delay  time.Duration
+	Jitter time.Duration
+
+	// Partition are the peers this node can't reach; partitioning two sets of
+	// nodes takes setting it on both sides
+	Partition []int
+
+	// PauseConsensus makes the node neither send nor answer the Raft RPCs,
+	// as if it were frozen
+	PauseConsensus bool
+	// DropAppendEntries is how many of the next AppendEntries RPCs sent by
+	// the node are dropped
+	DropAppendEntries int
+	// SlowDisk is added to every write to the storage
+	SlowDisk time.Duration
+	// RefuseTransfers makes the node refuse the services sent to it
+	RefuseTransfers bool
+}
+
+// Validate returns an error if a probability isn't in [0, 1] or a duration is
+// negative.
+func (f Faults) Validate() error {
+	var errs []error
+	if f.Drop < 0 || f.Drop > 1 {
+		errs = append(errs, fmt.Errorf("drop: %v not in [0, 1]", f.Drop))
+	}
+	if f.Duplicate < 0 || f.Duplicate > 1 {
+		errs = append(errs, fmt.Errorf("duplicate: %v not in [0, 1]", f.Duplicate))
+	}
+	if f.Delay < 0 {
+		errs = append(errs, fmt.Errorf("delay: %v is negative", f.Delay))
+	}
+	if f.Jitter < 0 {
+		errs = append(errs, fmt.Errorf("jitter: %v is negative", f.Jitter))
+	}
+	if f.DropAppendEntries < 0 {
+		errs = append(errs, fmt.Errorf("drop-aes: %v is negative", f.DropAppendEntries))
+	}
+	if f.SlowDisk < 0 {
+		errs = append(errs, fmt.Errorf("slow-disk: %v is negative", f.SlowDisk))
+	}
+	return joinErrors(errs)
+}
+
+// ParseFaults reads the faults in the drop, duplicate, delay, jitter,
+// partition, pause, drop-aes, slow-disk and refuse-transfers parameters of
+// values, such as drop=0.1&delay=50ms&jitter=10ms&partition=2,3 or
+// drop-aes=5&slow-disk=20ms.
+func ParseFaults(values url.Values) (Faults, error) {
+	var f Faults
+	var err error
+	if v := values.Get("drop"); v != "" {
+		if f.Drop, err = strconv.ParseFloat(v, 64); err != nil {
+			return f, fmt.Errorf("drop: %w", err)
+		}
+	}
+	if v := values.Get("duplicate"); v != "" {
+		if f.Duplicate, err = strconv.ParseFloat(v, 64); err != nil {
+			return f, fmt.Errorf("duplicate: %w", err)
+		}
+	}
+	if v := values.Get("delay"); v != "" {
+		if f.Delay, err = time.ParseDuration(v); err != nil {
+			return f, fmt.Errorf("delay: %w", err)
+		}
+	}
+	if v := values.Get("jitter"); v != "" {
+		if f.Jitter, err = time.ParseDuration(v); err != nil {
+			return f, fmt.Errorf("jitter: %w", err)
+		}
+	}
+	if v := values.Get("partition"); v != "" {
+		for _, id := range strings.Split(v, ",") {
+			peerId, err := strconv.Atoi(strings.TrimSpace(id))
+			if err != nil {
+				return f, fmt.Errorf("partition: %w", err)
+			}
+			f.Partition = append(f.Partition, peerId)
+		}
+	}
+	if v := values.Get("pause"); v != "" {
+		if f.PauseConsensus, err = strconv.ParseBool(v); err != nil {
+			return f, fmt.Errorf("pause: %w", err)
+		}
+	}
+	if v := values.Get("drop-aes"); v != "" {
+		if f.DropAppendEntries, err = strconv.Atoi(v); err != nil {
+			return f, fmt.Errorf("drop-aes: %w", err)
+		}
+	}
+	if v := values.Get("slow-disk"); v != "" {
+		if f.SlowDisk, err = time.ParseDuration(v); err != nil {
+			return f, fmt.Errorf("slow-disk: %w", err)
+		}
+	}
+	if v := values.Get("refuse-transfers"); v != "" {
+		if f.RefuseTransfers, err = strconv.ParseBool(v); err != nil {
+			return f, fmt.Errorf("refuse-transfers: %w", err)
+		}
+	}
+	return f, f.Validate()
+}
+
+// Faults returns the faults injected by this CM, with the AppendEntries RPCs
+// still to be dropped.
+func (cm *ConsensusModule) Faults() Faults {
+	f := cm.faults.Load().(Faults)
+	f.DropAppendEntries = int(atomic.LoadInt32(&cm.droppedAEs))
+	return f
+}
+
+// SetFaults makes this CM inject f from now on.
+func (cm *ConsensusModule) SetFaults(f Faults) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	cm.faults.Store(f)
+	atomic.StoreInt32(&cm.droppedAEs, int32(f.DropAppendEntries))
+	cm.logger.Printf("[%d] injecting faults %+v", cm.id, f)
+	cm.recordEventUnlocked(EventChaos, "injecting faults %+v", f)
+	return nil
+}
+
+// faultTransport injects the faults of cm in the RPCs carried by next.
+type faultTransport struct {
+	next Transport
+	cm   *ConsensusModule
+}
+
+func (t faultTransport) CallContext(ctx context.Context, id int, serviceMethod string, args interface{}, reply interface{}) error {
+	f := t.cm.Faults()
+	if err := t.cm.consensusFault(serviceMethod); err != nil {
+		return err
+	}
+	if serviceMethod == "ConsensusModule.AppendEntries" && t.cm.dropAppendEntries() {
+		return fmt.Errorf("%w: AppendEntries to %d dropped", ErrInjectedFault, id)
+	}
+	for _, peerId := range f.Partition {
+		if peerId == id {
+			return fmt.Errorf("%w: partitioned from %d", ErrInjectedFault, id)
+		}
+	}
+	if f.Drop > 0 && t.cm.random.Float64() < f.Drop {
+		return fmt.Errorf("%w: %s to %d dropped", ErrInjectedFault, serviceMethod, id)
+	}
+	delay := f.Delay
+	if f.Jitter > 0 {
+		delay += time.Duration(t.cm.random.Int63n(int64(f.Jitter) + 1))
+	}
+	if delay > 0 {
+		select {
+		case <-t.cm.clock.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if f.Duplicate > 0 && t.cm.random.Float64() < f.Duplicate {
+		// The reply of the copy is discarded.
+		duplicate := reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+		t.next.CallContext(ctx, id, serviceMethod, args, duplicate)
+	}
+	return t.next.CallContext(ctx, id, serviceMethod, args, reply)
+}
+
+// consensusFault returns ErrInjectedFault if serviceMethod is a Raft RPC and
+// the consensus is paused.
+func (cm *ConsensusModule) consensusFault(serviceMethod string) error {
+	switch serviceMethod {
+	case "ConsensusModule.RequestVote", "ConsensusModule.AppendEntries":
+		if cm.Faults().PauseConsensus {
+			return fmt.Errorf("%w: consensus paused", ErrInjectedFault)
+		}
+	}
+	return nil
+}
+
+// dropAppendEntries reports whether the next AppendEntries RPC is dropped,
+// counting it.
+func (cm *ConsensusModule) dropAppendEntries() bool {
+	for {
+		n := atomic.LoadInt32(&cm.droppedAEs)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&cm.droppedAEs, n, n-1) {
+			return true
+		}
+	}
+}
+
+// transferFault returns ErrInjectedFault if the node refuses the services
+// sent to it.
+func (cm *ConsensusModule) transferFault() error {
+	if cm.Faults().RefuseTransfers {
+		return fmt.Errorf("%w: transfers refused", ErrInjectedFault)
+	}
+	return nil
+}
+
+// faultStorage slows down the writes of next by the SlowDisk fault of cm.
+type faultStorage struct {
+	next st.Storage
+	cm   *ConsensusModule
+}
+
+func (s faultStorage) Set(value map[string]interface{}, toWrite bool) error {
+	if delay := s.cm.Faults().SlowDisk; delay > 0 {
+		s.cm.clock.Sleep(delay)
+	}
+	return s.next.Set(value, toWrite)
+}
+
+func (s faultStorage) VerifyChain() (string, error) {
+	if v, ok := s.next.(st.ChainVerifier); ok {
+		return v.VerifyChain()
+	}
+	return "", ErrChainUnsupported
+}
@@ -0,0 +1,10 @@
+package server
+
+import "errors"
+
+// mkfifo fails on Windows, which has no named pipes in its filesystem: the
+// peers aren't discovered by the scripts there, see Config.Discovery for the
+// other ways.
+func mkfifo(path string) error {
+	return errors.New("named pipes aren't supported on Windows")
+}
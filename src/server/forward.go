@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"fmt"
+)
+
+// SubmitArgs carries a command forwarded by a follower to the leader, along
+// with the description of the service, which the leader may not have. If the
+// nodes sign their RPCs, From is the ID of the sender, Seq the sequence
+// number and Signature the signature of the sender, see SignSubmit.
+type SubmitArgs struct {
+	Command   Service
+	Body      []byte
+	From      int
+	Seq       uint64
+	Signature []byte
+}
+
+type SubmitReply struct {
+	Index    int
+	Term     int
+	Accepted bool
+}
+
+// WaitCommitArgs asks the leader to wait for the entry at Index, appended in
+// Term, to be committed.
+type WaitCommitArgs struct {
+	Index int
+	Term  int
+}
+
+type WaitCommitReply struct {
+	Committed bool
+}
+
+// Submit appends a command forwarded by a follower to the log of this CM, if
+// it's the leader.
+func (cm *ConsensusModule) Submit(args SubmitArgs, reply *SubmitReply) error {
+	command := args.Command
+	if command.Kind == CommandDeploy {
+		if err := cm.verifyArtifact(command.ServiceID, args.Body, command.Signature); err != nil {
+			return err
+		}
+	}
+	if err := cm.artifacts.Save(command.ServiceID, args.Body); err != nil {
+		return err
+	}
+	cm.Dlog("Submit forwarded: %v", command)
+	reply.Index, reply.Term, reply.Accepted, _ = cm.appendCommand(&command)
+	return nil
+}
+
+// WaitCommit blocks until the entry at args.Index, appended in args.Term, is
+// committed or can't be committed anymore.
+func (cm *ConsensusModule) WaitCommit(args WaitCommitArgs, reply *WaitCommitReply) error {
+	cm.mu.Lock()
+	future, ok := cm.futures[args.Index]
+	if !ok || future.Term != args.Term {
+		reply.Committed = args.Index <= cm.commitIndex && args.Index < len(cm.log) && cm.log[args.Index].Term == args.Term
+		cm.mu.Unlock()
+		return nil
+	}
+	cm.mu.Unlock()
+	err := future.WaitContext(cm.ctx)
+	if err != nil && err == cm.ctx.Err() {
+		return err
+	}
+	reply.Committed = err == nil
+	return nil
+}
+
+// forwardCommand forwards command to the leader known by cm. The returned
+// future resolves when the leader reports the entry as committed. If the
+// leader is unknown or unreachable, the command is not accepted and the future
+// fails with a *NotLeaderError.
+func (cm *ConsensusModule) forwardCommand(ctx context.Context, command *Service) (index int, term int, accepted bool, future *CommitFuture) {
+	cm.mu.Lock()
+	leaderId, term := cm.leaderId, cm.currentTerm
+	cm.mu.Unlock()
+
+	notLeader := &NotLeaderError{LeaderId: -1}
+	if leaderId >= 0 && leaderId != cm.id {
+		notLeader.LeaderId = leaderId
+		if addr := cm.server.PeerAddr(leaderId); addr != nil {
+			notLeader.LeaderAddr = addr.String()
+		}
+		body, err := cm.artifacts.Load(command.ServiceID)
+		args := SubmitArgs{Command: *command, Body: body, From: cm.id, Seq: cm.nextSeq()}
+		if err == nil {
+			args.Signature, err = cm.sign(args)
+		}
+		if err == nil {
+			var reply SubmitReply
+			cm.Dlog("forwarding %v to leader %d", command.ServiceID, leaderId)
+			err = cm.transport.CallContext(ctx, leaderId, "ConsensusModule.Submit", args, &reply)
+			if err == nil && reply.Accepted {
+				future = newCommitFuture(reply.Index, reply.Term)
+				cm.tasks.Go(fmt.Sprintf("WaitCommit %d on %d", reply.Index, leaderId), func() {
+					future.resolve(cm.waitForwarded(leaderId, reply.Index, reply.Term))
+				})
+				return reply.Index, reply.Term, true, future
+			}
+		}
+		if err != nil {
+			cm.Dlog("forwarding %v to leader %d failed: %v", command.ServiceID, leaderId, err)
+		}
+	}
+
+	future = newCommitFuture(-1, term)
+	future.resolve(notLeader)
+	return -1, term, false, future
+}
+
+// waitForwarded waits for the leader leaderId to commit the entry at index,
+// appended in term.
+func (cm *ConsensusModule) waitForwarded(leaderId int, index int, term int) error {
+	var reply WaitCommitReply
+	err := cm.transport.CallContext(cm.ctx, leaderId, "ConsensusModule.WaitCommit", WaitCommitArgs{Index: index, Term: term}, &reply)
+	if err != nil {
+		return err
+	}
+	if !reply.Committed {
+		return ErrLeadershipLost
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	st "storage"
+	"strconv"
+	"sync"
+)
+
+// FSM is the state machine driven by a CM: every committed log entry is
+// applied to it, in log order, by a single goroutine.
+type FSM interface {
+	// Apply applies a committed entry.
+	Apply(entry LogEntry) error
+
+	// Snapshot returns the state built by the entries applied so far.
+	Snapshot() ([]byte, error)
+
+	// Restore replaces the state with one returned by Snapshot.
+	Restore(snapshot []byte) error
+}
+
+// BatchFSM is an FSM that applies the committed entries in batches, for
+// instance to write them to a slow sink at once. The entries of a batch are
+// consecutive and in log order.
+type BatchFSM interface {
+	FSM
+
+	// ApplyBatch applies a batch of committed entries.
+	ApplyBatch(entries []LogEntry) error
+}
+
+// CommandHandler applies a command of a kind registered with RegisterCommand;
+// payload is the decoded payload of the command.
+type CommandHandler func(entry LogEntry, payload interface{}) error
+
+// SchedulerFSM is the default FSM: it records every entry in the storage of
+// the CM, each record chained to the previous one by its hash, and, on the
+// leader that appended the entry, deploys, removes, expires or migrates the
+// service, on itself or on the chosen node. Configuration changes,
+// replicated settings and audit records are applied by every node. Other
+// kinds of commands are applied by the handlers set with Handle.
+type SchedulerFSM struct {
+	cm *ConsensusModule
+
+	mu sync.Mutex
+	// records are the records of the applied entries, kept for the
+	// snapshots only if the storage can't read them back, see reader
+	records  []map[string]interface{}
+	handlers map[CommandKind]CommandHandler
+	// lastHash is the hash of the latest record, that the next one is
+	// chained to
+	lastHash string
+}
+
+func NewSchedulerFSM(cm *ConsensusModule) *SchedulerFSM {
+	return &SchedulerFSM{cm: cm, handlers: make(map[CommandKind]CommandHandler)}
+}
+
+// Handle sets the handler applying the commands of the given kind.
+func (f *SchedulerFSM) Handle(kind CommandKind, handler CommandHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers[kind] = handler
+}
+
+func (f *SchedulerFSM) Apply(log LogEntry) error {
+	cm := f.cm
+	// Every entry, applied or not by this node, stops being tracked.
+	defer cm.metrics.Applied(log.Index)
+	if log.Command.Kind == CommandNoop {
+		return nil
+	}
+	payload, err := DecodeCommand(&log.Command)
+	if err != nil {
+		return err
+	}
+	termData := StorageRecord(log)
+
+	f.mu.Lock()
+	hash, err := st.ChainRecord(termData, f.lastHash)
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	f.lastHash = hash
+	if _, ok := f.reader(); !ok {
+		f.records = append(f.records, copyRecord(termData))
+	}
+	f.mu.Unlock()
+	if err := cm.storage.Set(termData, cm.CheckCMId(log.LeaderId)); err != nil {
+		return err
+	}
+
+	switch log.Command.Kind {
+	case CommandConfigChange:
+		return f.applyConfigChange(payload.(ConfigChangePayload))
+	case CommandSetConfig:
+		setting := payload.(SetConfigPayload)
+		return cm.setConfig(setting.Name, setting.Value)
+	case CommandAudit:
+		cm.appendAudit(log.Index, payload.(AuditPayload))
+		return nil
+	case CommandCron:
+		cm.applyCron(payload.(CronPayload))
+		return nil
+	case CommandDeploy, CommandRemove, CommandMigrate, CommandPreempt, CommandSchedule, CommandExpire:
+	default:
+		f.mu.Lock()
+		handler := f.handlers[log.Command.Kind]
+		f.mu.Unlock()
+		if handler == nil {
+			return fmt.Errorf("no handler for command %q", log.Command.Kind)
+		}
+		return handler(log, payload)
+	}
+
+	if deploy, ok := payload.(DeployPayload); ok && deploy.Cron != nil {
+		cm.recordCronRun(*deploy.Cron)
+	}
+
+	// Services are handled by the leader that appended the entry, whose term
+	// fences the side effects on the other nodes.
+	cm.mu.Lock()
+	currentTerm := cm.currentTerm
+	cm.mu.Unlock()
+	if log.Term < currentTerm || !cm.CheckCMId(log.LeaderId) {
+		return nil
+	}
+
+	serviceId := log.Command.ServiceID
+	switch log.Command.Kind {
+	case CommandSchedule:
+		// Every node stores the artifact, so that the leader of the time
+		// it's due can deploy it.
+		cm.mu.RLock()
+		peerIds := append([]int{}, cm.peerIds...)
+		cm.mu.RUnlock()
+		cm.tasks.Go("store "+serviceId, func() { cm.storeArtifact(cm.ctx, currentTerm, serviceId, peerIds) })
+		cm.recordEventUnlocked(EventTransfer, "service %s scheduled for %v", serviceId, *payload.(DeployPayload).NotBefore)
+		return nil
+	case CommandRemove:
+		if log.ChosenId == AnyNode {
+			// The removal cancels a scheduled deployment.
+			return nil
+		}
+		if err := cm.stopService(cm.ctx, currentTerm, log.ChosenId, serviceId); err != nil {
+			return err
+		}
+		return nil
+	case CommandPreempt:
+		preempt := payload.(PreemptPayload)
+		if err := cm.stopService(cm.ctx, currentTerm, log.ChosenId, serviceId); err != nil {
+			return err
+		}
+		cm.recordEventUnlocked(EventPreemption, "service %s stopped on %d to run %s", serviceId, log.ChosenId, preempt.By)
+		return nil
+	case CommandExpire:
+		if err := cm.stopService(cm.ctx, currentTerm, log.ChosenId, serviceId); err != nil {
+			return err
+		}
+		cm.recordEventUnlocked(EventUndeploy, "service %s expired on %d", serviceId, log.ChosenId)
+		return nil
+	case CommandMigrate:
+		from := payload.(MigratePayload).From
+		if err := cm.stopService(cm.ctx, currentTerm, from, serviceId); err != nil {
+			return err
+		}
+		cm.recordEventUnlocked(EventTransfer, "service %s stopped on %d to migrate it", serviceId, from)
+	}
+	return f.deploy(log, currentTerm)
+}
+
+// deploy runs the service of log on the chosen node, sending it with term as
+// fencing token, and stores it on the standby nodes.
+func (f *SchedulerFSM) deploy(log LogEntry, term int) error {
+	cm := f.cm
+	serviceId := log.Command.ServiceID
+	cm.tasks.Go("replicate "+serviceId, func() { cm.replicateArtifact(cm.ctx, term, serviceId) })
+	if cm.CheckCMId(log.ChosenId) {
+		if err := cm.verifyStoredArtifact(serviceId); err != nil {
+			cm.logger.Printf("[%d] not running %s: %v", cm.id, serviceId, err)
+			return nil
+		}
+		fmt.Println("Esecuzione da parte del leader")
+		cm.run(serviceId)
+		return nil
+	}
+	if err := cm.sendService(cm.ctx, term, log.ChosenId, serviceId); err != nil {
+		cm.mu.Lock()
+		cm.raiseAlert(AlertTransferFailed, fmt.Sprintf("deploy of %s to %d failed: %v", serviceId, log.ChosenId, err))
+		cm.mu.Unlock()
+		return nil
+	}
+	cm.recordEventUnlocked(EventTransfer, "service %s sent to %d", serviceId, log.ChosenId)
+	return nil
+}
+
+// applyConfigChange connects this node to the added nodes, reconnecting the
+// ones whose address changed, and disconnects it from the removed ones.
+func (f *SchedulerFSM) applyConfigChange(change ConfigChangePayload) error {
+	cm := f.cm
+	var errs []error
+	for _, nodes := range []map[int]string{change.Add, change.Learners} {
+		for id, ip := range nodes {
+			if uuid := change.UUIDs[id]; uuid != "" {
+				cm.mu.Lock()
+				known := cm.identities[id]
+				if known == "" {
+					cm.identities[id] = uuid
+				}
+				cm.mu.Unlock()
+				if known != "" && known != uuid {
+					errs = append(errs, fmt.Errorf("node %d already registered with another identity", id))
+					continue
+				}
+			}
+			if cm.CheckCMId(id) {
+				continue
+			}
+			if addr := cm.server.PeerAddr(id); addr != nil && addr.String() != ip {
+				cm.recordEventUnlocked(EventStateChange, "node %d moved from %s to %s", id, addr, ip)
+				cm.server.RemoveNode(id)
+			}
+			if cm.server.PeerAddr(id) == nil {
+				if err := cm.server.AddNode(id, ip); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	for _, id := range change.Remove {
+		if !cm.CheckCMId(id) {
+			if err := cm.server.RemoveNode(id); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	cm.mu.Lock()
+	for id := range change.Learners {
+		cm.learners[id] = true
+	}
+	for _, ids := range [][]int{change.Promote, change.Remove} {
+		for _, id := range ids {
+			delete(cm.learners, id)
+			delete(cm.promoting, id)
+		}
+	}
+	for id, labels := range change.Labels {
+		cm.labels[id] = labels
+	}
+	for id, capacity := range change.Capacity {
+		cm.capacity[id] = capacity
+	}
+	for _, id := range change.Standby {
+		cm.standby[id] = true
+	}
+	for _, ids := range [][]int{change.Activate, change.Remove} {
+		for _, id := range ids {
+			delete(cm.standby, id)
+		}
+	}
+	for _, id := range change.Remove {
+		delete(cm.identities, id)
+		delete(cm.labels, id)
+		delete(cm.capacity, id)
+		cm.loadMu.Lock()
+		delete(cm.loadLevelMap, id)
+		delete(cm.drained, id)
+		cm.loadMu.Unlock()
+		cm.peersMu.Lock()
+		delete(cm.peerUnreachable, id)
+		delete(cm.unreachableSince, id)
+		delete(cm.health, id)
+		cm.peersMu.Unlock()
+	}
+	cm.mu.Unlock()
+	cm.recordEventUnlocked(EventStateChange, "configuration changed: added %v, removed %v, learners %v, promoted %v", change.Add, change.Remove, change.Learners, change.Promote)
+	return joinErrors(errs)
+}
+
+// reader returns the storage of the CM if it can read its records back, in
+// which case the snapshots are taken from it rather than from f.records.
+func (f *SchedulerFSM) reader() (st.RecordReader, bool) {
+	storage := f.cm.storage
+	if s, ok := storage.(faultStorage); ok {
+		storage = s.next
+	}
+	r, ok := storage.(st.RecordReader)
+	return r, ok
+}
+
+// Snapshot returns the records of the applied entries, as JSON, in the order
+// they were applied.
+func (f *SchedulerFSM) Snapshot() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.reader()
+	if !ok {
+		return json.Marshal(f.records)
+	}
+	records, err := r.Records()
+	if err != nil {
+		return nil, err
+	}
+	ordered, err := st.ChainOrder(records)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ordered)
+}
+
+// Restore records the entries of snapshot in the storage, without deploying
+// their services again, and rebuilds the audit log and the recurring
+// deployments from them.
+func (f *SchedulerFSM) Restore(snapshot []byte) error {
+	var records []map[string]interface{}
+	if err := json.Unmarshal(snapshot, &records); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.records = nil
+	if _, ok := f.reader(); !ok {
+		f.records = records
+	}
+	f.lastHash = ""
+	if len(records) > 0 {
+		f.lastHash, _ = records[len(records)-1]["Hash"].(string)
+	}
+	f.mu.Unlock()
+	if err := f.cm.restoreAudit(records); err != nil {
+		return err
+	}
+	if err := f.cm.restoreCronJobs(records); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := f.cm.storage.Set(copyRecord(record), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StorageRecord returns the record of a committed entry written to the
+// storage by the SchedulerFSM, under its Id. The records already on disk
+// must stay readable by the nodes upgraded, so this format must stay
+// compatible, see testcluster.CheckGolden.
+func StorageRecord(log LogEntry) map[string]interface{} {
+	record := make(map[string]interface{})
+	record["Term"] = strconv.Itoa(log.Term)
+	record["Command"] = log.Command
+	record["Leader"] = strconv.Itoa(log.LeaderId)
+	record["Chosen"] = strconv.Itoa(log.ChosenId)
+	record["Id"] = log.Index
+	record["Timestamp"] = log.Timestamp
+	return record
+}
+
+// VerifyChain checks that the records persisted by the storage of this CM
+// weren't modified since they were written, and returns the hash of the
+// latest one: records removed from the end are only detected by comparing it
+// with a hash noted earlier, since every node chains the same records. It
+// returns ErrChainBroken if they were modified, and ErrChainUnsupported if
+// the storage can't be read back.
+func (cm *ConsensusModule) VerifyChain() (string, error) {
+	v, ok := cm.storage.(st.ChainVerifier)
+	if !ok {
+		return "", ErrChainUnsupported
+	}
+	return v.VerifyChain()
+}
+
+// copyRecord returns a shallow copy of record, since the storage takes
+// ownership of the records it's given.
+func copyRecord(record map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(record))
+	for k, v := range record {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// TestSnapshotFromStorage applies entries to a SchedulerFSM whose storage
+// reads its records back: they aren't kept in memory by the FSM, and its
+// snapshot lists them in the order they were applied.
+func TestSnapshotFromStorage(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		config := DefaultConfig()
+		config.LogPath = filepath.Join(t.TempDir(), "log.txt")
+		config.CompressLog = compressed
+		srv, err := NewServer(1, config, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { srv.Shutdown(context.Background()) })
+		fsm := NewSchedulerFSM(srv.cm)
+
+		// Applied out of the order of their Ids, by a leader other than 1
+		// so that nothing is undeployed.
+		indexes := []string{"c", "a", "b"}
+		for i, index := range indexes {
+			command, err := NewCommand(CommandRemove, fmt.Sprintf("%064x", i), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fsm.Apply(LogEntry{Command: *command, LeaderId: 2, Index: index}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(fsm.records) != 0 {
+			t.Errorf("compressed=%v: %d records kept in memory", compressed, len(fsm.records))
+		}
+
+		data, err := fsm.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []map[string]interface{}
+		if err := json.Unmarshal(data, &records); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, record := range records {
+			got = append(got, fmt.Sprint(record["Id"]))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(indexes) {
+			t.Errorf("compressed=%v: snapshot of %v, want %v", compressed, got, indexes)
+		}
+		if fsm.lastHash != records[len(records)-1]["Hash"] {
+			t.Errorf("compressed=%v: snapshot doesn't end with the last record chained", compressed)
+		}
+	}
+}
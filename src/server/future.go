@@ -0,0 +1,76 @@
+package server
+
+import "context"
+
+// CommitFuture resolves when the log entry at Index, appended in Term, is
+// committed or fails to be committed because leadership was lost.
+type CommitFuture struct {
+	Index int
+	Term  int
+
+	done chan struct{}
+	err  error
+}
+
+func newCommitFuture(index int, term int) *CommitFuture {
+	return &CommitFuture{
+		Index: index,
+		Term:  term,
+		done:  make(chan struct{}),
+	}
+}
+
+// Done returns a channel that's closed when the future resolves.
+func (f *CommitFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the future resolves and returns nil if the entry was
+// committed.
+func (f *CommitFuture) Wait() error {
+	<-f.done
+	return f.err
+}
+
+// WaitContext is like Wait, but returns ctx.Err() if ctx is done before the
+// future resolves.
+func (f *CommitFuture) WaitContext(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *CommitFuture) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// resolveFutures resolves the pending futures whose entries are committed or
+// have been replaced by entries of another term.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) resolveFutures() {
+	for index, future := range cm.futures {
+		if index < len(cm.log) && cm.log[index].Term != future.Term {
+			future.resolve(ErrLeadershipLost)
+			delete(cm.futures, index)
+		} else if index >= len(cm.log) {
+			future.resolve(ErrLeadershipLost)
+			delete(cm.futures, index)
+		} else if index <= cm.commitIndex {
+			future.resolve(nil)
+			delete(cm.futures, index)
+		}
+	}
+}
+
+// failFutures fails every pending future with err.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) failFutures(err error) {
+	for index, future := range cm.futures {
+		future.resolve(err)
+		delete(cm.futures, index)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// fuzzLogs builds the log of a leader and the one of a follower that holds
+// its first shared entries and then entries of terms the leader never had:
+// the leader's terms are even, the follower's own ones odd. Each step adds an
+// entry, in the same term as the previous one or the next.
+func fuzzLogs(leaderSteps, followerSteps []byte, shared uint8) (leader, follower []LogEntry) {
+	leader, follower = []LogEntry{}, []LogEntry{}
+	term := 2
+	for i, step := range leaderSteps {
+		term += 2 * int(step%2)
+		leader = append(leader, LogEntry{Term: term, Index: fmt.Sprint("L", i)})
+	}
+	k := int(shared) % (len(leader) + 1)
+	follower = append(follower, leader[:k]...)
+	term = 1
+	if k > 0 {
+		term = leader[k-1].Term + 1
+	}
+	for i, step := range followerSteps {
+		term += 2 * int(step%2)
+		follower = append(follower, LogEntry{Term: term, Index: fmt.Sprint("F", i)})
+	}
+	return leader, follower
+}
+
+// FuzzFindInsertionPoint applies the entries sent by a leader after an
+// entry the follower holds, as AppendEntries does, and checks the Log
+// Matching property: the follower's log then holds the leader's up to the
+// last entry sent, and it's cut there unless it held all the entries sent
+// already.
+func FuzzFindInsertionPoint(f *testing.F) {
+	f.Add([]byte{0, 1, 0, 1}, []byte{1, 0}, uint8(2), uint8(1), uint8(2))
+	f.Add([]byte{0, 0, 0}, []byte{}, uint8(3), uint8(0), uint8(3))
+	f.Add([]byte{0, 1}, []byte{0, 0, 0, 0}, uint8(2), uint8(2), uint8(0))
+	f.Add([]byte{}, []byte{1, 1}, uint8(0), uint8(0), uint8(0))
+	f.Fuzz(func(t *testing.T, leaderSteps, followerSteps []byte, shared, prev, sent uint8) {
+		leader, follower := fuzzLogs(leaderSteps, followerSteps, shared)
+		k := int(shared) % (len(leader) + 1)
+		prevLogIndex := int(prev)%(k+1) - 1
+		end := prevLogIndex + 1 + int(sent)%(len(leader)-prevLogIndex)
+		entries := leader[prevLogIndex+1 : end]
+
+		log := append([]LogEntry{}, follower...)
+		logInsertIndex, newEntriesIndex := findInsertionPoint(log, prevLogIndex, entries)
+		if logInsertIndex-newEntriesIndex != prevLogIndex+1 {
+			t.Fatalf("insertion at %d of the log and %d of the entries, after %d", logInsertIndex, newEntriesIndex, prevLogIndex)
+		}
+		if newEntriesIndex < len(entries) {
+			log = append(log[:logInsertIndex], entries[newEntriesIndex:]...)
+		}
+		if len(log) < end || !reflect.DeepEqual(log[:end], leader[:end]) {
+			t.Fatalf("log %v doesn't match the leader's %v up to %d", log, leader, end)
+		}
+		// A follower already holding the entries sent keeps the ones after
+		// them: the AE may be a stale one.
+		if held := len(follower) >= end && reflect.DeepEqual(follower[:end], leader[:end]); held && !reflect.DeepEqual(log, follower) {
+			t.Fatalf("log %v changed from %v by entries it held", log, follower)
+		} else if !held && len(log) != end {
+			t.Fatalf("log %v not cut at %d", log, end)
+		}
+	})
+}
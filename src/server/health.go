@@ -0,0 +1,183 @@
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// peerSuspectedFailures and peerDownFailures are how many consecutive
+	// RPCs to a peer must fail for it to be suspected and down.
+	peerSuspectedFailures = 1
+	peerDownFailures      = 3
+
+	// healthHistorySize is how many outcomes of the latest RPCs to a peer
+	// are kept.
+	healthHistorySize = 32
+)
+
+// Statuses of a peer in its PeerHealth.
+const (
+	PeerUp        = "up"
+	PeerSuspected = "suspected"
+	PeerDown      = "down"
+)
+
+// HealthSample is the outcome of an RPC to a peer.
+type HealthSample struct {
+	Time      time.Time
+	Reachable bool
+	RTT       time.Duration
+}
+
+// PeerHealth describes the health of a peer as seen by the leader, from the
+// AppendEntries RPCs sent to it: the last time it answered, the round-trip
+// time of its last answer, the smoothed round-trip time and its variation,
+// the timeout derived from them, how many RPCs failed since then and the
+// outcome of the latest RPCs, oldest first.
+type PeerHealth struct {
+	Id                  int
+	Status              string
+	LastContact         time.Time
+	RTT                 time.Duration
+	SmoothedRTT         time.Duration
+	RTTVariation        time.Duration
+	Timeout             time.Duration
+	ConsecutiveFailures int
+	History             []HealthSample
+}
+
+// recordContact records the outcome of an RPC to peerId, sent at start,
+// failed if err isn't nil, and returns the new status of peerId if it
+// changed, to be recorded as an event once cm.peersMu is unlocked.
+// Expects cm.peersMu to be locked.
+func (cm *ConsensusModule) recordContact(peerId int, start time.Time, err error) (changed string) {
+	h := cm.health[peerId]
+	if h == nil {
+		h = &PeerHealth{Id: peerId}
+		cm.health[peerId] = h
+	}
+	sample := HealthSample{Time: start, Reachable: err == nil}
+	if err == nil {
+		sample.RTT = cm.clock.Since(start)
+		h.LastContact, h.RTT, h.ConsecutiveFailures = cm.clock.Now(), sample.RTT, 0
+		h.updateRTT(sample.RTT)
+	} else {
+		h.ConsecutiveFailures++
+	}
+	if len(h.History) == healthHistorySize {
+		h.History = append(h.History[:0], h.History[1:]...)
+	}
+	h.History = append(h.History, sample)
+
+	status := PeerUp
+	switch {
+	case h.ConsecutiveFailures >= peerDownFailures:
+		status = PeerDown
+	case h.ConsecutiveFailures >= peerSuspectedFailures:
+		status = PeerSuspected
+	}
+	if status != h.Status && h.Status != "" {
+		changed = status
+	}
+	h.Status = status
+	return changed
+}
+
+// updateRTT adds rtt to the smoothed round-trip time of h and its variation,
+// computed as the retransmission timer of TCP (RFC 6298).
+func (h *PeerHealth) updateRTT(rtt time.Duration) {
+	if h.SmoothedRTT == 0 {
+		h.SmoothedRTT, h.RTTVariation = rtt, rtt/2
+		return
+	}
+	diff := h.SmoothedRTT - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	h.RTTVariation = (3*h.RTTVariation + diff) / 4
+	h.SmoothedRTT = (7*h.SmoothedRTT + rtt) / 8
+}
+
+// rpcTimeout returns how long an RPC to peerId may take: the smoothed
+// round-trip time to it plus four times its variation, within
+// [RPCTimeoutMin, RPCTimeoutMax]. It's RPCTimeoutMax until the peer answers.
+func (cm *ConsensusModule) rpcTimeout(peerId int) time.Duration {
+	config := cm.Config()
+	cm.peersMu.Lock()
+	defer cm.peersMu.Unlock()
+	return adaptiveTimeout(cm.health[peerId], config.RPCTimeoutMin, config.RPCTimeoutMax)
+}
+
+// adaptiveTimeout returns the timeout of the RPCs to the peer of h, within
+// [min, max].
+func adaptiveTimeout(h *PeerHealth, min time.Duration, max time.Duration) time.Duration {
+	if h == nil || h.SmoothedRTT == 0 {
+		return max
+	}
+	timeout := h.SmoothedRTT + 4*h.RTTVariation
+	switch {
+	case timeout < min:
+		return min
+	case timeout > max:
+		return max
+	}
+	return timeout
+}
+
+// isDown reports whether the RPCs to peerId have failed at least
+// peerDownFailures times in a row.
+// Expects cm.peersMu to be locked.
+func (cm *ConsensusModule) isDown(peerId int) bool {
+	h := cm.health[peerId]
+	return h != nil && h.Status == PeerDown
+}
+
+// unschedulable returns the nodes that mustn't run new services: the ones
+// draining, the standby ones and the ones down.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) unschedulable() map[int]bool {
+	excluded := make(map[int]bool)
+	for id := range cm.standby {
+		excluded[id] = true
+	}
+	cm.loadMu.RLock()
+	for id, draining := range cm.drained {
+		excluded[id] = excluded[id] || draining
+	}
+	cm.loadMu.RUnlock()
+	cm.peersMu.Lock()
+	for id := range cm.health {
+		excluded[id] = excluded[id] || cm.isDown(id)
+	}
+	cm.peersMu.Unlock()
+	return excluded
+}
+
+// GetPeers returns the health of the peers of this CM, as seen when it was
+// the leader, sorted by ID.
+func (cm *ConsensusModule) GetPeers() []PeerHealth {
+	config := cm.Config()
+	cm.mu.RLock()
+	peerIds := append([]int{}, cm.peerIds...)
+	cm.mu.RUnlock()
+	cm.peersMu.Lock()
+	defer cm.peersMu.Unlock()
+	peers := make([]PeerHealth, 0, len(peerIds))
+	for _, peerId := range peerIds {
+		h := PeerHealth{Id: peerId, Status: PeerUp}
+		if known := cm.health[peerId]; known != nil {
+			h = *known
+			h.History = append([]HealthSample{}, known.History...)
+		}
+		h.Timeout = adaptiveTimeout(cm.health[peerId], config.RPCTimeoutMin, config.RPCTimeoutMax)
+		peers = append(peers, h)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Id < peers[j].Id })
+	return peers
+}
+
+// GetPeers returns the health of the peers of this server.
+func (s *Server) GetPeers() []PeerHealth {
+	return s.cm.GetPeers()
+}
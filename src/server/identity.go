@@ -0,0 +1,17 @@
+package server
+
+import (
+	"context"
+	st "storage"
+)
+
+// RegisterAddress submits the current address of this server along with the
+// UUID of its identity, so that the other nodes reconnect to it when it comes
+// back on a new IP address with the same ID. It fails if the ID is
+// registered with another identity.
+func (s *Server) RegisterAddress(ctx context.Context, identity st.NodeIdentity) error {
+	return s.submitConfigChange(ctx, ConfigChangePayload{
+		Add:   map[int]string{s.serverId: s.cm.nodeAddr(s.serverId)},
+		UUIDs: map[int]string{s.serverId: identity.UUID},
+	})
+}
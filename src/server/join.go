@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"fmt"
+)
+
+// maxJoinRedirects is how many times a joining node follows the redirects to
+// the leader before giving up.
+const maxJoinRedirects = 3
+
+type JoinClusterArgs struct {
+	Id   int
+	Addr string
+}
+
+// JoinClusterReply either redirects the joining node to the leader, or
+// carries the state it starts from: the snapshot of the FSM of the leader, to
+// be read with the ReadSnapshot RPC, the index of the last entry applied to
+// it and the nodes of the cluster.
+type JoinClusterReply struct {
+	Redirect   bool
+	LeaderId   int
+	LeaderAddr string
+
+	Term          int
+	SnapshotId    uint64
+	SnapshotSize  int
+	SnapshotIndex int
+	Peers         map[int]string
+}
+
+// JoinCluster RPC. A follower redirects the joining node to the leader. The
+// leader connects to the node, appends a configuration change adding it as a
+// learner and, once it's committed, replies with the snapshot of its FSM and
+// the nodes of the cluster. The learner is promoted to voter by the leader as
+// soon as it has caught up with the log.
+func (cm *ConsensusModule) JoinCluster(args JoinClusterArgs, reply *JoinClusterReply) error {
+	cm.mu.Lock()
+	isLeader := cm.state == Leader
+	cm.mu.Unlock()
+	if !isLeader {
+		leaderId, leaderAddr := cm.GetLeader()
+		if leaderId < 0 || leaderId == cm.id {
+			return ErrNotLeader
+		}
+		reply.Redirect, reply.LeaderId, reply.LeaderAddr = true, leaderId, leaderAddr
+		return nil
+	}
+
+	if cm.server.PeerAddr(args.Id) == nil {
+		if err := cm.server.AddNode(args.Id, args.Addr); err != nil {
+			return fmt.Errorf("connecting to %d: %w", args.Id, err)
+		}
+	}
+	cm.mu.Lock()
+	isMember := false
+	for _, peerId := range cm.peerIds {
+		isMember = isMember || peerId == args.Id
+	}
+	// Until the change is committed the node must not count as a voter.
+	cm.learners[args.Id] = true
+	cm.mu.Unlock()
+	if !isMember {
+		return fmt.Errorf("node %d not connected", args.Id)
+	}
+
+	command, err := NewCommand(CommandConfigChange, "", ConfigChangePayload{Learners: map[int]string{args.Id: args.Addr}})
+	if err != nil {
+		return err
+	}
+	_, _, _, future := cm.appendCommand(command)
+	if err := future.WaitContext(cm.ctx); err != nil {
+		return err
+	}
+
+	cm.mu.Lock()
+	reply.Term = cm.currentTerm
+	reply.LeaderId = cm.id
+	peerIds := append([]int{}, cm.peerIds...)
+	cm.mu.Unlock()
+	if reply.SnapshotId, reply.SnapshotSize, reply.SnapshotIndex, err = cm.openSnapshot(cm.ctx); err != nil {
+		return err
+	}
+	reply.Peers = map[int]string{cm.id: cm.nodeAddr(cm.id)}
+	for _, peerId := range peerIds {
+		reply.Peers[peerId] = cm.nodeAddr(peerId)
+	}
+	cm.recordEventUnlocked(EventStateChange, "node %d joins as a learner", args.Id)
+	return nil
+}
+
+// Join adds this server to the cluster of node peerId, at ip, with the
+// JoinCluster RPC, following the redirects to the leader. This server joins
+// as a learner, restores the snapshot of the leader and is promoted once it
+// has caught up. It fails with ErrAlreadyBootstrapped if this server already
+// formed or joined a cluster.
+func (s *Server) Join(ctx context.Context, peerId int, ip string) error {
+	state, err := s.ClusterState()
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		return ErrAlreadyBootstrapped
+	}
+
+	s.cm.mu.Lock()
+	s.cm.learners[s.serverId] = true
+	s.cm.mu.Unlock()
+	args := JoinClusterArgs{Id: s.serverId, Addr: s.cm.nodeAddr(s.serverId)}
+	var reply JoinClusterReply
+	for redirects := 0; ; redirects++ {
+		if s.PeerAddr(peerId) == nil {
+			if err := s.AddNode(peerId, ip); err != nil {
+				return fmt.Errorf("connecting to %d: %w", peerId, err)
+			}
+		}
+		reply = JoinClusterReply{}
+		if err := s.CallContext(ctx, peerId, "ConsensusModule.JoinCluster", args, &reply); err != nil {
+			return fmt.Errorf("joining through %d: %w", peerId, err)
+		}
+		if !reply.Redirect {
+			break
+		}
+		if redirects == maxJoinRedirects {
+			return fmt.Errorf("joining through %d: too many redirects", peerId)
+		}
+		peerId, ip = reply.LeaderId, reply.LeaderAddr
+	}
+
+	for id, addr := range reply.Peers {
+		if id != s.serverId && addr != "" && s.PeerAddr(id) == nil {
+			if err := s.AddNode(id, addr); err != nil {
+				s.cm.Dlog("joining: can't connect to %d: %v", id, err)
+			}
+		}
+	}
+	snapshot, err := s.cm.fetchSnapshot(ctx, reply.LeaderId, reply.SnapshotId, reply.SnapshotSize)
+	if err != nil {
+		return err
+	}
+	if err := s.cm.restoreSnapshot(ctx, snapshot, reply.SnapshotIndex); err != nil {
+		return err
+	}
+	return s.createClusterState(reply.Peers, false)
+}
+
+// IsLearner reports whether this CM is a learner that doesn't vote yet.
+func (cm *ConsensusModule) IsLearner() bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.learners[cm.id]
+}
+
+// voters returns how many peers of this CM vote.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) voters() int {
+	voters := len(cm.peerIds)
+	for _, peerId := range cm.peerIds {
+		if cm.learners[peerId] {
+			voters--
+		}
+	}
+	return voters
+}
+
+// promoteIfCaughtUp appends the promotion of peerId to voter if it's a
+// learner whose log has caught up with the commitIndex of the leader.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) promoteIfCaughtUp(peerId int) {
+	if !cm.learners[peerId] || cm.promoting[peerId] || cm.matchIndex[peerId] < cm.commitIndex {
+		return
+	}
+	cm.promoting[peerId] = true
+	cm.tasks.Go(fmt.Sprintf("promote %d", peerId), func() {
+		command, err := NewCommand(CommandConfigChange, "", ConfigChangePayload{Promote: []int{peerId}})
+		if err == nil {
+			_, _, _, future := cm.appendCommand(command)
+			err = future.WaitContext(cm.ctx)
+		}
+		if err != nil {
+			cm.Dlog("promotion of %d failed: %v", peerId, err)
+			cm.mu.Lock()
+			delete(cm.promoting, peerId)
+			cm.mu.Unlock()
+		}
+	})
+}
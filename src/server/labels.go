@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ParseLabels parses labels written as comma-separated key=value pairs, such
+// as "zone=eu-1,class=gpu".
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", pair)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// RegisterLabels replaces the labels of this server in the configuration of
+// the cluster, where the scheduler and the admin API of every node see them,
+// and waits until the change is committed.
+func (s *Server) RegisterLabels(ctx context.Context, labels map[string]string) error {
+	return s.submitConfigChange(ctx, ConfigChangePayload{
+		Labels: map[int]map[string]string{s.serverId: labels},
+	})
+}
+
+// filterPeers returns the peers that have all labels.
+func filterPeers(peers []PeerInfo, labels map[string]string) []PeerInfo {
+	var filtered []PeerInfo
+	for _, peer := range peers {
+		matches := true
+		for key, value := range labels {
+			if v, ok := peer.Labels[key]; !ok || v != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			filtered = append(filtered, peer)
+		}
+	}
+	return filtered
+}
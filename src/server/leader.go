@@ -0,0 +1,61 @@
+package server
+
+import "context"
+
+// leaderFunc is a function registered with RunOnLeader.
+type leaderFunc struct {
+	name string
+	f    func(ctx context.Context)
+}
+
+// RunOnLeader makes f run in the background, with the given task name,
+// whenever this CM holds the leadership. The context passed to f is cancelled
+// as soon as the leadership is lost or the CM is stopped, and f should return
+// then; it's called again when the leadership is won back. If this CM is
+// already the leader f starts right away.
+func (cm *ConsensusModule) RunOnLeader(name string, f func(ctx context.Context)) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	lf := leaderFunc{name: name, f: f}
+	cm.leaderFuncs = append(cm.leaderFuncs, lf)
+	if cm.leaderCtx != nil {
+		cm.startLeaderFunc(lf)
+	}
+}
+
+// RunOnLeader makes f run whenever this server is the leader, see
+// ConsensusModule.RunOnLeader.
+func (s *Server) RunOnLeader(name string, f func(ctx context.Context)) {
+	s.cm.RunOnLeader(name, f)
+}
+
+// startLeaderFuncs starts the functions registered with RunOnLeader, unless
+// they're already running.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) startLeaderFuncs() {
+	if cm.leaderCtx != nil {
+		return
+	}
+	cm.leaderCtx, cm.leaderCancel = context.WithCancel(cm.ctx)
+	for _, lf := range cm.leaderFuncs {
+		cm.startLeaderFunc(lf)
+	}
+}
+
+// startLeaderFunc runs lf with the context of the current leadership.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) startLeaderFunc(lf leaderFunc) {
+	ctx := cm.leaderCtx
+	cm.tasks.Go(lf.name, func() { lf.f(ctx) })
+}
+
+// stopLeaderFuncs cancels the context of the functions registered with
+// RunOnLeader, if they're running.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) stopLeaderFuncs() {
+	if cm.leaderCtx == nil {
+		return
+	}
+	cm.leaderCancel()
+	cm.leaderCtx, cm.leaderCancel = nil, nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LoadSample is the load level reported by a node at a given time.
+type LoadSample struct {
+	Timestamp time.Time
+	LoadLevel int
+}
+
+// LoadHistory keeps a bounded history of the load levels reported by each
+// node, safe for concurrent use.
+type LoadHistory struct {
+	mu      sync.Mutex
+	size    int
+	samples map[int][]LoadSample
+}
+
+func NewLoadHistory(size int) *LoadHistory {
+	return &LoadHistory{
+		size:    size,
+		samples: make(map[int][]LoadSample),
+	}
+}
+
+// Record appends a sample for nodeId, dropping the oldest one if the history
+// of the node is full.
+func (lh *LoadHistory) Record(nodeId int, loadLevel int) {
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+	samples := append(lh.samples[nodeId], LoadSample{Timestamp: time.Now(), LoadLevel: loadLevel})
+	if len(samples) > lh.size {
+		samples = samples[len(samples)-lh.size:]
+	}
+	lh.samples[nodeId] = samples
+}
+
+// Samples returns a copy of the retained samples of every node, oldest first.
+func (lh *LoadHistory) Samples() map[int][]LoadSample {
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+	samples := make(map[int][]LoadSample, len(lh.samples))
+	for nodeId, s := range lh.samples {
+		samples[nodeId] = append([]LoadSample{}, s...)
+	}
+	return samples
+}
+
+// WriteTo writes the latest sample of every node in the Prometheus text
+// exposition format.
+func (lh *LoadHistory) WriteTo(w io.Writer) (int64, error) {
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+	nodeIds := make([]int, 0, len(lh.samples))
+	for nodeId := range lh.samples {
+		nodeIds = append(nodeIds, nodeId)
+	}
+	sort.Ints(nodeIds)
+
+	n, err := fmt.Fprintf(w, "# TYPE raft_load_level gauge\n")
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	for _, nodeId := range nodeIds {
+		last := lh.samples[nodeId][len(lh.samples[nodeId])-1]
+		n, err := fmt.Fprintf(w, "raft_load_level{node=\"%d\"} %d %d\n", nodeId, last.LoadLevel, last.Timestamp.UnixMilli())
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
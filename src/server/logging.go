@@ -0,0 +1,96 @@
+package server
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Components whose debug logging can be enabled at runtime.
+const (
+	ComponentCM      = "cm"
+	ComponentNetwork = "network"
+)
+
+var Components = []string{ComponentCM, ComponentNetwork}
+
+var (
+	debugMu      sync.RWMutex
+	debugEnabled = parseDebug(os.Getenv("DEBUG"))
+)
+
+// parseDebug parses the value of the DEBUG environment variable: "0" disables
+// debug logging, a comma separated list of components enables only those and
+// any other value enables every component. An empty value enables the
+// consensus logging only, so that the peers discovered aren't printed.
+func parseDebug(value string) map[string]bool {
+	enabled := make(map[string]bool)
+	if value == "0" {
+		return enabled
+	}
+	if strings.TrimSpace(value) == "" {
+		enabled[ComponentCM] = true
+		return enabled
+	}
+	for _, component := range strings.Split(value, ",") {
+		for _, known := range Components {
+			if strings.TrimSpace(component) == known {
+				enabled[known] = true
+			}
+		}
+	}
+	if len(enabled) == 0 {
+		for _, component := range Components {
+			enabled[component] = true
+		}
+	}
+	return enabled
+}
+
+// DebugEnabled reports whether debug logging is enabled for component.
+func DebugEnabled(component string) bool {
+	debugMu.RLock()
+	defer debugMu.RUnlock()
+	return debugEnabled[component]
+}
+
+// SetDebug enables or disables debug logging for component.
+func SetDebug(component string, enabled bool) {
+	debugMu.Lock()
+	defer debugMu.Unlock()
+	debugEnabled[component] = enabled
+}
+
+// DebugSettings returns the debug logging setting of every component.
+func DebugSettings() map[string]bool {
+	debugMu.RLock()
+	defer debugMu.RUnlock()
+	settings := make(map[string]bool, len(Components))
+	for _, component := range Components {
+		settings[component] = debugEnabled[component]
+	}
+	return settings
+}
+
+// HandleDebugSignal toggles debug logging of every component whenever the
+// process receives SIGHUP: if any component is enabled they are all disabled,
+// otherwise they are all enabled.
+func HandleDebugSignal() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		enable := true
+		for _, enabled := range DebugSettings() {
+			if enabled {
+				enable = false
+			}
+		}
+		for _, component := range Components {
+			SetDebug(component, enable)
+		}
+		log.Printf("SIGHUP received, debug logging enabled: %v", enable)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logShipInterval is how often a LogShipper sends its records and a
+// LogCollector flushes them.
+const logShipInterval = 1 * time.Second
+
+// LogRecord is a single log line tagged with the node that produced it.
+type LogRecord struct {
+	Timestamp time.Time
+	NodeId    int
+	Message   string
+}
+
+// LogShipper is an io.Writer that collects the log lines of a node and ships
+// them to the collector node.
+type LogShipper struct {
+	mu      sync.Mutex
+	nodeId  int
+	url     string
+	client  *http.Client
+	pending []LogRecord
+}
+
+func NewLogShipper(nodeId int, collector string) *LogShipper {
+	return &LogShipper{
+		nodeId: nodeId,
+		url:    "http://" + collector + "/logs",
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Write stores every line of p as a LogRecord. It never fails.
+func (ls *LogShipper) Write(p []byte) (int, error) {
+	now := time.Now()
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		ls.pending = append(ls.pending, LogRecord{Timestamp: now, NodeId: ls.nodeId, Message: line})
+	}
+	return len(p), nil
+}
+
+// Run sends the collected records to the collector every logShipInterval.
+// Records that can't be sent are kept for the next attempt. When done is
+// closed, the pending records are sent one last time and Run returns.
+func (ls *LogShipper) Run(done <-chan struct{}) {
+	for stopping := false; !stopping; {
+		select {
+		case <-time.After(logShipInterval):
+		case <-done:
+			stopping = true
+		}
+		ls.mu.Lock()
+		records := ls.pending
+		ls.pending = nil
+		ls.mu.Unlock()
+		if len(records) == 0 {
+			continue
+		}
+
+		body, _ := json.Marshal(records)
+		resp, err := ls.client.Post(ls.url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+		}
+		if err != nil || resp.StatusCode != http.StatusOK {
+			// Not logged through the log package, which would ship it again.
+			fmt.Fprintf(os.Stderr, "[%d] log shipping to %s failed: %v\n", ls.nodeId, ls.url, err)
+			ls.mu.Lock()
+			ls.pending = append(records, ls.pending...)
+			ls.mu.Unlock()
+		}
+	}
+}
+
+// LogCollector receives the records of every node and writes them to a file
+// as JSON lines, ordered by time. Records are held back for a few ship
+// intervals so that late batches can still be merged in order.
+type LogCollector struct {
+	mu      sync.Mutex
+	f       io.Writer
+	delay   time.Duration
+	pending []LogRecord
+}
+
+func NewLogCollector(path string) (*LogCollector, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &LogCollector{
+		f:     f,
+		delay: 3 * logShipInterval,
+	}, nil
+}
+
+// Add queues records to be written.
+func (lc *LogCollector) Add(records []LogRecord) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.pending = append(lc.pending, records...)
+}
+
+// Run writes, every logShipInterval, the queued records older than the
+// collector delay. When done is closed, all the queued records are written and
+// Run returns.
+func (lc *LogCollector) Run(done <-chan struct{}) {
+	enc := json.NewEncoder(lc.f)
+	for stopping := false; !stopping; {
+		watermark := time.Now().Add(-lc.delay)
+		select {
+		case <-time.After(logShipInterval):
+		case <-done:
+			stopping = true
+			watermark = time.Now()
+		}
+		lc.mu.Lock()
+		sort.SliceStable(lc.pending, func(i, j int) bool {
+			return lc.pending[i].Timestamp.Before(lc.pending[j].Timestamp)
+		})
+		n := sort.Search(len(lc.pending), func(i int) bool {
+			return lc.pending[i].Timestamp.After(watermark)
+		})
+		ready := lc.pending[:n]
+		lc.pending = append([]LogRecord{}, lc.pending[n:]...)
+		lc.mu.Unlock()
+
+		for _, record := range ready {
+			enc.Encode(record)
+		}
+	}
+}
+
+// StartLogShipping copies the output of the log package to the collector
+// listening at the admin address collector, over TLS if the node has a
+// certificate: the collector must present the one of a peer.
+func (s *Server) StartLogShipping(collector string) {
+	shipper := NewLogShipper(s.serverId, collector)
+	if s.peerTLS != nil {
+		shipper.url = "https://" + collector + "/logs"
+		shipper.client.Transport = &http.Transport{TLSClientConfig: s.peerTLS.Clone()}
+	}
+	log.SetOutput(io.MultiWriter(os.Stderr, shipper))
+	s.cm.tasks.Go("log shipper", func() { shipper.Run(s.cm.Done()) })
+}
+
+// StartLogCollector makes this server the collector of the cluster logs,
+// merging them in the file at path.
+func (s *Server) StartLogCollector(path string) error {
+	collector, err := NewLogCollector(path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.collector = collector
+	s.mu.Unlock()
+	s.cm.tasks.Go("log collector", func() { collector.Run(s.cm.Done()) })
+	return nil
+}
+
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	collector := s.collector
+	s.mu.Unlock()
+	if collector == nil {
+		http.Error(w, "this node is not a log collector", http.StatusNotFound)
+		return
+	}
+	var records []LogRecord
+	if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	collector.Add(records)
+}
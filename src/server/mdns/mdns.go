@@ -0,0 +1,287 @@
+// Package mdns advertises a node of a cluster on the local network with
+// multicast DNS, and browses for the other nodes, so that clusters on a LAN
+// without DNS infrastructure find each other.
+//
+// Every node answers the PTR queries for Service with a PTR record pointing
+// to its instance, node-<id>.<Service>, and a TXT record with its ID and IP
+// address.
+package mdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Service is the name of the service advertised by the nodes.
+const Service = "_raft._tcp.local."
+
+// QueryWait is how long Resolve waits for the answers to a query.
+var QueryWait = time.Second
+
+const (
+	typePTR = 12
+	typeTXT = 16
+	typeANY = 255
+	classIN = 1
+	ttl     = 120
+)
+
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+var errMalformed = errors.New("malformed mDNS message")
+
+// Node is a node advertised on the network.
+type Node struct {
+	Id int
+	IP net.IP
+}
+
+// Responder advertises a node and records the nodes advertised by the
+// others.
+type Responder struct {
+	conn *net.UDPConn
+	self Node
+
+	mu    sync.Mutex
+	seen  map[int]time.Time
+	nodes map[int]Node
+}
+
+// Listen joins the mDNS group on iface, or on the default interface if nil,
+// to advertise self. Run must be called to answer the queries.
+func Listen(iface *net.Interface, self Node) (*Responder, error) {
+	conn, err := net.ListenMulticastUDP("udp4", iface, group)
+	if err != nil {
+		return nil, err
+	}
+	return &Responder{
+		conn:  conn,
+		self:  self,
+		seen:  make(map[int]time.Time),
+		nodes: make(map[int]Node),
+	}, nil
+}
+
+// Run answers the queries for Service and records the answers of the other
+// nodes until done is closed or the responder is closed.
+func (r *Responder) Run(done <-chan struct{}) {
+	go func() {
+		<-done
+		r.conn.Close()
+	}()
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		r.handle(buf[:n])
+	}
+}
+
+// Close stops advertising the node.
+func (r *Responder) Close() error {
+	return r.conn.Close()
+}
+
+// Resolve queries the nodes advertising Service and returns the IP address of
+// the ones that answer within QueryWait, this node excluded.
+func (r *Responder) Resolve(ctx context.Context) ([]net.IP, error) {
+	start := time.Now()
+	if _, err := r.conn.WriteToUDP(query(Service), group); err != nil {
+		return nil, err
+	}
+	select {
+	case <-time.After(QueryWait):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ips []net.IP
+	for id, node := range r.nodes {
+		if id != r.self.Id && !r.seen[id].Before(start) {
+			ips = append(ips, node.IP)
+		}
+	}
+	return ips, nil
+}
+
+// IdOf returns the ID advertised by the node at ip.
+func (r *Responder) IdOf(ip net.IP) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, node := range r.nodes {
+		if node.IP.Equal(ip) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// handle answers msg if it's a query for Service, or records the nodes it
+// advertises if it's a response.
+func (r *Responder) handle(msg []byte) {
+	if len(msg) < 12 {
+		return
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(msg[4+2*i:]))
+	}
+
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return
+		}
+		qtype := binary.BigEndian.Uint16(msg[next:])
+		off = next + 4
+		if flags&0x8000 == 0 && strings.EqualFold(name, Service) && (qtype == typePTR || qtype == typeANY) {
+			r.conn.WriteToUDP(r.response(), group)
+		}
+	}
+	if flags&0x8000 == 0 {
+		return
+	}
+
+	for i := 0; i < counts[1]+counts[2]+counts[3]; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return
+		}
+		rtype := binary.BigEndian.Uint16(msg[next:])
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		off = next + 10 + length
+		if off > len(msg) {
+			return
+		}
+		if rtype == typeTXT && strings.HasSuffix(strings.ToLower(name), "."+Service) {
+			if node, ok := parseTXT(msg[next+10 : off]); ok {
+				r.mu.Lock()
+				r.nodes[node.Id] = node
+				r.seen[node.Id] = time.Now()
+				r.mu.Unlock()
+			}
+		}
+	}
+}
+
+// response returns the answer advertising this node.
+func (r *Responder) response() []byte {
+	instance := "node-" + strconv.Itoa(r.self.Id) + "." + Service
+	msg := header(0x8400, 0, 2)
+	msg = appendRecord(msg, Service, typePTR, appendName(nil, instance))
+	var txt []byte
+	for _, s := range []string{"id=" + strconv.Itoa(r.self.Id), "addr=" + r.self.IP.String()} {
+		txt = append(txt, byte(len(s)))
+		txt = append(txt, s...)
+	}
+	return appendRecord(msg, instance, typeTXT, txt)
+}
+
+// query returns a query for the PTR records of name.
+func query(name string) []byte {
+	msg := header(0, 1, 0)
+	msg = appendName(msg, name)
+	msg = appendUint16(msg, typePTR)
+	return appendUint16(msg, classIN)
+}
+
+func header(flags uint16, questions uint16, answers uint16) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[2:], flags)
+	binary.BigEndian.PutUint16(msg[4:], questions)
+	binary.BigEndian.PutUint16(msg[6:], answers)
+	return msg
+}
+
+func appendRecord(msg []byte, name string, rtype uint16, data []byte) []byte {
+	msg = appendName(msg, name)
+	msg = appendUint16(msg, rtype)
+	msg = appendUint16(msg, classIN)
+	msg = appendUint16(appendUint16(msg, ttl>>16), ttl&0xffff)
+	msg = appendUint16(msg, uint16(len(data)))
+	return append(msg, data...)
+}
+
+func appendName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
+
+// readName reads the possibly compressed name at off of msg, returning it and
+// the offset following it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// parseTXT returns the node advertised by the data of a TXT record.
+func parseTXT(data []byte) (Node, bool) {
+	var node Node
+	var err error
+	hasId := false
+	for len(data) > 0 {
+		length := int(data[0])
+		if 1+length > len(data) {
+			return node, false
+		}
+		key, value, _ := strings.Cut(string(data[1:1+length]), "=")
+		data = data[1+length:]
+		switch key {
+		case "id":
+			if node.Id, err = strconv.Atoi(value); err != nil {
+				return node, false
+			}
+			hasId = true
+		case "addr":
+			node.IP = net.ParseIP(value)
+		}
+	}
+	return node, hasId && node.IP != nil
+}
+
+func appendUint16(msg []byte, v uint16) []byte {
+	return append(msg, byte(v>>8), byte(v))
+}
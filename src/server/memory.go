@@ -0,0 +1,85 @@
+package server
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// memoryCheckInterval is how often the memory used by a node is checked
+// against Config.MemoryLimit.
+const memoryCheckInterval = 5 * time.Second
+
+// maxLoadLevel is the highest load level measured on a node.
+const maxLoadLevel = 10
+
+// memoryUsed returns the memory held by the Go runtime of the node, in bytes,
+// without the part returned to the OS.
+func memoryUsed() int64 {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return int64(mem.Sys - mem.HeapReleased)
+}
+
+// watchMemory keeps the memory used by the node under Config.MemoryLimit,
+// degrading gracefully: above the limit, the unused memory is first returned
+// to the OS and, if that's not enough, the node is under memory pressure
+// until it uses less than 80% of the limit, see UnderMemoryPressure. Returns
+// when the CM is stopped.
+func (cm *ConsensusModule) watchMemory() {
+	for {
+		select {
+		case <-cm.clock.After(memoryCheckInterval):
+		case <-cm.ctx.Done():
+			return
+		}
+		limit := cm.Config().MemoryLimit
+		if limit <= 0 {
+			if cm.UnderMemoryPressure() {
+				cm.setMemoryPressure(false, memoryUsed(), 0)
+			}
+			continue
+		}
+		used := memoryUsed()
+		if used > limit {
+			debug.FreeOSMemory()
+			used = memoryUsed()
+		}
+		switch {
+		case used > limit:
+			cm.setMemoryPressure(true, used, limit)
+		case used < limit/10*8:
+			cm.setMemoryPressure(false, used, limit)
+		}
+	}
+}
+
+// setMemoryPressure puts the node under memory pressure, or relieves it,
+// recording the change.
+func (cm *ConsensusModule) setMemoryPressure(pressure bool, used int64, limit int64) {
+	var v int32
+	if pressure {
+		v = 1
+	}
+	if atomic.SwapInt32(&cm.memoryPressure, v) == v {
+		return
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if !pressure {
+		cm.recordEvent(EventStateChange, "memory pressure relieved, %d bytes used", used)
+		return
+	}
+	cm.raiseAlert(AlertMemoryPressure, strconv.FormatInt(used, 10)+" bytes used, limit "+strconv.FormatInt(limit, 10))
+}
+
+// UnderMemoryPressure reports whether the node uses more memory than
+// Config.MemoryLimit allows, even after returning the unused memory to the
+// OS. Meanwhile the node reports the highest load level, so that the leader
+// places the new services on the other nodes, and its APIs refuse the
+// artifacts with ErrMemoryPressure; the consensus goes on.
+func (cm *ConsensusModule) UnderMemoryPressure() bool {
+	return atomic.LoadInt32(&cm.memoryPressure) == 1
+}
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// defaultBuckets are the upper bounds (in seconds) used by latency histograms.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram is a fixed-bucket latency histogram, safe for concurrent use.
+type Histogram struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(name string, help string) *Histogram {
+	return &Histogram{
+		name:    name,
+		help:    help,
+		buckets: defaultBuckets,
+		counts:  make([]uint64, len(defaultBuckets)),
+	}
+}
+
+// Observe records a single duration in the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v := d.Seconds()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// WriteTo writes the histogram in the Prometheus text exposition format.
+func (h *Histogram) WriteTo(w io.Writer) (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var written int64
+	out := func(format string, args ...interface{}) error {
+		n, err := fmt.Fprintf(w, format, args...)
+		written += int64(n)
+		return err
+	}
+	if err := out("# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name); err != nil {
+		return written, err
+	}
+	for i, bound := range h.buckets {
+		if err := out("%s_bucket{le=\"%g\"} %d\n", h.name, bound, h.counts[i]); err != nil {
+			return written, err
+		}
+	}
+	if err := out("%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", h.name, h.count, h.name, h.sum, h.name, h.count); err != nil {
+		return written, err
+	}
+	return written, nil
+}
+
+// metricsRetention is how long an entry is tracked at most: an entry
+// submitted but never committed, such as one truncated by a new leader, or
+// committed but never applied is forgotten after it.
+const metricsRetention = 10 * time.Minute
+
+// Metrics collects the latency measurements of a CM. Entries are tracked by
+// their log Index (the sha256 identifier), which is the same on every node.
+type Metrics struct {
+	mu sync.Mutex
+
+	// submitted holds the time each entry was appended by the leader
+	// committed holds the time each entry was committed
+	submitted map[string]time.Time
+	committed map[string]time.Time
+	// pruned is the last time the entries older than metricsRetention were
+	// forgotten
+	pruned time.Time
+
+	CommitLatency *Histogram
+	ApplyLatency  *Histogram
+
+	// transfersByPeer and transfersByService aggregate the service transfers
+	transfersByPeer    map[int]*TransferStats
+	transfersByService map[string]*TransferStats
+
+	// applyBacklog is the number of committed entries not applied yet,
+	// applyQueued the ones waiting in the apply queue, and applyQueueFull
+	// counts the times the queue was found full
+	applyBacklog   int
+	applyQueued    int
+	applyQueueFull uint64
+
+	// votesRefused counts the RequestVote RPCs refused by the vote
+	// throttle, by reason
+	votesRefused map[string]uint64
+
+	// disabled is set on Metrics that record nothing, see
+	// NewDisabledMetrics
+	disabled bool
+}
+
+// TransferStats aggregates the service transfers towards a peer or of a
+// service.
+type TransferStats struct {
+	Transfers uint64
+	Failures  uint64
+	Retries   uint64
+	Bytes     uint64
+	Duration  time.Duration
+}
+
+// Throughput returns the average throughput of the successful transfers in
+// bytes per second.
+func (ts *TransferStats) Throughput() float64 {
+	if ts.Duration <= 0 {
+		return 0
+	}
+	return float64(ts.Bytes) / ts.Duration.Seconds()
+}
+
+func (ts *TransferStats) add(bytes int, d time.Duration, retries int, err error) {
+	ts.Transfers++
+	ts.Retries += uint64(retries)
+	if err != nil {
+		ts.Failures++
+		return
+	}
+	ts.Bytes += uint64(bytes)
+	ts.Duration += d
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		submitted:     make(map[string]time.Time),
+		committed:     make(map[string]time.Time),
+		CommitLatency: NewHistogram("raft_commit_latency_seconds", "Time from Submit to commit of a log entry."),
+		ApplyLatency:  NewHistogram("raft_apply_latency_seconds", "Time from commit to deploy of a log entry."),
+
+		transfersByPeer:    make(map[int]*TransferStats),
+		transfersByService: make(map[string]*TransferStats),
+		votesRefused:       make(map[string]uint64),
+	}
+}
+
+// NewDisabledMetrics returns Metrics that record nothing and write no
+// sample, sparing the memory of the nodes short of it, see
+// Config.DisableMetrics.
+func NewDisabledMetrics() *Metrics {
+	m := NewMetrics()
+	m.disabled = true
+	return m
+}
+
+// Submitted marks the entry as appended to the leader's log.
+func (m *Metrics) Submitted(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.disabled {
+		return
+	}
+	now := time.Now()
+	m.submitted[id] = now
+	m.prune(now)
+}
+
+// prune forgets the entries tracked for longer than metricsRetention, at most
+// once per metricsRetention.
+// Expects m.mu to be locked.
+func (m *Metrics) prune(now time.Time) {
+	if now.Sub(m.pruned) < metricsRetention {
+		return
+	}
+	m.pruned = now
+	for _, tracked := range []map[string]time.Time{m.submitted, m.committed} {
+		for id, at := range tracked {
+			if now.Sub(at) > metricsRetention {
+				delete(tracked, id)
+			}
+		}
+	}
+}
+
+// Committed marks the entry as committed and observes its commit latency, if
+// the entry was submitted on this node.
+func (m *Metrics) Committed(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.disabled {
+		return
+	}
+	now := time.Now()
+	if start, ok := m.submitted[id]; ok {
+		m.CommitLatency.Observe(now.Sub(start))
+		delete(m.submitted, id)
+	}
+	m.committed[id] = now
+	m.prune(now)
+}
+
+// Applied observes the apply latency of a committed entry.
+func (m *Metrics) Applied(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.disabled {
+		return
+	}
+	if start, ok := m.committed[id]; ok {
+		m.ApplyLatency.Observe(time.Since(start))
+		delete(m.committed, id)
+	}
+}
+
+// ApplyBacklog records the number of committed entries not applied yet and
+// the ones waiting in the apply queue.
+func (m *Metrics) ApplyBacklog(backlog int, queued int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.disabled {
+		return
+	}
+	m.applyBacklog, m.applyQueued = backlog, queued
+}
+
+// ApplyQueueFull counts a committed entry that had to wait for room in the
+// apply queue.
+func (m *Metrics) ApplyQueueFull() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.disabled {
+		return
+	}
+	m.applyQueueFull++
+}
+
+// VoteRefused counts a RequestVote RPC refused by the vote throttle for
+// reason, rate or term_jump.
+func (m *Metrics) VoteRefused(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.disabled {
+		return
+	}
+	m.votesRefused[reason]++
+}
+
+// Transfer records a service transfer to peerId that moved bytes in d after
+// the given number of retries. A non-nil err marks the transfer as failed.
+func (m *Metrics) Transfer(peerId int, serviceId string, bytes int, d time.Duration, retries int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.disabled {
+		return
+	}
+	if m.transfersByPeer[peerId] == nil {
+		m.transfersByPeer[peerId] = &TransferStats{}
+	}
+	if m.transfersByService[serviceId] == nil {
+		m.transfersByService[serviceId] = &TransferStats{}
+	}
+	m.transfersByPeer[peerId].add(bytes, d, retries, err)
+	m.transfersByService[serviceId].add(bytes, d, retries, err)
+}
+
+// TransfersByPeer returns a copy of the transfer statistics of every peer.
+func (m *Metrics) TransfersByPeer() map[int]TransferStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make(map[int]TransferStats, len(m.transfersByPeer))
+	for peerId, ts := range m.transfersByPeer {
+		stats[peerId] = *ts
+	}
+	return stats
+}
+
+// WriteTo writes all the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m.disabled {
+		return 0, nil
+	}
+	var written int64
+	for _, h := range []*Histogram{m.CommitLatency, m.ApplyLatency} {
+		n, err := h.WriteTo(w)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := fmt.Fprintf(w, "# HELP raft_apply_backlog_entries Committed entries not applied yet.\n# TYPE raft_apply_backlog_entries gauge\nraft_apply_backlog_entries %d\n"+
+		"# HELP raft_apply_queue_entries Committed entries waiting in the apply queue.\n# TYPE raft_apply_queue_entries gauge\nraft_apply_queue_entries %d\n"+
+		"# HELP raft_apply_queue_full_total Committed entries that waited for room in the apply queue.\n# TYPE raft_apply_queue_full_total counter\nraft_apply_queue_full_total %d\n",
+		m.applyBacklog, m.applyQueued, m.applyQueueFull)
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+	n, err = fmt.Fprintf(w, "# HELP raft_votes_refused_total RequestVote RPCs refused to protect the node from floods.\n# TYPE raft_votes_refused_total counter\n"+
+		"raft_votes_refused_total{reason=\"rate\"} %d\nraft_votes_refused_total{reason=\"term_jump\"} %d\n",
+		m.votesRefused["rate"], m.votesRefused["term_jump"])
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+
+	labels := make(map[string]*TransferStats)
+	for peerId, ts := range m.transfersByPeer {
+		labels[fmt.Sprintf("peer=\"%d\"", peerId)] = ts
+	}
+	for serviceId, ts := range m.transfersByService {
+		labels[fmt.Sprintf("service=\"%s\"", serviceId)] = ts
+	}
+	n, err = writeTransferStats(w, labels)
+	return written + int64(n), err
+}
+
+// writeTransferStats writes the transfer statistics, one sample per label.
+func writeTransferStats(w io.Writer, labels map[string]*TransferStats) (int, error) {
+	metrics := []struct {
+		name  string
+		kind  string
+		value func(ts *TransferStats) float64
+	}{
+		{"raft_transfers_total", "counter", func(ts *TransferStats) float64 { return float64(ts.Transfers) }},
+		{"raft_transfer_failures_total", "counter", func(ts *TransferStats) float64 { return float64(ts.Failures) }},
+		{"raft_transfer_retries_total", "counter", func(ts *TransferStats) float64 { return float64(ts.Retries) }},
+		{"raft_transfer_bytes_total", "counter", func(ts *TransferStats) float64 { return float64(ts.Bytes) }},
+		{"raft_transfer_duration_seconds_total", "counter", func(ts *TransferStats) float64 { return ts.Duration.Seconds() }},
+		{"raft_transfer_throughput_bytes_per_second", "gauge", func(ts *TransferStats) float64 { return ts.Throughput() }},
+	}
+	written := 0
+	for _, metric := range metrics {
+		n, err := fmt.Fprintf(w, "# TYPE %s %s\n", metric.name, metric.kind)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		for label, ts := range labels {
+			n, err := fmt.Fprintf(w, "%s{%s} %g\n", metric.name, label, metric.value(ts))
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
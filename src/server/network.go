@@ -36,25 +36,11 @@ func GetPeersIp(serverIp net.Addr, subnetMask string, peerChan *chan net.Addr, c
 	// check is true if we want to get new peers in the network
 	if check {
 		if _, err := os.Stat("/tmp/ip.fifo"); os.IsNotExist(err) {
-			syscall.Mkfifo("/tmp/ip.fifo", 0666)
+			mkfifo("/tmp/ip.fifo")
 		}
 
-		// It reads the ip.fifo file and send the ip to the peerChan channel
-		newPipe, _ := os.OpenFile("/tmp/ip.fifo", os.O_RDONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
-		newReader := bufio.NewReader(newPipe)
-		exec.Command("bash", "/home/raft/scripts/get_ip.sh", "ping", serverIp.String(), subnetMask).Start()
-		for {
-			line, _, err := newReader.ReadLine()
-			if err != nil {
-				time.Sleep(1 * time.Second)
-				continue
-			}
-			nline := strings.TrimSuffix(string(line), "\n")
-			if os.Getenv("DEBUG") == "1" {
-				fmt.Println(nline)
-			}
-			*peerChan <- &net.IPAddr{IP: net.ParseIP(string(nline))}
-		}
+		readNewPeers(serverIp, subnetMask, *peerChan, nil)
+		return nil
 	} else {
 		// If check is false, it will get all peers in the network and returns them
 		if _, err := os.Stat("/tmp/newip.txt"); err == nil {
@@ -73,12 +59,47 @@ func GetPeersIp(serverIp net.Addr, subnetMask string, peerChan *chan net.Addr, c
 
 }
 
+// readNewPeers reads the ip.fifo file and sends the ips to peerChan, until
+// done is closed. It closes peerChan before returning.
+func readNewPeers(serverIp net.Addr, subnetMask string, peerChan chan<- net.Addr, done <-chan struct{}) {
+	defer close(peerChan)
+	newPipe, _ := os.OpenFile("/tmp/ip.fifo", os.O_RDONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
+	defer newPipe.Close()
+	newReader := bufio.NewReader(newPipe)
+	exec.Command("bash", "/home/raft/scripts/get_ip.sh", "ping", serverIp.String(), subnetMask).Start()
+	for {
+		line, _, err := newReader.ReadLine()
+		if err != nil {
+			select {
+			case <-time.After(1 * time.Second):
+				continue
+			case <-done:
+				return
+			}
+		}
+		nline := strings.TrimSuffix(string(line), "\n")
+		if DebugEnabled(ComponentNetwork) {
+			fmt.Println(nline)
+		}
+		select {
+		case peerChan <- &net.IPAddr{IP: net.ParseIP(string(nline))}:
+		case <-done:
+			return
+		}
+	}
+}
+
+// CheckNewPeers connects to the peers joining the network and disconnects
+// from the ones leaving it, until the server shuts down.
 func CheckNewPeers(server *Server, peersPtr *map[int]net.Addr) {
 	peers := *peersPtr
 	peerChan := make(chan net.Addr, 100)
 	ip, mask:= GetNetworkInfo()
 	var connect int
-	go GetPeersIp(ip, mask, &peerChan, true)
+	if _, err := os.Stat("/tmp/ip.fifo"); os.IsNotExist(err) {
+		mkfifo("/tmp/ip.fifo")
+	}
+	server.Go("readNewPeers", func() { readNewPeers(ip, mask, peerChan, server.Done()) })
 
 	for {
 		addr, notClosed := <-peerChan
@@ -88,7 +109,7 @@ func CheckNewPeers(server *Server, peersPtr *map[int]net.Addr) {
 		defaultGateway := GetDefaultGateway()
 		tmpId := 0
 		connect = 1
-		ok, err := exec.Command("bash", "/home/raft/scripts/get_ip.sh", "nc", addr.String(), os.Getenv("RPC_PORT")).Output()
+		ok, err := exec.Command("bash", "/home/raft/scripts/get_ip.sh", "nc", addr.String(), server.GetConfig().RPCPort).Output()
 		if err != nil {
 			fmt.Printf("Error net: %v\n", err)
 			continue
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"log"
+	"math/rand"
+	"net"
+	"server/clock"
+	"server/executor"
+	l "server/resource"
+	"server/scheduler"
+	st "storage"
+	"sync"
+	"time"
+)
+
+// Transport carries the RPCs of a CM to its peers.
+type Transport interface {
+	CallContext(ctx context.Context, id int, serviceMethod string, args interface{}, reply interface{}) error
+}
+
+// Logger receives the log messages of a CM.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// LoadProvider measures the load of a node: its load level, from 1 to 10,
+// and its CPU usage in percent.
+type LoadProvider interface {
+	LoadLevel() (int, float64)
+}
+
+// LoadProviderFunc is a function used as a LoadProvider.
+type LoadProviderFunc func() (int, float64)
+
+func (f LoadProviderFunc) LoadLevel() (int, float64) {
+	return f()
+}
+
+// options are the dependencies of a Server and its CM.
+type options struct {
+	storage   st.Storage
+	fsm       FSM
+	transport Transport
+	scheduler scheduler.Scheduler
+	executor  executor.Executor
+	load      LoadProvider
+	logger    Logger
+	clock     clock.Clock
+	random    rand.Source
+	restart   func()
+	keys      *signingKeys
+	trusted   map[string]ed25519.PublicKey
+	keyring   *st.Keyring
+	resolve   func(net.Addr) (int, bool)
+}
+
+// Option sets a dependency of a Server and its CM.
+type Option func(*options)
+
+// WithStorage makes the CM persist the log in storage, instead of a
+// MapStorage at config.LogPath.
+func WithStorage(storage st.Storage) Option {
+	return func(o *options) { o.storage = storage }
+}
+
+// WithFSM makes the CM apply the committed entries to fsm, instead of its
+// SchedulerFSM.
+func WithFSM(fsm FSM) Option {
+	return func(o *options) { o.fsm = fsm }
+}
+
+// WithTransport makes the CM send its RPCs through transport, instead of the
+// RPC clients of the Server.
+func WithTransport(transport Transport) Option {
+	return func(o *options) { o.transport = transport }
+}
+
+// WithScheduler makes the leader choose the nodes running new services with
+// s, instead of the one of config.SchedulerPolicy.
+func WithScheduler(s scheduler.Scheduler) Option {
+	return func(o *options) { o.scheduler = s }
+}
+
+// WithExecutor makes the CM run the services deployed on this node with e,
+// instead of docker-compose.
+func WithExecutor(e executor.Executor) Option {
+	return func(o *options) { o.executor = e }
+}
+
+// WithLoadProvider makes the CM measure the load of the node with p, instead
+// of the CPU and memory usage of the host.
+func WithLoadProvider(p LoadProvider) Option {
+	return func(o *options) { o.load = p }
+}
+
+// WithLogger makes the CM log to logger, instead of the standard logger.
+func WithLogger(logger Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithClock makes the CM tell the time with clock, instead of the system
+// clock.
+func WithClock(c clock.Clock) Option {
+	return func(o *options) { o.clock = c }
+}
+
+// WithRandom makes the CM draw its random choices, such as the simulated RPC
+// delays, from src instead of a source seeded with the current time, so that
+// a seeded src reproduces them.
+func WithRandom(src rand.Source) Option {
+	return func(o *options) { o.random = src }
+}
+
+// WithRestart makes the node restart itself with restart when asked to by a
+// rolling restart, see Server.RollingRestart. restart must make the process
+// exit to be restarted by its supervisor. It's called by a task of the CM,
+// which Server.Shutdown waits for: it mustn't wait for the shutdown itself.
+func WithRestart(restart func()) Option {
+	return func(o *options) { o.restart = restart }
+}
+
+// WithSigningKeys makes the CM sign its RequestVote and AppendEntries RPCs,
+// and its replies to them, with key, and refuse the ones of its peers that
+// aren't signed by their key in peers, by node ID, with ErrBadSignature.
+// Without it, the RPCs are neither signed nor verified.
+func WithSigningKeys(key ed25519.PrivateKey, peers map[int]ed25519.PublicKey) Option {
+	return func(o *options) { o.keys = &signingKeys{private: key, peers: peers} }
+}
+
+// WithTrustedKeys makes the CM run only the artifacts of services signed by
+// one of the publishers of keys, by name, see SignService: the others are
+// refused with ErrUnverifiedArtifact before being stored. Without it, the
+// artifacts aren't verified.
+func WithTrustedKeys(keys map[string]ed25519.PublicKey) Option {
+	return func(o *options) { o.trusted = keys }
+}
+
+// WithKeyring tells the CM the keys encrypting its storage, so that they
+// can be rotated, see Server.RotateStorageKey. The storage created at
+// config.LogPath when WithStorage isn't set is encrypted with them.
+func WithKeyring(keys *st.Keyring) Option {
+	return func(o *options) { o.keyring = keys }
+}
+
+// WithPeerResolver makes the server identify the peers connecting to it
+// with resolve, which returns the ID of the node at an IP address, to
+// check them against Config.AllowedPeers, when the RPCs aren't encrypted:
+// with TLS, a peer is identified by its certificate. Without it, a peer is
+// only identified once the server has connected to it.
+func WithPeerResolver(resolve func(addr net.Addr) (int, bool)) Option {
+	return func(o *options) { o.resolve = resolve }
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.executor == nil {
+		o.executor = executor.Compose{Dir: "/home/raft/services"}
+	}
+	if o.load == nil {
+		o.load = LoadProviderFunc(l.GetLoadLevel)
+	}
+	if o.logger == nil {
+		o.logger = log.Default()
+	}
+	if o.clock == nil {
+		o.clock = clock.Real
+	}
+	if o.random == nil {
+		o.random = rand.NewSource(time.Now().UnixNano())
+	}
+	o.random = &lockedSource{src: o.random}
+	return o
+}
+
+// lockedSource makes a rand.Source safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
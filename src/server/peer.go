@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+)
+
+// peerWorker sends the RPCs of the Raft rounds to a peer from two long-lived
+// goroutines: the replicator sends the AEs, see replicate, and the voter the
+// RequestVotes, see requestVote. Their RPCs time out after rpcTimeout, so
+// that a peer that stops answering doesn't hold its worker forever. Each
+// sends one RPC at a time, and the rounds
+// triggered while one is in flight are coalesced into the next, so that the
+// goroutines per peer are bounded however flaky the peer is.
+type peerWorker struct {
+	peerId      int
+	replicate   chan struct{}
+	requestVote chan struct{}
+	stop        chan struct{}
+
+	// args and reply are reused by the replicator between rounds
+	args  AppendEntriesArgs
+	reply *AppendEntriesReply
+}
+
+// startPeerWorker starts the worker of peerId, if not running yet.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) startPeerWorker(peerId int) {
+	if cm.workers[peerId] != nil {
+		return
+	}
+	w := &peerWorker{
+		peerId:      peerId,
+		replicate:   make(chan struct{}, 1),
+		requestVote: make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		reply:       &AppendEntriesReply{},
+	}
+	cm.workers[peerId] = w
+	cm.tasks.Go(fmt.Sprintf("replicator of %d", peerId), func() {
+		cm.runPeerWorker(w, w.replicate, cm.replicate)
+	})
+	cm.tasks.Go(fmt.Sprintf("voter of %d", peerId), func() {
+		cm.runPeerWorker(w, w.requestVote, cm.requestVote)
+	})
+}
+
+// runPeerWorker calls round with w whenever trigger is notified, until w is
+// stopped or the CM is.
+func (cm *ConsensusModule) runPeerWorker(w *peerWorker, trigger <-chan struct{}, round func(w *peerWorker)) {
+	for {
+		select {
+		case <-trigger:
+			round(w)
+		case <-w.stop:
+			return
+		case <-cm.ctx.Done():
+			return
+		}
+	}
+}
+
+// stopPeerWorker stops the worker of peerId, if running.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) stopPeerWorker(peerId int) {
+	if w := cm.workers[peerId]; w != nil {
+		close(w.stop)
+		delete(cm.workers, peerId)
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	st "storage"
+	"strconv"
+	"sync/atomic"
+)
+
+// raftLogPath returns the file persisting the term, the vote and the log of
+// node id, next to the storage at logPath.
+func raftLogPath(logPath string, id int) string {
+	return filepath.Join(filepath.Dir(logPath), "raft"+strconv.Itoa(id)+".log")
+}
+
+// restoreRaftLog opens the raft log of cm, encrypted like its storage, and
+// restores the term, the vote and the log persisted before a crash or a
+// restart. The entries restored aren't known to be committed: they're
+// applied again, from the first one, once the leader commits them, as the
+// entries of a new node.
+func (cm *ConsensusModule) restoreRaftLog() error {
+	raftLog, state, records, err := st.OpenRaftLog(raftLogPath(cm.config.LogPath, cm.id), cm.secrets.keyring)
+	if err != nil {
+		return err
+	}
+	cm.raftLog = raftLog
+	cm.secrets.encrypts("raft log", raftLog)
+	cm.currentTerm, cm.votedFor = state.Term, state.VotedFor
+	cm.savedState = state
+	cm.keys.restoreSeqs(state.Seqs)
+	for i, record := range records {
+		var entry LogEntry
+		if err := json.Unmarshal(record, &entry); err != nil {
+			raftLog.Close()
+			return fmt.Errorf("%w: entry %d: %v", ErrStorageCorrupt, i, err)
+		}
+		cm.log = append(cm.log, entry)
+		cm.terms.add(entry.Term, i)
+	}
+	cm.persisted = len(cm.log)
+	return nil
+}
+
+// persistState writes currentTerm, votedFor and the marks of the sequence
+// numbers of the signed RPCs received, see seqLease, to the raft log if they
+// changed since they were last written, so that a node restarted never goes
+// back to an older term, nor votes twice in a term, nor accepts an RPC
+// again. It must be called before
+// replying to a RequestVote or an AE, and before asking for votes.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) persistState() error {
+	state := st.HardState{Term: cm.currentTerm, VotedFor: cm.votedFor, Seqs: cm.keys.seqs()}
+	if state.Equal(cm.savedState) {
+		return nil
+	}
+	if err := cm.raftLog.SaveState(state); err != nil {
+		return fmt.Errorf("persisting term %d: %w", state.Term, err)
+	}
+	cm.savedState = state
+	cm.keys.savedSeqs(state.Seqs)
+	return nil
+}
+
+// persistLog writes the entries of the log from cm.persisted on, the first
+// one not written yet or replaced since, to the raft log. A follower calls it
+// before acknowledging the entries to the leader; the leader persists the
+// entries it appends in the background instead, see persistAppended.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) persistLog() error {
+	if cm.persisted >= len(cm.log) {
+		return nil
+	}
+	records, err := encodeEntries(cm.log[cm.persisted:])
+	if err != nil {
+		return err
+	}
+	// A write of persistAppended not started yet would be older than this
+	// one, see persistAppended.
+	atomic.AddUint64(&cm.persistGen, 1)
+	cm.persistMu.Lock()
+	err = cm.raftLog.Append(cm.persisted, records)
+	cm.persistMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("persisting entries from %d: %w", cm.persisted, err)
+	}
+	cm.persisted = len(cm.log)
+	return nil
+}
+
+// persistAppended writes the entries appended by the leader to the raft log
+// whenever persistChan is notified, without holding cm.mu: the AEs
+// replicating them are sent meanwhile, and the leader counts itself for
+// their commit once they're written, see advanceCommitIndex. This method
+// should run in a separate background goroutine. Returns when the CM is
+// stopped.
+func (cm *ConsensusModule) persistAppended() {
+	for {
+		select {
+		case <-cm.persistChan:
+		case <-cm.ctx.Done():
+			return
+		}
+		cm.mu.RLock()
+		at, gen := cm.persisted, atomic.LoadUint64(&cm.persistGen)
+		entries := append([]LogEntry{}, cm.log[at:]...)
+		cm.mu.RUnlock()
+		if len(entries) == 0 {
+			continue
+		}
+		records, err := encodeEntries(entries)
+		if err == nil {
+			cm.persistMu.Lock()
+			// The log was written by persistLog since it was read, so
+			// the entries may have been replaced: they're written again
+			// at the next notification, if still needed.
+			if atomic.LoadUint64(&cm.persistGen) != gen {
+				cm.persistMu.Unlock()
+				cm.notify(cm.persistChan)
+				continue
+			}
+			err = cm.raftLog.Append(at, records)
+			cm.persistMu.Unlock()
+		}
+
+		cm.mu.Lock()
+		if err != nil {
+			cm.Dlog("error while persisting entries from %d: %v", at, err)
+			cm.recordEvent(EventPersistError, "persisting entries from %d: %v", at, err)
+		} else if atomic.LoadUint64(&cm.persistGen) == gen && at+len(entries) > cm.persisted {
+			cm.persisted = at + len(entries)
+			cm.advanceCommitIndex()
+		}
+		cm.mu.Unlock()
+	}
+}
+
+// CompactLog rewrites the raft log with the current term, vote and log only,
+// dropping the records written before that they replaced, and returns its
+// size before and after.
+func (cm *ConsensusModule) CompactLog() (before, after int64, err error) {
+	cm.mu.RLock()
+	raftLog := cm.raftLog
+	cm.mu.RUnlock()
+	return raftLog.Compact()
+}
+
+// truncatePersisted records that the entries of the log from position on were
+// replaced, so that persistLog writes them again.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) truncatePersisted(position int) {
+	if position < cm.persisted {
+		cm.persisted = position
+	}
+}
+
+// encodeEntries returns the records of entries written to the raft log.
+func encodeEntries(entries []LogEntry) ([]json.RawMessage, error) {
+	records := make([]json.RawMessage, len(entries))
+	for i, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		records[i] = data
+	}
+	return records, nil
+}
@@ -0,0 +1,93 @@
+package server
+
+// placement is where a service of the log runs, and the options it was
+// deployed with.
+type placement struct {
+	node   int
+	deploy DeployPayload
+	index  int
+}
+
+// deployOptions returns the options of the deployment command, the zero ones
+// if its payload doesn't decode.
+func deployOptions(command *Service) DeployPayload {
+	payload, err := DecodeCommand(command)
+	if err != nil {
+		return DeployPayload{}
+	}
+	p, _ := payload.(DeployPayload)
+	return p
+}
+
+// placements returns where the log, committed or not, runs the services, by
+// ID, with the index of the entry that deployed them.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) placements() map[string]placement {
+	placed := make(map[string]placement)
+	for i, entry := range cm.log {
+		command := entry.Command
+		switch command.Kind {
+		case CommandDeploy:
+			placed[command.ServiceID] = placement{node: entry.ChosenId, deploy: deployOptions(&command), index: i}
+		case CommandMigrate:
+			if p, ok := placed[command.ServiceID]; ok {
+				p.node = entry.ChosenId
+				placed[command.ServiceID] = p
+			}
+		case CommandRemove, CommandPreempt, CommandExpire:
+			delete(placed, command.ServiceID)
+		}
+	}
+	return placed
+}
+
+// preemption returns the command that preempts a service to run the
+// deployment command instead, and the node it frees, or nil if the cluster
+// isn't saturated: when every schedulable node has a load level of at least
+// Config.SaturatedLoad, the service of lowest priority below the one of
+// command is stopped, the latest deployed among equals.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) preemption(command *Service) (*Service, int) {
+	saturated := cm.Config().SaturatedLoad
+	if saturated <= 0 {
+		return nil, 0
+	}
+	excluded := cm.unschedulable()
+	cm.loadMu.RLock()
+	schedulable := 0
+	for id, load := range cm.loadLevelMap {
+		if excluded[id] {
+			continue
+		}
+		if load < saturated {
+			cm.loadMu.RUnlock()
+			return nil, 0
+		}
+		schedulable++
+	}
+	cm.loadMu.RUnlock()
+	if schedulable == 0 {
+		return nil, 0
+	}
+
+	priority := deployOptions(command).Priority
+	var victim string
+	var chosen placement
+	for serviceId, p := range cm.placements() {
+		if serviceId == command.ServiceID || excluded[p.node] || p.deploy.Priority >= priority {
+			continue
+		}
+		if victim == "" || p.deploy.Priority < chosen.deploy.Priority || (p.deploy.Priority == chosen.deploy.Priority && p.index > chosen.index) {
+			victim, chosen = serviceId, p
+		}
+	}
+	if victim == "" {
+		return nil, 0
+	}
+	preempt, err := NewCommand(CommandPreempt, victim, PreemptPayload{Priority: chosen.deploy.Priority, By: command.ServiceID, ByPriority: priority})
+	if err != nil {
+		return nil, 0
+	}
+	cm.recordEvent(EventPreemption, "preempting %s (priority %d) on %d to run %s (priority %d)", victim, chosen.deploy.Priority, chosen.node, command.ServiceID, priority)
+	return preempt, chosen.node
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// PeerInfo describes a peer as seen by a node.
+type PeerInfo struct {
+	Id        int
+	UUID      string
+	Addr      string
+	Labels    map[string]string
+	Reachable bool
+	LoadLevel int
+	Draining  bool
+	Standby   bool
+}
+
+// ClusterInfo describes the cluster as seen by a node. LeaderId is -1 if the
+// leader is unknown; StartedAt tells apart the runs of the node.
+type ClusterInfo struct {
+	Id           int
+	StartedAt    time.Time
+	Term         int
+	State        string
+	LeaderId     int
+	LeaderAddr   string
+	Labels       map[string]string
+	Peers        []PeerInfo
+	LoadLevelMap map[int]int
+}
+
+// GetLeader returns the ID and the IP address of the leader known by this CM.
+// leaderId is -1 if the leader is unknown; addr is empty if its address isn't
+// known.
+func (cm *ConsensusModule) GetLeader() (leaderId int, addr string) {
+	leaderId = cm.Status().LeaderId
+	return leaderId, cm.nodeAddr(leaderId)
+}
+
+// nodeAddr returns the IP address of node id, or an empty string if it isn't
+// known.
+func (cm *ConsensusModule) nodeAddr(id int) string {
+	if id < 0 {
+		return ""
+	}
+	if id == cm.id {
+		if addr := cm.server.GetListenAddr(); addr != nil {
+			host, _, _ := net.SplitHostPort(addr.String())
+			return host
+		}
+		return ""
+	}
+	if addr := cm.server.PeerAddr(id); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// ClusterInfo returns the leader, the peers with their liveness and the
+// latest load levels known by this CM.
+func (cm *ConsensusModule) ClusterInfo() ClusterInfo {
+	cm.mu.RLock()
+	info := ClusterInfo{
+		Id:        cm.id,
+		StartedAt: cm.startedAt,
+		Term:      cm.currentTerm,
+		State:     cm.state.String(),
+		LeaderId:  cm.leaderId,
+		Labels:    cm.labels[cm.id],
+	}
+	for _, peerId := range cm.peerIds {
+		info.Peers = append(info.Peers, PeerInfo{
+			Id:      peerId,
+			UUID:    cm.identities[peerId],
+			Labels:  cm.labels[peerId],
+			Standby: cm.standby[peerId],
+		})
+	}
+	cm.mu.RUnlock()
+
+	cm.loadMu.RLock()
+	info.LoadLevelMap = copyIntMap(cm.loadLevelMap)
+	for i := range info.Peers {
+		info.Peers[i].LoadLevel = cm.loadLevelMap[info.Peers[i].Id]
+		info.Peers[i].Draining = cm.drained[info.Peers[i].Id]
+	}
+	cm.loadMu.RUnlock()
+	cm.peersMu.Lock()
+	for i := range info.Peers {
+		info.Peers[i].Reachable = !cm.peerUnreachable[info.Peers[i].Id]
+	}
+	cm.peersMu.Unlock()
+
+	info.LeaderAddr = cm.nodeAddr(info.LeaderId)
+	for i := range info.Peers {
+		info.Peers[i].Addr = cm.nodeAddr(info.Peers[i].Id)
+	}
+	sort.Slice(info.Peers, func(i, j int) bool { return info.Peers[i].Id < info.Peers[j].Id })
+	return info
+}
+
+type ClusterInfoArgs struct{}
+
+type LeaderArgs struct{}
+
+// LeaderReply reports the leader known by a node. LeaderId is -1 if the
+// leader is unknown; LeaderAddr is empty if the leader is the node itself.
+type LeaderReply struct {
+	LeaderId   int
+	LeaderAddr string
+	Term       int
+}
+
+// Leader reports the leader known by this CM, so that clients can find it.
+func (cm *ConsensusModule) Leader(args LeaderArgs, reply *LeaderReply) error {
+	status := cm.Status()
+	reply.LeaderId, reply.Term = status.LeaderId, status.Term
+	if reply.LeaderId != cm.id {
+		reply.LeaderAddr = cm.nodeAddr(reply.LeaderId)
+	}
+	return nil
+}
+
+type ServiceStatusArgs struct {
+	ServiceId string
+}
+
+// ServiceStatusReply reports the latest entry about a service in the log of a
+// node. Found is false if the node has no entry for the service; Removed is
+// true if the latest entry removes it, Preempted if it removed it to run a
+// service of higher priority and Expired if its lifetime elapsed. Scheduled
+// is true if the service waits for NotBefore to be placed. ExpiresAt is the
+// end of the lifetime of a placed service with a TTL.
+type ServiceStatusReply struct {
+	Found     bool
+	Removed   bool
+	Preempted bool
+	Expired   bool
+	Scheduled bool
+	NotBefore time.Time
+	ExpiresAt time.Time `json:",omitempty"`
+	Index     int
+	Term      int
+	Committed bool
+	ChosenId  int
+}
+
+// ServiceStatus reports the latest log entry about the service
+// args.ServiceId, and the node chosen to run it.
+func (cm *ConsensusModule) ServiceStatus(args ServiceStatusArgs, reply *ServiceStatusReply) error {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	if i := cm.lastServiceEntry(args.ServiceId); i >= 0 {
+		reply.Found = true
+		reply.Preempted = cm.log[i].Command.Kind == CommandPreempt
+		reply.Expired = cm.log[i].Command.Kind == CommandExpire
+		reply.Removed = undeployed(cm.log[i].Command.Kind)
+		if p, ok := cm.placements()[args.ServiceId]; ok && p.deploy.ExpiresAt != nil {
+			reply.ExpiresAt = *p.deploy.ExpiresAt
+		}
+		if cm.log[i].Command.Kind == CommandSchedule {
+			payload, _ := DecodeCommand(&cm.log[i].Command)
+			reply.Scheduled = true
+			if deploy, ok := payload.(DeployPayload); ok && deploy.NotBefore != nil {
+				reply.NotBefore = *deploy.NotBefore
+			}
+		}
+		reply.Index = i
+		reply.Term = cm.log[i].Term
+		reply.Committed = i <= cm.commitIndex
+		reply.ChosenId = cm.log[i].ChosenId
+	}
+	return nil
+}
+
+// lastServiceEntry returns the index of the latest entry that deploys,
+// schedules, migrates, removes, preempts or expires the service serviceId, or
+// -1 if there's none.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) lastServiceEntry(serviceId string) int {
+	for i := len(cm.log) - 1; i >= 0; i-- {
+		command := cm.log[i].Command
+		if command.ServiceID != serviceId {
+			continue
+		}
+		switch command.Kind {
+		case CommandDeploy, CommandSchedule, CommandMigrate, CommandRemove, CommandPreempt, CommandExpire:
+			return i
+		}
+	}
+	return -1
+}
+
+// undeployed reports whether an entry of kind undeploys its service.
+func undeployed(kind CommandKind) bool {
+	return kind == CommandRemove || kind == CommandPreempt || kind == CommandExpire
+}
+
+// runningServices returns the services that the committed log runs on node
+// nodeId.
+func (cm *ConsensusModule) runningServices(nodeId int) []string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	chosen := make(map[string]int)
+	var order []string
+	for i := 0; i <= cm.commitIndex && i < len(cm.log); i++ {
+		command := cm.log[i].Command
+		switch command.Kind {
+		case CommandDeploy, CommandMigrate:
+			if _, ok := chosen[command.ServiceID]; !ok {
+				order = append(order, command.ServiceID)
+			}
+			chosen[command.ServiceID] = cm.log[i].ChosenId
+		case CommandRemove, CommandPreempt, CommandExpire:
+			chosen[command.ServiceID] = -1
+		}
+	}
+	var services []string
+	for _, serviceId := range order {
+		if chosen[serviceId] == nodeId {
+			services = append(services, serviceId)
+		}
+	}
+	return services
+}
+
+// CommittedEntry is a committed log entry with its position in the log.
+type CommittedEntry struct {
+	Position int
+	LogEntry
+}
+
+// ReadCommittedLog returns the committed entries with position in [from, to),
+// oldest first. to is clipped to the committed part of the log.
+func (cm *ConsensusModule) ReadCommittedLog(from int, to int) ([]CommittedEntry, error) {
+	if from < 0 || to < from {
+		return nil, fmt.Errorf("invalid range [%d, %d)", from, to)
+	}
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	if to > cm.commitIndex+1 {
+		to = cm.commitIndex + 1
+	}
+	var entries []CommittedEntry
+	for i := from; i < to; i++ {
+		entries = append(entries, CommittedEntry{Position: i, LogEntry: cm.log[i]})
+	}
+	return entries, nil
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"server/transfer"
+	"sort"
+)
+
+// ErrInvalidMembership is returned when a configuration of the cluster can't
+// work, such as one without voters.
+var ErrInvalidMembership = errors.New("invalid cluster membership")
+
+// Membership is the configuration of a cluster: its voters and learners, by
+// ID, with their IP address.
+type Membership struct {
+	Voters   map[int]string
+	Learners map[int]string
+}
+
+// Validate checks m, failing with ErrInvalidMembership if it can't work and
+// returning the warnings about the problems that make it fragile otherwise.
+func (m Membership) Validate() (warnings []string, err error) {
+	var errs []error
+	if len(m.Voters) == 0 {
+		errs = append(errs, fmt.Errorf("%w: no voters", ErrInvalidMembership))
+	}
+	ids := make(map[string][]int)
+	for _, nodes := range []map[int]string{m.Voters, m.Learners} {
+		for id, ip := range nodes {
+			if ip != "" {
+				ids[ip] = append(ids[ip], id)
+			}
+		}
+	}
+	for ip, listed := range ids {
+		if len(listed) > 1 {
+			sort.Ints(listed)
+			errs = append(errs, fmt.Errorf("%w: %s listed as nodes %v", ErrInvalidMembership, ip, listed))
+		}
+	}
+	for id := range m.Learners {
+		if _, ok := m.Voters[id]; ok {
+			errs = append(errs, fmt.Errorf("%w: node %d both voter and learner", ErrInvalidMembership, id))
+		}
+	}
+	if err := joinErrors(errs); err != nil {
+		return nil, err
+	}
+
+	if n := len(m.Voters); n%2 == 0 {
+		warnings = append(warnings, fmt.Sprintf("%d voters tolerate as many failures as %d", n, n-1))
+	}
+	if len(m.Voters) == 1 && len(m.Learners) > 0 {
+		warnings = append(warnings, fmt.Sprintf("a single voter with %d learners: losing it loses the cluster", len(m.Learners)))
+	}
+	return warnings, nil
+}
+
+// membership returns the configuration of the cluster known by this CM.
+func (cm *ConsensusModule) membership() Membership {
+	cm.mu.Lock()
+	ids := append([]int{cm.id}, cm.peerIds...)
+	learners := make(map[int]bool)
+	for id := range cm.learners {
+		learners[id] = true
+	}
+	cm.mu.Unlock()
+
+	m := Membership{Voters: make(map[int]string), Learners: make(map[int]string)}
+	for _, id := range ids {
+		if learners[id] {
+			m.Learners[id] = cm.nodeAddr(id)
+		} else {
+			m.Voters[id] = cm.nodeAddr(id)
+		}
+	}
+	return m
+}
+
+// validateCommand validates the ID of the service of command, and command
+// if it's a configuration change.
+func (cm *ConsensusModule) validateCommand(command *Service) error {
+	switch command.Kind {
+	case CommandDeploy, CommandRemove, CommandMigrate, CommandExpire:
+		if !transfer.ValidID(command.ServiceID) {
+			return fmt.Errorf("%w: %q", ErrInvalidServiceID, command.ServiceID)
+		}
+		return nil
+	case CommandPreempt, CommandSchedule:
+		return fmt.Errorf("command %q is appended by the leader only", command.Kind)
+	case CommandCron:
+		payload, err := DecodeCommand(command)
+		if err != nil {
+			return err
+		}
+		return validateCron(payload.(CronPayload))
+	case CommandConfigChange:
+	default:
+		return nil
+	}
+	payload, err := DecodeCommand(command)
+	if err != nil {
+		return err
+	}
+	return cm.validateConfigChange(payload.(ConfigChangePayload))
+}
+
+// validateConfigChange checks the configuration of the cluster that change
+// results in, failing if it can't work and recording its warnings.
+func (cm *ConsensusModule) validateConfigChange(change ConfigChangePayload) error {
+	var errs []error
+	for _, id := range change.Remove {
+		_, added := change.Add[id]
+		_, learner := change.Learners[id]
+		if added || learner {
+			errs = append(errs, fmt.Errorf("%w: node %d both added and removed", ErrInvalidMembership, id))
+		}
+	}
+	if err := joinErrors(errs); err != nil {
+		return err
+	}
+
+	m := cm.membership()
+	for id, ip := range change.Learners {
+		if _, ok := m.Voters[id]; !ok {
+			m.Learners[id] = ip
+		}
+	}
+	for id, ip := range change.Add {
+		if _, ok := m.Learners[id]; !ok {
+			m.Voters[id] = ip
+		} else {
+			m.Learners[id] = ip
+		}
+	}
+	for _, id := range change.Promote {
+		if ip, ok := m.Learners[id]; ok {
+			delete(m.Learners, id)
+			m.Voters[id] = ip
+		}
+	}
+	for _, id := range change.Remove {
+		delete(m.Voters, id)
+		delete(m.Learners, id)
+	}
+	warnings, err := m.Validate()
+	cm.warn(warnings)
+	return err
+}
+
+// warn logs and records warnings.
+// Expects cm.mu to be unlocked.
+func (cm *ConsensusModule) warn(warnings []string) {
+	for _, warning := range warnings {
+		cm.logger.Printf("[%d] warning: %s", cm.id, warning)
+		cm.recordEventUnlocked(EventWarning, "%s", warning)
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quota limits the services a client submits through the APIs. A zero field
+// doesn't limit.
+type Quota struct {
+	// Rate is the submissions and uploads allowed per second on average,
+	// Burst how many are allowed at once; at least one.
+	Rate  float64 `json:",omitempty"`
+	Burst int     `json:",omitempty"`
+
+	// MaxPending is the submissions allowed at once before they're committed.
+	MaxPending int `json:",omitempty"`
+
+	// MaxBytesPerDay is the size of the artifacts allowed per day, UTC.
+	MaxBytesPerDay int64 `json:",omitempty"`
+}
+
+// ParseQuota parses a quota written as key=value settings: rate, burst,
+// pending and bytes-per-day, such as "rate=0.5 pending=3".
+func ParseQuota(settings []string) (Quota, error) {
+	var q Quota
+	for _, setting := range settings {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return Quota{}, fmt.Errorf("invalid quota %q, expected key=value", setting)
+		}
+		var err error
+		switch key {
+		case "rate":
+			q.Rate, err = strconv.ParseFloat(value, 64)
+		case "burst":
+			q.Burst, err = strconv.Atoi(value)
+		case "pending":
+			q.MaxPending, err = strconv.Atoi(value)
+		case "bytes-per-day":
+			q.MaxBytesPerDay, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return Quota{}, fmt.Errorf("unknown quota %q", key)
+		}
+		if err != nil || strings.HasPrefix(value, "-") {
+			return Quota{}, fmt.Errorf("invalid quota %s=%s", key, value)
+		}
+	}
+	return q, nil
+}
+
+// QuotaUsage is the usage of the quota of a client, see Server.QuotaUsage.
+type QuotaUsage struct {
+	Quota      Quota
+	Pending    int
+	BytesToday int64
+}
+
+// quotas tracks the usage of the quotas of the clients of a node. The usage
+// isn't replicated: the requests to the REST API are all counted by the
+// leader, the ones to the admin API by the node receiving them.
+type quotas struct {
+	mu      sync.Mutex
+	clients map[string]*clientUsage
+}
+
+type clientUsage struct {
+	quota Quota
+
+	// bucket allows the requests at quota.Rate
+	bucket tokenBucket
+
+	pending int
+	day     string
+	bytes   int64
+}
+
+func newQuotas() *quotas {
+	return &quotas{clients: make(map[string]*clientUsage)}
+}
+
+func (q *quotas) usage(p Principal, now time.Time) *clientUsage {
+	u := q.clients[p.Name]
+	if u == nil {
+		u = &clientUsage{}
+		q.clients[p.Name] = u
+	}
+	if u.quota != p.Quota {
+		// The tokens were reloaded with another quota.
+		u.quota = p.Quota
+		u.bucket = tokenBucket{}
+	}
+	if day := now.UTC().Format("2006-01-02"); day != u.day {
+		u.day, u.bytes = day, 0
+	}
+	return u
+}
+
+func (u *clientUsage) burst() int {
+	if u.quota.Burst > 0 {
+		return u.quota.Burst
+	}
+	return int(math.Max(1, math.Ceil(u.quota.Rate)))
+}
+
+// charge counts a request of p carrying an artifact of size bytes, returning
+// ErrQuotaExceeded if it exceeds the rate or the bytes per day of p.
+func (q *quotas) charge(p Principal, size int64, now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usage(p, now)
+	if u.quota.MaxBytesPerDay > 0 && u.bytes+size > u.quota.MaxBytesPerDay {
+		return fmt.Errorf("%w: %s exceeds %d bytes of artifacts per day", ErrQuotaExceeded, p.Name, u.quota.MaxBytesPerDay)
+	}
+	if u.quota.Rate > 0 && !u.bucket.take(u.quota.Rate, u.burst(), now) {
+		return fmt.Errorf("%w: %s exceeds %g requests per second", ErrQuotaExceeded, p.Name, u.quota.Rate)
+	}
+	u.bytes += size
+	return nil
+}
+
+// startSubmit counts a submission of p until release is called, returning
+// ErrQuotaExceeded if p has too many submissions pending already.
+func (q *quotas) startSubmit(p Principal, now time.Time) (release func(), err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usage(p, now)
+	if u.quota.MaxPending > 0 && u.pending >= u.quota.MaxPending {
+		return nil, fmt.Errorf("%w: %s has %d submissions pending", ErrQuotaExceeded, p.Name, u.pending)
+	}
+	u.pending++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			u.pending--
+			q.mu.Unlock()
+		})
+	}, nil
+}
+
+// QuotaUsage returns the usage of the quotas of the clients that used this
+// node, by name.
+func (s *Server) QuotaUsage() map[string]QuotaUsage {
+	now := s.cm.clock.Now()
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	usage := make(map[string]QuotaUsage, len(s.quotas.clients))
+	for name, u := range s.quotas.clients {
+		bytes := u.bytes
+		if u.day != now.UTC().Format("2006-01-02") {
+			bytes = 0
+		}
+		usage[name] = QuotaUsage{Quota: u.quota, Pending: u.pending, BytesToday: bytes}
+	}
+	return usage
+}
+
+// chargeQuota charges a request r carrying an artifact of size bytes to the
+// quota of its principal, see quotas.charge. The artifacts are refused while
+// the node is under memory pressure.
+func (s *Server) chargeQuota(r *http.Request, size int) error {
+	if s.cm.UnderMemoryPressure() {
+		return ErrMemoryPressure
+	}
+	principal, _ := PrincipalFrom(r.Context())
+	return s.quotas.charge(principal, int64(size), s.cm.clock.Now())
+}
+
+// startSubmit counts the submission of r as pending for its principal until
+// release is called, see quotas.startSubmit.
+func (s *Server) startSubmit(r *http.Request) (release func(), err error) {
+	principal, _ := PrincipalFrom(r.Context())
+	return s.quotas.startSubmit(principal, s.cm.clock.Now())
+}
+
+// releaseOnCommit calls release, the one of a submission counted by
+// startSubmit, once future is resolved.
+func (s *Server) releaseOnCommit(future *CommitFuture, release func()) {
+	s.cm.tasks.Go("release quota", func() {
+		<-future.Done()
+		release()
+	})
+}
+
+// quotaStatus returns the HTTP status of err, an error of the quotas.
+func quotaStatus(err error) int {
+	if errors.Is(err, ErrQuotaExceeded) {
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, ErrMemoryPressure) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"fmt"
+)
+
+// rejoinSnapshotGap is how many committed entries a returning node must
+// miss for it to catch up from a snapshot of the leader, instead of applying
+// the entries one by one.
+const rejoinSnapshotGap = 100
+
+type RejoinArgs struct {
+	Id          int
+	LogLength   int
+	LastApplied int
+}
+
+// RejoinReply carries the snapshot of the FSM of the leader, to be read with
+// the ReadSnapshot RPC, and the index of the last entry applied to it, if the
+// rejoining node is too far behind to apply the missing entries; SnapshotId
+// is 0 otherwise.
+type RejoinReply struct {
+	Term          int
+	SnapshotId    uint64
+	SnapshotSize  int
+	SnapshotIndex int
+}
+
+// Rejoin RPC, received by the leader from a node that returns after being
+// disconnected. The leader resumes sending it entries from the end of its log
+// and, if the node missed more than rejoinSnapshotGap entries, replies with a
+// snapshot to catch up from.
+func (cm *ConsensusModule) Rejoin(args RejoinArgs, reply *RejoinReply) error {
+	cm.mu.Lock()
+	if cm.state != Leader {
+		cm.mu.Unlock()
+		return ErrNotLeader
+	}
+	if args.LogLength < cm.nextIndex[args.Id] {
+		cm.nextIndex[args.Id] = args.LogLength
+	}
+	reply.Term = cm.currentTerm
+	gap := cm.lastApplied - args.LastApplied
+	cm.mu.Unlock()
+
+	if gap < rejoinSnapshotGap {
+		cm.recordEventUnlocked(EventStateChange, "node %d rejoins %d entries behind", args.Id, gap)
+		return nil
+	}
+	var err error
+	if reply.SnapshotId, reply.SnapshotSize, reply.SnapshotIndex, err = cm.openSnapshot(cm.ctx); err != nil {
+		return err
+	}
+	cm.recordEventUnlocked(EventStateChange, "node %d rejoins %d entries behind, from a snapshot", args.Id, gap)
+	return nil
+}
+
+// rejoin makes this CM catch up with the leader leaderId after being
+// disconnected, restoring the snapshot of the leader if it's too far behind.
+func (cm *ConsensusModule) rejoin(ctx context.Context, leaderId int) error {
+	cm.mu.Lock()
+	args := RejoinArgs{Id: cm.id, LogLength: len(cm.log), LastApplied: cm.lastApplied}
+	cm.mu.Unlock()
+	var reply RejoinReply
+	if err := cm.transport.CallContext(ctx, leaderId, "ConsensusModule.Rejoin", args, &reply); err != nil {
+		return fmt.Errorf("rejoining through %d: %w", leaderId, err)
+	}
+	if reply.SnapshotId == 0 {
+		return nil
+	}
+	snapshot, err := cm.fetchSnapshot(ctx, leaderId, reply.SnapshotId, reply.SnapshotSize)
+	if err != nil {
+		return err
+	}
+
+	if err := cm.restoreSnapshot(ctx, snapshot, reply.SnapshotIndex); err != nil {
+		return err
+	}
+	cm.recordEventUnlocked(EventStateChange, "caught up from a snapshot at index %d", reply.SnapshotIndex)
+	return nil
+}
+
+// rejoinIfBehind starts rejoining the leader of args if this CM missed more
+// than rejoinSnapshotGap committed entries and isn't rejoining already.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) rejoinIfBehind(args AppendEntriesArgs) {
+	if cm.rejoining || args.PrevLogIndex < len(cm.log) || args.LeaderCommit-cm.lastApplied < rejoinSnapshotGap {
+		return
+	}
+	cm.rejoining = true
+	cm.tasks.Go("rejoin", func() {
+		if err := cm.rejoin(cm.ctx, args.LeaderId); err != nil {
+			cm.Dlog("rejoin failed: %v", err)
+		}
+		cm.mu.Lock()
+		cm.rejoining = false
+		cm.mu.Unlock()
+	})
+}
+
+// Rejoin makes this server catch up with the leader after being
+// disconnected or restarted. It's also done automatically when the leader
+// sends entries far ahead of the log of this server.
+func (s *Server) Rejoin(ctx context.Context) error {
+	leaderId, _ := s.cm.GetLeader()
+	if leaderId < 0 {
+		return &NotLeaderError{LeaderId: -1}
+	}
+	if leaderId == s.serverId {
+		return nil
+	}
+	return s.cm.rejoin(ctx, leaderId)
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// setting is a parameter that can be changed while the node runs. Replicated
+// settings must have the same value on every node, so they're changed by
+// appending a CommandSetConfig entry to the log; the others only affect the
+// node they're set on.
+type setting struct {
+	replicated bool
+	get        func(c Config) string
+	set        func(c *Config, value string) error
+}
+
+func durationSetting(replicated bool, field func(c *Config) *time.Duration) setting {
+	return setting{
+		replicated: replicated,
+		get:        func(c Config) string { return field(&c).String() },
+		set: func(c *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			*field(c) = d
+			return nil
+		},
+	}
+}
+
+// settings lists the runtime settings by the name of their flag. The debug
+// setting takes the same values as the DEBUG environment variable.
+var settings = map[string]setting{
+	"load-poll-interval":       durationSetting(false, func(c *Config) *time.Duration { return &c.LoadPollInterval }),
+	"vote-delay":               durationSetting(true, func(c *Config) *time.Duration { return &c.VoteDelay }),
+	"transfer-backoff":         durationSetting(false, func(c *Config) *time.Duration { return &c.TransferBackoff }),
+	"replication-batch-window": durationSetting(false, func(c *Config) *time.Duration { return &c.ReplicationBatchWindow }),
+	"rpc-timeout-min":          durationSetting(false, func(c *Config) *time.Duration { return &c.RPCTimeoutMin }),
+	"rpc-timeout-max":          durationSetting(false, func(c *Config) *time.Duration { return &c.RPCTimeoutMax }),
+	"alert-stuck-after":        durationSetting(false, func(c *Config) *time.Duration { return &c.AlertStuckAfter }),
+	"evict-after":              durationSetting(false, func(c *Config) *time.Duration { return &c.EvictAfter }),
+	"never-evict": {
+		get: func(c Config) string { return strconv.FormatBool(c.NeverEvict) },
+		set: func(c *Config, value string) error {
+			b, err := strconv.ParseBool(value)
+			c.NeverEvict = b
+			return err
+		},
+	},
+	"transfer-retries": {
+		get: func(c Config) string { return strconv.Itoa(c.TransferRetries) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			c.TransferRetries = n
+			return err
+		},
+	},
+	"vote-rate-limit": {
+		get: func(c Config) string { return strconv.Itoa(c.VoteRateLimit) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			c.VoteRateLimit = n
+			return err
+		},
+	},
+	"max-term-jump": {
+		get: func(c Config) string { return strconv.Itoa(c.MaxTermJump) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			c.MaxTermJump = n
+			return err
+		},
+	},
+	"saturated-load": {
+		replicated: true,
+		get:        func(c Config) string { return strconv.Itoa(c.SaturatedLoad) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			c.SaturatedLoad = n
+			return err
+		},
+	},
+	"memory-limit": {
+		get: func(c Config) string { return strconv.FormatInt(c.MemoryLimit, 10) },
+		set: func(c *Config, value string) error {
+			n, err := ParseBytes(value)
+			c.MemoryLimit = n
+			return err
+		},
+	},
+	"unreliable-rpc": {
+		get: func(c Config) string { return strconv.FormatBool(c.UnreliableRPC) },
+		set: func(c *Config, value string) error {
+			b, err := strconv.ParseBool(value)
+			c.UnreliableRPC = b
+			return err
+		},
+	},
+	"debug": {
+		get: func(c Config) string {
+			var enabled []string
+			for _, component := range Components {
+				if DebugEnabled(component) {
+					enabled = append(enabled, component)
+				}
+			}
+			if len(enabled) == 0 {
+				return "0"
+			}
+			return strings.Join(enabled, ",")
+		},
+		set: func(c *Config, value string) error {
+			enabled := parseDebug(value)
+			for _, component := range Components {
+				SetDebug(component, enabled[component])
+			}
+			return nil
+		},
+	},
+}
+
+// Config returns the current configuration of this CM.
+func (cm *ConsensusModule) Config() Config {
+	cm.configMu.RLock()
+	defer cm.configMu.RUnlock()
+	return cm.config
+}
+
+// setConfig changes the runtime setting name of this CM, if the resulting
+// configuration is valid.
+func (cm *ConsensusModule) setConfig(name string, value string) error {
+	s, ok := settings[name]
+	if !ok {
+		return fmt.Errorf("unknown setting %q", name)
+	}
+	cm.configMu.Lock()
+	config := cm.config
+	err := s.set(&config, value)
+	if err == nil {
+		err = config.Validate()
+	}
+	if err == nil {
+		cm.config = config
+	}
+	cm.configMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	cm.recordEventUnlocked(EventStateChange, "setting %s changed to %s", name, value)
+	return nil
+}
+
+// Settings returns the current value of every runtime setting.
+func (s *Server) Settings() map[string]string {
+	config := s.cm.Config()
+	values := make(map[string]string, len(settings))
+	for name, setting := range settings {
+		values[name] = setting.get(config)
+	}
+	return values
+}
+
+// SetConfig changes the runtime setting name. Replicated settings are
+// submitted to the cluster and SetConfig waits until they're committed; the
+// others are changed on this node only.
+func (s *Server) SetConfig(ctx context.Context, name string, value string) error {
+	setting, ok := settings[name]
+	if !ok {
+		return fmt.Errorf("unknown setting %q", name)
+	}
+	if !setting.replicated {
+		return s.cm.setConfig(name, value)
+	}
+
+	// Check the value before replicating it, since every node would fail to
+	// apply it.
+	config := s.cm.Config()
+	if err := setting.set(&config, value); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	command, err := NewCommand(CommandSetConfig, "", SetConfigPayload{Name: name, Value: value})
+	if err != nil {
+		return err
+	}
+	_, _, _, future := s.Submit(ctx, command)
+	return future.WaitContext(ctx)
+}
+
+// ReloadConfig applies the settings in the file at path, one name=value per
+// line. Empty lines and lines starting with # are skipped.
+func (s *Server) ReloadConfig(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var errs []error
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			errs = append(errs, fmt.Errorf("invalid line %q", line))
+			continue
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if current, ok := s.Settings()[name]; ok && current == value {
+			continue
+		}
+		if err := s.SetConfig(ctx, name, value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return joinErrors(errs)
+}
+
+// HandleReloadSignal applies the settings in config.ReloadPath whenever the
+// process receives SIGHUP. Returns when the server is shut down.
+func (s *Server) HandleReloadSignal() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-sigChan:
+		case <-s.Done():
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := s.ReloadConfig(ctx, s.config.ReloadPath)
+		cancel()
+		if err != nil {
+			log.Printf("[%v] SIGHUP received, reloading %s: %v", s.serverId, s.config.ReloadPath, err)
+		} else {
+			log.Printf("[%v] SIGHUP received, %s reloaded", s.serverId, s.config.ReloadPath)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"sync"
+
+	"server/clock"
+)
+
+// maxPooledBatch is the capacity above which an entry batch isn't returned
+// to entryBatchPool, so that catching up a peer far behind doesn't pin a
+// large buffer.
+const maxPooledBatch = 1024
+
+// entryBatchPool recycles the batches of entries sent in the AEs.
+var entryBatchPool = sync.Pool{
+	New: func() interface{} {
+		batch := make([]LogEntry, 0, 64)
+		return &batch
+	},
+}
+
+// replicate sends an AE to the peer of w, collects its reply and adjusts
+// cm's state.
+func (cm *ConsensusModule) replicate(w *peerWorker) {
+	peerId := w.peerId
+	cm.mu.Lock()
+	if cm.state != Leader {
+		cm.mu.Unlock()
+		return
+	}
+	savedCurrentTerm := cm.currentTerm
+	ni := cm.nextIndex[peerId]
+	prevLogIndex := ni - 1
+	prevLogTerm := -1
+	if prevLogIndex >= 0 {
+		prevLogTerm = cm.log[prevLogIndex].Term
+	}
+	// The entries are copied, since the log may be appended to or truncated
+	// while the RPC marshals them. The batch is only recycled once the
+	// transport is done with it, see recycle.
+	batch := entryBatchPool.Get().(*[]LogEntry)
+	entries := append((*batch)[:0], cm.log[ni:]...)
+	recycle := false
+	defer func() {
+		if recycle && cap(entries) <= maxPooledBatch {
+			*batch = entries[:0]
+			entryBatchPool.Put(batch)
+		}
+	}()
+	chosenId := -1
+	if len(entries) > 0 {
+		chosenId = entries[0].ChosenId
+	}
+
+	w.args = AppendEntriesArgs{
+		Term:         savedCurrentTerm,
+		LeaderId:     cm.id,
+		PrevLogIndex: prevLogIndex,
+		PrevLogTerm:  prevLogTerm,
+		Entries:      entries,
+		LeaderCommit: cm.commitIndex,
+		ChosenId:     chosenId,
+		Seq:          cm.nextSeq(),
+	}
+	cm.mu.Unlock()
+	// The entries are copied, so they're signed without holding cm.mu.
+	signature, err := cm.sign(w.args)
+	if err != nil {
+		cm.Dlog("signing AppendEntries to %d: %v", peerId, err)
+		return
+	}
+	w.args.Signature = signature
+	cm.Dlog("sending AppendEntries to %v: ni=%d, args=%+v", peerId, ni, w.args)
+	// The reply is reset, since gob doesn't send the zero fields.
+	reply := w.reply
+	*reply = AppendEntriesReply{}
+	ctx, cancel := clock.WithTimeout(cm.clock, cm.ctx, cm.rpcTimeout(peerId))
+	defer cancel()
+	start := cm.clock.Now()
+	err = cm.transport.CallContext(ctx, peerId, "ConsensusModule.AppendEntries", w.args, reply)
+	if err == nil {
+		if err = cm.verifyReply(peerId, *reply, reply.Seq, w.args.Seq, reply.Signature); err != nil {
+			cm.Dlog("refusing AppendEntries reply from %d: %v", peerId, err)
+		}
+	}
+	if err != nil {
+		// A call given up may still write its reply.
+		w.reply = &AppendEntriesReply{}
+	}
+	// A net/rpc call that completed has encoded its args. A call given up
+	// may still be encoding them, and another transport, set with
+	// WithTransport, may keep them to deliver them later, so their batch is
+	// left to the garbage collector.
+	recycle = err == nil && cm.server != nil && cm.server.ownsTransport()
+	cm.peersMu.Lock()
+	status := cm.recordContact(peerId, start, err)
+	if err != nil && !cm.peerUnreachable[peerId] {
+		cm.unreachableSince[peerId] = cm.clock.Now()
+	}
+	cm.peerUnreachable[peerId] = err != nil
+	cm.peersMu.Unlock()
+	if status != "" {
+		cm.recordEventUnlocked(EventStateChange, "peer %d is %s", peerId, status)
+	}
+	if err != nil {
+		return
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if reply.Term > cm.currentTerm {
+		cm.Dlog("term out of date in heartbeat reply")
+		cm.becomeFollower(reply.Term)
+		return
+	}
+	if cm.state != Leader || savedCurrentTerm != reply.Term {
+		return
+	}
+
+	if reply.Success {
+		cm.nextIndex[peerId] = ni + len(entries)
+		cm.matchIndex[peerId] = cm.nextIndex[peerId] - 1
+		cm.promoteIfCaughtUp(peerId)
+		cm.Dlog("AppendEntries reply from %d success: nextIndex := %v, matchIndex := %v", peerId, cm.nextIndex, cm.matchIndex)
+		cm.advanceCommitIndex()
+		return
+	}
+
+	if reply.ConflictTerm >= 0 {
+		if _, lastIndexOfTerm, ok := cm.terms.bounds(reply.ConflictTerm); ok {
+			cm.nextIndex[peerId] = lastIndexOfTerm + 1
+		} else {
+			cm.nextIndex[peerId] = reply.ConflictIndex
+		}
+	} else {
+		cm.nextIndex[peerId] = reply.ConflictIndex
+	}
+	cm.Dlog("AppendEntries reply from %d !success: nextIndex := %d", peerId, cm.nextIndex[peerId])
+	cm.recordEvent(EventConflict, "log of %d conflicts at index %d, nextIndex := %d", peerId, ni, cm.nextIndex[peerId])
+	// The AEs stop between submits, see Pause, so the peer is retried from
+	// its new nextIndex right away rather than at the next submit.
+	if cm.nextIndex[peerId] < ni {
+		cm.notify(w.replicate)
+	}
+}
+
+// advanceCommitIndex commits the entries of the current term held by a
+// majority of the voters. The leader counts itself only for the entries it
+// has persisted, see persistAppended.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) advanceCommitIndex() {
+	if cm.state != Leader {
+		return
+	}
+	savedCommitIndex := cm.commitIndex
+	for i := cm.commitIndex + 1; i < len(cm.log); i++ {
+		if cm.log[i].Term == cm.currentTerm {
+			matchCount := 0
+			if i < cm.persisted {
+				matchCount++
+			}
+			for _, peerId := range cm.peerIds {
+				if !cm.learners[peerId] && cm.matchIndex[peerId] >= i {
+					matchCount++
+				}
+			}
+			if matchCount*2 > cm.voters()+1 {
+				cm.commitIndex = i
+			}
+		}
+	}
+	if cm.commitIndex != savedCommitIndex {
+		cm.Dlog("leader sets commitIndex := %d", cm.commitIndex)
+		cm.resolveFutures()
+		cm.signalAdvance()
+		for _, entry := range cm.log[savedCommitIndex+1 : cm.commitIndex+1] {
+			cm.metrics.Committed(entry.Index)
+		}
+		// Commit index changed: the leader considers new entries to be
+		// committed. Apply new entries to the state machine and notify
+		// followers by sending them AEs.
+		cm.notify(cm.newCommitReadyChan)
+		cm.notify(cm.triggerAEChan)
+	}
+}
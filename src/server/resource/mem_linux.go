@@ -0,0 +1,45 @@
+package load
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// getMem returns the total and the available memory of the node, in kB, read
+// from /proc/meminfo.
+func getMem() (total float64, free float64) {
+	// Reads the /proc/meminfo file
+	contents, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return
+	}
+
+	// Parses the file
+	lines := strings.Split(string(contents), "\n")
+	for _, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) != 2 {
+			continue
+		}
+		fields[1] = strings.Replace(fields[1], "kB", "", -1)
+		fields[1] = strings.TrimSpace(fields[1])
+		if fields[0] == "MemTotal" {
+			total, err = strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				fmt.Printf("error parsing mem stat: %v\n", err)
+			}
+		} else if fields[0] == "MemAvailable" {
+			free, err = strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				fmt.Printf("error parsing mem stat: %v\n", err)
+			}
+		} else {
+			continue
+		}
+	}
+
+	// Returns the total and free memory
+	return total, free
+}
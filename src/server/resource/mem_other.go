@@ -0,0 +1,15 @@
+//go:build !linux
+
+package load
+
+import "github.com/shirou/gopsutil/mem"
+
+// getMem returns the total and the available memory of the node, in kB, as
+// reported by the platform, such as Windows and macOS.
+func getMem() (total float64, free float64) {
+	vm, err := mem.VirtualMemory()
+	if err != nil {
+		return 0, 0
+	}
+	return float64(vm.Total) / 1024, float64(vm.Available) / 1024
+}
@@ -2,67 +2,46 @@ package load
 
 import (
 	"github.com/shirou/gopsutil/cpu"
-	"fmt"
-	"os"
-	"strconv"
-	"strings"
+	loadavg "github.com/shirou/gopsutil/load"
+	"math"
+	"runtime"
 	"time"
 )
 
 func getCPUPercent() float64 {
 	// Gets per-core CPU usage in 5 ms
 	perc, err :=  cpu.Percent(5 * time.Millisecond, true)
+	if err != nil || len(perc) == 0 {
+		// Not every platform reports the usage of the cores, such as
+		// macOS without cgo
+		return loadAvgPercent()
+	}
 	sum := 0.0
 	
 	// Sums all the usages
 	for _,core := range perc {
 		sum += core
 	}
-	if err != nil {
-		return 0
-	}
 	
 	// Returns the average
 	return sum / float64(len(perc))
 }
 
-func getMem() (total float64, free float64) {
-	// Reads the /proc/meminfo file
-	contents, err := os.ReadFile("/proc/meminfo")
+// loadAvgPercent estimates the CPU usage from the load average of the last
+// minute, the runnable processes per core.
+func loadAvgPercent() float64 {
+	avg, err := loadavg.Avg()
 	if err != nil {
-		return 
-	}
-
-	// Parses the file
-	lines := strings.Split(string(contents), "\n")
-	for _, line := range lines {
-		fields := strings.Split(line, ":")
-		if len(fields) != 2 {
-			continue
-		}
-		fields[1] = strings.Replace(fields[1], "kB", "", -1)
-		fields[1] = strings.TrimSpace(fields[1])
-		if fields[0] == "MemTotal" {
-			total, err = strconv.ParseFloat(fields[1], 64)
-			if err != nil {
-				fmt.Printf("error parsing mem stat: %v\n", err)
-			}
-		} else if fields[0] == "MemAvailable" {
-			free, err = strconv.ParseFloat(fields[1], 64)
-			if err != nil {
-				fmt.Printf("error parsing mem stat: %v\n", err)
-			}
-		} else {
-			continue
-		}
+		return 0
 	}
-
-	// Returns the total and free memory
-	return total, free
+	return math.Min(100, 100 * avg.Load1 / float64(runtime.NumCPU()))
 }
 
 func getMemPercent() float64 {
 	total, free := getMem()
+	if total <= 0 {
+		return 0
+	}
 	return 100 * (1 - free / total)
 }
 
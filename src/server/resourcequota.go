@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"server/scheduler"
+	"strconv"
+	"strings"
+)
+
+// DefaultNamespace is the namespace of the services whose manifest doesn't
+// declare one.
+const DefaultNamespace = "default"
+
+// Resources are the resources requested by a service, declared by its
+// manifest, or the ones allowed by a resource quota. A zero field of a quota
+// doesn't limit.
+type Resources struct {
+	// CPU is in cores, such as 0.5.
+	CPU float64 `json:",omitempty"`
+
+	// Memory is in bytes.
+	Memory int64 `json:",omitempty"`
+
+	// Services is the number of services, one for a service.
+	Services int `json:",omitempty"`
+}
+
+func (r Resources) add(other Resources) Resources {
+	return Resources{CPU: r.CPU + other.CPU, Memory: r.Memory + other.Memory, Services: r.Services + other.Services}
+}
+
+// exceeding describes the first resource of r above quota, or returns "" if
+// r fits in it.
+func (r Resources) exceeding(quota Resources) string {
+	switch {
+	case quota.CPU > 0 && r.CPU > quota.CPU:
+		return fmt.Sprintf("cpu %.4g > %.4g", r.CPU, quota.CPU)
+	case quota.Memory > 0 && r.Memory > quota.Memory:
+		return fmt.Sprintf("memory %d > %d", r.Memory, quota.Memory)
+	case quota.Services > 0 && r.Services > quota.Services:
+		return fmt.Sprintf("services %d > %d", r.Services, quota.Services)
+	}
+	return ""
+}
+
+// ParseResources parses resources written as key=value settings: cpu, in
+// cores, memory, in bytes with an optional unit among K, M, G, T and Ki, Mi,
+// Gi, Ti, and services, such as "cpu=4 memory=8Gi services=10".
+func ParseResources(settings []string) (Resources, error) {
+	var r Resources
+	for _, setting := range settings {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return Resources{}, fmt.Errorf("invalid resource %q, expected key=value", setting)
+		}
+		var err error
+		switch key {
+		case "cpu":
+			r.CPU, err = strconv.ParseFloat(value, 64)
+		case "memory":
+			r.Memory, err = ParseBytes(value)
+		case "services":
+			r.Services, err = strconv.Atoi(value)
+		default:
+			return Resources{}, fmt.Errorf("unknown resource %q", key)
+		}
+		if err != nil || strings.HasPrefix(value, "-") {
+			return Resources{}, fmt.Errorf("invalid resource %s=%s", key, value)
+		}
+	}
+	return r, nil
+}
+
+// byteUnits are the units of ParseBytes, the binary ones first so that "Mi"
+// isn't read as "M".
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+}
+
+// ParseBytes parses a size in bytes, such as "512Mi" or "1G".
+func ParseBytes(s string) (int64, error) {
+	digits, size := s, int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			digits, size = strings.TrimSuffix(s, unit.suffix), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/size {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * size, nil
+}
+
+// ResourceQuotas limit the resources requested by the services running in
+// the cluster, by namespace and by client, the principal that submitted
+// them, see Config.ResourceQuotasPath. The namespaces and the clients
+// without quota aren't limited.
+type ResourceQuotas struct {
+	Namespaces map[string]Resources
+	Clients    map[string]Resources
+}
+
+// LoadResourceQuotas reads the file of resource quotas at path, with one
+// quota per line: "namespace" or "client", its name and its resources as
+// accepted by ParseResources, such as "namespace team-a cpu=4 memory=8Gi".
+// Empty lines and lines starting with # are ignored.
+func LoadResourceQuotas(path string) (*ResourceQuotas, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	q := &ResourceQuotas{Namespaces: make(map[string]Resources), Clients: make(map[string]Resources)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected kind, name and resources", path, line)
+		}
+		var quotas map[string]Resources
+		switch fields[0] {
+		case "namespace":
+			quotas = q.Namespaces
+		case "client":
+			quotas = q.Clients
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown kind %q, expected namespace or client", path, line, fields[0])
+		}
+		if _, ok := quotas[fields[1]]; ok {
+			return nil, fmt.Errorf("%s:%d: %s %s listed twice", path, line, fields[0], fields[1])
+		}
+		resources, err := ParseResources(fields[2:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		quotas[fields[1]] = resources
+	}
+	return q, scanner.Err()
+}
+
+// ResourceUsage is the resources Used by the services of a namespace or of a
+// client, and its Quota, zero if none.
+type ResourceUsage struct {
+	Used  Resources
+	Quota Resources
+}
+
+// TenantUsage is the usage of the resources of the cluster, by namespace and
+// by client, see Server.ResourceUsage.
+type TenantUsage struct {
+	Namespaces map[string]ResourceUsage
+	Clients    map[string]ResourceUsage
+}
+
+// requested returns the resources requested by the service deployed with p.
+func (p DeployPayload) requested() Resources {
+	r := Resources{Services: 1}
+	if p.Resources != nil {
+		r.CPU, r.Memory = p.Resources.CPU, p.Resources.Memory
+	}
+	return r
+}
+
+// scheduled returns the resources of r the schedulers compare to the
+// capacity of the nodes.
+func (r Resources) scheduled() scheduler.Resources {
+	return scheduler.Resources{CPU: r.CPU, Memory: r.Memory}
+}
+
+// namespace returns the namespace of the service deployed with p.
+func (p DeployPayload) namespace() string {
+	if p.Namespace == "" {
+		return DefaultNamespace
+	}
+	return p.Namespace
+}
+
+// resourceUsage returns the resources requested by the services the log,
+// committed or not, runs, but except, by namespace and by client. The
+// services only scheduled don't count until they're placed.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) resourceUsage(except string) (namespaces map[string]Resources, clients map[string]Resources) {
+	namespaces, clients = make(map[string]Resources), make(map[string]Resources)
+	for serviceId, p := range cm.placements() {
+		if serviceId == except {
+			continue
+		}
+		requested := p.deploy.requested()
+		namespace := p.deploy.namespace()
+		namespaces[namespace] = namespaces[namespace].add(requested)
+		if p.deploy.Client != "" {
+			clients[p.deploy.Client] = clients[p.deploy.Client].add(requested)
+		}
+	}
+	return namespaces, clients
+}
+
+// freeResources returns the resources left on the nodes that registered
+// their capacity by the services the log, committed or not, runs on them, but
+// except. A zero field of a capacity doesn't limit.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) freeResources(except string) map[int]scheduler.Resources {
+	if len(cm.capacity) == 0 {
+		return nil
+	}
+	used := make(map[int]Resources)
+	for serviceId, p := range cm.placements() {
+		if serviceId != except {
+			used[p.node] = used[p.node].add(p.deploy.requested())
+		}
+	}
+	free := make(map[int]scheduler.Resources, len(cm.capacity))
+	for id, capacity := range cm.capacity {
+		left := scheduler.Resources{CPU: math.Inf(1), Memory: math.MaxInt64}
+		if capacity.CPU > 0 {
+			left.CPU = capacity.CPU - used[id].CPU
+		}
+		if capacity.Memory > 0 {
+			left.Memory = capacity.Memory - used[id].Memory
+		}
+		free[id] = left
+	}
+	return free
+}
+
+// RegisterCapacity replaces the capacity of this server, the cpu and memory
+// it offers to the services, in the configuration of the cluster, and waits
+// until the change is committed: the schedulers only choose it for the
+// services whose requested resources fit in what the services already
+// placed on it leave.
+func (s *Server) RegisterCapacity(ctx context.Context, capacity Resources) error {
+	return s.submitConfigChange(ctx, ConfigChangePayload{
+		Capacity: map[int]Resources{s.serverId: capacity},
+	})
+}
+
+// checkResourceQuotas returns an error wrapping ErrQuotaExceeded if running
+// the service serviceId, deployed with deploy, would exceed the resource quota
+// of its namespace or of its client.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) checkResourceQuotas(serviceId string, deploy DeployPayload) error {
+	if cm.resourceQuotas == nil {
+		return nil
+	}
+	namespaces, clients := cm.resourceUsage(serviceId)
+	requested := deploy.requested()
+	namespace := deploy.namespace()
+	if quota, ok := cm.resourceQuotas.Namespaces[namespace]; ok {
+		if over := namespaces[namespace].add(requested).exceeding(quota); over != "" {
+			return fmt.Errorf("%w: namespace %s would use %s", ErrQuotaExceeded, namespace, over)
+		}
+	}
+	if quota, ok := cm.resourceQuotas.Clients[deploy.Client]; ok && deploy.Client != "" {
+		if over := clients[deploy.Client].add(requested).exceeding(quota); over != "" {
+			return fmt.Errorf("%w: client %s would use %s", ErrQuotaExceeded, deploy.Client, over)
+		}
+	}
+	return nil
+}
+
+// ResourceUsage returns the resources requested by the services running in
+// the cluster, as known by this CM, and the resource quotas, by namespace
+// and by client. Every namespace and client with a quota or a service is
+// listed.
+func (cm *ConsensusModule) ResourceUsage() TenantUsage {
+	cm.mu.RLock()
+	namespaces, clients := cm.resourceUsage("")
+	cm.mu.RUnlock()
+	usage := TenantUsage{Namespaces: make(map[string]ResourceUsage), Clients: make(map[string]ResourceUsage)}
+	for namespace, used := range namespaces {
+		usage.Namespaces[namespace] = ResourceUsage{Used: used}
+	}
+	for client, used := range clients {
+		usage.Clients[client] = ResourceUsage{Used: used}
+	}
+	if cm.resourceQuotas != nil {
+		for namespace, quota := range cm.resourceQuotas.Namespaces {
+			usage.Namespaces[namespace] = ResourceUsage{Used: namespaces[namespace], Quota: quota}
+		}
+		for client, quota := range cm.resourceQuotas.Clients {
+			usage.Clients[client] = ResourceUsage{Used: clients[client], Quota: quota}
+		}
+	}
+	return usage
+}
+
+// ResourceUsage returns the usage of the resources of the cluster, see
+// ConsensusModule.ResourceUsage.
+func (s *Server) ResourceUsage() TenantUsage {
+	return s.cm.ResourceUsage()
+}
+
+// submittedBy returns a copy of service, a deployment, submitted by the
+// client name, whose resource quota it's charged to.
+func submittedBy(service *Service, name string) (*Service, error) {
+	payload, err := DecodeCommand(service)
+	if err != nil {
+		return nil, err
+	}
+	deploy := payload.(DeployPayload)
+	deploy.Client = name
+	submitted := *service
+	if submitted.Payload, err = json.Marshal(deploy); err != nil {
+		return nil, err
+	}
+	return &submitted, nil
+}
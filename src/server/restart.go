@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// restartPollInterval is how often a rolling restart checks whether the
+	// restarted node is back.
+	restartPollInterval = 500 * time.Millisecond
+
+	// restartCatchUpLag is how many entries a restarted node may lag behind
+	// the leader to be considered caught up.
+	restartCatchUpLag = 1
+)
+
+// ErrRestartUnsupported is returned by the nodes that don't know how to
+// restart themselves.
+var ErrRestartUnsupported = errors.New("restart not supported")
+
+type RestartArgs struct{}
+
+type RestartReply struct{}
+
+// Restart makes this node restart itself with the function of WithRestart,
+// after the reply is sent, unless it's stopped first.
+func (cm *ConsensusModule) Restart(args RestartArgs, reply *RestartReply) error {
+	if cm.restart == nil {
+		return ErrRestartUnsupported
+	}
+	cm.recordEventUnlocked(EventStateChange, "restarting")
+	cm.tasks.Go("restart", func() {
+		select {
+		case <-cm.clock.After(restartPollInterval):
+		case <-cm.Done():
+			return
+		}
+		cm.restart()
+	})
+	return nil
+}
+
+// RollingRestart restarts the nodes of the cluster one at a time, waiting
+// for every node to be back and caught up with the log before restarting the
+// next one, so that the quorum is never lost by more than one node at a time.
+// It must be called on the leader, which restarts itself last after
+// transferring its leadership to a caught up peer.
+func (s *Server) RollingRestart(ctx context.Context) error {
+	cm := s.cm
+	cm.mu.Lock()
+	isLeader := cm.state == Leader
+	peerIds := append([]int{}, cm.peerIds...)
+	cm.mu.Unlock()
+	if !isLeader {
+		leaderId, leaderAddr := cm.GetLeader()
+		return &NotLeaderError{LeaderId: leaderId, LeaderAddr: leaderAddr}
+	}
+
+	sort.Ints(peerIds)
+	for _, peerId := range peerIds {
+		if err := s.restartPeer(ctx, peerId); err != nil {
+			return fmt.Errorf("restarting %d: %w", peerId, err)
+		}
+	}
+
+	if cm.restart == nil {
+		return ErrRestartUnsupported
+	}
+	if len(peerIds) > 0 {
+		if err := s.TransferLeadership(ctx, peerIds[0]); err != nil {
+			return fmt.Errorf("transferring leadership to %d: %w", peerIds[0], err)
+		}
+	}
+	return cm.Restart(RestartArgs{}, &RestartReply{})
+}
+
+// restartPeer restarts the node peerId and waits until it's reconnected and
+// caught up.
+func (s *Server) restartPeer(ctx context.Context, peerId int) error {
+	cm := s.cm
+	addr := s.PeerAddr(peerId)
+	if addr == nil {
+		return fmt.Errorf("node %d not connected", peerId)
+	}
+	var before ClusterInfo
+	if err := s.CallContext(ctx, peerId, "ConsensusModule.ClusterInfo", ClusterInfoArgs{}, &before); err != nil {
+		return err
+	}
+	if err := s.CallContext(ctx, peerId, "ConsensusModule.Restart", RestartArgs{}, &RestartReply{}); err != nil {
+		return err
+	}
+	// The connection to the node breaks when it restarts: it's opened again
+	// until it reaches the new run of the node, whose log is then matched
+	// from scratch.
+	s.RemoveNode(peerId)
+	for restarted := false; ; {
+		select {
+		case <-cm.clock.After(restartPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !restarted {
+			var after ClusterInfo
+			if s.PeerAddr(peerId) == nil && s.AddNode(peerId, addr.String()) != nil {
+				continue
+			}
+			if err := s.CallContext(ctx, peerId, "ConsensusModule.ClusterInfo", ClusterInfoArgs{}, &after); err != nil || after.StartedAt.Equal(before.StartedAt) {
+				s.RemoveNode(peerId)
+				continue
+			}
+			restarted = true
+			cm.mu.Lock()
+			cm.matchIndex[peerId] = -1
+			cm.mu.Unlock()
+			continue
+		}
+		cm.mu.Lock()
+		caughtUp := cm.matchIndex[peerId] >= len(cm.log)-1-restartCatchUpLag
+		cm.mu.Unlock()
+		if caughtUp {
+			cm.recordEventUnlocked(EventStateChange, "node %d restarted and caught up", peerId)
+			return nil
+		}
+	}
+}
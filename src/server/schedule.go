@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// scheduleCheckInterval is how often the leader looks for the scheduled
+// deployments that are due.
+const scheduleCheckInterval = time.Second
+
+// ScheduledDeployment is a deployment waiting in the log for its NotBefore
+// time, in the CommandSchedule entry at Index.
+type ScheduledDeployment struct {
+	ServiceID string
+	NotBefore time.Time
+	Index     int
+}
+
+// scheduledDeployments returns the pending queue: the committed
+// CommandSchedule entries followed by no other entry about their service,
+// soonest first.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) scheduledDeployments() []ScheduledDeployment {
+	var pending []ScheduledDeployment
+	for i := 0; i <= cm.commitIndex && i < len(cm.log); i++ {
+		command := cm.log[i].Command
+		if command.Kind != CommandSchedule || cm.lastServiceEntry(command.ServiceID) != i {
+			continue
+		}
+		payload, err := DecodeCommand(&command)
+		if err != nil || payload.(DeployPayload).NotBefore == nil {
+			continue
+		}
+		pending = append(pending, ScheduledDeployment{ServiceID: command.ServiceID, NotBefore: *payload.(DeployPayload).NotBefore, Index: i})
+	}
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].NotBefore.Before(pending[j].NotBefore) })
+	return pending
+}
+
+// ScheduledDeployments returns the deployments waiting for their NotBefore
+// time in the log of this node, soonest first.
+func (s *Server) ScheduledDeployments() []ScheduledDeployment {
+	s.cm.mu.RLock()
+	defer s.cm.mu.RUnlock()
+	return s.cm.scheduledDeployments()
+}
+
+// deployScheduled runs on the leader: it submits the deployment of every
+// scheduled service whose NotBefore time has come, placing it like any other.
+// The queue lives in the log, so the deployments due during a change of
+// leader are placed by the next one. Returns when ctx is done.
+func (cm *ConsensusModule) deployScheduled(ctx context.Context) {
+	for {
+		select {
+		case <-cm.clock.After(scheduleCheckInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		now := cm.clock.Now()
+		var due []Service
+		cm.mu.RLock()
+		for _, scheduled := range cm.scheduledDeployments() {
+			if scheduled.NotBefore.After(now) {
+				break
+			}
+			command := cm.log[scheduled.Index].Command
+			command.Kind = CommandDeploy
+			due = append(due, command)
+		}
+		cm.mu.RUnlock()
+
+		for i := range due {
+			_, _, _, future := cm.appendCommand(&due[i])
+			if err := future.WaitContext(ctx); err != nil {
+				cm.Dlog("deployment of scheduled %s failed: %v", due[i].ServiceID, err)
+				break
+			}
+		}
+	}
+}
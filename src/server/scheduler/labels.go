@@ -0,0 +1,75 @@
+package scheduler
+
+import "sync"
+
+// AffinityScheduler only lets Next choose among the nodes that have all
+// Labels, or self if none of them is left.
+type AffinityScheduler struct {
+	Labels map[string]string
+	Next   Scheduler
+}
+
+func (a AffinityScheduler) Choose(self int, loadLevels map[int]int, drained map[int]bool, labels map[int]map[string]string, requested Resources, free map[int]Resources) int {
+	drained = unfit(loadLevels, drained, requested, free)
+	excluded := make(map[int]bool)
+	candidates := 0
+	for nodeId := range loadLevels {
+		if drained[nodeId] || !matches(labels[nodeId], a.Labels) {
+			excluded[nodeId] = true
+		} else {
+			candidates++
+		}
+	}
+	if candidates == 0 {
+		return self
+	}
+	return a.Next.Choose(self, loadLevels, excluded, labels, requested, free)
+}
+
+// SpreadScheduler spreads the services across the values of Label, such as
+// the zones of the nodes: it lets Next choose among the nodes left whose
+// value was chosen the fewest times, the nodes without Label sharing the
+// empty value.
+type SpreadScheduler struct {
+	Label string
+	Next  Scheduler
+
+	mu     sync.Mutex
+	chosen map[string]int
+}
+
+func (s *SpreadScheduler) Choose(self int, loadLevels map[int]int, drained map[int]bool, labels map[int]map[string]string, requested Resources, free map[int]Resources) int {
+	drained = unfit(loadLevels, drained, requested, free)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chosen == nil {
+		s.chosen = make(map[string]int)
+	}
+
+	fewest := -1
+	for nodeId := range loadLevels {
+		if n := s.chosen[labels[nodeId][s.Label]]; !drained[nodeId] && (fewest < 0 || n < fewest) {
+			fewest = n
+		}
+	}
+	excluded := make(map[int]bool)
+	for nodeId := range loadLevels {
+		if drained[nodeId] || s.chosen[labels[nodeId][s.Label]] != fewest {
+			excluded[nodeId] = true
+		}
+	}
+
+	nodeId := s.Next.Choose(self, loadLevels, excluded, labels, requested, free)
+	s.chosen[labels[nodeId][s.Label]]++
+	return nodeId
+}
+
+// matches returns whether labels has every label of want.
+func matches(labels map[string]string, want map[string]string) bool {
+	for key, value := range want {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+// Package scheduler chooses the nodes of a cluster that run new services.
+package scheduler
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Scheduler chooses the node that runs a new service, given the latest load
+// level of every node, the nodes that are draining, the labels of the nodes,
+// the resources requested by the service and the ones left on the nodes. A
+// node without resources in free has no known capacity, so any request fits
+// in it.
+type Scheduler interface {
+	Choose(self int, loadLevels map[int]int, drained map[int]bool, labels map[int]map[string]string, requested Resources, free map[int]Resources) int
+}
+
+// Resources are the resources requested by a service or left on a node: CPU,
+// in cores, and Memory, in bytes.
+type Resources struct {
+	CPU    float64
+	Memory int64
+}
+
+// Fits reports whether requested fits in the resources left on node id.
+func Fits(requested Resources, free map[int]Resources, id int) bool {
+	left, ok := free[id]
+	return !ok || (requested.CPU <= left.CPU && requested.Memory <= left.Memory)
+}
+
+// unfit returns the nodes of loadLevels that are draining or that requested
+// doesn't fit in.
+func unfit(loadLevels map[int]int, drained map[int]bool, requested Resources, free map[int]Resources) map[int]bool {
+	excluded := make(map[int]bool, len(drained))
+	for nodeId := range loadLevels {
+		if drained[nodeId] || !Fits(requested, free, nodeId) {
+			excluded[nodeId] = true
+		}
+	}
+	return excluded
+}
+
+// LoadScheduler is the default Scheduler: it chooses at random one of the
+// least loaded nodes that aren't draining and have the resources requested
+// left, or self if there's none.
+// Ties are broken with Rand, or the global generator if nil: given the same
+// inputs, a generator seeded the same way makes the same choices.
+type LoadScheduler struct {
+	Rand *rand.Rand
+}
+
+func (l LoadScheduler) Choose(self int, loadLevels map[int]int, drained map[int]bool, labels map[int]map[string]string, requested Resources, free map[int]Resources) int {
+	lowestPeers := make([]int, 0)
+	lowestLoad := 0
+	drained = unfit(loadLevels, drained, requested, free)
+
+	for _, peerId := range sortedIds(loadLevels) {
+		if drained[peerId] {
+			continue
+		}
+		loadLevel := loadLevels[peerId]
+		if len(lowestPeers) == 0 || loadLevel < lowestLoad {
+			lowestLoad = loadLevel
+			lowestPeers = []int{peerId}
+		} else if loadLevel == lowestLoad {
+			lowestPeers = append(lowestPeers, peerId)
+		}
+	}
+	if len(lowestPeers) == 0 {
+		// No load level known yet, or no node left: the leader runs the
+		// command itself, if it can.
+		return self
+	}
+	return lowestPeers[intn(l.Rand, len(lowestPeers))]
+}
+
+// RandomScheduler chooses at random, with Rand or the global generator if
+// nil, one of the nodes that aren't draining and have the resources
+// requested left, regardless of their load, or self if there's none.
+type RandomScheduler struct {
+	Rand *rand.Rand
+}
+
+func (r RandomScheduler) Choose(self int, loadLevels map[int]int, drained map[int]bool, labels map[int]map[string]string, requested Resources, free map[int]Resources) int {
+	drained = unfit(loadLevels, drained, requested, free)
+	candidates := make([]int, 0, len(loadLevels))
+	for _, peerId := range sortedIds(loadLevels) {
+		if !drained[peerId] {
+			candidates = append(candidates, peerId)
+		}
+	}
+	if len(candidates) == 0 {
+		return self
+	}
+	return candidates[intn(r.Rand, len(candidates))]
+}
+
+// sortedIds returns the IDs of the nodes in loadLevels in increasing order,
+// so that a choice doesn't depend on the order of iteration of the map.
+func sortedIds(loadLevels map[int]int) []int {
+	ids := make([]int, 0, len(loadLevels))
+	for id := range loadLevels {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// intn returns a random number in [0, n) from random, or from the global
+// generator if random is nil.
+func intn(random *rand.Rand, n int) int {
+	if random == nil {
+		return rand.Intn(n)
+	}
+	return random.Intn(n)
+}
+
+// New returns the Scheduler of the given policy: "load" (or "") for a
+// LoadScheduler, "random" for a RandomScheduler. A policy can be restricted
+// by an AffinityScheduler, as in "load affinity:zone=eu-1,class=gpu", and
+// spread by a SpreadScheduler, as in "load spread:zone". The random choices
+// are made with random, or the global generator if nil; random must be safe
+// for concurrent use if the Scheduler is.
+func New(policy string, random *rand.Rand) (Scheduler, error) {
+	fields := strings.Fields(policy)
+	if len(fields) == 0 {
+		return LoadScheduler{Rand: random}, nil
+	}
+
+	var s Scheduler
+	switch fields[0] {
+	case "load":
+		s = LoadScheduler{Rand: random}
+	case "random":
+		s = RandomScheduler{Rand: random}
+	default:
+		return nil, fmt.Errorf("unknown scheduler policy %q", policy)
+	}
+	for _, field := range fields[1:] {
+		kind, arg, _ := strings.Cut(field, ":")
+		switch {
+		case kind == "affinity" && arg != "":
+			affinity := AffinityScheduler{Labels: make(map[string]string), Next: s}
+			for _, pair := range strings.Split(arg, ",") {
+				key, value, ok := strings.Cut(pair, "=")
+				if !ok || key == "" {
+					return nil, fmt.Errorf("invalid affinity %q in scheduler policy %q", pair, policy)
+				}
+				affinity.Labels[key] = value
+			}
+			s = affinity
+		case kind == "spread" && arg != "":
+			s = &SpreadScheduler{Label: arg, Next: s}
+		default:
+			return nil, fmt.Errorf("unknown scheduler modifier %q in policy %q", field, policy)
+		}
+	}
+	return s, nil
+}
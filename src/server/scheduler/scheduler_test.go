@@ -0,0 +1,181 @@
+package scheduler
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// policies are the policies the properties are checked on.
+var policies = []string{"", "random", "load affinity:zone=a", "load spread:zone", "random affinity:zone=b spread:zone"}
+
+// cluster is the input of a choice: the load levels of up to 8 nodes, some
+// of them draining, in zones a and b, the resources requested by the service
+// and the ones left on the nodes with a known capacity.
+type cluster struct {
+	Self       int
+	LoadLevels map[int]int
+	Drained    map[int]bool
+	Labels     map[int]map[string]string
+	Requested  Resources
+	Free       map[int]Resources
+}
+
+func (cluster) Generate(r *rand.Rand, size int) reflect.Value {
+	c := cluster{
+		Self:       1 + r.Intn(8),
+		LoadLevels: make(map[int]int),
+		Drained:    make(map[int]bool),
+		Labels:     make(map[int]map[string]string),
+		Requested:  Resources{CPU: float64(r.Intn(4)) / 2, Memory: int64(r.Intn(4)) << 30},
+		Free:       make(map[int]Resources),
+	}
+	for id := 1; id <= 8; id++ {
+		if r.Intn(4) == 0 {
+			continue
+		}
+		c.LoadLevels[id] = 1 + r.Intn(4)
+		c.Drained[id] = r.Intn(3) == 0
+		c.Labels[id] = map[string]string{"zone": string(rune('a' + r.Intn(2)))}
+		if r.Intn(3) != 0 {
+			c.Free[id] = Resources{CPU: float64(r.Intn(4)) / 2, Memory: int64(r.Intn(4)) << 30}
+		}
+	}
+	return reflect.ValueOf(c)
+}
+
+// eligible returns the nodes of c a choice may land on.
+func (c cluster) eligible() []int {
+	var ids []int
+	for _, id := range sortedIds(c.LoadLevels) {
+		if !c.Drained[id] && Fits(c.Requested, c.Free, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// choose makes a choice of a new Scheduler of policy on c, with a generator
+// seeded with seed.
+func (c cluster) choose(t *testing.T, policy string, seed int64) int {
+	t.Helper()
+	s, err := New(policy, rand.New(rand.NewSource(seed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.Choose(c.Self, c.LoadLevels, c.Drained, c.Labels, c.Requested, c.Free)
+}
+
+// TestNeverChoosesDrained checks that a choice never lands on a node
+// draining. A scheduler falls back on self, that the caller refuses if it's
+// draining too or the resources requested don't fit in it, only if no node
+// is left, or none with the labels of an affinity.
+func TestNeverChoosesDrained(t *testing.T) {
+	for _, policy := range policies {
+		property := func(c cluster, seed int64) bool {
+			id := c.choose(t, policy, seed)
+			_, known := c.LoadLevels[id]
+			if known && !c.Drained[id] {
+				return true
+			}
+			return id == c.Self && (len(c.eligible()) == 0 || strings.Contains(policy, "affinity"))
+		}
+		if err := quick.Check(property, nil); err != nil {
+			t.Errorf("policy %q: %v", policy, err)
+		}
+	}
+}
+
+// TestRespectsCapacity checks that a choice never lands on a node with less
+// resources left than the ones requested, unless it falls back on self, as
+// in TestNeverChoosesDrained.
+func TestRespectsCapacity(t *testing.T) {
+	for _, policy := range policies {
+		property := func(c cluster, seed int64) bool {
+			id := c.choose(t, policy, seed)
+			if Fits(c.Requested, c.Free, id) {
+				return true
+			}
+			return id == c.Self && (len(c.eligible()) == 0 || strings.Contains(policy, "affinity"))
+		}
+		if err := quick.Check(property, nil); err != nil {
+			t.Errorf("policy %q: %v", policy, err)
+		}
+	}
+}
+
+// TestLoadChoosesLeastLoaded checks that no node left is less loaded than
+// the one chosen by a LoadScheduler.
+func TestLoadChoosesLeastLoaded(t *testing.T) {
+	property := func(c cluster, seed int64) bool {
+		eligible := c.eligible()
+		if len(eligible) == 0 {
+			return true
+		}
+		id := c.choose(t, "load", seed)
+		for _, other := range eligible {
+			if c.LoadLevels[other] < c.LoadLevels[id] {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestSameSeedSameChoices makes the same choices twice with generators
+// seeded the same way: they must be the same.
+func TestSameSeedSameChoices(t *testing.T) {
+	for _, policy := range policies {
+		property := func(cs []cluster, seed int64) bool {
+			choices := func() []int {
+				s, err := New(policy, rand.New(rand.NewSource(seed)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var ids []int
+				for _, c := range cs {
+					ids = append(ids, s.Choose(c.Self, c.LoadLevels, c.Drained, c.Labels, c.Requested, c.Free))
+				}
+				return ids
+			}
+			return reflect.DeepEqual(choices(), choices())
+		}
+		if err := quick.Check(property, nil); err != nil {
+			t.Errorf("policy %q: %v", policy, err)
+		}
+	}
+}
+
+// TestTiesUniform chooses many times among tied nodes: each must be chosen
+// about as often as the others.
+func TestTiesUniform(t *testing.T) {
+	const nodes, draws = 4, 4000
+	c := cluster{LoadLevels: make(map[int]int), Drained: map[int]bool{nodes + 1: true}}
+	for id := 1; id <= nodes+1; id++ {
+		c.LoadLevels[id] = 2
+	}
+	for _, policy := range []string{"load", "random"} {
+		s, err := New(policy, rand.New(rand.NewSource(1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[int]int)
+		for i := 0; i < draws; i++ {
+			counts[s.Choose(c.Self, c.LoadLevels, c.Drained, c.Labels, c.Requested, c.Free)]++
+		}
+		// 150 is more than 5 standard deviations of a uniform draw.
+		for id := 1; id <= nodes; id++ {
+			if n := counts[id]; n < draws/nodes-150 || n > draws/nodes+150 {
+				t.Errorf("policy %q: node %d chosen %d times of %d, counts %v", policy, id, n, draws, counts)
+			}
+		}
+		if counts[nodes+1] != 0 {
+			t.Errorf("policy %q: drained node chosen %d times", policy, counts[nodes+1])
+		}
+	}
+}
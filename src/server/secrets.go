@@ -0,0 +1,209 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	st "storage"
+	"sync"
+	"time"
+)
+
+// Secrets describes the secrets of a node, as returned by Server.Secrets.
+type Secrets struct {
+	// StorageKey is the ID of the key encrypting the storage, StorageKeys
+	// the ones it can still be decrypted with; empty if not encrypted.
+	StorageKey  string   `json:",omitempty"`
+	StorageKeys []string `json:",omitempty"`
+
+	// Certificate is the TLS certificate of the node, nil without one.
+	Certificate *CertificateInfo `json:",omitempty"`
+}
+
+// CertificateInfo identifies a TLS certificate.
+type CertificateInfo struct {
+	Subject     string
+	NotAfter    time.Time
+	Fingerprint string
+}
+
+// rekeyer is a file encrypted with a keyring, rewritten with its current
+// key by Rekey.
+type rekeyer interface{ Rekey() (bool, error) }
+
+// secrets rotates the secrets of a CM without restarting it: the key
+// encrypting its files and its TLS certificate.
+type secrets struct {
+	keyring *st.Keyring
+	// files are the files encrypted with keyring, by name
+	files map[string]rekeyer
+
+	certFile, keyFile string
+	mu                sync.RWMutex
+	cert              *tls.Certificate
+}
+
+// newSecrets loads the TLS certificate of config, if any. keyring encrypts
+// storage, nil if it isn't encrypted.
+func newSecrets(config Config, keyring *st.Keyring, storage st.Storage) (*secrets, error) {
+	s := &secrets{keyring: keyring, files: make(map[string]rekeyer), certFile: config.TLSCert, keyFile: config.TLSKey}
+	if file, ok := storage.(rekeyer); ok {
+		s.encrypts("storage", file)
+	}
+	if s.certFile != "" {
+		if err := s.reloadCertificate(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// encrypts records that file is encrypted with the keyring, to reencrypt it
+// when the key is rotated. It must be called before the CM starts.
+func (s *secrets) encrypts(name string, file rekeyer) {
+	if s.keyring != nil {
+		s.files[name] = file
+	}
+}
+
+// reloadCertificate reads the certificate and key files again. The old
+// certificate is kept if they can't be loaded.
+func (s *secrets) reloadCertificate() error {
+	if s.certFile == "" {
+		return ErrNoCertificate
+	}
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.cert = &cert
+	s.mu.Unlock()
+	return nil
+}
+
+// getCertificate returns the current certificate, for tls.Config.
+func (s *secrets) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert == nil {
+		return nil, ErrNoCertificate
+	}
+	return s.cert, nil
+}
+
+func (s *secrets) describe() Secrets {
+	var d Secrets
+	if s.keyring != nil {
+		d.StorageKey = s.keyring.Current()
+		d.StorageKeys = s.keyring.IDs()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert != nil {
+		d.Certificate = &CertificateInfo{
+			Subject:     s.cert.Leaf.Subject.String(),
+			NotAfter:    s.cert.Leaf.NotAfter,
+			Fingerprint: Fingerprint(s.cert.Leaf.Raw),
+		}
+	}
+	return d
+}
+
+// Secrets returns the keys encrypting the storage of the node and its TLS
+// certificate.
+func (s *Server) Secrets() Secrets {
+	return s.cm.secrets.describe()
+}
+
+// RotateStorageKey makes a new key encrypt the storage of the node and
+// returns its ID. The storage, the raft log and the leadership history are
+// reencrypted with it in the background, the storage by its next write
+// anyway; the older keys are kept to decrypt the
+// backups of the storage, and can be removed from the keys directory once
+// they're not needed anymore.
+func (s *Server) RotateStorageKey() (string, error) {
+	secrets := s.cm.secrets
+	if secrets.keyring == nil {
+		return "", ErrNotEncrypted
+	}
+	id, err := secrets.keyring.Rotate()
+	if err != nil {
+		return "", err
+	}
+	s.cm.recordEventUnlocked(EventRotation, "storage key rotated to %s", id)
+	for name, file := range secrets.files {
+		name, file := name, file
+		s.cm.tasks.Go("rekey "+name, func() {
+			if _, err := file.Rekey(); err != nil {
+				log.Printf("[%v] reencrypting the %s with key %s: %v", s.serverId, name, id, err)
+				s.cm.recordEventUnlocked(EventWarning, "%s not reencrypted with key %s: %v", name, id, err)
+			}
+		})
+	}
+	return id, nil
+}
+
+// ReloadCertificate makes the node use the TLS certificate and key in the
+// files of Config.TLSCert and TLSKey again, after they were replaced. The
+// connections opened with the old certificate are kept. If the files can't
+// be loaded, the old certificate stays in use.
+func (s *Server) ReloadCertificate() error {
+	if err := s.cm.secrets.reloadCertificate(); err != nil {
+		return err
+	}
+	s.cm.recordEventUnlocked(EventRotation, "TLS certificate reloaded from %s", s.config.TLSCert)
+	return nil
+}
+
+// ClientTLSConfig returns the TLS configuration of the clients of the admin
+// and REST APIs of the nodes, whose certificates must be signed by the
+// certificate in the file ca: the one of the cluster CA, or the one of the
+// node if it's pinned rather than signed. The name of the node isn't
+// checked, since its certificate names its node ID rather than its address,
+// see PeerName.
+func ClientTLSConfig(ca string) (*tls.Config, error) {
+	pem, err := os.ReadFile(ca)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in %s", ca)
+	}
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, len(raw))
+			for i, der := range raw {
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return err
+				}
+				certs[i] = cert
+			}
+			if len(certs) == 0 {
+				return errors.New("no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+			return err
+		},
+	}, nil
+}
+
+// TLSConfig returns a tls.Config presenting the TLS certificate of the node,
+// the one loaded last by ReloadCertificate.
+func (s *Server) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: s.cm.secrets.getCertificate, MinVersion: tls.VersionTLS12}
+}
@@ -6,13 +6,15 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"net"
+	"net/http"
 	"net/rpc"
-	"os"
-	st "storage"
 	"sync"
 	"time"
 )
@@ -21,58 +23,111 @@ type Server struct {
 	mu sync.Mutex
 
 	serverId int
+	config   Config
 	peerIds  []int
 	peers	 map[int]net.Addr
 
 	cm       *ConsensusModule
-	storage  st.Storage
 	rpcProxy *RPCProxy
 
 	rpcServer *rpc.Server
 	listener  net.Listener
 
-	commitChan  chan<- CommitEntry
+	// conns are the inbound connections served, and httpServers the admin
+	// and REST APIs, closed by Shutdown; proxyTransports carry the requests
+	// proxied to the REST API of the leader, by its ID
+	conns           map[io.Closer]struct{}
+	httpServers     []*http.Server
+	proxyTransports map[int]*http.Transport
+
 	peerClients map[int]*rpc.Client
 
-	ready <-chan interface{}
-	quit  chan interface{}
-	wg    sync.WaitGroup
+	ready    <-chan interface{}
+	quit     chan interface{}
+	quitOnce sync.Once
+	wg       sync.WaitGroup
+
+	// collector merges the logs of the cluster, if this server collects them
+	collector *LogCollector
+
+	// artifacts are the services uploaded through the REST API and not yet
+	// submitted, by ID
+	artifacts map[string]*Service
+
+	// tokens authenticate the requests to the APIs; nil if authentication is
+	// disabled
+	tokens *Tokens
+	// quotas tracks the usage of the quotas of the principals of tokens
+	quotas *quotas
+
+	// allowlist restricts the peers accepted, identified by their
+	// certificate or else by resolvePeer if not nil; peerTLS, if not nil,
+	// encrypts the connections to the peers, whose certificates are signed
+	// by peerRoots unless pinned by allowlist
+	allowlist   PeerAllowlist
+	resolvePeer func(net.Addr) (int, bool)
+	peerTLS     *tls.Config
+	peerRoots   *x509.CertPool
 }
 
-func NewServer(serverId int, storage st.Storage, ready <-chan interface{}, commitChan chan<- CommitEntry) *Server {
+// NewServer creates a server and its CM, whose dependencies can be replaced
+// with opts.
+func NewServer(serverId int, config Config, ready <-chan interface{}, opts ...Option) (*Server, error) {
 	s := new(Server)
 	s.serverId = serverId
+	s.config = config
 	s.peerIds = []int{}
 	s.peers = make(map[int]net.Addr)
 	s.peerClients = make(map[int]*rpc.Client)
-	s.storage = storage
 	s.ready = ready
-	s.commitChan = commitChan
 	s.quit = make(chan interface{})
-	s.cm = NewConsensusModule(s.serverId, s, s.storage, s.ready, s.commitChan) 
-	return s
+	s.conns = make(map[io.Closer]struct{})
+	s.artifacts = make(map[string]*Service)
+	s.quotas = newQuotas()
+	if config.AuthTokensPath != "" {
+		tokens, err := LoadTokens(config.AuthTokensPath)
+		if err != nil {
+			return nil, err
+		}
+		s.tokens = tokens
+	}
+	allowlist, err := ParsePeerAllowlist(config.AllowedPeers)
+	if err != nil {
+		return nil, err
+	}
+	s.allowlist = allowlist
+	s.resolvePeer = newOptions(opts).resolve
+	cm, err := NewConsensusModule(s.serverId, s.config, s, s.ready, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.cm = cm
+	if config.TLSCert != "" {
+		if s.peerTLS, err = s.peerTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 func (s *Server) Serve(ip net.Addr, wg *sync.WaitGroup, ready chan interface{}) {
 	s.mu.Lock()
-
-	// Create a new RPC server and register a RPCProxy that forwards all methods
-	// to n.cm
-	s.rpcServer = rpc.NewServer()
-	s.rpcProxy = &RPCProxy{cm: s.cm}
-	s.rpcServer.RegisterName("ConsensusModule", s.rpcProxy)
+	s.registerRPC()
 
 	var err error
-	s.listener, err = net.Listen("tcp", ip.String()+":" + os.Getenv("RPC_PORT"))
+	s.listener, err = net.Listen("tcp", ip.String()+":" + s.config.RPCPort)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if s.peerTLS != nil {
+		s.listener = tls.NewListener(s.listener, s.peerTLS)
+	}
 	log.Printf("[%v] listening at %s", s.serverId, s.listener.Addr())
 	s.mu.Unlock()
 	ready <- struct{}{}
 
 	s.wg.Add(1)
-	go func() {
+	s.cm.tasks.Go("accept loop", func() {
 		defer s.wg.Done()
 
 		for {
@@ -85,16 +140,117 @@ func (s *Server) Serve(ip net.Addr, wg *sync.WaitGroup, ready chan interface{})
 					log.Fatal("accept error:", err)
 				}
 			}
+			if !s.trackConn(conn) {
+				return
+			}
 			s.wg.Add(1)
-			go func() {
-				s.rpcServer.ServeConn(conn)
-				s.wg.Done()
-			}()
+			s.cm.tasks.Go("ServeConn "+conn.RemoteAddr().String(), func() {
+				defer s.wg.Done()
+				defer s.untrackConn(conn)
+				if err := s.admitPeer(conn); err != nil {
+					conn.Close()
+					return
+				}
+				s.rpcServer.ServeCodec(newServerCodec(conn, s.config.TransferBufferSize))
+			})
 		}
-	}()
+	})
 	wg.Done()
 }
 
+// registerRPC creates the RPC server, if it doesn't exist yet, and registers
+// a RPCProxy that forwards all methods to s.cm.
+// Expects s.mu to be locked.
+func (s *Server) registerRPC() {
+	if s.rpcServer != nil {
+		return
+	}
+	s.rpcServer = rpc.NewServer()
+	s.rpcProxy = &RPCProxy{cm: s.cm}
+	s.rpcServer.RegisterName("ConsensusModule", s.rpcProxy)
+}
+
+// ServeRPC serves the RPCs of the CM on conn until it's closed. It's how a
+// transport that doesn't go through the listener of Serve, such as the
+// in-memory one of package testcluster, reaches the server.
+func (s *Server) ServeRPC(conn io.ReadWriteCloser) {
+	s.mu.Lock()
+	s.registerRPC()
+	rpcServer := s.rpcServer
+	s.mu.Unlock()
+
+	if !s.trackConn(conn) {
+		return
+	}
+	s.wg.Add(1)
+	s.cm.tasks.Go("ServeRPC", func() {
+		defer s.wg.Done()
+		defer s.untrackConn(conn)
+		rpcServer.ServeCodec(newServerCodec(conn, s.config.TransferBufferSize))
+	})
+}
+
+// trackConn records conn, an inbound connection, so that Shutdown closes it.
+// If the server is shutting down already, conn is closed and false is
+// returned.
+func (s *Server) trackConn(conn io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.quit:
+		conn.Close()
+		return false
+	default:
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+// untrackConn forgets conn, once it's served.
+func (s *Server) untrackConn(conn io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// serveHTTP serves handler at addr until Shutdown, logging the errors as
+// those of the API name. The API is served over TLS if the node has a
+// certificate, see apiTLSConfig, since its requests carry the tokens of the
+// clients.
+func (s *Server) serveHTTP(name string, addr string, handler http.Handler) {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	if s.peerTLS != nil {
+		srv.TLSConfig = s.apiTLSConfig()
+	}
+	s.mu.Lock()
+	select {
+	case <-s.quit:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	s.httpServers = append(s.httpServers, srv)
+	s.mu.Unlock()
+	log.Printf("[%v] %s listening at %s", s.serverId, name, addr)
+	var err error
+	if srv.TLSConfig != nil {
+		// The certificate is the one of TLSConfig.
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("[%v] %s error: %v", s.serverId, name, err)
+	}
+}
+
+// ownsTransport reports whether the CM sends its RPCs through the clients of
+// this server, rather than a transport set with WithTransport.
+func (s *Server) ownsTransport() bool {
+	t, ok := s.cm.transport.(faultTransport)
+	return ok && t.next == Transport(s)
+}
+
 // DisconnectAll closes all the client connections to peers for this server.
 func (s *Server) DisconnectAll() {
 	s.mu.Lock()
@@ -107,17 +263,74 @@ func (s *Server) DisconnectAll() {
 	}
 }
 
-// Shutdown closes the server and waits for it to shut down properly.
-func (s *Server) Shutdown() {
-	s.cm.Stop()
-	close(s.quit)
-	s.listener.Close()
-	s.wg.Wait()
+// Shutdown stops the CM, closes the listener, the connections from and to
+// peers and the APIs, and waits until every goroutine of the server and its
+// CM has exited, or until ctx is done, in which case ctx.Err() is returned.
+// It's safe to call it more than once.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.quitOnce.Do(func() {
+		s.cm.Stop()
+		s.mu.Lock()
+		close(s.quit)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		s.DisconnectAll()
+	})
+	s.mu.Lock()
+	httpServers := s.httpServers
+	for _, transport := range s.proxyTransports {
+		transport.CloseIdleConnections()
+	}
+	s.mu.Unlock()
+	for _, srv := range httpServers {
+		if err := srv.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.cm.Wait(ctx)
 }
 
+// Close shuts the server down, returning only when every goroutine of the
+// server and its CM has exited. It's safe to call it more than once.
+func (s *Server) Close() error {
+	return s.Shutdown(context.Background())
+}
+
+// Go runs f in a background goroutine tracked by the server, so that Shutdown
+// waits for it. f should return once Done is closed.
+func (s *Server) Go(name string, f func()) {
+	s.cm.tasks.Go(name, f)
+}
+
+// Done returns a channel that's closed when the server is shutting down.
+func (s *Server) Done() <-chan struct{} {
+	return s.cm.Done()
+}
+
+// GetListenAddr returns the address of the RPC listener, or nil if the server
+// isn't serving yet.
 func (s *Server) GetListenAddr() net.Addr {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
 	return s.listener.Addr()
 }
 
@@ -125,12 +338,27 @@ func (s *Server) ConnectToPeer(peerId int, addr net.Addr) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	fmt.Printf("Connecting to peer %d at %s\n", peerId, addr.String())
+	if !s.ownsTransport() {
+		// There's no connection to dial, the transport reaches the peer.
+		if s.peers[peerId] == nil {
+			s.peerIds = append(s.peerIds, peerId)
+			s.peers[peerId] = addr
+			s.cm.ConnectPeer(peerId)
+		}
+		return nil
+	}
 	if s.peerClients[peerId] == nil {
-		client, err := rpc.Dial("tcp", addr.String()+":" + os.Getenv("RPC_PORT"))
+		var conn net.Conn
+		var err error
+		if s.peerTLS != nil {
+			conn, err = tls.Dial("tcp", addr.String()+":" + s.config.RPCPort, s.dialTLSConfig(peerId))
+		} else {
+			conn, err = net.Dial("tcp", addr.String()+":" + s.config.RPCPort)
+		}
 		if err != nil {
 			return err
 		} else {
-			s.peerClients[peerId] = client
+			s.peerClients[peerId] = rpc.NewClientWithCodec(newClientCodec(conn, s.config.TransferBufferSize))
 			s.peerIds = append(s.peerIds, peerId)
 			s.peers[peerId] = addr
 			s.cm.ConnectPeer(peerId)
@@ -143,8 +371,11 @@ func (s *Server) ConnectToPeer(peerId int, addr net.Addr) error {
 func (s *Server) DisconnectPeer(peerId int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.peerClients[peerId] != nil {
-		err := s.peerClients[peerId].Close()
+	if s.peerClients[peerId] != nil || !s.ownsTransport() && s.peers[peerId] != nil {
+		var err error
+		if s.peerClients[peerId] != nil {
+			err = s.peerClients[peerId].Close()
+		}
 		s.cm.DisconnectPeer(peerId)
 		delete(s.peerClients, peerId)
 		for i, elem := range s.peerIds {
@@ -160,6 +391,12 @@ func (s *Server) DisconnectPeer(peerId int) error {
 }
 
 func (s *Server) Call(id int, serviceMethod string, args interface{}, reply interface{}) error {
+	return s.CallContext(context.Background(), id, serviceMethod, args, reply)
+}
+
+// CallContext is like Call, but returns ctx.Err() as soon as ctx is done
+// without waiting for the reply.
+func (s *Server) CallContext(ctx context.Context, id int, serviceMethod string, args interface{}, reply interface{}) error {
 	s.mu.Lock()
 	peer := s.peerClients[id]
 	s.mu.Unlock()
@@ -168,8 +405,13 @@ func (s *Server) Call(id int, serviceMethod string, args interface{}, reply inte
 	// return an error.
 	if peer == nil {
 		return fmt.Errorf("call client %d after it's closed", id)
-	} else {
-		return peer.Call(serviceMethod, args, reply)
+	}
+	call := peer.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -183,58 +425,167 @@ type RPCProxy struct {
 	cm *ConsensusModule
 }
 
-func (rpp *RPCProxy) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
-	if len(os.Getenv("RAFT_UNRELIABLE_RPC")) > 0 {
-		dice := rand.Intn(10)
+func (rpp *RPCProxy) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) (err error) {
+	defer rpp.cm.recoverPanic("RequestVote RPC", &err)
+	if err := rpp.cm.consensusFault("ConsensusModule.RequestVote"); err != nil {
+		return err
+	}
+	if err := rpp.cm.verify(args.CandidateId, args, args.Seq, args.Signature); err != nil {
+		rpp.cm.Dlog("refusing RequestVote: %v", err)
+		return err
+	}
+	if err := rpp.cm.admitVote(args); err != nil {
+		return err
+	}
+	if rpp.cm.Config().UnreliableRPC {
+		dice := rpp.cm.random.Intn(10)
 		if dice == 9 {
 			rpp.cm.Dlog("drop RequestVote")
 			return fmt.Errorf("RPC failed")
 		} else if dice == 8 {
 			rpp.cm.Dlog("delay RequestVote")
-			time.Sleep(75 * time.Millisecond)
+			rpp.cm.clock.Sleep(75 * time.Millisecond)
 		}
 	} else {
-		time.Sleep(time.Duration(1+rand.Intn(5)) * time.Millisecond)
+		rpp.cm.clock.Sleep(time.Duration(1+rpp.cm.random.Intn(5)) * time.Millisecond)
+	}
+	if err := rpp.cm.RequestVote(args, reply); err != nil {
+		return err
 	}
-	return rpp.cm.RequestVote(args, reply)
+	reply.Seq = args.Seq
+	reply.Signature, err = rpp.cm.sign(*reply)
+	return err
 }
 
-func (rpp *RPCProxy) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
-	if len(os.Getenv("RAFT_UNRELIABLE_RPC")) > 0 {
-		dice := rand.Intn(10)
+func (rpp *RPCProxy) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) (err error) {
+	defer rpp.cm.recoverPanic("AppendEntries RPC", &err)
+	if err := rpp.cm.consensusFault("ConsensusModule.AppendEntries"); err != nil {
+		return err
+	}
+	if err := rpp.cm.verify(args.LeaderId, args, args.Seq, args.Signature); err != nil {
+		rpp.cm.Dlog("refusing AppendEntries: %v", err)
+		return err
+	}
+	if rpp.cm.Config().UnreliableRPC {
+		dice := rpp.cm.random.Intn(10)
 		if dice == 9 {
 			rpp.cm.Dlog("drop AppendEntries")
 			return fmt.Errorf("RPC failed")
 		} else if dice == 8 {
 			rpp.cm.Dlog("delay AppendEntries")
-			time.Sleep(75 * time.Millisecond)
+			rpp.cm.clock.Sleep(75 * time.Millisecond)
 		}
 	} else {
-		time.Sleep(time.Duration(1+rand.Intn(5)) * time.Millisecond)
+		rpp.cm.clock.Sleep(time.Duration(1+rpp.cm.random.Intn(5)) * time.Millisecond)
+	}
+	if err := rpp.cm.AppendEntries(args, reply); err != nil {
+		return err
+	}
+	reply.Seq = args.Seq
+	reply.Signature, err = rpp.cm.sign(*reply)
+	return err
+}
+
+func (rpp *RPCProxy) Submit(args SubmitArgs, reply *SubmitReply) (err error) {
+	defer rpp.cm.recoverPanic("Submit RPC", &err)
+	if err := rpp.cm.verify(args.From, args, args.Seq, args.Signature); err != nil {
+		rpp.cm.Dlog("refusing Submit: %v", err)
+		return err
 	}
-	return rpp.cm.AppendEntries(args, reply)
+	return rpp.cm.Submit(args, reply)
+}
+
+func (rpp *RPCProxy) WaitCommit(args WaitCommitArgs, reply *WaitCommitReply) (err error) {
+	defer rpp.cm.recoverPanic("WaitCommit RPC", &err)
+	return rpp.cm.WaitCommit(args, reply)
+}
+
+func (rpp *RPCProxy) Leader(args LeaderArgs, reply *LeaderReply) (err error) {
+	defer rpp.cm.recoverPanic("Leader RPC", &err)
+	return rpp.cm.Leader(args, reply)
+}
+
+func (rpp *RPCProxy) JoinCluster(args JoinClusterArgs, reply *JoinClusterReply) (err error) {
+	defer rpp.cm.recoverPanic("JoinCluster RPC", &err)
+	return rpp.cm.JoinCluster(args, reply)
+}
+
+func (rpp *RPCProxy) ClusterInfo(args ClusterInfoArgs, reply *ClusterInfo) (err error) {
+	defer rpp.cm.recoverPanic("ClusterInfo RPC", &err)
+	*reply = rpp.cm.ClusterInfo()
+	return nil
 }
 
-func (rpp *RPCProxy) Deploy(args DeployArgs, reply *DeployReply) error {
-	if len(os.Getenv("RAFT_UNRELIABLE_RPC")) > 0 {
-		dice := rand.Intn(10)
+func (rpp *RPCProxy) ServiceStatus(args ServiceStatusArgs, reply *ServiceStatusReply) (err error) {
+	defer rpp.cm.recoverPanic("ServiceStatus RPC", &err)
+	return rpp.cm.ServiceStatus(args, reply)
+}
+
+func (rpp *RPCProxy) Undeploy(args UndeployArgs, reply *UndeployReply) (err error) {
+	defer rpp.cm.recoverPanic("Undeploy RPC", &err)
+	return rpp.cm.Undeploy(args, reply)
+}
+
+func (rpp *RPCProxy) Rejoin(args RejoinArgs, reply *RejoinReply) (err error) {
+	defer rpp.cm.recoverPanic("Rejoin RPC", &err)
+	return rpp.cm.Rejoin(args, reply)
+}
+
+func (rpp *RPCProxy) ReadSnapshot(args ReadSnapshotArgs, reply *ReadSnapshotReply) (err error) {
+	defer rpp.cm.recoverPanic("ReadSnapshot RPC", &err)
+	return rpp.cm.ReadSnapshot(args, reply)
+}
+
+func (rpp *RPCProxy) Restart(args RestartArgs, reply *RestartReply) (err error) {
+	defer rpp.cm.recoverPanic("Restart RPC", &err)
+	return rpp.cm.Restart(args, reply)
+}
+
+func (rpp *RPCProxy) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) (err error) {
+	defer rpp.cm.recoverPanic("TimeoutNow RPC", &err)
+	return rpp.cm.TimeoutNow(args, reply)
+}
+
+func (rpp *RPCProxy) Deploy(args DeployArgs, reply *DeployReply) (err error) {
+	defer rpp.cm.recoverPanic("Deploy RPC", &err)
+	if err := rpp.cm.transferFault(); err != nil {
+		return err
+	}
+	if rpp.cm.Config().UnreliableRPC {
+		dice := rpp.cm.random.Intn(10)
 		if dice == 9 {
 			rpp.cm.Dlog("drop AppendEntries")
 			return fmt.Errorf("RPC failed")
 		} else if dice == 8 {
 			rpp.cm.Dlog("delay AppendEntries")
-			time.Sleep(75 * time.Millisecond)
+			rpp.cm.clock.Sleep(75 * time.Millisecond)
 		}
 	} else {
-		time.Sleep(time.Duration(1+rand.Intn(5)) * time.Millisecond)
+		rpp.cm.clock.Sleep(time.Duration(1+rpp.cm.random.Intn(5)) * time.Millisecond)
 	}
 	return rpp.cm.Deploy(args, reply)
 }
 
+// PeerAddr returns the address of peer peerId, or nil if it isn't connected.
+func (s *Server) PeerAddr(peerId int) net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peers[peerId]
+}
+
 func (s *Server) GetQuit() chan interface{} {
 	return s.quit
 }
 
+// GetConfig returns the configuration of this server, including the changes
+// made at runtime.
+func (s *Server) GetConfig() Config {
+	if s.cm == nil {
+		return s.config
+	}
+	return s.cm.Config()
+}
+
 func (s *Server) GetId() int {
 	return s.serverId
 }
@@ -243,10 +594,35 @@ func (s *Server) GetConsensusModule() *ConsensusModule {
 	return s.cm
 }
 
-func (s *Server) Submit(command *Service) {
+// Submit elects this server and submits command to it. It returns the index
+// and term of the new entry, whether it was accepted and a future that
+// resolves when the entry is committed. If this server lost the leadership in
+// the meantime, the command is forwarded to the known leader; if that's not
+// possible, the future fails with a *NotLeaderError. If ctx is done before the
+// election is won, the command is not accepted and the future fails with
+// ctx.Err().
+func (s *Server) Submit(ctx context.Context, command *Service) (index int, term int, accepted bool, future *CommitFuture) {
+	if s.cm.IsLearner() {
+		// Learners don't run elections, the command goes to the leader.
+		return s.cm.forwardCommand(ctx, command)
+	}
+	// A notification left by an election a previous Submit gave up on
+	// isn't about this one.
+	select {
+	case <-s.cm.ElectionChan:
+	default:
+	}
 	s.cm.Election()
-	<- s.cm.ElectionChan
-	s.cm.Voting(command)	
+	select {
+	case <-s.cm.ElectionChan:
+	case <-ctx.Done():
+		_, term, _ = s.cm.Report()
+		future = newCommitFuture(-1, term)
+		future.resolve(ctx.Err())
+		return -1, term, false, future
+	}
+	index, term, accepted, future = s.cm.Voting(command)
 	<- s.cm.VotingChan
 	s.cm.Pause()
+	return index, term, accepted, future
 }
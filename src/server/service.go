@@ -2,69 +2,199 @@ package server
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 	"gopkg.in/yaml.v3"
 )
 
 type SType string
 
+// Service is the command carried by a log entry. Kind tells what to do with
+// the service; the empty Kind deploys it. Commands of other kinds carry their
+// arguments in Payload, see DecodeCommand.
 type Service struct {
 	// Unique ID of service
 	ServiceID		string
 	// Type of service
 	Type 			SType
+	// Kind of command
+	Kind			CommandKind
+	// Encoded arguments of the command
+	Payload			[]byte
+	// Signature of the artifact by its publisher, see SignService
+	Signature		[]byte	`json:",omitempty"`
 
 }
 
-func NewService(command string, server *Server) *Service {
+func NewService(command string, server *Server) (*Service, error) {
 	
+	service, body, err := ParseService(command)
+	if err != nil {
+		return nil, err
+	}
+	if err := server.cm.verifyArtifact(service.ServiceID, body, service.Signature); err != nil {
+		return nil, err
+	}
+	if err := server.cm.artifacts.Save(service.ServiceID, body); err != nil {
+		return nil, err
+	}
+
+	return service, nil
+}
+
+// ParseService parses command into a new Service and the description of the
+// service to deploy, without saving it.
+func ParseService(command string) (*Service, []byte, error) {
+
 	service := &Service{}
-	
-	serviceMap := parseService(command)
-	service.ServiceID = fmt.Sprintf("%x", sha256.Sum256([]byte(serviceMap["Command"] + time.Now().String())))
-	if err := service.saveToFile(serviceMap["Command"]); err != nil {
-		fmt.Printf("Error: %v\n", err)
+
+	serviceMap, err := parseService(command)
+	if err != nil {
+		return nil, nil, err
 	}
+	service.ServiceID = serviceId(serviceMap)
 	service.Type = SType(serviceMap["Type"])
+	var deploy DeployPayload
+	if serviceMap["Priority"] != "" {
+		if deploy.Priority, err = strconv.Atoi(serviceMap["Priority"]); err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid Priority", ErrInvalidService)
+		}
+	}
+	if serviceMap["NotBefore"] != "" {
+		notBefore, err := time.Parse(time.RFC3339, serviceMap["NotBefore"])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid NotBefore, expected RFC 3339", ErrInvalidService)
+		}
+		deploy.NotBefore = &notBefore
+	}
+	deploy.Namespace = serviceMap["Namespace"]
+	if serviceMap["Resources"] != "" {
+		resources, err := ParseResources(strings.Fields(serviceMap["Resources"]))
+		if err != nil || resources.Services != 0 {
+			return nil, nil, fmt.Errorf("%w: invalid Resources, expected cpu and memory", ErrInvalidService)
+		}
+		deploy.Resources = &resources
+	}
+	if serviceMap["TTL"] != "" {
+		if deploy.TTL, err = time.ParseDuration(serviceMap["TTL"]); err != nil || deploy.TTL <= 0 {
+			return nil, nil, fmt.Errorf("%w: invalid TTL, expected a duration such as 30m", ErrInvalidService)
+		}
+	}
+	deploy.Version = serviceMap["Version"]
+	if deploy.Priority != 0 || deploy.NotBefore != nil || deploy.Namespace != "" || deploy.Resources != nil || deploy.TTL != 0 || deploy.Version != "" {
+		if service.Payload, err = json.Marshal(deploy); err != nil {
+			return nil, nil, err
+		}
+	}
+	if serviceMap["Signature"] != "" {
+		if service.Signature, err = hex.DecodeString(serviceMap["Signature"]); err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid Signature", ErrInvalidService)
+		}
+	}
+
+	return service, []byte(serviceMap["Command"]), nil
+}
 
-	return service
+// serviceId returns the ID of the service described by serviceMap. A service
+// declaring its Version is identified by its description, so that a client
+// submitting it again, even parsing it anew, deploys it once, see
+// duplicateDeploy. Without a Version, every submission is a new service.
+func serviceId(serviceMap map[string]string) string {
+	key := serviceMap["Command"] + time.Now().String()
+	if serviceMap["Version"] != "" {
+		key = strings.Join([]string{serviceMap["Type"], serviceMap["Namespace"], serviceMap["Version"], serviceMap["Command"]}, "\x00")
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
 }
 
-func parseService(command string) map[string]string {
+func parseService(command string) (map[string]string, error) {
 	
 	/* 	The first two lines of the command must be as follows:
 		1. ServiceType: <Docker|Kubernetes>
 	 	2. 
 
-		Then, the rest of the command is the actual body of the command.
+		The optional Signature is the hex signature of the body by the
+		publisher of the service, see SignService, and the optional
+		Priority ranks the service for preemption and the optional
+		NotBefore, in RFC 3339, defers it, see DeployPayload. The
+		optional Namespace and Resources, a map of the cpu and the
+		memory the service requests, charge it to the resource quota
+		of the namespace, see ResourceQuotas. The optional TTL, such as
+		30m, is the lifetime of the service, undeployed once it elapses.
+		The optional Version keeps a deployment submitted twice from
+		being placed twice.
+
+		Then, the rest of the command is the actual body of the command,
+		whose x-sandbox may opt out of the sandbox the services run in, see
+		executor.Sandbox.
 		...
 	*/
 	parsedCommand := make(map[string]interface{})
 	err := yaml.Unmarshal([]byte(command), &parsedCommand)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidService, err)
+	}
+	Type, ok := parsedCommand["ServiceType"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing ServiceType", ErrInvalidService)
 	}
-	Type := parsedCommand["ServiceType"].(string)
 	delete(parsedCommand, "ServiceType")
+	Signature, _ := parsedCommand["Signature"].(string)
+	delete(parsedCommand, "Signature")
+	var Priority string
+	if p, ok := parsedCommand["Priority"]; ok {
+		Priority = fmt.Sprint(p)
+	}
+	delete(parsedCommand, "Priority")
+	var NotBefore string
+	switch t := parsedCommand["NotBefore"].(type) {
+	case time.Time:
+		NotBefore = t.Format(time.RFC3339)
+	case string:
+		NotBefore = t
+	}
+	delete(parsedCommand, "NotBefore")
+	Namespace, _ := parsedCommand["Namespace"].(string)
+	delete(parsedCommand, "Namespace")
+	var Resources []string
+	if r, ok := parsedCommand["Resources"]; ok {
+		requested, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid Resources, expected a map", ErrInvalidService)
+		}
+		for key, value := range requested {
+			Resources = append(Resources, fmt.Sprintf("%s=%v", key, value))
+		}
+	}
+	delete(parsedCommand, "Resources")
+	var TTL string
+	if t, ok := parsedCommand["TTL"]; ok {
+		TTL = fmt.Sprint(t)
+	}
+	delete(parsedCommand, "TTL")
+	var Version string
+	if v, ok := parsedCommand["Version"]; ok {
+		Version = fmt.Sprint(v)
+	}
+	delete(parsedCommand, "Version")
 	Command, err := yaml.Marshal(parsedCommand)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidService, err)
 	}
 
 	service := make(map[string]string)
 	service["Type"] = Type
+	service["Signature"] = Signature
+	service["Priority"] = Priority
+	service["NotBefore"] = NotBefore
+	service["Namespace"] = Namespace
+	service["Resources"] = strings.Join(Resources, " ")
+	service["TTL"] = TTL
+	service["Version"] = Version
 	service["Command"] = string(Command)
-	return service
+	return service, nil
 }
-
-func (s *Service) saveToFile(command string) error {
-
-	if _, err := os.Stat("services"); os.IsNotExist(err) {
-		os.Mkdir("services", 0700)
-	}
-
-	return os.WriteFile("services/" + s.ServiceID, []byte(command), 0700)
-
-}
\ No newline at end of file
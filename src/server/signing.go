@@ -0,0 +1,298 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// replayWindow is how far below the highest sequence number received from a
+// peer a sequence number is still accepted, since concurrent RPCs may arrive
+// out of order.
+const replayWindow = 1024
+
+// seqLease is how far above the sequence number received from a peer the
+// mark persisted for it is raised once it's crossed, see replayFilter. The
+// sequence numbers follow the time in nanoseconds, so the mark of a peer is
+// written at most about ten times a second rather than on every RPC, and
+// the RPCs a peer signs in the 100ms after the ones received before a
+// restart are refused.
+const seqLease = uint64(100 * time.Millisecond)
+
+// signingKeys are the keys signing the RPCs of a CM and verifying the ones
+// of its peers, see WithSigningKeys. Every signed RPC carries a sequence
+// number, higher than the ones of the RPCs sent before it, so that a
+// captured RPC can't be replayed: the sequence numbers received from every
+// peer are remembered, within replayWindow, and a mark above the highest one
+// is persisted with the term. Every reply is signed too, and carries the
+// sequence number of the RPC it replies to.
+type signingKeys struct {
+	private ed25519.PrivateKey
+	peers   map[int]ed25519.PublicKey
+
+	mu sync.Mutex
+	// seq is the sequence number of the latest RPC signed
+	seq uint64
+	// received are the sequence numbers received from the peers, by ID
+	received map[int]*replayFilter
+}
+
+// replayFilter remembers the sequence numbers received from a peer.
+type replayFilter struct {
+	highest uint64
+	seen    map[uint64]bool
+	// floor is the mark persisted before the CM was restarted: the
+	// sequence numbers up to it may have been received, so they're refused.
+	floor uint64
+	// mark is seqLease above the sequence number that last crossed it, and
+	// saved the mark last persisted: the sequence numbers up to saved are
+	// refused after a restart.
+	mark  uint64
+	saved uint64
+}
+
+// accept records seq, returning false if it was already received or is too
+// old to tell, since it's below the window or the floor.
+func (f *replayFilter) accept(seq uint64) bool {
+	if f.seen[seq] || seq+replayWindow <= f.highest || seq <= f.floor {
+		return false
+	}
+	f.seen[seq] = true
+	if seq > f.highest {
+		f.highest = seq
+		if len(f.seen) > 2*replayWindow {
+			for s := range f.seen {
+				if s+replayWindow <= f.highest {
+					delete(f.seen, s)
+				}
+			}
+		}
+	}
+	return true
+}
+
+// raise raises the mark to seqLease above seq if seq isn't below it yet,
+// returning whether the mark must be persisted before seq is accepted, since
+// it was raised or a previous one couldn't be persisted.
+func (f *replayFilter) raise(seq uint64) bool {
+	if seq > f.mark {
+		f.mark = seq + seqLease
+	}
+	return f.mark > f.saved
+}
+
+// signedMessage is an RPC message carrying the signature of its sender.
+type signedMessage interface {
+	// signedBytes returns the bytes signed: the message without its
+	// signature.
+	signedBytes() ([]byte, error)
+}
+
+func (args RequestVoteArgs) signedBytes() ([]byte, error) {
+	args.Signature = nil
+	return json.Marshal(args)
+}
+
+func (args AppendEntriesArgs) signedBytes() ([]byte, error) {
+	args.Signature = nil
+	return json.Marshal(args)
+}
+
+func (args SubmitArgs) signedBytes() ([]byte, error) {
+	args.Signature = nil
+	return json.Marshal(args)
+}
+
+func (reply RequestVoteReply) signedBytes() ([]byte, error) {
+	reply.Signature = nil
+	return json.Marshal(reply)
+}
+
+func (reply AppendEntriesReply) signedBytes() ([]byte, error) {
+	reply.Signature = nil
+	return json.Marshal(reply)
+}
+
+// nextSeq returns the sequence number of the next RPC signed by this CM, or
+// 0 if it doesn't sign its RPCs. The sequence numbers start from the time,
+// in nanoseconds, so that they keep growing when the node restarts.
+func (cm *ConsensusModule) nextSeq() uint64 {
+	if cm.keys == nil {
+		return 0
+	}
+	cm.keys.mu.Lock()
+	defer cm.keys.mu.Unlock()
+	cm.keys.seq++
+	if now := uint64(cm.clock.Now().UnixNano()); now > cm.keys.seq {
+		cm.keys.seq = now
+	}
+	return cm.keys.seq
+}
+
+// sign returns the signature of m by this CM, or nil if it doesn't sign its
+// RPCs.
+func (cm *ConsensusModule) sign(m signedMessage) ([]byte, error) {
+	if cm.keys == nil {
+		return nil, nil
+	}
+	return signWith(cm.keys.private, m)
+}
+
+// SignSubmit signs args with key, the private key of node args.From, for
+// the clusters whose nodes sign their RPCs. args.Seq must be higher than the
+// one of every Submit signed before with key, and should follow the time in
+// nanoseconds, as the ones of the nodes do, see seqLease.
+func SignSubmit(args *SubmitArgs, key ed25519.PrivateKey) error {
+	signature, err := signWith(key, *args)
+	args.Signature = signature
+	return err
+}
+
+// signWith returns the signature of m by key.
+func signWith(key ed25519.PrivateKey, m signedMessage) ([]byte, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid signing key of %d bytes", len(key))
+	}
+	data, err := m.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(key, data), nil
+}
+
+// verify returns ErrBadSignature unless signature is the one of m by node
+// from, and ErrReplayed if seq, the sequence number of m, was already
+// received from it, if this CM verifies the RPCs of its peers. A mark above
+// seq is persisted with the term before verify returns, if seq crossed the
+// previous one, so that m is refused even after a restart: an RPC of the
+// current term, unlike the ones of older terms, would otherwise be handled
+// again.
+func (cm *ConsensusModule) verify(from int, m signedMessage, seq uint64, signature []byte) error {
+	if cm.keys == nil {
+		return nil
+	}
+	if err := cm.verifySignature(from, m, signature); err != nil {
+		return err
+	}
+
+	cm.keys.mu.Lock()
+	filter := cm.keys.filter(from)
+	accepted := filter.accept(seq)
+	persist := accepted && filter.raise(seq)
+	cm.keys.mu.Unlock()
+	if !accepted {
+		return fmt.Errorf("%w: message %d from node %d", ErrReplayed, seq, from)
+	}
+	if !persist {
+		return nil
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if err := cm.persistState(); err != nil {
+		cm.recordEvent(EventPersistError, "%v", err)
+		return err
+	}
+	return nil
+}
+
+// verifyReply returns ErrBadSignature unless signature is the one of reply
+// by node from, and ErrReplayed unless seq, the sequence number of the RPC
+// replied to according to reply, is want, the one of the RPC sent, if this
+// CM verifies the RPCs of its peers.
+func (cm *ConsensusModule) verifyReply(from int, reply signedMessage, seq, want uint64, signature []byte) error {
+	if cm.keys == nil {
+		return nil
+	}
+	if err := cm.verifySignature(from, reply, signature); err != nil {
+		return err
+	}
+	if seq != want {
+		return fmt.Errorf("%w: reply to %d from node %d, sent %d", ErrReplayed, seq, from, want)
+	}
+	return nil
+}
+
+// verifySignature returns ErrBadSignature unless signature is the one of m
+// by node from.
+func (cm *ConsensusModule) verifySignature(from int, m signedMessage, signature []byte) error {
+	key, ok := cm.keys.peers[from]
+	if !ok {
+		return fmt.Errorf("%w: no public key for node %d", ErrBadSignature, from)
+	}
+	data, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return fmt.Errorf("%w: message from node %d", ErrBadSignature, from)
+	}
+	return nil
+}
+
+// filter returns the replayFilter of node from, creating it if needed.
+// Expects k.mu to be locked.
+func (k *signingKeys) filter(from int) *replayFilter {
+	if k.received == nil {
+		k.received = make(map[int]*replayFilter)
+	}
+	filter, ok := k.received[from]
+	if !ok {
+		filter = &replayFilter{seen: make(map[uint64]bool)}
+		k.received[from] = filter
+	}
+	return filter
+}
+
+// seqs returns the mark of every peer, by ID, to be persisted, or nil if k
+// is nil.
+func (k *signingKeys) seqs() map[int]uint64 {
+	if k == nil {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var seqs map[int]uint64
+	for id, filter := range k.received {
+		seq := filter.mark
+		if seq == 0 {
+			continue
+		}
+		if seqs == nil {
+			seqs = make(map[int]uint64)
+		}
+		seqs[id] = seq
+	}
+	return seqs
+}
+
+// restoreSeqs makes the sequence numbers up to the ones of seqs, persisted
+// before a restart, refused, see seqs.
+func (k *signingKeys) restoreSeqs(seqs map[int]uint64) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for id, seq := range seqs {
+		filter := k.filter(id)
+		filter.floor, filter.mark, filter.saved = seq, seq, seq
+	}
+}
+
+// savedSeqs records that the marks of seqs, returned by seqs, were
+// persisted.
+func (k *signingKeys) savedSeqs(seqs map[int]uint64) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for id, seq := range seqs {
+		if filter := k.filter(id); seq > filter.saved {
+			filter.saved = seq
+		}
+	}
+}
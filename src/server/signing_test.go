@@ -0,0 +1,44 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSeqMark receives the sequence numbers of a peer signing an RPC every
+// 10ms for a second: its mark must be persisted about once per seqLease,
+// not for every RPC, and a CM restoring it must refuse every sequence
+// number received.
+func TestSeqMark(t *testing.T) {
+	k := &signingKeys{}
+	start := uint64(time.Now().UnixNano())
+	step := uint64(10 * time.Millisecond)
+	persisted := 0
+	var last uint64
+	for seq := start; seq < start+uint64(time.Second); seq += step {
+		filter := k.filter(1)
+		if !filter.accept(seq) {
+			t.Fatalf("%d refused", seq)
+		}
+		if filter.raise(seq) {
+			persisted++
+			k.savedSeqs(k.seqs())
+		}
+		last = seq
+	}
+	if want := int(uint64(time.Second)/seqLease) + 1; persisted > want {
+		t.Errorf("mark persisted %d times, want at most %d", persisted, want)
+	}
+
+	restarted := &signingKeys{}
+	restarted.restoreSeqs(k.seqs())
+	filter := restarted.filter(1)
+	for _, seq := range []uint64{start, last} {
+		if filter.accept(seq) {
+			t.Errorf("%d accepted again after a restart", seq)
+		}
+	}
+	if !filter.accept(last+seqLease+1) || !filter.raise(last+seqLease+1) {
+		t.Errorf("sequence number past the mark refused or not persisted")
+	}
+}
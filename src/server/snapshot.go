@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"server/transfer"
+	"sync"
+	"time"
+)
+
+// snapshotStreamTTL is how long a snapshot stays readable after its last
+// chunk was read, so that a node can resume reading it after a failure.
+const snapshotStreamTTL = 5 * time.Minute
+
+// snapshotStream is a snapshot of the FSM being streamed to a node.
+type snapshotStream struct {
+	data     []byte
+	lastRead time.Time
+}
+
+// snapshotStreams keeps the snapshots being streamed, by ID.
+type snapshotStreams struct {
+	mu      sync.Mutex
+	next    uint64
+	streams map[uint64]*snapshotStream
+}
+
+// openSnapshot takes a snapshot of cm.fsm to be read in chunks with the
+// ReadSnapshot RPC, and returns its ID, its size and the position of the last
+// entry it includes. The snapshot is taken on the goroutine applying the
+// entries, so that no entry is applied meanwhile. The snapshots not read for
+// snapshotStreamTTL are dropped.
+func (cm *ConsensusModule) openSnapshot(ctx context.Context) (id uint64, size int, index int, err error) {
+	var data []byte
+	err = cm.onApplier(ctx, func() error {
+		var err error
+		if data, err = cm.fsm.Snapshot(); err != nil {
+			return err
+		}
+		cm.mu.RLock()
+		index = cm.lastApplied
+		cm.mu.RUnlock()
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	now := cm.clock.Now()
+	ss := &cm.snapshots
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for id, stream := range ss.streams {
+		if now.Sub(stream.lastRead) > snapshotStreamTTL {
+			delete(ss.streams, id)
+		}
+	}
+	ss.next++
+	ss.streams[ss.next] = &snapshotStream{data: data, lastRead: now}
+	return ss.next, len(data), index, nil
+}
+
+type ReadSnapshotArgs struct {
+	Id     uint64
+	Offset int
+}
+
+// ReadSnapshotReply carries the chunk of the snapshot from the requested
+// offset, up to SnapshotChunkSize bytes, and the size of the whole snapshot.
+type ReadSnapshotReply struct {
+	Data []byte
+	Size int
+}
+
+// ReadSnapshot RPC. Returns a chunk of the snapshot args.Id opened by
+// openSnapshot, or ErrSnapshotNotFound if it was dropped.
+func (cm *ConsensusModule) ReadSnapshot(args ReadSnapshotArgs, reply *ReadSnapshotReply) error {
+	chunkSize := cm.Config().SnapshotChunkSize
+	ss := &cm.snapshots
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	stream := ss.streams[args.Id]
+	if stream == nil {
+		return fmt.Errorf("%w: %d", ErrSnapshotNotFound, args.Id)
+	}
+	if args.Offset < 0 || args.Offset > len(stream.data) {
+		return fmt.Errorf("invalid offset %d of snapshot %d of %d bytes", args.Offset, args.Id, len(stream.data))
+	}
+	end := intMin(args.Offset+chunkSize, len(stream.data))
+	reply.Data = stream.data[args.Offset:end]
+	reply.Size = len(stream.data)
+	stream.lastRead = cm.clock.Now()
+	return nil
+}
+
+// fetchSnapshot reads the snapshot id of size bytes from peerId, a chunk at
+// a time, so that the AEs aren't stalled behind a single large RPC. A failed
+// chunk is retried as a service transfer, resuming from its offset, and the
+// chunks are paced to SnapshotRate bytes per second, if set.
+func (cm *ConsensusModule) fetchSnapshot(ctx context.Context, peerId int, id uint64, size int) ([]byte, error) {
+	config := cm.Config()
+	policy := transfer.Policy{
+		Retries:   config.TransferRetries,
+		Backoff:   config.TransferBackoff,
+		Clock:     cm.clock,
+		Permanent: func(err error) bool { return isRPCError(err, ErrSnapshotNotFound) },
+	}
+	data := make([]byte, 0, size)
+	for len(data) < size {
+		start := cm.clock.Now()
+		var reply ReadSnapshotReply
+		_, err := policy.Do(ctx, func() error {
+			reply = ReadSnapshotReply{}
+			args := ReadSnapshotArgs{Id: id, Offset: len(data)}
+			return cm.transport.CallContext(ctx, peerId, "ConsensusModule.ReadSnapshot", args, &reply)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading snapshot %d from %d at offset %d: %w", id, peerId, len(data), err)
+		}
+		if len(reply.Data) == 0 {
+			return nil, fmt.Errorf("reading snapshot %d from %d at offset %d: empty chunk", id, peerId, len(data))
+		}
+		data = append(data, reply.Data...)
+
+		if config.SnapshotRate > 0 {
+			wait := time.Duration(len(reply.Data))*time.Second/time.Duration(config.SnapshotRate) - cm.clock.Since(start)
+			if wait > 0 {
+				select {
+				case <-cm.clock.After(wait):
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// SetStandby makes this server a standby node, or an active one if standby
+// is false, in the configuration of the cluster, and waits until the change
+// is committed. A standby node replicates the log and the artifacts of the
+// services but isn't chosen to run them until it's activated.
+func (s *Server) SetStandby(ctx context.Context, standby bool) error {
+	if !standby {
+		return s.Activate(ctx, s.serverId)
+	}
+	return s.submitConfigChange(ctx, ConfigChangePayload{Standby: []int{s.serverId}})
+}
+
+// Activate makes the standby node nodeId an active one, that can be chosen
+// to run services, and waits until the change is committed.
+func (s *Server) Activate(ctx context.Context, nodeId int) error {
+	return s.submitConfigChange(ctx, ConfigChangePayload{Activate: []int{nodeId}})
+}
+
+// activateStandby runs on the leader: while an active peer is down, it
+// activates a standby peer that isn't, to take its place. Returns when ctx is
+// done.
+func (cm *ConsensusModule) activateStandby(ctx context.Context) {
+	for {
+		select {
+		case <-cm.clock.After(evictionCheckInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		down, spare := -1, -1
+		cm.mu.RLock()
+		peerIds := append([]int{}, cm.peerIds...)
+		standby := make(map[int]bool, len(cm.standby))
+		for id := range cm.standby {
+			standby[id] = true
+		}
+		cm.mu.RUnlock()
+		sort.Ints(peerIds)
+		cm.peersMu.Lock()
+		for _, peerId := range peerIds {
+			switch {
+			case cm.isDown(peerId) && !standby[peerId] && down < 0:
+				down = peerId
+			case !cm.isDown(peerId) && standby[peerId] && spare < 0:
+				spare = peerId
+			}
+		}
+		cm.peersMu.Unlock()
+		if down < 0 || spare < 0 {
+			continue
+		}
+
+		command, err := NewCommand(CommandConfigChange, "", ConfigChangePayload{Activate: []int{spare}})
+		if err != nil {
+			return
+		}
+		_, _, _, future := cm.appendCommand(command)
+		if err := future.WaitContext(ctx); err != nil {
+			cm.Dlog("activation of %d failed: %v", spare, err)
+			continue
+		}
+		cm.recordEventUnlocked(EventStateChange, "standby node %d activated to replace node %d, down", spare, down)
+	}
+}
+
+// replicateArtifact sends the artifact of serviceId to the standby peers,
+// with term as fencing token, so that they can run it once activated.
+func (cm *ConsensusModule) replicateArtifact(ctx context.Context, term int, serviceId string) {
+	cm.mu.RLock()
+	var standby []int
+	for _, peerId := range cm.peerIds {
+		if cm.standby[peerId] {
+			standby = append(standby, peerId)
+		}
+	}
+	cm.mu.RUnlock()
+	cm.storeArtifact(ctx, term, serviceId, standby)
+}
+
+// storeArtifact sends the artifact of serviceId to the nodes peerIds, with
+// term as fencing token, for them to store it without running it.
+func (cm *ConsensusModule) storeArtifact(ctx context.Context, term int, serviceId string, peerIds []int) {
+	if len(peerIds) == 0 {
+		return
+	}
+
+	file, err := cm.artifacts.Load(serviceId)
+	if err != nil {
+		cm.Dlog("replicating %s: %v", serviceId, err)
+		return
+	}
+	cm.mu.RLock()
+	signature := cm.artifactSignature(serviceId)
+	cm.mu.RUnlock()
+	args := DeployArgs{Id: serviceId, Service: file, Term: term, StoreOnly: true, Signature: signature}
+	for _, peerId := range peerIds {
+		if err := cm.transport.CallContext(ctx, peerId, "ConsensusModule.Deploy", args, &DeployReply{}); err != nil {
+			cm.Dlog("replicating %s to node %d: %v", serviceId, peerId, fmt.Errorf("%w: %v", ErrTransferFailed, err))
+		}
+	}
+}
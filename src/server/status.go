@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"io"
+)
+
+// Status is a consistent view of the Raft state of a CM. It's published
+// whenever that state changes, so that it's read without locking cm.mu and
+// observability never blocks the consensus.
+type Status struct {
+	Id          int
+	State       string
+	Term        int
+	LeaderId    int
+	CommitIndex int
+	LastApplied int
+}
+
+// publishStatus publishes the current Raft state of cm, read by Status.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) publishStatus() {
+	cm.status.Store(Status{
+		Id:          cm.id,
+		State:       cm.state.String(),
+		Term:        cm.currentTerm,
+		LeaderId:    cm.leaderId,
+		CommitIndex: cm.commitIndex,
+		LastApplied: cm.lastApplied,
+	})
+}
+
+// Status returns the latest Raft state published by this CM.
+func (cm *ConsensusModule) Status() Status {
+	return cm.status.Load().(Status)
+}
+
+// WriteTo writes the status in the Prometheus text exposition format.
+func (st Status) WriteTo(w io.Writer) (int64, error) {
+	leader := 0
+	if st.State == Leader.String() {
+		leader = 1
+	}
+	n, err := fmt.Fprintf(w, "# HELP raft_term Current term.\n# TYPE raft_term gauge\nraft_term %d\n"+
+		"# HELP raft_leader Whether this node is the leader.\n# TYPE raft_leader gauge\nraft_leader %d\n"+
+		"# HELP raft_commit_index Index of the latest committed entry.\n# TYPE raft_commit_index gauge\nraft_commit_index %d\n"+
+		"# HELP raft_last_applied Index of the latest applied entry.\n# TYPE raft_last_applied gauge\nraft_last_applied %d\n",
+		st.Term, leader, st.CommitIndex, st.LastApplied)
+	return int64(n), err
+}
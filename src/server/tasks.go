@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TaskInfo describes a goroutine spawned by a CM or its Server.
+type TaskInfo struct {
+	Id      uint64
+	Name    string
+	Started time.Time
+}
+
+// TaskRegistry tracks the goroutines spawned through it until they return,
+// so that leaked goroutines can be spotted.
+type TaskRegistry struct {
+	mu    sync.Mutex
+	next  uint64
+	tasks map[uint64]TaskInfo
+	wg    sync.WaitGroup
+
+	// recoverFunc is deferred by every goroutine to recover its panics.
+	recoverFunc func(task string, errp *error)
+}
+
+func NewTaskRegistry(recoverFunc func(task string, errp *error)) *TaskRegistry {
+	return &TaskRegistry{
+		tasks:       make(map[uint64]TaskInfo),
+		recoverFunc: recoverFunc,
+	}
+}
+
+// Go runs f in a new goroutine registered under name until f returns. A
+// panic of f is recovered by the recoverFunc of the registry.
+func (tr *TaskRegistry) Go(name string, f func()) {
+	tr.mu.Lock()
+	id := tr.next
+	tr.next++
+	tr.tasks[id] = TaskInfo{Id: id, Name: name, Started: time.Now()}
+	tr.wg.Add(1)
+	tr.mu.Unlock()
+
+	go func() {
+		defer func() {
+			tr.mu.Lock()
+			delete(tr.tasks, id)
+			tr.mu.Unlock()
+			tr.wg.Done()
+		}()
+		if tr.recoverFunc != nil {
+			defer tr.recoverFunc(name, nil)
+		}
+		f()
+	}()
+}
+
+// Wait blocks until every goroutine of the registry has returned, or until
+// ctx is done, in which case ctx.Err() is returned.
+func (tr *TaskRegistry) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		tr.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Tasks returns the goroutines still running, oldest first.
+func (tr *TaskRegistry) Tasks() []TaskInfo {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tasks := make([]TaskInfo, 0, len(tr.tasks))
+	for _, task := range tr.tasks {
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Id < tasks[j].Id })
+	return tasks
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestTaskRegistry runs two tasks through a registry: both must be listed,
+// oldest first, until they return, and none once they have.
+func TestTaskRegistry(t *testing.T) {
+	tr := NewTaskRegistry(nil)
+	release := make(chan struct{})
+	for _, name := range []string{"first", "second"} {
+		tr.Go(name, func() { <-release })
+	}
+	tasks := tr.Tasks()
+	if len(tasks) != 2 || tasks[0].Name != "first" || tasks[1].Name != "second" {
+		t.Fatalf("tasks %+v, want first and second", tasks)
+	}
+
+	close(release)
+	waitNoTasks(t, tr)
+}
+
+// TestTaskRegistryRecovers panics in a task: the recoverFunc of the registry
+// must recover it, and the task must be removed.
+func TestTaskRegistryRecovers(t *testing.T) {
+	recovered := make(chan interface{}, 1)
+	tr := NewTaskRegistry(func(task string, errp *error) {
+		if r := recover(); r != nil {
+			recovered <- r
+		}
+	})
+	tr.Go("panicking", func() { panic("boom") })
+	select {
+	case r := <-recovered:
+		if r != "boom" {
+			t.Errorf("recovered %v, want boom", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("panic not recovered")
+	}
+	waitNoTasks(t, tr)
+}
+
+// waitNoTasks waits up to 5 seconds until tr tracks no task.
+func waitNoTasks(t *testing.T, tr *TaskRegistry) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tr.Tasks()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("tasks %+v left after they returned", tr.Tasks())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestStopLeavesNoTasks stops the nodes of a cluster that elected a leader
+// and replicated entries: every goroutine of their registries, the
+// replicators, voters and leader functions included, must have returned.
+func TestStopLeavesNoTasks(t *testing.T) {
+	c := newTestCluster(t, 3)
+	cm := c.elect(t, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		command, err := NewCommand(CommandNoop, fmt.Sprintf("%d", i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, accepted, future := cm.appendCommand(command)
+		if !accepted {
+			t.Fatalf("appending %d: %v", i, future.Wait())
+		}
+		if err := future.WaitContext(ctx); err != nil {
+			t.Fatalf("entry %d: %v", future.Index, err)
+		}
+	}
+
+	// A stopped CM leaves no task once Wait returns, even though its server
+	// is still up.
+	follower := c.servers[3].cm
+	follower.Stop()
+	if err := follower.Wait(ctx); err != nil {
+		t.Fatalf("waiting for 3: %v, tasks %+v", err, follower.Tasks())
+	}
+	if tasks := follower.Tasks(); len(tasks) != 0 {
+		t.Errorf("tasks %+v left on 3 after Stop", tasks)
+	}
+
+	for _, id := range []int{1, 2, 3} {
+		if err := c.servers[id].Shutdown(ctx); err != nil {
+			t.Fatalf("shutting down %d: %v, tasks %+v", id, err, c.servers[id].cm.Tasks())
+		}
+		if tasks := c.servers[id].cm.Tasks(); len(tasks) != 0 {
+			t.Errorf("tasks %+v left on %d after Shutdown", tasks, id)
+		}
+	}
+}
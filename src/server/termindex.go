@@ -0,0 +1,59 @@
+package server
+
+// termSpan is the range of log indexes [first, last] holding the entries of
+// a term.
+type termSpan struct {
+	first int
+	last  int
+}
+
+// termIndex maps every term in the log to the indexes of its entries, so
+// that the conflict resolution of AppendEntries doesn't scan the log. Since
+// the terms in a log never decrease, the entries of a term are contiguous.
+// It's protected by cm.mu, like the log.
+type termIndex struct {
+	spans map[int]*termSpan
+
+	// terms lists the terms in the log in order
+	terms []int
+}
+
+func newTermIndex() termIndex {
+	return termIndex{spans: make(map[int]*termSpan)}
+}
+
+// add records the entry of term at index, the new end of the log.
+func (ti *termIndex) add(term int, index int) {
+	if span := ti.spans[term]; span != nil {
+		span.last = index
+		return
+	}
+	ti.spans[term] = &termSpan{first: index, last: index}
+	ti.terms = append(ti.terms, term)
+}
+
+// truncate drops the entries from index length on.
+func (ti *termIndex) truncate(length int) {
+	for len(ti.terms) > 0 {
+		term := ti.terms[len(ti.terms)-1]
+		span := ti.spans[term]
+		if span.first < length {
+			if span.last >= length {
+				span.last = length - 1
+			}
+			return
+		}
+		delete(ti.spans, term)
+		ti.terms = ti.terms[:len(ti.terms)-1]
+	}
+}
+
+// bounds returns the first and the last index of the entries of term, and
+// false if the log holds none.
+func (ti *termIndex) bounds(term int) (first int, last int, ok bool) {
+	span := ti.spans[term]
+	if span == nil {
+		return -1, -1, false
+	}
+	return span.first, span.last, true
+}
@@ -0,0 +1,44 @@
+package testcluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"server"
+)
+
+// TestConcurrentElections starts elections on every node at once, while the
+// leader is paused and resumed, a few times in a row: the votes must be
+// decided on the state of the voter when it answers. Run with -race.
+func TestConcurrentElections(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, 3)
+	for round := 0; round < 3; round++ {
+		var wg sync.WaitGroup
+		for _, id := range c.Ids() {
+			wg.Add(1)
+			go func(cm *server.ConsensusModule) {
+				defer wg.Done()
+				cm.Election()
+				// A second pause doesn't block.
+				cm.Pause()
+				cm.Pause()
+			}(c.Server(id).GetConsensusModule())
+		}
+		wg.Wait()
+		// The votes may be split, or another node may hold a higher term:
+		// the nodes only run the elections they're asked to, so 1 is
+		// elected again until it wins.
+		if err := c.CheckNoSplitBrain(); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.electRetry(ctx, 1, fmt.Sprint("round-", round)); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.mustCommit(ctx, 1, fmt.Sprint("round-", round)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
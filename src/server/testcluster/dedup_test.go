@@ -0,0 +1,81 @@
+package testcluster
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"server"
+)
+
+// TestDuplicateSubmitFollowerDown submits a deployment again to a leader
+// restarted with a follower down, before it commits the placement: the
+// leader is one of the two nodes of the majority, so the no-op committing
+// the placement must be persisted, or the retry never resolves.
+func TestDuplicateSubmitFollowerDown(t *testing.T) {
+	chdir(t, t.TempDir())
+	ctx := context.Background()
+	c := newTestCluster(t, 3)
+	command, err := server.NewCommand(server.CommandDeploy, fmt.Sprintf("%064x", 1), server.DeployPayload{Version: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := c.SubmitAndWaitCommit(ctx, 1, command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Stop(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Restart(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StepTimeout)
+	defer cancel()
+	again, err := c.SubmitAndWaitCommit(ctx, 1, command)
+	if err != nil {
+		t.Fatalf("submitting again: %v", err)
+	}
+	if again != index {
+		t.Errorf("submitted again at %d, want the placement at %d", again, index)
+	}
+}
+
+// TestDuplicateManifest parses a manifest declaring its Version twice, as
+// clients retrying its submission do, and submits both: the service is
+// placed once.
+func TestDuplicateManifest(t *testing.T) {
+	chdir(t, t.TempDir())
+	ctx := context.Background()
+	c := newTestCluster(t, 3)
+	const manifest = "ServiceType: Docker\nVersion: 1\nservices:\n  web:\n    image: nginx\n"
+	var indexes []int
+	for i := 0; i < 2; i++ {
+		command, _, err := server.ParseService(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, err := c.SubmitAndWaitCommit(ctx, 1, command)
+		if err != nil {
+			t.Fatalf("submission %d: %v", i, err)
+		}
+		indexes = append(indexes, index)
+	}
+	if indexes[0] != indexes[1] {
+		t.Fatalf("placed at %d and %d, want once", indexes[0], indexes[1])
+	}
+	entries, err := c.Server(1).GetConsensusModule().ReadCommittedLog(0, indexes[1]+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys := 0
+	for _, entry := range entries {
+		if entry.Command.Kind == server.CommandDeploy {
+			deploys++
+		}
+	}
+	if deploys != 1 {
+		t.Errorf("%d deployments committed, want 1", deploys)
+	}
+}
@@ -0,0 +1,144 @@
+package testcluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// The fakes below stand in for the dependencies of a single
+// ConsensusModule, passed with server.WithStorage, server.WithTransport and
+// server.WithLoadProvider, so that its elections, commits and scheduling
+// are driven without a cluster. Executor fakes the executor.
+
+// Storage keeps the records persisted by a CM in memory, by Id, as a
+// storage.MapStorage does on disk; SetErr makes it fail. It's safe for
+// concurrent use.
+type Storage struct {
+	mu      sync.Mutex
+	records map[string]map[string]interface{}
+	writes  int
+	err     error
+}
+
+// NewStorage creates an empty storage.
+func NewStorage() *Storage {
+	return &Storage{records: make(map[string]map[string]interface{})}
+}
+
+func (s *Storage) Set(value map[string]interface{}, toWrite bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	id, ok := value["Id"].(string)
+	if !ok {
+		return fmt.Errorf("entry without Id: %v", value)
+	}
+	if s.records[id] == nil {
+		record := make(map[string]interface{}, len(value)-1)
+		for key, v := range value {
+			if key != "Id" {
+				record[key] = v
+			}
+		}
+		s.records[id] = record
+		if toWrite {
+			s.writes++
+		}
+	}
+	return nil
+}
+
+// Record returns the record persisted with id, or nil.
+func (s *Storage) Record(id string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[id]
+}
+
+// Len returns how many records are persisted.
+func (s *Storage) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.records)
+}
+
+// Writes returns how many records were asked to be written through.
+func (s *Storage) Writes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writes
+}
+
+// SetErr makes every Set from now on fail with err, or succeed if nil.
+func (s *Storage) SetErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// Call is an RPC sent through a Transport.
+type Call struct {
+	To            int
+	ServiceMethod string
+	Args          interface{}
+}
+
+// Transport records the RPCs sent by a CM and answers them with Handler,
+// or fails them if Handler is nil. It's safe for concurrent use.
+type Transport struct {
+	// Handler fills reply, as peer id would, or returns an error; it must
+	// be set before the CM is started
+	Handler func(id int, serviceMethod string, args interface{}, reply interface{}) error
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+func (t *Transport) CallContext(ctx context.Context, id int, serviceMethod string, args interface{}, reply interface{}) error {
+	t.mu.Lock()
+	t.calls = append(t.calls, Call{To: id, ServiceMethod: serviceMethod, Args: args})
+	t.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t.Handler == nil {
+		return fmt.Errorf("node %d unreachable", id)
+	}
+	return t.Handler(id, serviceMethod, args, reply)
+}
+
+// Calls returns the RPCs sent so far, in order.
+func (t *Transport) Calls() []Call {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Call(nil), t.calls...)
+}
+
+// Load is a load provider whose level and CPU usage are set with Set. It's
+// safe for concurrent use.
+type Load struct {
+	mu    sync.Mutex
+	level int
+	cpu   float64
+}
+
+// NewLoad creates a load provider measuring level and cpu.
+func NewLoad(level int, cpu float64) *Load {
+	return &Load{level: level, cpu: cpu}
+}
+
+func (l *Load) LoadLevel() (int, float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.level, l.cpu
+}
+
+// Set makes the provider measure level and cpu from now on.
+func (l *Load) Set(level int, cpu float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level, l.cpu = level, cpu
+}
@@ -0,0 +1,214 @@
+package testcluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"server"
+)
+
+// peers are the loads of the peers of the CM driven by the fakes: 2 is the
+// least loaded.
+var peers = map[int]int{2: 1, 3: 5}
+
+// newFakeNode starts node 1 on the fakes, connected to peers, whose RPCs are
+// answered by transport.
+func newFakeNode(t *testing.T, transport *Transport, storage *Storage, load *Load) *server.Server {
+	t.Helper()
+	config := server.DefaultConfig()
+	config.LogPath = filepath.Join(t.TempDir(), "log.txt")
+	srv, err := server.NewServer(1, config, nil,
+		server.WithTransport(transport),
+		server.WithStorage(storage),
+		server.WithLoadProvider(load),
+		server.WithExecutor(NewExecutor()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	for id := range peers {
+		if err := srv.AddNode(id, addr(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return srv
+}
+
+// voters answers the RequestVotes as peers with their loads, granting the
+// vote if grant returns true for the peer, and the AEs as followers holding
+// the log.
+func voters(grant func(id int) bool) func(int, string, interface{}, interface{}) error {
+	return func(id int, serviceMethod string, args interface{}, reply interface{}) error {
+		switch serviceMethod {
+		case "ConsensusModule.RequestVote":
+			args := args.(server.RequestVoteArgs)
+			*reply.(*server.RequestVoteReply) = server.RequestVoteReply{
+				Term:        args.Term,
+				VoteGranted: grant(id),
+				LoadLevel:   peers[id],
+			}
+		case "ConsensusModule.AppendEntries":
+			args := args.(server.AppendEntriesArgs)
+			*reply.(*server.AppendEntriesReply) = server.AppendEntriesReply{Term: args.Term, Success: true}
+		default:
+			return fmt.Errorf("unexpected %s to %d", serviceMethod, id)
+		}
+		return nil
+	}
+}
+
+// chdir changes the working directory to dir until the end of the test, for
+// the node saving the artifacts of the commands submitted to it.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// waitFor polls done until it returns true, or fails the test after a
+// second.
+func waitFor(t *testing.T, message string, done func() bool) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for !done() {
+		select {
+		case <-time.After(PollInterval):
+		case <-ctx.Done():
+			t.Fatal(message)
+		}
+	}
+}
+
+// TestFakesElection makes the CM run an election its peers vote for.
+func TestFakesElection(t *testing.T) {
+	transport := &Transport{Handler: voters(func(int) bool { return true })}
+	srv := newFakeNode(t, transport, NewStorage(), NewLoad(3, 30))
+	cm := srv.GetConsensusModule()
+	cm.Election()
+	waitFor(t, "not elected", func() bool { return cm.Status().State == server.Leader.String() })
+
+	// The first vote granted makes a majority; the new leader then sends
+	// an AE to every peer.
+	waitFor(t, "no AE sent to every peer", func() bool {
+		sent := make(map[int]bool)
+		for _, call := range transport.Calls() {
+			if call.ServiceMethod == "ConsensusModule.AppendEntries" && call.Args.(server.AppendEntriesArgs).Term == cm.Status().Term {
+				sent[call.To] = true
+			}
+		}
+		return len(sent) == len(peers)
+	})
+}
+
+// TestFakesElectionHigherTerm makes the CM run an election its peers answer
+// from a later term: it must step down to that term.
+func TestFakesElectionHigherTerm(t *testing.T) {
+	const term = 7
+	transport := &Transport{Handler: func(id int, serviceMethod string, args interface{}, reply interface{}) error {
+		*reply.(*server.RequestVoteReply) = server.RequestVoteReply{Term: term}
+		return nil
+	}}
+	srv := newFakeNode(t, transport, NewStorage(), NewLoad(3, 30))
+	cm := srv.GetConsensusModule()
+	cm.Election()
+	waitFor(t, "still a candidate", func() bool {
+		status := cm.Status()
+		return status.State == server.Follower.String() && status.Term == term
+	})
+}
+
+// TestFakesElectionUnreachable makes the CM run an election its peers never
+// answer: it stays a candidate.
+func TestFakesElectionUnreachable(t *testing.T) {
+	transport := &Transport{}
+	srv := newFakeNode(t, transport, NewStorage(), NewLoad(3, 30))
+	cm := srv.GetConsensusModule()
+	cm.Election()
+	waitFor(t, "no vote asked", func() bool { return len(transport.Calls()) >= len(peers) })
+	if state := cm.Status().State; state != server.Candidate.String() {
+		t.Fatalf("%s without votes, want %s", state, server.Candidate)
+	}
+}
+
+// TestFakesCommitAndSchedule deploys a service through a leader whose
+// followers acknowledge every AE: it's committed, placed on the least loaded
+// node and persisted.
+func TestFakesCommitAndSchedule(t *testing.T) {
+	chdir(t, t.TempDir())
+	storage := NewStorage()
+	// The election is won once 2 votes, so that its load is known.
+	transport := &Transport{Handler: voters(func(id int) bool { return id == 2 })}
+	srv := newFakeNode(t, transport, storage, NewLoad(9, 90))
+	cm := srv.GetConsensusModule()
+	srv.Go("MonitorLoad", cm.MonitorLoad)
+	waitFor(t, "load not measured", func() bool { return cm.DumpState().LoadLevel == 9 })
+
+	command, err := server.NewCommand(server.CommandDeploy, fmt.Sprintf("%064x", 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	index, _, accepted, future := srv.Submit(ctx, command)
+	if !accepted {
+		t.Fatalf("not accepted: %v", future.Wait())
+	}
+	if err := future.WaitContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := cm.ReadCommittedLog(index, index+1)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("reading entry %d: %v, %v", index, entries, err)
+	}
+	if chosen := entries[0].ChosenId; chosen != 2 {
+		t.Errorf("placed on %d, want 2 with load %d", chosen, peers[2])
+	}
+	waitFor(t, "entry not persisted", func() bool { return storage.Record(entries[0].Index) != nil })
+}
+
+// TestFakesStorageError makes the storage fail: the entry is committed, but
+// the failure to apply it is reported.
+func TestFakesStorageError(t *testing.T) {
+	chdir(t, t.TempDir())
+	storage := NewStorage()
+	storage.SetErr(errors.New("disk full"))
+	transport := &Transport{Handler: voters(func(int) bool { return true })}
+	srv := newFakeNode(t, transport, storage, NewLoad(1, 10))
+	cm := srv.GetConsensusModule()
+
+	command, err := server.NewCommand(server.CommandDeploy, fmt.Sprintf("%064x", 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, _, _, future := srv.Submit(ctx, command)
+	if err := future.WaitContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "apply error not reported", func() bool {
+		for _, event := range cm.Events() {
+			if strings.Contains(event.Message, "disk full") {
+				return true
+			}
+		}
+		return false
+	})
+	if storage.Len() != 0 {
+		t.Fatalf("%d records persisted by a failing storage", storage.Len())
+	}
+}
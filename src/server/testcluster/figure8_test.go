@@ -0,0 +1,45 @@
+package testcluster
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+// TestFigure8 runs the Figure 8 scenario: X, the entry of an old term
+// replicated to a majority, must never be committed, and Y, overwriting it,
+// must be committed on every node.
+func TestFigure8(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, 5)
+	if err := figure8(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	index, err := c.SubmitAndWaitCommit(ctx, 5, noop(t, "after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The commit reaches the followers with the next AE.
+	if err := c.mustCommit(ctx, 5, "flush"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range c.Ids() {
+		if err := c.waitForCommit(ctx, id, index); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := c.Server(id).GetConsensusModule().ReadCommittedLog(0, math.MaxInt32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		committed := make(map[string]bool)
+		for _, entry := range entries {
+			committed[entry.Command.ServiceID] = true
+		}
+		if committed["X"] || !committed["Y"] {
+			t.Errorf("node %d committed X %v and Y %v, want only Y", id, committed["X"], committed["Y"])
+		}
+	}
+	if err := c.CheckHistory(); err != nil {
+		t.Fatal(err)
+	}
+}
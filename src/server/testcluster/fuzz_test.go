@@ -0,0 +1,98 @@
+package testcluster
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"server"
+)
+
+// maxFuzzEntries bounds the entries added by each side in
+// FuzzAppendEntries, so that the whole log fits in a StateDump.
+const maxFuzzEntries = 5
+
+// FuzzAppendEntries makes a follower hold a log sharing a prefix with the
+// leader's and then entries of terms the leader never had, the leader's
+// terms being even and the follower's own ones odd, and sends it an AE of
+// the leader after an entry they share. The follower's log must then hold
+// the leader's up to the last entry sent, and be cut there unless it held
+// all the entries sent already.
+func FuzzAppendEntries(f *testing.F) {
+	f.Add([]byte{0, 1, 0, 1}, []byte{1, 0}, uint8(2), uint8(1), uint8(2))
+	f.Add([]byte{0, 0, 0}, []byte{}, uint8(3), uint8(0), uint8(3))
+	f.Add([]byte{0, 1}, []byte{0, 0, 0, 0}, uint8(2), uint8(2), uint8(0))
+	f.Add([]byte{}, []byte{1, 1}, uint8(0), uint8(0), uint8(0))
+	f.Fuzz(func(t *testing.T, leaderSteps, followerSteps []byte, shared, prev, sent uint8) {
+		if len(leaderSteps) > maxFuzzEntries || len(followerSteps) > maxFuzzEntries {
+			t.Skip()
+		}
+		// Each step adds an entry, in the same term as the previous one or
+		// the next.
+		leader, follower := []server.LogEntry{}, []server.LogEntry{}
+		term := 2
+		for i, step := range leaderSteps {
+			term += 2 * int(step%2)
+			leader = append(leader, server.LogEntry{Term: term, Index: fmt.Sprint("L", i)})
+		}
+		k := int(shared) % (len(leader) + 1)
+		follower = append(follower, leader[:k]...)
+		term = 1
+		if k > 0 {
+			term = leader[k-1].Term + 1
+		}
+		for i, step := range followerSteps {
+			term += 2 * int(step%2)
+			follower = append(follower, server.LogEntry{Term: term, Index: fmt.Sprint("F", i)})
+		}
+		prevLogIndex := int(prev)%(k+1) - 1
+		end := prevLogIndex + 1 + int(sent)%(len(leader)-prevLogIndex)
+		prevLogTerm := -1
+		if prevLogIndex >= 0 {
+			prevLogTerm = leader[prevLogIndex].Term
+		}
+
+		c, err := New(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Shutdown(context.Background())
+		cm := c.Server(1).GetConsensusModule()
+		appendEntries := func(args server.AppendEntriesArgs) {
+			t.Helper()
+			args.LeaderId, args.LeaderCommit = 2, -1
+			var reply server.AppendEntriesReply
+			if err := cm.AppendEntries(args, &reply); err != nil || !reply.Success {
+				t.Fatalf("AppendEntries %+v: success %v, %v", args, reply.Success, err)
+			}
+		}
+		// The follower's log comes from a leader of its last term.
+		appendEntries(server.AppendEntriesArgs{Term: term, PrevLogIndex: -1, PrevLogTerm: -1, Entries: follower})
+		appendEntries(server.AppendEntriesArgs{
+			Term:         term + 2*len(leader) + 2,
+			PrevLogIndex: prevLogIndex,
+			PrevLogTerm:  prevLogTerm,
+			Entries:      leader[prevLogIndex+1 : end],
+		})
+
+		dump := cm.DumpState()
+		log := dump.LogTail
+		if len(log) != dump.LogLength {
+			t.Fatalf("dump of %d entries of %d", len(log), dump.LogLength)
+		}
+		for i := range log {
+			log[i] = server.LogEntry{Term: log[i].Term, Index: log[i].Index}
+		}
+		if len(log) < end || !reflect.DeepEqual(log[:end], leader[:end]) {
+			t.Fatalf("log %v doesn't match the leader's %v up to %d", log, leader, end)
+		}
+		// A follower already holding the entries sent keeps the ones after
+		// them: the AE may be a stale one.
+		if held := len(follower) >= end && reflect.DeepEqual(follower[:end], leader[:end]); held && !reflect.DeepEqual(log, follower) {
+			t.Fatalf("log %v changed from %v by entries it held", log, follower)
+		} else if !held && len(log) != end {
+			t.Fatalf("log %v not cut at %d", log, end)
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package testcluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"server"
+	st "storage"
+)
+
+// GoldenDir is the directory of the golden files written with the formats
+// of the released nodes, relative to this package.
+const GoldenDir = "testdata/golden"
+
+// goldenEntry is the log entry of the samples.
+var goldenEntry = server.LogEntry{
+	Command:   server.Service{ServiceID: "web", Type: "Docker", Kind: server.CommandMigrate, Payload: []byte(`{"To":3}`)},
+	Term:      4,
+	LeaderId:  1,
+	Index:     "4640a2160d123fdee192ea33e3cb0179859aa59d95641a589e1a61b11c34cd77",
+	ChosenId:  2,
+	Timestamp: "2024-01-02 15:04:05.0000",
+}
+
+// goldenMessages are samples of the RPC messages exchanged by the nodes, by
+// name. Every field is set, since gob leaves out the zero ones.
+func goldenMessages() map[string]interface{} {
+	return map[string]interface{}{
+		"RequestVoteArgs": server.RequestVoteArgs{
+			Term: 4, CandidateId: 1, LastLogIndex: 7, LastLogTerm: 3, LoadLevel: 5,
+			Seq: 1704207845000000000, Signature: []byte("signature"),
+		},
+		"RequestVoteReply": server.RequestVoteReply{
+			Term: 4, VoteGranted: true, LoadLevel: 2, VoteElabTime: 3 * time.Millisecond, Draining: true,
+		},
+		"AppendEntriesArgs": server.AppendEntriesArgs{
+			Term: 4, LeaderId: 1, PrevLogIndex: 7, PrevLogTerm: 3,
+			Entries: []server.LogEntry{goldenEntry}, LeaderCommit: 6, ChosenId: 2,
+			Seq: 1704207845000000001, Signature: []byte("signature"),
+		},
+		"AppendEntriesReply": server.AppendEntriesReply{
+			Term: 4, Success: true, ConflictIndex: 5, ConflictTerm: 2, VoteElabTime: time.Millisecond,
+		},
+	}
+}
+
+// goldenStorage returns the content of a storage holding the record of
+// goldenEntry, first of its hash chain, as written by storage.MapStorage.
+func goldenStorage() ([]byte, error) {
+	record := server.StorageRecord(goldenEntry)
+	if _, err := st.ChainRecord(record, ""); err != nil {
+		return nil, err
+	}
+	id := record["Id"].(string)
+	delete(record, "Id")
+	return json.MarshalIndent(map[string]map[string]interface{}{id: record}, "", "  ")
+}
+
+// CheckGolden returns an error if the persistence and wire formats changed
+// in a way that breaks the nodes already released: the samples in the
+// golden files of dir, such as GoldenDir, must still decode to the same
+// values with the current types, and the storage must still be written byte
+// for byte as it was. With update, it writes the golden files instead; that
+// is only right for a new format that the released nodes can read too.
+func CheckGolden(dir string, update bool) error {
+	if update {
+		return writeGolden(dir)
+	}
+	var violations []string
+	for name, sample := range goldenMessages() {
+		data, err := os.ReadFile(filepath.Join(dir, name+".gob"))
+		if err != nil {
+			return err
+		}
+		decoded := reflect.New(reflect.TypeOf(sample))
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(decoded.Interface()); err != nil {
+			violations = append(violations, fmt.Sprintf("%s: %v", name, err))
+		} else if !reflect.DeepEqual(decoded.Elem().Interface(), sample) {
+			violations = append(violations, fmt.Sprintf("%s: decoded %+v, expected %+v", name, decoded.Elem().Interface(), sample))
+		}
+	}
+
+	path := filepath.Join(dir, "storage.json")
+	golden, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	current, err := goldenStorage()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(golden, current) {
+		violations = append(violations, fmt.Sprintf("storage: written as\n%s\nexpected\n%s", current, golden))
+	}
+	if ms, err := st.NewMapStorage(path); err != nil {
+		violations = append(violations, fmt.Sprintf("storage: %v", err))
+	} else if _, err := ms.VerifyChain(); err != nil {
+		violations = append(violations, fmt.Sprintf("storage: %v", err))
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	sort.Strings(violations)
+	return fmt.Errorf("incompatible formats:\n%s", strings.Join(violations, "\n"))
+}
+
+// writeGolden writes the golden files of the current formats to dir.
+func writeGolden(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, sample := range goldenMessages() {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(sample); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".gob"), buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	data, err := goldenStorage()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "storage.json"), data, 0644)
+}
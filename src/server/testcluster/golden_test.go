@@ -0,0 +1,17 @@
+package testcluster
+
+import (
+	"flag"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "write the golden files of the current formats")
+
+// TestGolden checks that the storage and RPC formats can still be read by
+// the released nodes, see CheckGolden. Run with -update to write the golden
+// files of a new format instead.
+func TestGolden(t *testing.T) {
+	if err := CheckGolden(GoldenDir, *update); err != nil {
+		t.Fatal(err)
+	}
+}
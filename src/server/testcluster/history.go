@@ -0,0 +1,150 @@
+package testcluster
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"server"
+)
+
+// Decision is a committed entry as seen by History: the service it concerns
+// and the node chosen for it.
+type Decision struct {
+	Position  int
+	Term      int
+	Index     string
+	Kind      server.CommandKind
+	ServiceID string
+	ChosenId  int
+}
+
+func decisionOf(entry server.CommittedEntry) Decision {
+	return Decision{
+		Position:  entry.Position,
+		Term:      entry.Term,
+		Index:     entry.Index,
+		Kind:      entry.Command.Kind,
+		ServiceID: entry.Command.ServiceID,
+		ChosenId:  entry.ChosenId,
+	}
+}
+
+// History records the decisions committed on the nodes of a cluster during a
+// run, across crashes and partitions, and the ones acknowledged to clients,
+// to check that they form a single sequence: every node commits the same
+// decision at a position, a committed decision is never replaced or dropped
+// and an acknowledged one is never lost. It's safe for concurrent use.
+type History struct {
+	mu sync.Mutex
+	// committed is the longest committed log seen on every node, by ID
+	committed map[int][]Decision
+	// acked are the decisions whose commit was acknowledged, by position
+	acked map[int]Decision
+	// violations are the changes of a committed log seen by Observe
+	violations []string
+}
+
+// NewHistory creates an empty history.
+func NewHistory() *History {
+	return &History{
+		committed: make(map[int][]Decision),
+		acked:     make(map[int]Decision),
+	}
+}
+
+// Observe records the committed log of node id. A node that restarted may
+// commit fewer entries than before, but the ones it commits must not
+// change.
+func (h *History) Observe(id int, cm *server.ConsensusModule) error {
+	entries, err := cm.ReadCommittedLog(0, math.MaxInt32)
+	if err != nil {
+		return err
+	}
+	decisions := make([]Decision, len(entries))
+	for i, entry := range entries {
+		decisions[i] = decisionOf(entry)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seen := h.committed[id]
+	for i := 0; i < len(seen) && i < len(decisions); i++ {
+		if seen[i] != decisions[i] {
+			h.violations = append(h.violations, fmt.Sprintf("node %d: committed %+v at %d, then %+v", id, seen[i], i, decisions[i]))
+		}
+	}
+	if len(decisions) >= len(seen) {
+		h.committed[id] = decisions
+	}
+	return nil
+}
+
+// Ack records that the commit of d was acknowledged to a client.
+func (h *History) Ack(d Decision) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if other, ok := h.acked[d.Position]; ok && other != d {
+		h.violations = append(h.violations, fmt.Sprintf("acknowledged %+v and %+v at %d", other, d, d.Position))
+	}
+	h.acked[d.Position] = d
+}
+
+// Check returns an error listing the violations in the history: the nodes
+// that committed different decisions at the same position, the committed
+// logs that changed and the acknowledged decisions that no node commits.
+func (h *History) Check() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	violations := append([]string(nil), h.violations...)
+
+	ids := make([]int, 0, len(h.committed))
+	longest := 0
+	for id, decisions := range h.committed {
+		ids = append(ids, id)
+		if len(decisions) > longest {
+			longest = len(decisions)
+		}
+	}
+	sort.Ints(ids)
+	for position := 0; position < longest; position++ {
+		first := -1
+		for _, id := range ids {
+			decisions := h.committed[id]
+			if position >= len(decisions) {
+				continue
+			}
+			if first < 0 {
+				first = id
+			} else if decisions[position] != h.committed[first][position] {
+				violations = append(violations, fmt.Sprintf("nodes %d and %d committed %+v and %+v at %d",
+					first, id, h.committed[first][position], decisions[position], position))
+			}
+		}
+	}
+
+	for position, d := range h.acked {
+		found := false
+		for _, id := range ids {
+			decisions := h.committed[id]
+			if position >= len(decisions) {
+				continue
+			}
+			if decisions[position] != d {
+				violations = append(violations, fmt.Sprintf("node %d committed %+v at %d, acknowledged %+v", id, decisions[position], position, d))
+			}
+			found = true
+		}
+		if !found {
+			violations = append(violations, fmt.Sprintf("acknowledged %+v is committed by no node", d))
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	sort.Strings(violations)
+	return fmt.Errorf("inconsistent history:\n%s", strings.Join(violations, "\n"))
+}
@@ -0,0 +1,173 @@
+package testcluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+
+	"server"
+)
+
+// Network connects the servers of a Cluster in memory: every RPC goes
+// through a net.Pipe to the server it's addressed to. It's safe for
+// concurrent use.
+type Network struct {
+	mu      sync.Mutex
+	servers map[int]*server.Server
+	// clients are the connections from a node to another, by [from, to]
+	clients map[[2]int]*rpc.Client
+	// schedule, if not nil, receives the RPCs instead of delivering them,
+	// see Simulator
+	schedule func(m *Message)
+	// cut are the links partitioned, by [from, to]
+	cut map[[2]int]bool
+}
+
+// Message is an RPC waiting to be delivered on a Network.
+type Message struct {
+	From          int
+	To            int
+	ServiceMethod string
+	Args          interface{}
+	Reply         interface{}
+
+	done chan error
+	// seq orders the RPCs from From to To, see Simulator.Step
+	seq int
+}
+
+// NewNetwork creates a network without servers.
+func NewNetwork() *Network {
+	return &Network{
+		servers: make(map[int]*server.Server),
+		clients: make(map[[2]int]*rpc.Client),
+		cut:     make(map[[2]int]bool),
+	}
+}
+
+// Partition cuts the links between nodes of different groups, in both
+// directions, until Heal is called. The nodes in no group are unaffected.
+// The faults of a single node are injected with its SetFaults instead.
+func (n *Network) Partition(groups ...[]int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, group := range groups {
+		for _, other := range groups[i+1:] {
+			for _, a := range group {
+				for _, b := range other {
+					n.cut[[2]int{a, b}] = true
+					n.cut[[2]int{b, a}] = true
+				}
+			}
+		}
+	}
+}
+
+// Heal restores every link cut by Partition.
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cut = make(map[[2]int]bool)
+}
+
+// Transport returns the transport of node id, to be passed to
+// server.WithTransport.
+func (n *Network) Transport(id int) server.Transport {
+	return transport{network: n, from: id}
+}
+
+// Attach makes srv reachable as node id.
+func (n *Network) Attach(id int, srv *server.Server) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.servers[id] = srv
+}
+
+// Detach makes node id unreachable and closes its connections, so that the
+// server can shut down.
+func (n *Network) Detach(id int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.servers, id)
+	for pair, client := range n.clients {
+		if pair[0] == id || pair[1] == id {
+			client.Close()
+			delete(n.clients, pair)
+		}
+	}
+}
+
+// client returns the connection from node from to node to, connecting them
+// if needed.
+func (n *Network) client(from int, to int) (*rpc.Client, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	pair := [2]int{from, to}
+	if n.servers[from] == nil || n.servers[to] == nil || n.cut[pair] {
+		return nil, fmt.Errorf("node %d unreachable from %d", to, from)
+	}
+	if client := n.clients[pair]; client != nil {
+		return client, nil
+	}
+	conn, peer := net.Pipe()
+	n.servers[to].ServeRPC(peer)
+	client := rpc.NewClient(conn)
+	n.clients[pair] = client
+	return client, nil
+}
+
+// drop forgets client if it's still the connection from node from to node to,
+// so that the next call reconnects them.
+func (n *Network) drop(from int, to int, client *rpc.Client) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	pair := [2]int{from, to}
+	if n.clients[pair] == client {
+		client.Close()
+		delete(n.clients, pair)
+	}
+}
+
+// transport carries the RPCs of node from over a Network.
+type transport struct {
+	network *Network
+	from    int
+}
+
+func (t transport) CallContext(ctx context.Context, id int, serviceMethod string, args interface{}, reply interface{}) error {
+	t.network.mu.Lock()
+	schedule := t.network.schedule
+	t.network.mu.Unlock()
+	if schedule == nil {
+		return t.network.call(ctx, t.from, id, serviceMethod, args, reply)
+	}
+
+	m := &Message{From: t.from, To: id, ServiceMethod: serviceMethod, Args: args, Reply: reply, done: make(chan error, 1)}
+	schedule(m)
+	select {
+	case err := <-m.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// call delivers an RPC from node from to node to.
+func (n *Network) call(ctx context.Context, from int, to int, serviceMethod string, args interface{}, reply interface{}) error {
+	client, err := n.client(from, to)
+	if err != nil {
+		return err
+	}
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == rpc.ErrShutdown {
+			n.drop(from, to, client)
+		}
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package testcluster
+
+// raceEnabled reports whether the tests run with the race detector, that
+// shuffles the order in which the runtime runs the goroutines woken together.
+const raceEnabled = true
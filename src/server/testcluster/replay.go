@@ -0,0 +1,229 @@
+package testcluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"server"
+)
+
+// ErrDiverged is returned when a replayed run doesn't follow its recording.
+var ErrDiverged = errors.New("replay diverged from the recording")
+
+// Kinds of steps of a recorded run.
+const (
+	// StepDeliver is the delivery of an RPC waiting
+	StepDeliver = "deliver"
+	// StepAdvance is a move of the clock, firing the timers due
+	StepAdvance = "advance"
+	// StepElect and StepSubmit are the elections and submits asked to a node
+	StepElect  = "elect"
+	StepSubmit = "submit"
+	// StepState is a change of the state or term of a node, checked when
+	// replayed
+	StepState = "state"
+)
+
+// Step is a step of a run recorded by a Simulator.
+type Step struct {
+	Kind string
+	// At is the virtual time of the step since the start of the run
+	At time.Duration
+
+	// From, To and ServiceMethod describe a delivery
+	From          int    `json:",omitempty"`
+	To            int    `json:",omitempty"`
+	ServiceMethod string `json:",omitempty"`
+	// By is how much the clock is moved forward
+	By time.Duration `json:",omitempty"`
+	// Node is the node elected, submitted to or whose state changed
+	Node    int             `json:",omitempty"`
+	Command *server.Service `json:",omitempty"`
+	State   string          `json:",omitempty"`
+	Term    int             `json:",omitempty"`
+}
+
+func (step Step) String() string {
+	switch step.Kind {
+	case StepDeliver:
+		return fmt.Sprintf("%v deliver %d->%d %s", step.At, step.From, step.To, step.ServiceMethod)
+	case StepAdvance:
+		return fmt.Sprintf("%v advance %v", step.At, step.By)
+	case StepSubmit:
+		return fmt.Sprintf("%v submit %+v to %d", step.At, *step.Command, step.Node)
+	case StepState:
+		return fmt.Sprintf("%v node %d is %s in term %d", step.At, step.Node, step.State, step.Term)
+	default:
+		return fmt.Sprintf("%v %s %d", step.At, step.Kind, step.Node)
+	}
+}
+
+// recordingHeader is the first line of a recording: how to create the
+// simulator to replay it.
+type recordingHeader struct {
+	Nodes int
+	Seed  int64
+}
+
+// Record makes the simulator write the steps of the run to w, one JSON object
+// per line, until Shutdown, which returns the first error writing them. It
+// must be called before the run starts, the steps taken before are missing
+// from the recording.
+func (s *Simulator) Record(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(recordingHeader{Nodes: len(s.Cluster.Ids()), Seed: s.Seed}); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recorder = encoder
+	s.states = make(map[int]Step)
+	return nil
+}
+
+// record writes step to the recording, if any.
+// Expects s.mu to be locked.
+func (s *Simulator) record(step Step) {
+	if s.recorder == nil || s.recordErr != nil {
+		return
+	}
+	step.At = s.Clock.Now().Sub(s.start)
+	s.recordErr = s.recorder.Encode(step)
+}
+
+// recordStates records the nodes whose state or term changed since the last
+// call.
+func (s *Simulator) recordStates() {
+	for _, id := range s.Cluster.Ids() {
+		status, ok := s.Cluster.status(id)
+		if !ok {
+			continue
+		}
+		step := Step{Kind: StepState, Node: id, State: status.State, Term: status.Term}
+		s.mu.Lock()
+		if s.recorder != nil && s.states[id] != step {
+			s.states[id] = step
+			s.record(step)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Replayer replays a run recorded by a Simulator on a new simulated cluster,
+// one step at a time, so that the nodes can be inspected in between through
+// Sim. The RPCs are delivered in the recorded order and the clock moves as
+// recorded; a state of a node different from the recorded one, or an RPC
+// recorded but never sent, ends the replay with ErrDiverged.
+type Replayer struct {
+	Sim *Simulator
+
+	decoder *json.Decoder
+	steps   int
+	// ctx bounds the submits replayed
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewReplayer reads the recording in r and starts the simulated cluster to
+// replay it on, with the dependencies set by opts.
+func NewReplayer(r io.Reader, opts ...server.Option) (*Replayer, error) {
+	decoder := json.NewDecoder(r)
+	var header recordingHeader
+	if err := decoder.Decode(&header); err != nil {
+		return nil, fmt.Errorf("reading the recording: %w", err)
+	}
+	sim, err := NewSimulator(header.Nodes, header.Seed, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Replayer{Sim: sim, decoder: decoder, ctx: ctx, cancel: cancel}, nil
+}
+
+// Next replays the next step of the recording and returns it, or returns
+// io.EOF at the end of the recording.
+func (r *Replayer) Next() (Step, error) {
+	var step Step
+	if err := r.decoder.Decode(&step); err != nil {
+		return step, err
+	}
+	r.steps++
+	s := r.Sim
+	s.settle()
+	switch step.Kind {
+	case StepDeliver:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.inflight > 0 {
+			return step, fmt.Errorf("%w: step %d: %s while an RPC is being delivered", ErrDiverged, r.steps, step)
+		}
+		for i, m := range s.pending {
+			if m.From == step.From && m.To == step.To && m.ServiceMethod == step.ServiceMethod {
+				s.deliver(i)
+				return step, nil
+			}
+		}
+		return step, fmt.Errorf("%w: step %d: %s never sent", ErrDiverged, r.steps, step)
+	case StepAdvance:
+		// The timer expiring by then was fired alone, see
+		// Simulator.advanceToNext.
+		now := s.Clock.Now()
+		if next, ok := s.Clock.Next(); ok && !next.After(now.Add(step.By)) {
+			if !next.Equal(now.Add(step.By)) {
+				return step, fmt.Errorf("%w: step %d: %s, a timer expires after %v", ErrDiverged, r.steps, step, next.Sub(now))
+			}
+			s.Clock.AdvanceToNext()
+		} else {
+			s.Clock.Advance(step.By)
+		}
+	case StepElect:
+		srv := s.Cluster.Server(step.Node)
+		if srv == nil {
+			return step, fmt.Errorf("%w: step %d: node %d not running", ErrDiverged, r.steps, step.Node)
+		}
+		cm := srv.GetConsensusModule()
+		cm.Election()
+		// Nobody waits for the end of the election, see Simulator.Elect.
+		go func() {
+			select {
+			case <-cm.ElectionChan:
+			case <-r.ctx.Done():
+			}
+		}()
+	case StepSubmit:
+		srv := s.Cluster.Server(step.Node)
+		if srv == nil {
+			return step, fmt.Errorf("%w: step %d: node %d not running", ErrDiverged, r.steps, step.Node)
+		}
+		go srv.Submit(r.ctx, step.Command)
+	case StepState:
+		status, ok := s.Cluster.status(step.Node)
+		if !ok || status.State != step.State || status.Term != step.Term {
+			return step, fmt.Errorf("%w: step %d: expected %s, node %d is %s in term %d", ErrDiverged, r.steps, step, step.Node, status.State, status.Term)
+		}
+	default:
+		return step, fmt.Errorf("step %d: unknown kind %q", r.steps, step.Kind)
+	}
+	return step, nil
+}
+
+// Run replays the rest of the recording.
+func (r *Replayer) Run() error {
+	for {
+		if _, err := r.Next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Shutdown stops the submits replayed and the simulated cluster.
+func (r *Replayer) Shutdown(ctx context.Context) error {
+	r.cancel()
+	return r.Sim.Shutdown(ctx)
+}
@@ -0,0 +1,202 @@
+package testcluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"server"
+)
+
+func newTestCluster(t *testing.T, n int, opts ...server.Option) *Cluster {
+	t.Helper()
+	c, err := New(n, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Shutdown(context.Background()) })
+	return c
+}
+
+// commit appends a no-op labelled step to the log of node id, electing it
+// first if it doesn't lead, and waits up to StepTimeout until the entry is
+// committed and the cluster is consistent. Unlike SubmitAndWaitCommit, it
+// doesn't pause the leader, which keeps replicating to the followers left
+// behind.
+func (c *Cluster) commit(ctx context.Context, id int, step string) error {
+	ctx, cancel := context.WithTimeout(ctx, StepTimeout)
+	defer cancel()
+	if status, ok := c.status(id); !ok || status.State != server.Leader.String() {
+		if err := c.electRetry(ctx, id, step); err != nil {
+			return err
+		}
+	}
+	command, err := server.NewCommand(server.CommandNoop, step, nil)
+	if err != nil {
+		return err
+	}
+	srv := c.Server(id)
+	cm := srv.GetConsensusModule()
+	index, _, accepted, future := cm.Voting(command)
+	<-cm.VotingChan
+	if !accepted {
+		return fmt.Errorf("%s: not accepted by %d: %v", step, id, future.Wait())
+	}
+	if err := future.WaitContext(ctx); err != nil {
+		return fmt.Errorf("%s: committing through %d: %w", step, id, err)
+	}
+	c.acknowledge(srv, index)
+	if err := c.CheckNoSplitBrain(); err != nil {
+		return fmt.Errorf("%s: %w", step, err)
+	}
+	if err := c.CheckHistory(); err != nil {
+		return fmt.Errorf("%s: %w", step, err)
+	}
+	return nil
+}
+
+// waitForCommit waits until node id has committed the entries up to index.
+func (c *Cluster) waitForCommit(ctx context.Context, id int, index int) error {
+	return c.poll(ctx, fmt.Sprintf("entry %d not committed on %d", index, id), func() bool {
+		srv := c.Server(id)
+		return srv != nil && srv.GetConsensusModule().DumpState().CommitIndex >= index
+	})
+}
+
+// logLength returns the length of the log of node id.
+func (c *Cluster) logLength(id int) int {
+	return c.Server(id).GetConsensusModule().DumpState().LogLength
+}
+
+// TestRestartMidWorkload restarts a follower while entries are submitted to
+// the leader: it must come back with the log it persisted, and the entries
+// committed must stay consistent.
+func TestRestartMidWorkload(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, 3)
+	if err := c.commit(ctx, 1, "before"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		length := c.logLength(3)
+		if err := c.Stop(ctx, 3); err != nil {
+			t.Errorf("stopping 3: %v", err)
+			return
+		}
+		if err := c.Start(3); err != nil {
+			t.Errorf("starting 3: %v", err)
+			return
+		}
+		if got := c.logLength(3); got < length {
+			t.Errorf("3 restarted with %d entries, had %d", got, length)
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		if err := c.commit(ctx, 1, fmt.Sprintf("during-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	if err := c.commit(ctx, 1, "after"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRestartWholeCluster crashes every node: they must restore their logs
+// from disk rather than start empty, and the entries committed before must
+// survive the next commit.
+func TestRestartWholeCluster(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, 3)
+	for _, step := range []string{"a", "b", "c"} {
+		if err := c.commit(ctx, 1, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The followers may still be receiving the last entry: the lengths are
+	// only compared once every node holds it.
+	if err := c.waitForMatch(ctx, 1, c.logLength(1)-1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	lengths := make(map[int]int)
+	for _, id := range c.Ids() {
+		lengths[id] = c.logLength(id)
+	}
+	for _, id := range c.Ids() {
+		if err := c.Stop(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := 1; id <= 3; id++ {
+		if err := c.Start(id); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.logLength(id); got != lengths[id] {
+			t.Errorf("node %d restarted with %d entries, had %d", id, got, lengths[id])
+		}
+	}
+
+	// The leader of the entries holds all of them, so it can be elected.
+	if err := c.electRetry(ctx, 1, "restarted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.commit(ctx, 1, "after"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := c.Server(1).GetConsensusModule().ReadCommittedLog(0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, step := range []string{"a", "b", "c"} {
+		if i >= len(entries) || entries[i].Command.ServiceID != step {
+			t.Fatalf("committed log %+v doesn't start with a, b, c", entries)
+		}
+	}
+}
+
+// TestRestartKeepsVote restarts a node that voted in a term: it must not
+// vote for another candidate in the same term.
+func TestRestartKeepsVote(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, 3)
+	const term = 5
+	vote := func(candidateId int) bool {
+		t.Helper()
+		args := server.RequestVoteArgs{Term: term, CandidateId: candidateId, LastLogIndex: 100, LastLogTerm: term, LoadLevel: 1}
+		var reply server.RequestVoteReply
+		if err := c.Server(2).GetConsensusModule().RequestVote(args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.VoteGranted
+	}
+	if !vote(1) {
+		t.Fatalf("2 didn't vote for 1 in term %d", term)
+	}
+	if err := c.Restart(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Server(2).GetConsensusModule().Status().Term; got != term {
+		t.Fatalf("restarted in term %d, want %d", got, term)
+	}
+	if vote(3) {
+		t.Fatalf("2 voted for 3 in term %d after voting for 1", term)
+	}
+	if !vote(1) {
+		t.Fatalf("2 didn't vote for 1 again in term %d", term)
+	}
+}
+
+func noop(t *testing.T, step string) *server.Service {
+	t.Helper()
+	command, err := server.NewCommand(server.CommandNoop, step, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return command
+}
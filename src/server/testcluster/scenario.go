@@ -0,0 +1,290 @@
+package testcluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"server"
+)
+
+// StepTimeout is how long a step of a scenario waits for an entry to be
+// committed, or makes sure it isn't.
+var StepTimeout = 2 * time.Second
+
+// Scenario is a scripted run on a cluster of Nodes nodes that returns an
+// error if the cluster misbehaves: if two nodes lead the same term, an entry
+// commits without a majority or a committed entry is lost.
+type Scenario struct {
+	Name  string
+	Nodes int
+	Run   func(ctx context.Context, c *Cluster) error
+}
+
+// Scenarios are the partition and heal scenarios checking the safety of the
+// leader.
+var Scenarios = []Scenario{
+	{Name: "leader-isolated", Nodes: 3, Run: leaderIsolated},
+	{Name: "minority-submit", Nodes: 5, Run: minoritySubmit},
+	{Name: "symmetric-heal", Nodes: 4, Run: symmetricHeal},
+	{Name: "figure-8", Nodes: 5, Run: figure8},
+}
+
+// RunScenario runs sc on a new cluster, checking the history of the run at
+// the end.
+func RunScenario(ctx context.Context, sc Scenario, opts ...server.Option) error {
+	c, err := New(sc.Nodes, opts...)
+	if err != nil {
+		return err
+	}
+	defer c.Shutdown(context.Background())
+	if err := sc.Run(ctx, c); err != nil {
+		return fmt.Errorf("%s: %w", sc.Name, err)
+	}
+	if err := c.CheckHistory(); err != nil {
+		return fmt.Errorf("%s: %w", sc.Name, err)
+	}
+	return nil
+}
+
+// leaderIsolated cuts the leader off the others: it can't commit anymore,
+// while the majority elects a new leader that does.
+func leaderIsolated(ctx context.Context, c *Cluster) error {
+	if err := c.mustCommit(ctx, 1, "before"); err != nil {
+		return err
+	}
+	c.Network.Partition([]int{1}, []int{2, 3})
+	if err := c.mustNotCommit(ctx, 1, "isolated"); err != nil {
+		return err
+	}
+	if err := c.mustCommit(ctx, 2, "majority"); err != nil {
+		return err
+	}
+	c.Network.Heal()
+	return c.mustCommit(ctx, 2, "healed")
+}
+
+// minoritySubmit submits to both sides of a partition: only the majority
+// commits, and the entries of the minority are discarded once healed.
+func minoritySubmit(ctx context.Context, c *Cluster) error {
+	if err := c.mustCommit(ctx, 1, "before"); err != nil {
+		return err
+	}
+	c.Network.Partition([]int{1, 2}, []int{3, 4, 5})
+	if err := c.mustNotCommit(ctx, 1, "minority"); err != nil {
+		return err
+	}
+	if err := c.mustCommit(ctx, 3, "majority"); err != nil {
+		return err
+	}
+	c.Network.Heal()
+	return c.mustCommit(ctx, 3, "healed")
+}
+
+// symmetricHeal splits the cluster in two halves, none of which commits,
+// and then heals it.
+func symmetricHeal(ctx context.Context, c *Cluster) error {
+	if err := c.mustCommit(ctx, 1, "before"); err != nil {
+		return err
+	}
+	c.Network.Partition([]int{1, 2}, []int{3, 4})
+	for _, id := range []int{1, 3} {
+		if err := c.mustNotCommit(ctx, id, "half"); err != nil {
+			return err
+		}
+	}
+	c.Network.Heal()
+	return c.mustCommit(ctx, 1, "healed")
+}
+
+// figure8 rebuilds Figure 8 of the Raft paper with partitions: an entry X of
+// an old term, replicated to a majority by a later leader, mustn't be
+// committed by counting its replicas, since a leader with a newer entry Y
+// at the same index may still overwrite it. The partitions of a step replace
+// the ones of the previous step, since nothing is sent between the calls to
+// Heal and Partition.
+func figure8(ctx context.Context, c *Cluster) error {
+	if err := c.mustCommit(ctx, 1, "before"); err != nil {
+		return err
+	}
+	// (a) Node 1 replicates X to node 2 only. The first entry must be on
+	// every node, or node 5 can't be elected later.
+	if err := c.electRetry(ctx, 1, "X"); err != nil {
+		return err
+	}
+	if err := c.waitForMatch(ctx, 1, 0, 2, 3, 4, 5); err != nil {
+		return fmt.Errorf("before: %w", err)
+	}
+	c.Network.Partition([]int{1, 2}, []int{3, 4, 5})
+	index, oldTerm, err := c.appendOnly(1, "X")
+	if err != nil {
+		return err
+	}
+	if err := c.waitForEntry(ctx, 2, index, oldTerm); err != nil {
+		return fmt.Errorf("X: %w", err)
+	}
+
+	// (b) Node 5 is elected by nodes 3 and 4 and appends Y at the same index,
+	// alone.
+	if err := c.electRetry(ctx, 5, "Y"); err != nil {
+		return err
+	}
+	c.Network.Heal()
+	c.Network.Partition([]int{1, 2}, []int{3, 4}, []int{5})
+	if i, _, err := c.appendOnly(5, "Y"); err != nil {
+		return err
+	} else if i != index {
+		return fmt.Errorf("Y: appended at %d instead of %d", i, index)
+	}
+
+	// (c) Node 1 is elected again by nodes 2 and 3 and replicates X to node
+	// 3: X is on a majority, but it's of an older term.
+	c.Network.Heal()
+	c.Network.Partition([]int{1, 2, 3}, []int{4}, []int{5})
+	if err := c.electRetry(ctx, 1, "X"); err != nil {
+		return err
+	}
+	if err := c.waitForEntry(ctx, 3, index, oldTerm); err != nil {
+		return fmt.Errorf("X: %w", err)
+	}
+	if err := c.waitForMatch(ctx, 1, index, 2, 3); err != nil {
+		return fmt.Errorf("X: %w", err)
+	}
+	select {
+	case <-time.After(StepTimeout / 4):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if commitIndex := c.Server(1).GetConsensusModule().Status().CommitIndex; commitIndex >= index {
+		return fmt.Errorf("X: entry %d of term %d committed by the leader of a later term, commit index %d", index, oldTerm, commitIndex)
+	}
+
+	// (d) Node 5 is elected by the others and overwrites X with Y, that's
+	// committed with an entry of its term.
+	c.Network.Heal()
+	c.Network.Partition([]int{1}, []int{2, 3, 4, 5})
+	if err := c.electRetry(ctx, 5, "overwrite"); err != nil {
+		return err
+	}
+	if err := c.mustCommit(ctx, 5, "overwrite"); err != nil {
+		return err
+	}
+	c.Network.Heal()
+	return c.mustCommit(ctx, 5, "healed")
+}
+
+// appendOnly appends a no-op labelled step to the log of node id, that must
+// be the leader, and replicates it to the nodes it reaches without waiting
+// for its commit. It returns the index and the term of the entry.
+func (c *Cluster) appendOnly(id int, step string) (int, int, error) {
+	command, err := server.NewCommand(server.CommandNoop, step, nil)
+	if err != nil {
+		return -1, -1, err
+	}
+	cm := c.Server(id).GetConsensusModule()
+	index, term, accepted, _ := cm.Voting(command)
+	<-cm.VotingChan
+	cm.Pause()
+	if !accepted {
+		return -1, -1, fmt.Errorf("%s: not accepted by %d", step, id)
+	}
+	return index, term, nil
+}
+
+// electRetry makes node id run, in step, elections until it wins one, or StepTimeout
+// elapses: the first ones may be lost to the voters of a higher term.
+func (c *Cluster) electRetry(ctx context.Context, id int, step string) error {
+	ctx, cancel := context.WithTimeout(ctx, StepTimeout)
+	defer cancel()
+	for {
+		attempt, cancelAttempt := context.WithTimeout(ctx, StepTimeout/8)
+		err := c.Elect(attempt, id)
+		cancelAttempt()
+		if status, ok := c.status(id); err == nil && ok && status.State == server.Leader.String() {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s: electing %d: %w", step, id, ctx.Err())
+		}
+	}
+}
+
+// waitForEntry waits up to StepTimeout until the last entry of the log of
+// node id is at index and of term.
+func (c *Cluster) waitForEntry(ctx context.Context, id int, index int, term int) error {
+	return c.poll(ctx, fmt.Sprintf("entry %d of term %d not replicated to %d", index, term, id), func() bool {
+		dump := c.Server(id).GetConsensusModule().DumpState()
+		return dump.LogLength == index+1 && dump.LogTail[len(dump.LogTail)-1].Term == term
+	})
+}
+
+// waitForMatch waits up to StepTimeout until the leader id knows that peers
+// hold its log up to index.
+func (c *Cluster) waitForMatch(ctx context.Context, id int, index int, peers ...int) error {
+	return c.poll(ctx, fmt.Sprintf("%d doesn't know that %v match entry %d", id, peers, index), func() bool {
+		dump := c.Server(id).GetConsensusModule().DumpState()
+		for _, peerId := range peers {
+			if dump.MatchIndex[peerId] < index {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// poll calls done every PollInterval until it returns true, failing with
+// message once StepTimeout elapses.
+func (c *Cluster) poll(ctx context.Context, message string, done func() bool) error {
+	ctx, cancel := context.WithTimeout(ctx, StepTimeout)
+	defer cancel()
+	for !done() {
+		select {
+		case <-time.After(PollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", message, ctx.Err())
+		}
+	}
+	return nil
+}
+
+// mustCommit submits a no-op labelled step to node id and fails unless it's
+// committed within StepTimeout and the cluster is consistent.
+func (c *Cluster) mustCommit(ctx context.Context, id int, step string) error {
+	ctx, cancel := context.WithTimeout(ctx, StepTimeout)
+	defer cancel()
+	command, err := server.NewCommand(server.CommandNoop, step, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := c.SubmitAndWaitCommit(ctx, id, command); err != nil {
+		return fmt.Errorf("%s: submitting to %d: %w", step, id, err)
+	}
+	return c.check(step)
+}
+
+// mustNotCommit submits a no-op labelled step to node id and fails if it's
+// committed within StepTimeout or the cluster isn't consistent.
+func (c *Cluster) mustNotCommit(ctx context.Context, id int, step string) error {
+	ctx, cancel := context.WithTimeout(ctx, StepTimeout)
+	defer cancel()
+	command, err := server.NewCommand(server.CommandNoop, step, nil)
+	if err != nil {
+		return err
+	}
+	if index, err := c.SubmitAndWaitCommit(ctx, id, command); err == nil {
+		return fmt.Errorf("%s: entry %d committed through %d without a majority", step, index, id)
+	}
+	return c.check(step)
+}
+
+// check returns an error if two nodes lead the same term or the history is
+// inconsistent.
+func (c *Cluster) check(step string) error {
+	if err := c.CheckNoSplitBrain(); err != nil {
+		return fmt.Errorf("%s: %w", step, err)
+	}
+	if err := c.CheckHistory(); err != nil {
+		return fmt.Errorf("%s: %w", step, err)
+	}
+	return nil
+}
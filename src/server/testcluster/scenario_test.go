@@ -0,0 +1,19 @@
+package testcluster
+
+import (
+	"context"
+	"testing"
+)
+
+// TestScenarios runs the partition and heal scenarios, each on a new
+// cluster: at most one leader per term and no committed entry lost.
+func TestScenarios(t *testing.T) {
+	for _, sc := range Scenarios {
+		sc := sc
+		t.Run(sc.Name, func(t *testing.T) {
+			if err := RunScenario(context.Background(), sc); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package testcluster
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"server"
+)
+
+// TestSignedReplayAfterRestart captures an AE delivered to a follower and
+// sends it again once the follower restarted: it must be refused, since the
+// sequence numbers received are persisted with the term.
+func TestSignedReplayAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	c, err := NewSigned(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Shutdown(context.Background()) })
+	if err := c.mustCommit(ctx, 1, "before"); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var captured *server.AppendEntriesArgs
+	c.Network.mu.Lock()
+	c.Network.schedule = func(m *Message) {
+		go func() {
+			err := c.Network.call(ctx, m.From, m.To, m.ServiceMethod, m.Args, m.Reply)
+			if args, ok := m.Args.(server.AppendEntriesArgs); ok && err == nil && m.To == 2 {
+				mu.Lock()
+				if captured == nil {
+					captured = &args
+				}
+				mu.Unlock()
+			}
+			m.done <- err
+		}()
+	}
+	c.Network.mu.Unlock()
+	if err := c.mustCommit(ctx, 1, "captured"); err != nil {
+		t.Fatal(err)
+	}
+	var args *server.AppendEntriesArgs
+	err = c.poll(ctx, "no AE to 2 captured", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		args = captured
+		return args != nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Network.mu.Lock()
+	c.Network.schedule = nil
+	c.Network.mu.Unlock()
+
+	if err := c.Restart(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	var reply server.AppendEntriesReply
+	err = c.Network.call(ctx, 1, 2, "ConsensusModule.AppendEntries", *args, &reply)
+	if err == nil || !strings.Contains(err.Error(), server.ErrReplayed.Error()) {
+		t.Fatalf("replayed AE after restart: got %v, want %v", err, server.ErrReplayed)
+	}
+
+	// The RPCs signed after the restart are still accepted.
+	if err := c.mustCommit(ctx, 1, "after"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CheckHistory(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,367 @@
+package testcluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"server"
+	"server/clock"
+)
+
+// ErrLimit is returned when a simulation reaches its limit of virtual time
+// before the awaited outcome.
+var ErrLimit = errors.New("simulation limit reached")
+
+var errShutdown = errors.New("simulation shut down")
+
+// settleRounds is how many consecutive checks must see the simulation
+// unchanged and the nodes idle before the simulator takes the next step.
+const settleRounds = 3
+
+// Simulator runs a Cluster in virtual time. Every node tells the time with
+// the same clock.Fake, that only moves when no RPC can be delivered, and
+// measures the timeouts of its RPCs with it; the RPCs wait on the Network
+// until the simulator delivers them, one at a time, on a single goroutine,
+// in an order chosen by a generator seeded with Seed; the random choices of
+// the nodes are seeded from Seed too. So a run, such as an election race, is
+// replayed from its seed: Trace lists the deliveries to compare.
+//
+// A run can be recorded with Record and replayed step by step with a
+// Replayer.
+//
+// Before every step the simulator waits for the nodes to settle, until none
+// of their goroutines is running, see settle, rather than for some real
+// time to pass. The goroutines run on a single thread meanwhile, see
+// runtime.GOMAXPROCS, so that the ones woken by the same step take the locks
+// of the nodes in the same order in every run.
+type Simulator struct {
+	Cluster *Cluster
+	Clock   *clock.Fake
+	Seed    int64
+
+	// rand chooses the deliveries, it's only used by the goroutine running
+	// the simulation
+	rand  *rand.Rand
+	start time.Time
+	// deliveries carries the RPC chosen to the goroutine delivering it, see
+	// deliverAll
+	deliveries chan *Message
+
+	mu       sync.Mutex
+	pending  []*Message
+	inflight int
+	// sent counts the RPCs sent on every link, by [from, to]
+	sent  map[[2]int]int
+	trace []string
+	// recorder, if not nil, receives the steps of the run, see Record;
+	// states are the latest states recorded, by node
+	recorder  *json.Encoder
+	recordErr error
+	states    map[int]Step
+	// procs is the GOMAXPROCS set before the simulation, restored by
+	// Shutdown
+	procs int
+}
+
+// NewSimulator starts a simulated cluster of n nodes, with the dependencies
+// set by opts.
+func NewSimulator(n int, seed int64, opts ...server.Option) (*Simulator, error) {
+	start := time.Unix(0, 0).UTC()
+	s := &Simulator{
+		Clock:      clock.NewFake(start),
+		Seed:       seed,
+		rand:       rand.New(rand.NewSource(seed)),
+		start:      start,
+		deliveries: make(chan *Message, 1),
+		sent:       make(map[[2]int]int),
+		procs:      runtime.GOMAXPROCS(1),
+	}
+	network := NewNetwork()
+	network.schedule = s.schedule
+	c, err := newCluster(n, network, func(id int) []server.Option {
+		return append([]server.Option{
+			server.WithClock(s.Clock),
+			server.WithRandom(rand.NewSource(seed + int64(id))),
+		}, opts...)
+	})
+	if err != nil {
+		runtime.GOMAXPROCS(s.procs)
+		return nil, err
+	}
+	s.Cluster = c
+	go s.deliverAll()
+	return s, nil
+}
+
+// schedule queues m until Step delivers it.
+func (s *Simulator) schedule(m *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link := [2]int{m.From, m.To}
+	m.seq = s.sent[link]
+	s.sent[link]++
+	s.pending = append(s.pending, m)
+}
+
+// Step delivers one of the RPCs waiting, chosen at random, and reports
+// whether it did: it doesn't while an RPC is being delivered. The RPCs are
+// sorted first, by link and in the order they were sent on it, so that the
+// choice doesn't depend on the order in which the goroutines of the nodes
+// sent them.
+func (s *Simulator) Step() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 || s.inflight > 0 {
+		return false
+	}
+	sort.Slice(s.pending, func(i, j int) bool {
+		a, b := s.pending[i], s.pending[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.seq < b.seq
+	})
+	s.deliver(s.rand.Intn(len(s.pending)))
+	return true
+}
+
+// deliver hands the i-th RPC waiting to deliverAll.
+// Expects s.mu to be locked.
+func (s *Simulator) deliver(i int) {
+	m := s.pending[i]
+	s.pending = append(s.pending[:i], s.pending[i+1:]...)
+	s.inflight++
+	s.trace = append(s.trace, fmt.Sprintf("%v %d->%d %s", s.Clock.Now().Sub(s.start), m.From, m.To, m.ServiceMethod))
+	s.record(Step{Kind: StepDeliver, From: m.From, To: m.To, ServiceMethod: m.ServiceMethod})
+	s.deliveries <- m
+}
+
+// deliverAll delivers the RPCs handed by deliver, one at a time, until
+// Shutdown. A node may wait for the clock while handling an RPC: the
+// simulation moves it meanwhile, without delivering another one.
+func (s *Simulator) deliverAll() {
+	for m := range s.deliveries {
+		err := s.Cluster.Network.call(context.Background(), m.From, m.To, m.ServiceMethod, m.Args, m.Reply)
+		s.mu.Lock()
+		s.inflight--
+		s.mu.Unlock()
+		m.done <- err
+	}
+}
+
+// advance moves the clock forward by d, that must end before the next timer
+// expires.
+func (s *Simulator) advance(d time.Duration) {
+	s.mu.Lock()
+	s.record(Step{Kind: StepAdvance, By: d})
+	s.mu.Unlock()
+	s.Clock.Advance(d)
+}
+
+// advanceToNext moves the clock forward to the next timer, at next, and
+// fires it, see clock.Fake.AdvanceToNext.
+func (s *Simulator) advanceToNext(next time.Time) {
+	s.mu.Lock()
+	s.record(Step{Kind: StepAdvance, By: next.Sub(s.Clock.Now())})
+	s.mu.Unlock()
+	s.Clock.AdvanceToNext()
+}
+
+// settle waits until the nodes are idle, for settleRounds checks in a row:
+// none of their goroutines is running, see busy, and no RPC is sent or
+// answered and no timer is set since the previous check. The goroutines of
+// the nodes only wait for the clock and for the RPCs delivered, so that
+// they're idle until the next step.
+func (s *Simulator) settle() {
+	last := [3]int{-1, -1, -1}
+	for stable := 0; stable < settleRounds; {
+		runtime.Gosched()
+		s.mu.Lock()
+		now := [3]int{len(s.pending), s.inflight, s.Clock.Waiters()}
+		s.mu.Unlock()
+		if now == last && !busy() {
+			stable++
+		} else {
+			stable, last = 0, now
+		}
+	}
+}
+
+// goroutineState matches the state of a goroutine in the dump of
+// runtime.Stack, such as "goroutine 7 [chan receive]:".
+var goroutineState = regexp.MustCompile(`(?m)^goroutine \d+ \[([^,\]]+)`)
+
+// busy reports whether a goroutine other than the calling one is running,
+// ready to run or in a system call, such as a node writing its log.
+func busy() bool {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	// The calling goroutine comes first.
+	for _, match := range goroutineState.FindAllSubmatch(buf, -1)[1:] {
+		switch string(match[1]) {
+		case "running", "runnable", "syscall":
+			return true
+		}
+	}
+	return false
+}
+
+// Run runs the simulation for d of virtual time.
+func (s *Simulator) Run(d time.Duration) {
+	s.RunUntil(d, func() bool { return false })
+}
+
+// RunUntil runs the simulation until done returns true, checking it before
+// every step, or for at most limit of virtual time. It reports whether done
+// returned true. The RPCs waiting are delivered before the clock is advanced
+// to the next timer, and the timers expiring at the same time are fired one
+// at a time.
+func (s *Simulator) RunUntil(limit time.Duration, done func() bool) bool {
+	end := s.Clock.Now().Add(limit)
+	for {
+		s.settle()
+		s.recordStates()
+		if done() {
+			return true
+		}
+		if s.Step() {
+			continue
+		}
+		next, ok := s.Clock.Next()
+		if !ok || next.After(end) {
+			s.advance(end.Sub(s.Clock.Now()))
+			s.settle()
+			s.recordStates()
+			return done()
+		}
+		s.advanceToNext(next)
+	}
+}
+
+// Elect makes node id start an election and runs the simulation until it
+// wins it, or for at most limit of virtual time.
+func (s *Simulator) Elect(id int, limit time.Duration) error {
+	cm := s.Cluster.Server(id).GetConsensusModule()
+	s.mu.Lock()
+	s.record(Step{Kind: StepElect, Node: id})
+	s.mu.Unlock()
+	cm.Election()
+	won := s.RunUntil(limit, func() bool {
+		leaderId, ok := s.Cluster.Leader()
+		return ok && leaderId == id
+	})
+	if !won {
+		return ErrLimit
+	}
+	// Nobody waits for the end of the election, see Server.Submit.
+	<-cm.ElectionChan
+	return nil
+}
+
+// SubmitAndWaitCommit submits command to node id and runs the simulation
+// until it's committed, or for at most limit of virtual time, returning its
+// index.
+func (s *Simulator) SubmitAndWaitCommit(id int, command *server.Service, limit time.Duration) (int, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := s.Cluster.Server(id)
+	if srv == nil {
+		return -1, fmt.Errorf("node %d not running", id)
+	}
+	s.mu.Lock()
+	s.record(Step{Kind: StepSubmit, Node: id, Command: command})
+	s.mu.Unlock()
+	var index int
+	submitted := make(chan *server.CommitFuture, 1)
+	go func() {
+		var future *server.CommitFuture
+		index, _, _, future = srv.Submit(ctx, command)
+		submitted <- future
+	}()
+
+	var future *server.CommitFuture
+	committed := s.RunUntil(limit, func() bool {
+		if future == nil {
+			select {
+			case future = <-submitted:
+			default:
+				return false
+			}
+		}
+		select {
+		case <-future.Done():
+			return true
+		default:
+			return false
+		}
+	})
+	if !committed {
+		return -1, ErrLimit
+	}
+	if err := future.Wait(); err != nil {
+		return -1, err
+	}
+	s.Cluster.acknowledge(srv, index)
+	return index, nil
+}
+
+// Trace returns the RPCs delivered so far, in order, with the virtual time
+// of their delivery.
+func (s *Simulator) Trace() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.trace...)
+}
+
+// Shutdown stops the simulated cluster. The RPCs still waiting fail, the
+// ones sent from now on are delivered right away. It returns the first error
+// writing the recording, if any.
+func (s *Simulator) Shutdown(ctx context.Context) error {
+	// The RPCs being delivered might wait for the clock to move.
+	for {
+		s.settle()
+		s.mu.Lock()
+		inflight := s.inflight
+		s.mu.Unlock()
+		if inflight == 0 || !s.Clock.AdvanceToNext() {
+			break
+		}
+	}
+
+	network := s.Cluster.Network
+	network.mu.Lock()
+	network.schedule = nil
+	network.mu.Unlock()
+	s.mu.Lock()
+	for _, m := range s.pending {
+		m.done <- errShutdown
+	}
+	s.pending = nil
+	close(s.deliveries)
+	recordErr := s.recordErr
+	s.recorder = nil
+	s.mu.Unlock()
+	defer runtime.GOMAXPROCS(s.procs)
+	if err := s.Cluster.Shutdown(ctx); err != nil {
+		return err
+	}
+	return recordErr
+}
@@ -0,0 +1,76 @@
+package testcluster
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const simLimit = 10 * time.Second
+
+// simulate elects node 1 and commits a few entries on a simulated cluster
+// seeded with seed, recording the run to w if not nil, and returns the trace
+// of the run.
+func simulate(t *testing.T, seed int64, w io.Writer) []string {
+	t.Helper()
+	s, err := NewSimulator(3, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w != nil {
+		if err := s.Record(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Elect(1, simLimit); err != nil {
+		t.Fatalf("seed %d: electing 1: %v", seed, err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := s.SubmitAndWaitCommit(1, noop(t, fmt.Sprint(i)), simLimit); err != nil {
+			t.Fatalf("seed %d: submitting %d: %v", seed, i, err)
+		}
+	}
+	trace := s.Trace()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Cluster.CheckHistory(); err != nil {
+		t.Fatal(err)
+	}
+	return trace
+}
+
+// TestSimulatorDeterministic runs the same simulation twice: the RPCs must
+// be delivered in the same order at the same virtual times.
+func TestSimulatorDeterministic(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector runs the goroutines in a random order")
+	}
+	for seed := int64(1); seed <= 3; seed++ {
+		first := simulate(t, seed, nil)
+		if second := simulate(t, seed, nil); !reflect.DeepEqual(first, second) {
+			t.Errorf("seed %d: runs diverged:\n%v\n%v", seed, first, second)
+		}
+	}
+}
+
+// TestReplay replays a recorded run to its end.
+func TestReplay(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector runs the goroutines in a random order")
+	}
+	var recording bytes.Buffer
+	simulate(t, 7, &recording)
+	r, err := NewReplayer(&recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Shutdown(context.Background())
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,176 @@
+package testcluster
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"server"
+)
+
+// SoakConfig is the workload of a soak run, see Soak.
+type SoakConfig struct {
+	// Duration is how long the workload runs
+	Duration time.Duration
+	// Interval is the time between two submits
+	Interval time.Duration
+	// SubmitTimeout is how long a submit waits for its commit
+	SubmitTimeout time.Duration
+	// CheckInterval is the time between two checks of the invariants, that
+	// are also checked at the end
+	CheckInterval time.Duration
+	// Progress, if not nil, receives the report after every check
+	Progress func(SoakReport)
+}
+
+// DefaultSoakConfig returns a workload of one submit every 50ms for an hour,
+// checked every 10 seconds.
+func DefaultSoakConfig() SoakConfig {
+	return SoakConfig{
+		Duration:      time.Hour,
+		Interval:      50 * time.Millisecond,
+		SubmitTimeout: 5 * time.Second,
+		CheckInterval: 10 * time.Second,
+	}
+}
+
+// SoakReport sums up a soak run.
+type SoakReport struct {
+	Elapsed   time.Duration
+	Submitted int
+	Committed int
+	Failed    int
+	Checks    int
+}
+
+// soak is the state of a soak run: the highest commit index seen on every
+// node.
+type soak struct {
+	c           *Cluster
+	report      SoakReport
+	commitIndex map[int]int
+}
+
+// Soak submits a steady workload of no-ops to the leader of c, or node 1
+// while there is none, and checks the invariants of the cluster every
+// config.CheckInterval until config.Duration elapses or ctx is done:
+//   - no two nodes lead the same term
+//   - the commit index of a node never decreases
+//   - the committed logs of the nodes are prefixes of each other and the
+//     acknowledged entries are never lost, see History
+//
+// It returns the report of the run and, at the first violation, an error
+// describing it with the state and the latest events of every node. A
+// submit that isn't committed isn't a violation, it's counted as failed.
+// The nodes mustn't be restarted during the run.
+func Soak(ctx context.Context, c *Cluster, config SoakConfig) (SoakReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.Duration)
+	defer cancel()
+	s := &soak{c: c, commitIndex: make(map[int]int)}
+	start := time.Now()
+	submit := time.NewTicker(config.Interval)
+	defer submit.Stop()
+	check := time.NewTicker(config.CheckInterval)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-submit.C:
+			s.submit(ctx, config.SubmitTimeout)
+		case <-check.C:
+			s.report.Elapsed = time.Since(start)
+			if err := s.check(); err != nil {
+				return s.report, err
+			}
+			if config.Progress != nil {
+				config.Progress(s.report)
+			}
+		case <-ctx.Done():
+			s.report.Elapsed = time.Since(start)
+			return s.report, s.check()
+		}
+	}
+}
+
+// submit submits a no-op and waits for its commit.
+func (s *soak) submit(ctx context.Context, timeout time.Duration) {
+	id, ok := s.c.Leader()
+	if !ok {
+		id = 1
+	}
+	submitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	s.report.Submitted++
+	command, err := server.NewCommand(server.CommandNoop, fmt.Sprintf("soak-%d", s.report.Submitted), nil)
+	if err == nil {
+		_, err = s.c.SubmitAndWaitCommit(submitCtx, id, command)
+	}
+	if err != nil && ctx.Err() != nil {
+		// Interrupted by the end of the run.
+		s.report.Submitted--
+		return
+	}
+	if err != nil {
+		s.report.Failed++
+		return
+	}
+	s.report.Committed++
+}
+
+// check checks the invariants, returning the first violation.
+func (s *soak) check() error {
+	s.report.Checks++
+	err := s.c.CheckNoSplitBrain()
+	if err == nil {
+		err = s.checkCommitIndex()
+	}
+	if err == nil {
+		err = s.c.CheckHistory()
+	}
+	if err != nil {
+		return fmt.Errorf("after %v, check %d, %d entries committed: %w\n%s", s.report.Elapsed.Round(time.Second), s.report.Checks, s.report.Committed, err, s.context())
+	}
+	return nil
+}
+
+// checkCommitIndex returns an error if the commit index of a node decreased
+// since the previous check.
+func (s *soak) checkCommitIndex() error {
+	for _, id := range s.c.Ids() {
+		status, ok := s.c.status(id)
+		if !ok {
+			continue
+		}
+		if last, ok := s.commitIndex[id]; ok && status.CommitIndex < last {
+			return fmt.Errorf("commit index of node %d went from %d back to %d", id, last, status.CommitIndex)
+		}
+		s.commitIndex[id] = status.CommitIndex
+	}
+	return nil
+}
+
+// soakEvents is how many of the latest events of every node are reported
+// with a violation.
+const soakEvents = 10
+
+// context describes the state and the latest events of every node.
+func (s *soak) context() string {
+	var b strings.Builder
+	for _, id := range s.c.Ids() {
+		srv := s.c.Server(id)
+		if srv == nil {
+			continue
+		}
+		cm := srv.GetConsensusModule()
+		fmt.Fprintf(&b, "node %d: %+v\n", id, cm.Status())
+		events := cm.Events()
+		if len(events) > soakEvents {
+			events = events[len(events)-soakEvents:]
+		}
+		for _, event := range events {
+			fmt.Fprintf(&b, "  %s %s term=%d %s\n", event.Timestamp, event.Kind, event.Term, event.Message)
+		}
+	}
+	return b.String()
+}
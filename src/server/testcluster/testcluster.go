@@ -0,0 +1,367 @@
+// Package testcluster runs the nodes of a cluster in a single process, wired
+// over an in-memory Network, so that the consensus is exercised end to end
+// without containers:
+//
+//	c, err := testcluster.New(3)
+//	...
+//	defer c.Shutdown(context.Background())
+//	err = c.Elect(ctx, 1)
+//	leader, err := c.WaitForLeader(ctx)
+//	index, err := c.SubmitAndWaitCommit(ctx, leader, command)
+//	err = c.CheckNoSplitBrain()
+//	err = c.CheckHistory()
+//
+// Every node keeps its log in a temporary directory and runs its services
+// with an Executor that only records them.
+package testcluster
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"server"
+)
+
+// PollInterval is how often the helpers waiting for the cluster check its
+// state.
+var PollInterval = 5 * time.Millisecond
+
+// Cluster is a set of servers connected by a Network. The servers are
+// numbered from 1. It's safe for concurrent use, so that nodes can be
+// stopped and restarted in the middle of a workload.
+type Cluster struct {
+	Network *Network
+	// History records the decisions committed during the run, see
+	// CheckHistory
+	History *History
+
+	dir  string
+	opts func(id int) []server.Option
+
+	mu        sync.Mutex
+	servers   map[int]*server.Server
+	executors map[int]*Executor
+}
+
+// New starts a cluster of n nodes, with the default configuration and the
+// dependencies set by opts, and connects every node to the others.
+func New(n int, opts ...server.Option) (*Cluster, error) {
+	return newCluster(n, NewNetwork(), func(id int) []server.Option { return opts })
+}
+
+// NewSigned starts a cluster like New whose nodes sign their RPCs, each with
+// a new key, and refuse the ones not signed by the key of their sender, see
+// server.WithSigningKeys.
+func NewSigned(n int, opts ...server.Option) (*Cluster, error) {
+	keys := make(map[int]ed25519.PrivateKey, n)
+	peers := make(map[int]ed25519.PublicKey, n)
+	for id := 1; id <= n; id++ {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		keys[id], peers[id] = private, public
+	}
+	return newCluster(n, NewNetwork(), func(id int) []server.Option {
+		if keys[id] == nil {
+			// The nodes started later have no key: their RPCs are refused.
+			return opts
+		}
+		return append([]server.Option{server.WithSigningKeys(keys[id], peers)}, opts...)
+	})
+}
+
+// newCluster starts a cluster of n nodes connected by network, with the
+// dependencies of node id set by opts(id).
+func newCluster(n int, network *Network, opts func(id int) []server.Option) (*Cluster, error) {
+	dir, err := os.MkdirTemp("", "testcluster")
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{
+		Network:   network,
+		History:   NewHistory(),
+		dir:       dir,
+		opts:      opts,
+		servers:   make(map[int]*server.Server),
+		executors: make(map[int]*Executor),
+	}
+	for id := 1; id <= n; id++ {
+		if err := c.Start(id); err != nil {
+			c.Shutdown(context.Background())
+			return nil, fmt.Errorf("starting node %d: %w", id, err)
+		}
+	}
+	return c, nil
+}
+
+// Start starts node id and connects it to the nodes running. A node stopped
+// with Stop starts again on the storage it persisted and with the services
+// its Executor was running, like a process restarted by its supervisor: its
+// CM restores the term, the vote and the log it persisted, and applies the
+// entries again once the leader commits them.
+func (c *Cluster) Start(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.servers[id] != nil {
+		return fmt.Errorf("node %d already running", id)
+	}
+
+	config := server.DefaultConfig()
+	config.LogPath = filepath.Join(c.dir, strconv.Itoa(id), "log.txt")
+	if err := os.MkdirAll(filepath.Dir(config.LogPath), 0700); err != nil {
+		return err
+	}
+	executor := c.executors[id]
+	if executor == nil {
+		executor = NewExecutor()
+	}
+	opts := append([]server.Option{
+		server.WithTransport(c.Network.Transport(id)),
+		server.WithExecutor(executor),
+	}, c.opts(id)...)
+	srv, err := server.NewServer(id, config, nil, opts...)
+	if err != nil {
+		return err
+	}
+	c.servers[id] = srv
+	c.executors[id] = executor
+	c.Network.Attach(id, srv)
+
+	for peerId, peer := range c.servers {
+		if peerId == id {
+			continue
+		}
+		if err := srv.AddNode(peerId, addr(peerId)); err != nil {
+			return fmt.Errorf("connecting %d to %d: %w", id, peerId, err)
+		}
+		if err := peer.AddNode(id, addr(id)); err != nil {
+			return fmt.Errorf("connecting %d to %d: %w", peerId, id, err)
+		}
+	}
+	return nil
+}
+
+// addr returns the IP address of node id, that only identifies it.
+func addr(id int) string {
+	return fmt.Sprintf("10.0.%d.%d", id/256, id%256)
+}
+
+// Server returns node id, or nil if it isn't running.
+func (c *Cluster) Server(id int) *server.Server {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.servers[id]
+}
+
+// Executor returns the executor of node id.
+func (c *Cluster) Executor(id int) *Executor {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.executors[id]
+}
+
+// Ids returns the IDs of the nodes running, in order.
+func (c *Cluster) Ids() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]int, 0, len(c.servers))
+	for id := range c.servers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// status returns the status of node id, and false if it isn't running.
+func (c *Cluster) status(id int) (server.Status, bool) {
+	srv := c.Server(id)
+	if srv == nil {
+		return server.Status{}, false
+	}
+	return srv.GetConsensusModule().Status(), true
+}
+
+// Elect makes node id start an election and waits until it wins it, or
+// returns ctx.Err() if ctx is done first.
+func (c *Cluster) Elect(ctx context.Context, id int) error {
+	cm := c.Server(id).GetConsensusModule()
+	select {
+	case <-cm.ElectionChan:
+	default:
+	}
+	cm.Election()
+	select {
+	case <-cm.ElectionChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Leader returns the ID of the leader of the highest term among the nodes of
+// the cluster, if any.
+func (c *Cluster) Leader() (int, bool) {
+	leaderId, leaderTerm := -1, -1
+	for _, id := range c.Ids() {
+		status, ok := c.status(id)
+		if ok && status.State == server.Leader.String() && status.Term > leaderTerm {
+			leaderId, leaderTerm = id, status.Term
+		}
+	}
+	return leaderId, leaderId >= 0
+}
+
+// WaitForLeader waits until a node of the cluster is the leader and returns
+// its ID, or ctx.Err() if ctx is done first.
+func (c *Cluster) WaitForLeader(ctx context.Context) (int, error) {
+	for {
+		if id, ok := c.Leader(); ok {
+			return id, nil
+		}
+		select {
+		case <-time.After(PollInterval):
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		}
+	}
+}
+
+// SubmitAndWaitCommit submits command to node id and waits until it's
+// committed, returning its index. Like Server.Submit, it makes node id run an
+// election first. The commit is acknowledged in the History.
+func (c *Cluster) SubmitAndWaitCommit(ctx context.Context, id int, command *server.Service) (int, error) {
+	srv := c.Server(id)
+	if srv == nil {
+		return -1, fmt.Errorf("node %d not running", id)
+	}
+	index, _, _, future := srv.Submit(ctx, command)
+	if err := future.WaitContext(ctx); err != nil {
+		return -1, err
+	}
+	c.acknowledge(srv, index)
+	return index, nil
+}
+
+// acknowledge records in the History that the entry at index of srv was
+// committed.
+func (c *Cluster) acknowledge(srv *server.Server, index int) {
+	entries, err := srv.GetConsensusModule().ReadCommittedLog(index, index+1)
+	if err == nil && len(entries) == 1 {
+		c.History.Ack(decisionOf(entries[0]))
+	}
+}
+
+// CheckHistory records the committed log of every node running in the
+// History and checks it, see History.Check.
+func (c *Cluster) CheckHistory() error {
+	for _, id := range c.Ids() {
+		if srv := c.Server(id); srv != nil {
+			if err := c.History.Observe(id, srv.GetConsensusModule()); err != nil {
+				return fmt.Errorf("observing node %d: %w", id, err)
+			}
+		}
+	}
+	return c.History.Check()
+}
+
+// CheckNoSplitBrain returns an error if two nodes are both leaders of the
+// same term.
+func (c *Cluster) CheckNoSplitBrain() error {
+	leaders := make(map[int]int)
+	for _, id := range c.Ids() {
+		status, ok := c.status(id)
+		if !ok || status.State != server.Leader.String() {
+			continue
+		}
+		if other, ok := leaders[status.Term]; ok {
+			return fmt.Errorf("split brain: nodes %d and %d are both leaders of term %d", other, id, status.Term)
+		}
+		leaders[status.Term] = id
+	}
+	return nil
+}
+
+// Stop disconnects node id from the network and shuts it down, leaving the
+// others running; its RPCs in flight fail. Its committed log is recorded in
+// the History first.
+func (c *Cluster) Stop(ctx context.Context, id int) error {
+	c.mu.Lock()
+	srv := c.servers[id]
+	delete(c.servers, id)
+	c.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	c.History.Observe(id, srv.GetConsensusModule())
+	c.Network.Detach(id)
+	return srv.Shutdown(ctx)
+}
+
+// Restart crashes node id and starts it again, see Start.
+func (c *Cluster) Restart(ctx context.Context, id int) error {
+	if err := c.Stop(ctx, id); err != nil {
+		return fmt.Errorf("stopping node %d: %w", id, err)
+	}
+	return c.Start(id)
+}
+
+// Shutdown stops every node of the cluster and removes their logs.
+func (c *Cluster) Shutdown(ctx context.Context) error {
+	var firstErr error
+	for _, id := range c.Ids() {
+		if err := c.Stop(ctx, id); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("stopping node %d: %w", id, err)
+		}
+	}
+	if err := os.RemoveAll(c.dir); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// Executor records the services run on a node instead of running them. It's
+// safe for concurrent use.
+type Executor struct {
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// NewExecutor creates an executor running no services.
+func NewExecutor() *Executor {
+	return &Executor{running: make(map[string]bool)}
+}
+
+func (e *Executor) Run(ctx context.Context, service string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.running[service] = true
+	return nil
+}
+
+func (e *Executor) Stop(ctx context.Context, service string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.running, service)
+	return nil
+}
+
+// Running returns the services running, in order.
+func (e *Executor) Running() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	services := make([]string, 0, len(e.running))
+	for service := range e.running {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services
+}
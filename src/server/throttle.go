@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// voteAlertInterval is the least time between two alerts about the
+// RequestVote RPCs refused from the same candidate.
+const voteAlertInterval = time.Minute
+
+// tokenBucket allows events at an average rate, and bursts of them up to a
+// size.
+type tokenBucket struct {
+	tokens   float64
+	refilled time.Time
+}
+
+// take refills the bucket at rate tokens per second, up to burst, and takes
+// a token from it, returning false if it's empty.
+func (b *tokenBucket) take(rate float64, burst int, now time.Time) bool {
+	if b.refilled.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.refilled).Seconds()*rate)
+	}
+	b.refilled = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// voteThrottle protects a CM from floods of RequestVote RPCs: every candidate
+// is allowed Config.VoteRateLimit of them per second, and the ones with a
+// term more than Config.MaxTermJump ahead of the CM are refused before the
+// CM adopts it, so that a misbehaving node can't make the cluster drop its
+// leader over and over.
+type voteThrottle struct {
+	mu      sync.Mutex
+	buckets map[int]*tokenBucket
+	alerted map[int]time.Time
+}
+
+func newVoteThrottle() *voteThrottle {
+	return &voteThrottle{buckets: make(map[int]*tokenBucket), alerted: make(map[int]time.Time)}
+}
+
+// admitVote returns ErrVoteThrottled if the RequestVote RPC args must be
+// refused. The refusals are counted in the metrics and raise an
+// AlertVoteFlood, at most every voteAlertInterval for the same candidate.
+func (cm *ConsensusModule) admitVote(args RequestVoteArgs) error {
+	config := cm.Config()
+	now := cm.clock.Now()
+	var err error
+	var reason string
+	cm.mu.RLock()
+	currentTerm := cm.currentTerm
+	cm.mu.RUnlock()
+	if config.MaxTermJump > 0 && args.Term-currentTerm > config.MaxTermJump {
+		err = fmt.Errorf("%w: term %d of node %d is %d ahead of %d", ErrVoteThrottled, args.Term, args.CandidateId, args.Term-currentTerm, currentTerm)
+		reason = "term_jump"
+	}
+
+	t := cm.voteThrottle
+	t.mu.Lock()
+	if err == nil && config.VoteRateLimit > 0 {
+		bucket := t.buckets[args.CandidateId]
+		if bucket == nil {
+			bucket = &tokenBucket{}
+			t.buckets[args.CandidateId] = bucket
+		}
+		if !bucket.take(float64(config.VoteRateLimit), config.VoteRateLimit, now) {
+			err = fmt.Errorf("%w: node %d exceeds %d RequestVote per second", ErrVoteThrottled, args.CandidateId, config.VoteRateLimit)
+			reason = "rate"
+		}
+	}
+	alert := err != nil && now.Sub(t.alerted[args.CandidateId]) >= voteAlertInterval
+	if alert {
+		t.alerted[args.CandidateId] = now
+	}
+	t.mu.Unlock()
+
+	if err != nil {
+		cm.metrics.VoteRefused(reason)
+		cm.Dlog("refusing RequestVote: %v", err)
+		if alert {
+			cm.mu.Lock()
+			cm.raiseAlert(AlertVoteFlood, err.Error())
+			cm.mu.Unlock()
+		}
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"server/transfer"
+	"strings"
+)
+
+// isRPCError reports whether err, possibly returned through an RPC, is
+// target. The errors returned through an RPC only keep their message.
+func isRPCError(err error, target error) bool {
+	return errors.Is(err, target) || strings.Contains(err.Error(), target.Error())
+}
+
+// isStaleTerm reports whether err, possibly returned through an RPC, is
+// ErrStaleTerm.
+func isStaleTerm(err error) bool {
+	return isRPCError(err, ErrStaleTerm)
+}
+
+// sendService transfers the file of serviceId to peerId and asks it to deploy
+// the service, with term as fencing token, retrying on failure. Transfer statistics are recorded in
+// cm.metrics. The returned errors wrap ErrTransferFailed. Retries stop when
+// ctx is done.
+func (cm *ConsensusModule) sendService(ctx context.Context, term int, peerId int, serviceId string) error {
+	file, err := cm.artifacts.Load(serviceId)
+	if err != nil {
+		cm.metrics.Transfer(peerId, serviceId, 0, 0, 0, err)
+		return fmt.Errorf("%w: %v", ErrTransferFailed, err)
+	}
+	cm.mu.RLock()
+	signature := cm.artifactSignature(serviceId)
+	cm.mu.RUnlock()
+	args := DeployArgs{
+		Id:        serviceId,
+		Service:   file,
+		Term:      term,
+		Signature: signature,
+	}
+
+	config := cm.Config()
+	policy := transfer.Policy{Retries: config.TransferRetries, Backoff: config.TransferBackoff, Clock: cm.clock, Permanent: isStaleTerm}
+	start := cm.clock.Now()
+	attempt := 0
+	retries, err := policy.Do(ctx, func() error {
+		if attempt > 0 {
+			cm.Dlog("retrying deploy of %s to %d, retry %d", serviceId, peerId, attempt)
+		}
+		attempt++
+		var reply DeployReply
+		return cm.transport.CallContext(ctx, peerId, "ConsensusModule.Deploy", args, &reply)
+	})
+	cm.metrics.Transfer(peerId, serviceId, len(file), cm.clock.Since(start), retries, err)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrTransferFailed, err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Package transfer moves the artifacts of services between the nodes of a
+// cluster.
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"server/clock"
+	"time"
+)
+
+// Policy sets how a failed transfer is retried: up to Retries times, waiting
+// Backoff more before every retry. Clock tells the time, or clock.Real if nil.
+// Permanent, if not nil, reports the errors that retrying can't fix.
+type Policy struct {
+	Retries   int
+	Backoff   time.Duration
+	Clock     clock.Clock
+	Permanent func(err error) bool
+}
+
+// Do calls send until it succeeds, the retries of p are exhausted or ctx is
+// done. It returns the number of retries and the last error of send.
+func (p Policy) Do(ctx context.Context, send func() error) (int, error) {
+	clk := p.Clock
+	if clk == nil {
+		clk = clock.Real
+	}
+	retries := 0
+	for {
+		err := send()
+		if err == nil || retries == p.Retries || ctx.Err() != nil || (p.Permanent != nil && p.Permanent(err)) {
+			return retries, err
+		}
+		retries++
+		select {
+		case <-ctx.Done():
+		case <-clk.After(time.Duration(retries) * p.Backoff):
+		}
+	}
+}
+
+// ErrInvalidID is returned for a service ID that isn't the hex SHA-256
+// digest given to every service, since the IDs name the files of the
+// artifacts.
+var ErrInvalidID = errors.New("invalid service ID")
+
+// ValidID reports whether id is a service ID: 64 lowercase hex digits. Only
+// these are accepted as file names, so that an ID can never escape the
+// directory of the artifacts.
+func ValidID(id string) bool {
+	if len(id) != 64 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Path returns the file of the service id in dir, failing with ErrInvalidID
+// unless id is valid.
+func Path(dir string, id string) (string, error) {
+	if !ValidID(id) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	return filepath.Join(dir, id), nil
+}
+
+// Store keeps the artifacts of services, by ID, in a directory.
+type Store struct {
+	Dir string
+}
+
+// Load returns the artifact of the service id.
+func (s Store) Load(id string) ([]byte, error) {
+	path, err := Path(s.Dir, id)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// Save stores artifact as the artifact of the service id. The artifact is
+// written to a temporary file, flushed to disk and then renamed, so that it's
+// never run half written and it's durable once Save returns. The directory
+// is created if missing.
+func (s Store) Save(id string, artifact []byte) error {
+	path, err := Path(s.Dir, id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.Dir, "."+id+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(artifact); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Remove deletes the artifact of the service id.
+func (s Store) Remove(id string) error {
+	path, err := Path(s.Dir, id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
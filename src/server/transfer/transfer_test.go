@@ -0,0 +1,50 @@
+package transfer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// id returns the ID of the i-th service of a test.
+func id(i int) string {
+	return fmt.Sprintf("%064x", i)
+}
+
+func TestSaveLoad(t *testing.T) {
+	s := Store{Dir: t.TempDir()}
+	artifact := []byte("services:\n  web:\n    image: nginx\n")
+	if err := s.Save(id(1), artifact); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Load(id(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, artifact) {
+		t.Fatalf("loaded %q, want %q", got, artifact)
+	}
+	if err := s.Save("../escape", artifact); err == nil {
+		t.Fatal("saved an artifact under an invalid ID")
+	}
+}
+
+// BenchmarkSave measures a transfer leg on the receiving node: the artifact
+// is written and flushed before the deploy is acknowledged, with no delay
+// before the end of the transfer.
+func BenchmarkSave(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			s := Store{Dir: b.TempDir()}
+			artifact := []byte(strings.Repeat("x", size))
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := s.Save(id(i), artifact); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	st "storage"
+	"strings"
+)
+
+// Compares the storage backends on the same workloads, printing a table of
+// the results, to choose the backend of the nodes of a given hardware.
+func main() {
+	size := 1000
+	dir := os.TempDir()
+	backends := ""
+	flag.IntVar(&size, "n", size, "Number of records written by every workload")
+	flag.StringVar(&dir, "dir", dir, "Directory of the storage files, on the disk to measure")
+	flag.StringVar(&backends, "backends", backends, "Comma-separated backends to compare, all if empty")
+	flag.Parse()
+
+	selected := st.Backends
+	if backends != "" {
+		selected = nil
+		for _, name := range strings.Split(backends, ",") {
+			found := false
+			for _, b := range st.Backends {
+				if b.Name == name {
+					selected = append(selected, b)
+					found = true
+				}
+			}
+			if !found {
+				fmt.Printf("Error: unknown backend %q\n", name)
+				os.Exit(1)
+			}
+		}
+	}
+
+	results := st.Benchmark(selected, st.Workloads, dir, size)
+	st.WriteBenchTable(os.Stdout, results)
+	for _, r := range results {
+		if r.Err != nil {
+			os.Exit(1)
+		}
+	}
+}